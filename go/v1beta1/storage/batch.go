@@ -0,0 +1,76 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// batchDuplicatesKeepFirst and batchDuplicatesReject are the values of
+	// Config.BatchDuplicates.
+	batchDuplicatesKeepFirst = "keep_first"
+	batchDuplicatesReject    = "reject"
+)
+
+// batchDuplicates detects the entities of a batch create with the same name.
+type batchDuplicates struct {
+	// kind is the kind of entities, for error messages.
+	kind string
+	// fold compares names regardless of case.
+	fold bool
+	// reject fails the batch on the first duplicate.
+	reject bool
+	// seen holds the names checked so far, lowercased if fold is set.
+	seen map[string]bool
+	// errs reports the duplicates skipped when not rejecting.
+	errs []error
+	// dup is the first duplicate name.
+	dup string
+}
+
+// newBatchDuplicates returns a duplicate detector for a batch create of entities of kind.
+func (pg *PgSQLStore) newBatchDuplicates(kind string) *batchDuplicates {
+	return &batchDuplicates{kind: kind, fold: pg.foldIDs, reject: pg.rejectBatchDuplicates, seen: map[string]bool{}, errs: []error{}}
+}
+
+// check reports whether the entity named n is to be created, i.e. no entity of the batch
+// checked before has the same name.
+func (d *batchDuplicates) check(n string) bool {
+	key := n
+	if d.fold {
+		key = strings.ToLower(n)
+	}
+	if !d.seen[key] {
+		d.seen[key] = true
+		return true
+	}
+	if d.dup == "" {
+		d.dup = n
+	}
+	d.errs = append(d.errs, status.Errorf(codes.AlreadyExists, "%s with name %q is duplicated in the batch", d.kind, n))
+	return false
+}
+
+// rejected returns the error failing the batch, if it is to be rejected.
+func (d *batchDuplicates) rejected() error {
+	if d.reject && d.dup != "" {
+		return status.Errorf(codes.InvalidArgument, "Batch has several entities with name %q", d.dup)
+	}
+	return nil
+}
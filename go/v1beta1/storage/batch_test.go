@@ -0,0 +1,142 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStore_BatchCreateNotesDuplicates(t *testing.T) {
+	// With case-insensitive IDs, CVE-1 and cve-1 name the same note.
+	notes := map[string]*pb.Note{"cve-1": {}, "CVE-1": {}, "cve-2": {}}
+	tests := []struct {
+		desc       string
+		duplicates string
+		// want are the IDs of the created notes, in order.
+		want    []string
+		wantErr codes.Code
+	}{
+		{desc: "keep first", want: []string{"CVE-1", "cve-2"}, wantErr: codes.AlreadyExists},
+		{desc: "reject", duplicates: batchDuplicatesReject, wantErr: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey, CaseInsensitiveIDs: true, BatchDuplicates: tt.duplicates})
+			for _, nID := range tt.want {
+				mock.ExpectExec("INSERT INTO notes").WithArgs(pid, nID, sqlmock.AnyArg(), nil).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			created, errs := s.BatchCreateNotes(context.Background(), pid, "", notes)
+			if len(created) != len(tt.want) {
+				t.Errorf("BatchCreateNotes() created %d notes, want %d", len(created), len(tt.want))
+			}
+			if len(errs) != 1 || status.Code(errs[0]) != tt.wantErr {
+				t.Errorf("BatchCreateNotes() errors = %v, want one %v", errs, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestStore_BatchCreateOccurrencesDuplicates(t *testing.T) {
+	o := &pb.Occurrence{Name: name.FormatOccurrence(pid, "o1"), NoteName: name.FormatNote(pid, nid)}
+	other := &pb.Occurrence{Name: name.FormatOccurrence(pid, "o2"), NoteName: name.FormatNote(pid, nid)}
+	occs := []*pb.Occurrence{o, other, o}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	s.SetOccurrenceIDGenerator(ClientOccurrenceIDs)
+	for _, oID := range []string{"o1", "o2"} {
+		mock.ExpectQuery("INSERT INTO occurrences").WithArgs(pid, oID, pid, nid, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg(), nil, nil, nil).
+			WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	}
+	created, errs := s.BatchCreateOccurrences(context.Background(), pid, "", occs)
+	if len(created) != 2 || len(errs) != 1 || status.Code(errs[0]) != codes.AlreadyExists {
+		t.Errorf("BatchCreateOccurrences() = %d occurrences, %v, want 2 occurrences and one AlreadyExists error", len(created), errs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	// Rejected batches create nothing.
+	s = newStore(db, &Config{PaginationKey: paginationKey, BatchDuplicates: batchDuplicatesReject})
+	s.SetOccurrenceIDGenerator(ClientOccurrenceIDs)
+	created, errs = s.BatchCreateOccurrences(context.Background(), pid, "", occs)
+	if len(created) != 0 || len(errs) != 1 || status.Code(errs[0]) != codes.InvalidArgument {
+		t.Errorf("BatchCreateOccurrences() = %d occurrences, %v, want one InvalidArgument error", len(created), errs)
+	}
+}
+
+func TestStore_BatchCreateOccurrencesInvalidID(t *testing.T) {
+	o := &pb.Occurrence{Name: name.FormatOccurrence(pid, "o1"), NoteName: name.FormatNote(pid, nid)}
+	elsewhere := &pb.Occurrence{Name: name.FormatOccurrence("other", "o2"), NoteName: name.FormatNote(pid, nid)}
+	occs := []*pb.Occurrence{nil, o, elsewhere}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	s.SetOccurrenceIDGenerator(ClientOccurrenceIDs)
+	mock.ExpectQuery("INSERT INTO occurrences").WithArgs(pid, "o1", pid, nid, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg(), nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	created, errs := s.BatchCreateOccurrences(context.Background(), pid, "", occs)
+	if len(created) != 1 || len(errs) != 2 {
+		t.Fatalf("BatchCreateOccurrences() = %d occurrences, %v, want 1 occurrence and 2 errors", len(created), errs)
+	}
+	for _, err := range errs {
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("BatchCreateOccurrences() error = %v, want code InvalidArgument", err)
+		}
+	}
+	if msg := status.Convert(errs[1]).Message(); !strings.HasPrefix(msg, "Occurrence 2 of the batch") {
+		t.Errorf("BatchCreateOccurrences() error = %q, want it to name occurrence 2", msg)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestValidateConfig_BatchDuplicates(t *testing.T) {
+	for _, v := range []string{"", batchDuplicatesKeepFirst, batchDuplicatesReject} {
+		if err := validateConfig(&Config{BatchDuplicates: v}); err != nil {
+			t.Errorf("validateConfig() with batch_duplicates %q error = %v", v, err)
+		}
+	}
+	if err := validateConfig(&Config{BatchDuplicates: "keep_last"}); err == nil {
+		t.Error("validateConfig() with batch_duplicates keep_last succeeded, want error")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	fieldmaskpb "google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// OccurrenceUpdate describes the update of an occurrence by BatchUpdateOccurrences.
+type OccurrenceUpdate struct {
+	// ID is the ID of the occurrence to update.
+	ID string
+	// Occurrence holds the values of the fields to update.
+	Occurrence *pb.Occurrence
+	// Mask names the top-level fields to update, e.g. "remediation"; fields it names which are
+	// not set in Occurrence are cleared. An empty mask replaces all the fields of the
+	// occurrence but its name and creation time, like UpdateOccurrence.
+	Mask *fieldmaskpb.FieldMask
+}
+
+// OccurrenceUpdateResult is the result of an OccurrenceUpdate: the updated occurrence, or the
+// error the update failed with.
+type OccurrenceUpdateResult struct {
+	Occurrence *pb.Occurrence
+	Err        error
+}
+
+// outputOnlyOccurrenceFields are the fields of occurrences set by the store, which updates
+// may not name.
+var outputOnlyOccurrenceFields = map[string]bool{"name": true, "create_time": true, "update_time": true}
+
+// BatchUpdateOccurrences applies updates to occurrences of project pID in a single
+// transaction, e.g. to re-classify many occurrences at once, and returns their results in the
+// order of updates. Updates of occurrences which do not exist fail with NotFound, and invalid
+// updates with InvalidArgument, without failing the others; updates of the same occurrence
+// apply in turn. Database errors fail the whole batch, of which nothing is then updated.
+// Changes are reported to the OccurrenceChangeObserver, if one is set, once committed.
+func (pg *PgSQLStore) BatchUpdateOccurrences(ctx context.Context, pID string, updates []OccurrenceUpdate) ([]OccurrenceUpdateResult, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	var results []OccurrenceUpdateResult
+	var olds []*pb.Occurrence
+	err := pg.WithTransaction(ctx, func(tx *sql.Tx) error {
+		// The transaction may be retried, so results are only kept from the last attempt.
+		results = make([]OccurrenceUpdateResult, len(updates))
+		olds = make([]*pb.Occurrence, len(updates))
+		now := time.Now().Truncate(time.Microsecond)
+		for i, u := range updates {
+			old, o, err := pg.updateOccurrenceInTx(ctx, tx, pID, u, now)
+			if _, ok := status.FromError(err); !ok {
+				// Database errors abort the transaction.
+				return err
+			}
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			results[i].Occurrence, olds[i] = o, old
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Failed to update Occurrences", err)
+		return nil, dbError(err, "Failed to update Occurrences")
+	}
+	if pg.occurrenceChanges != nil {
+		for i, r := range results {
+			if r.Err == nil {
+				// The update time always changes and is not reported.
+				pg.occurrenceChanges(ctx, pID, updates[i].ID, changedFields(olds[i], r.Occurrence, "update_time"))
+			}
+		}
+	}
+	return results, nil
+}
+
+// updateOccurrenceInTx applies u to occurrence of project pID in tx, as updated at now, and
+// returns the occurrence it replaced and the updated one. Database errors are returned as
+// they are, so that serialization failures are retried; others are statuses failing the update.
+func (pg *PgSQLStore) updateOccurrenceInTx(ctx context.Context, tx *sql.Tx, pID string, u OccurrenceUpdate, now time.Time) (*pb.Occurrence, *pb.Occurrence, error) {
+	if u.Occurrence == nil {
+		return nil, nil, nilError("Occurrence")
+	}
+	fields := u.Occurrence.ProtoReflect().Descriptor().Fields()
+	for _, path := range u.Mask.GetPaths() {
+		if fields.ByName(protoreflect.Name(path)) == nil || outputOnlyOccurrenceFields[path] || strings.Contains(path, ".") {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "Invalid field mask path %q for Occurrence", path)
+		}
+	}
+	var data []byte
+	err := pg.txQueryRowContext(ctx, tx, lockOccurrence, pID, u.ID).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil, status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, u.ID)
+	case err != nil:
+		return nil, nil, err
+	}
+	var old pb.Occurrence
+	if err := protojson.Unmarshal(data, &old); err != nil {
+		return nil, nil, status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+	}
+	o := applyOccurrenceMask(&old, u.Occurrence, u.Mask.GetPaths())
+	o.Name = name.FormatOccurrence(pID, u.ID)
+	o.UpdateTime = timestamppb.New(now)
+	occurrenceJson, err := marshalJSON(o)
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, "Failed to marshal occurrence to json")
+	}
+	if err := pg.checkEntitySize("Occurrence", occurrenceJson); err != nil {
+		return nil, nil, err
+	}
+	if _, err := pg.txExecContext(ctx, tx, updateOccurrence, occurrenceJson, pID, u.ID, occurrenceSeverity(o), now, occurrenceResourceURI(o)); err != nil {
+		return nil, nil, err
+	}
+	return &old, o, nil
+}
+
+// applyOccurrenceMask returns a copy of old with the top-level fields named by paths taken
+// from updated, or, if paths is empty, a copy of updated with the creation time of old.
+func applyOccurrenceMask(old, updated *pb.Occurrence, paths []string) *pb.Occurrence {
+	if len(paths) == 0 {
+		o := proto.Clone(updated).(*pb.Occurrence)
+		o.CreateTime = old.CreateTime
+		return o
+	}
+	o := proto.Clone(old).(*pb.Occurrence)
+	dst, src := o.ProtoReflect(), updated.ProtoReflect()
+	fields := dst.Descriptor().Fields()
+	for _, path := range paths {
+		fd := fields.ByName(protoreflect.Name(path))
+		if src.Has(fd) {
+			dst.Set(fd, src.Get(fd))
+		} else {
+			dst.Clear(fd)
+		}
+	}
+	return o
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	fieldmaskpb "google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStore_BatchUpdateOccurrences(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	var changes [][]string
+	s.SetOccurrenceChangeObserver(func(_ context.Context, _, oID string, changed []string) {
+		changes = append(changes, append([]string{oID}, changed...))
+	})
+
+	acked := &pb.Occurrence{Remediation: "acknowledged", Resource: &pb.Resource{Uri: "ignored"}}
+	mask := &fieldmaskpb.FieldMask{Paths: []string{"remediation"}}
+	updates := []OccurrenceUpdate{
+		{ID: "o1", Occurrence: acked, Mask: mask},
+		{ID: "missing", Occurrence: acked, Mask: mask},
+		{ID: "o2", Occurrence: acked, Mask: &fieldmaskpb.FieldMask{Paths: []string{"create_time"}}},
+		{ID: "o3", Occurrence: acked, Mask: mask},
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(lockOccurrence)).WithArgs(pid, "o1").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{"name":"projects/pid/occurrences/o1","remediation":"upgrade","resource":{"uri":"a"}}`))
+	mock.ExpectExec(regexp.QuoteMeta(updateOccurrence)).
+		WithArgs(sqlmock.AnyArg(), pid, "o1", sqlmock.AnyArg(), sqlmock.AnyArg(), "a").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(lockOccurrence)).WithArgs(pid, "missing").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	mock.ExpectQuery(regexp.QuoteMeta(lockOccurrence)).WithArgs(pid, "o3").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{"name":"projects/pid/occurrences/o3","resource":{"uri":"b"}}`))
+	mock.ExpectExec(regexp.QuoteMeta(updateOccurrence)).
+		WithArgs(sqlmock.AnyArg(), pid, "o3", sqlmock.AnyArg(), sqlmock.AnyArg(), "b").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	results, err := s.BatchUpdateOccurrences(context.Background(), pid, updates)
+	if err != nil {
+		t.Fatalf("BatchUpdateOccurrences() got error %v", err)
+	}
+	if len(results) != len(updates) {
+		t.Fatalf("BatchUpdateOccurrences() returned %d results, want %d", len(results), len(updates))
+	}
+	wantCodes := []codes.Code{codes.OK, codes.NotFound, codes.InvalidArgument, codes.OK}
+	for i, r := range results {
+		if got := status.Code(r.Err); got != wantCodes[i] {
+			t.Errorf("results[%d].Err = %v, want code %v", i, r.Err, wantCodes[i])
+		}
+		if (r.Occurrence != nil) != (wantCodes[i] == codes.OK) {
+			t.Errorf("results[%d].Occurrence = %v, want it set only on success", i, r.Occurrence)
+		}
+	}
+	if o := results[0].Occurrence; o.Remediation != "acknowledged" || o.GetResource().GetUri() != "a" || o.UpdateTime == nil ||
+		o.Name != "projects/pid/occurrences/o1" {
+		t.Errorf("results[0].Occurrence = %v, want the stored occurrence with the masked remediation", o)
+	}
+	wantChanges := [][]string{{"o1", "remediation"}, {"o3", "remediation"}}
+	if !reflect.DeepEqual(changes, wantChanges) {
+		t.Errorf("observed changes %v, want %v", changes, wantChanges)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStore_BatchUpdateOccurrencesDatabaseError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(lockOccurrence)).WithArgs(pid, "o1").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{}`))
+	mock.ExpectExec(regexp.QuoteMeta(updateOccurrence)).WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	updates := []OccurrenceUpdate{{ID: "o1", Occurrence: &pb.Occurrence{Remediation: "acknowledged"}}}
+	if _, err := s.BatchUpdateOccurrences(context.Background(), pid, updates); status.Code(err) != codes.Internal {
+		t.Errorf("BatchUpdateOccurrences() = %v, want code Internal", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestApplyOccurrenceMask(t *testing.T) {
+	old := &pb.Occurrence{Remediation: "upgrade", Resource: &pb.Resource{Uri: "a"}, NoteName: "projects/p/notes/n"}
+	updated := &pb.Occurrence{Resource: &pb.Resource{Uri: "b"}}
+
+	o := applyOccurrenceMask(old, updated, []string{"resource", "remediation"})
+	if o.GetResource().GetUri() != "b" || o.Remediation != "" || o.NoteName != old.NoteName {
+		t.Errorf("applyOccurrenceMask() = %v, want the resource updated, the remediation cleared and the note kept", o)
+	}
+	o = applyOccurrenceMask(old, updated, nil)
+	if o.GetResource().GetUri() != "b" || o.NoteName != "" {
+		t.Errorf("applyOccurrenceMask() with no paths = %v, want the updated occurrence", o)
+	}
+	if old.GetResource().GetUri() != "a" {
+		t.Errorf("applyOccurrenceMask() changed the old occurrence to %v", old)
+	}
+}
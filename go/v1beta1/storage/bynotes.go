@@ -0,0 +1,98 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// maxListedNotes bounds the number of notes ListOccurrencesByNotes takes, two query
+// parameters each.
+const maxListedNotes = 1000
+
+// ListOccurrencesByNotes returns up to pageSize occurrences of project pID referencing any of
+// the notes named by noteNames, e.g. "projects/cve-feed/notes/CVE-2021-44228", beginning at
+// pageToken (or from start if pageToken is the empty string). The notes may belong to any
+// project, and those which do not exist are ignored. Occurrences are listed once, in the order
+// they were stored, whichever notes they reference.
+func (pg *PgSQLStore) ListOccurrencesByNotes(ctx context.Context, pID string, noteNames []string, pageSize int32, pageToken string) ([]*pb.Occurrence, string, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	if len(noteNames) == 0 {
+		return nil, "", status.Error(codes.InvalidArgument, "At least one note name is required")
+	}
+	if len(noteNames) > maxListedNotes {
+		return nil, "", status.Errorf(codes.InvalidArgument, "At most %d note names may be listed, got %d", maxListedNotes, len(noteNames))
+	}
+	id := decryptCursor(pageToken, pg.paginationKey, pg.pageTokenTTL("ListOccurrencesByNotes")).ID
+	args := []interface{}{pID, id, pageLimit(int64(pageSize))}
+	pairs := make([]string, 0, len(noteNames))
+	seen := map[string]bool{}
+	for _, n := range noteNames {
+		nPID, nID, err := name.ParseNote(n)
+		if err != nil {
+			return nil, "", status.Errorf(codes.InvalidArgument, "Invalid note name %q", n)
+		}
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		pairs = append(pairs, fmt.Sprintf("($%d, $%d)", len(args)+1, len(args)+2))
+		args = append(args, nPID, nID)
+	}
+	rows, err := pg.queryContext(ctx, fmt.Sprintf(listOccurrencesByNotes, strings.Join(pairs, ", ")), args...)
+	if err != nil {
+		return nil, "", dbError(err, "Failed to list Occurrences from database")
+	}
+	defer rows.Close()
+
+	var os []*pb.Occurrence
+	var lastID int64
+	budget := pageBudget{max: pg.maxPageBytes}
+	var full bool
+	for rows.Next() {
+		if full || len(os) == int(pageSize) {
+			encryptedPage, err := encryptCursor(pageCursor{ID: lastID}, pg.paginationKey)
+			if err != nil {
+				return nil, "", status.Error(codes.Internal, "Failed to paginate occurrences")
+			}
+			return os, encryptedPage, nil
+		}
+		var oID string
+		var data []byte
+		if err := rows.Scan(&lastID, &oID, &data); err != nil {
+			return nil, "", status.Error(codes.Internal, "Failed to scan Occurrences row")
+		}
+		var o pb.Occurrence
+		if err := protojson.Unmarshal(data, &o); err != nil {
+			return nil, "", status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+		}
+		// Set the output-only field before returning
+		o.Name = name.FormatOccurrence(pID, oID)
+		os = append(os, &o)
+		full = budget.spend(len(data))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", dbError(err, "Failed to list Occurrences from database")
+	}
+	return os, "", nil
+}
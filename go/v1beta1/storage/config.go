@@ -0,0 +1,224 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultPageTokenTTL is how long page tokens stay valid unless overridden per list method.
+const defaultPageTokenTTL = time.Hour
+
+// listMethods is the set of list methods issuing page tokens.
+var listMethods = map[string]bool{
+	"ListProjects":                 true,
+	"ListOccurrences":              true,
+	"ListNotes":                    true,
+	"ListNoteOccurrences":          true,
+	"ListOccurrencesByNotes":       true,
+	"ListOccurrencesModifiedSince": true,
+	"ListNotesByOccurrenceCount":   true,
+	"ListDistinctResourceURIs":     true,
+}
+
+// isolationLevels maps the isolation_level config values, compared case-insensitively,
+// to the isolation levels supported by PostgreSQL.
+var isolationLevels = map[string]sql.IsolationLevel{
+	"read committed":  sql.LevelReadCommitted,
+	"repeatable read": sql.LevelRepeatableRead,
+	"serializable":    sql.LevelSerializable,
+}
+
+// tablespaceRE matches unquoted PostgreSQL identifiers. Reserved words are accepted: the
+// tablespace is quoted in the generated DDL. It also validates text search configurations.
+var tablespaceRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]{0,62}$`)
+
+// validateConfig checks the store options in c.
+func validateConfig(c *Config) error {
+	if c.Tablespace != "" && !tablespaceRE.MatchString(c.Tablespace) {
+		return fmt.Errorf("invalid tablespace %q; must be a valid unquoted identifier", c.Tablespace)
+	}
+	switch c.Dialect {
+	case "", dialectPostgres:
+	case dialectCockroach:
+		if c.Tablespace != "" {
+			return errors.New("invalid tablespace; tablespaces are not supported by the cockroach dialect")
+		}
+		if c.TextSearchConfig != "" {
+			return errors.New("invalid text_search_config; text search is not supported by the cockroach dialect")
+		}
+	default:
+		return fmt.Errorf("invalid dialect %q; must be postgres or cockroach", c.Dialect)
+	}
+	if c.TextSearchConfig != "" && !tablespaceRE.MatchString(c.TextSearchConfig) {
+		return fmt.Errorf("invalid text_search_config %q; must be a valid unquoted identifier", c.TextSearchConfig)
+	}
+	if c.MaxFilterDepth < 0 || c.MaxFilterNodes < 0 {
+		return errors.New("invalid filter limits; max_filter_depth and max_filter_nodes must not be negative")
+	}
+	if _, ok := isolationLevels[strings.ToLower(c.IsolationLevel)]; c.IsolationLevel != "" && !ok {
+		return fmt.Errorf("invalid isolation_level %q; must be one of read committed, repeatable read or serializable", c.IsolationLevel)
+	}
+	if c.ConnectTimeoutSeconds < 0 {
+		return errors.New("invalid connect_timeout_seconds; must not be negative")
+	}
+	switch c.NullsOrder {
+	case "", nullsOrderLast, nullsOrderFirst:
+	default:
+		return fmt.Errorf("invalid nulls_order %q; must be last or first", c.NullsOrder)
+	}
+	switch c.BatchDuplicates {
+	case "", batchDuplicatesKeepFirst, batchDuplicatesReject:
+	default:
+		return fmt.Errorf("invalid batch_duplicates %q; must be keep_first or reject", c.BatchDuplicates)
+	}
+	if c.MaxPageBytes < 0 {
+		return errors.New("invalid max_page_bytes; must not be negative")
+	}
+	if c.MaxEntitySizeBytes < 0 {
+		return errors.New("invalid max_entity_size_bytes; must not be negative")
+	}
+	if c.SchemaVersion < 0 {
+		return errors.New("invalid schema_version; must not be negative")
+	}
+	if c.BatchSize < 0 {
+		return errors.New("invalid batch_size; must not be negative")
+	}
+	if c.OccurrenceIDRetries < 0 {
+		return errors.New("invalid occurrence_id_retries; must not be negative")
+	}
+	if c.TxRetries < 0 {
+		return errors.New("invalid tx_retries; must not be negative")
+	}
+	if c.MaxOpenConns < 0 || c.PrewarmConns < 0 {
+		return errors.New("invalid connection pool size; max_open_conns and prewarm_conns must not be negative")
+	}
+	if c.OccurrenceRateLimit < 0 || c.OccurrenceRateBurst < 0 {
+		return errors.New("invalid occurrence rate limit; occurrence_rate_limit and occurrence_rate_burst must not be negative")
+	}
+	for pID, rate := range c.ProjectOccurrenceRateLimits {
+		if rate < 0 {
+			return fmt.Errorf("invalid project_occurrence_rate_limits entry for %s: %v; must not be negative", pID, rate)
+		}
+	}
+	if c.TenantMaxConns < 0 {
+		return errors.New("invalid tenant_max_conns; must not be negative")
+	}
+	for t, max := range c.TenantConnLimits {
+		if max < 0 {
+			return fmt.Errorf("invalid tenant_conn_limits entry for %s: %d; must not be negative", t, max)
+		}
+	}
+	for field, v := range map[string]string{"max_conn_wait": c.MaxConnWait, "conn_wait_threshold": c.ConnWaitThreshold, "retry_delay": c.RetryDelay} {
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q; must be a positive duration", field, v)
+		}
+	}
+	if c.SlowQueryThreshold != "" {
+		if d, err := time.ParseDuration(c.SlowQueryThreshold); err != nil || d <= 0 {
+			return fmt.Errorf("invalid slow_query_threshold %q; must be a positive duration", c.SlowQueryThreshold)
+		}
+	}
+	if c.OccurrenceTTL != "" {
+		if d, err := time.ParseDuration(c.OccurrenceTTL); err != nil || d <= 0 {
+			return fmt.Errorf("invalid occurrence_ttl %q; must be a positive duration", c.OccurrenceTTL)
+		}
+	}
+	if c.DeletedOccurrenceRetention != "" {
+		if d, err := time.ParseDuration(c.DeletedOccurrenceRetention); err != nil || d <= 0 {
+			return fmt.Errorf("invalid deleted_occurrence_retention %q; must be a positive duration", c.DeletedOccurrenceRetention)
+		}
+	}
+	for name := range c.SessionSettings {
+		if name == "" {
+			return errors.New("invalid session_settings; names must not be empty")
+		}
+	}
+	if c.PageTokenTTL != "" {
+		if ttl, err := time.ParseDuration(c.PageTokenTTL); err != nil || ttl < 0 {
+			return fmt.Errorf("invalid page_token_ttl %q; must be a positive duration, or zero for no expiry", c.PageTokenTTL)
+		}
+	}
+	for op, v := range c.PageTokenTTLs {
+		if !listMethods[op] {
+			return fmt.Errorf("invalid page_token_ttls entry %q; not a list method", op)
+		}
+		if ttl, err := time.ParseDuration(v); err != nil || ttl < 0 {
+			return fmt.Errorf("invalid page_token_ttls entry for %s: %q; must be a positive duration, or zero for no expiry", op, v)
+		}
+	}
+	return nil
+}
+
+// envRefRE matches ${NAME} environment variable references. The bare $NAME form is
+// deliberately not supported so that literal values such as passwords may contain '$'.
+var envRefRE = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${NAME} references in s with the value of the environment variable NAME.
+// It fails if a referenced variable is not set.
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envRefRE.ReplaceAllStringFunc(s, func(ref string) string {
+		key := envRefRE.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(key)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %q referenced in config is not set", key)
+		}
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+	return expanded, nil
+}
+
+// expandConfigEnv returns a copy of c with ${NAME} references expanded in the
+// connection and secret fields.
+func expandConfigEnv(c Config) (Config, error) {
+	for _, f := range []*string{&c.Host, &c.DBName, &c.User, &c.Password, &c.PasswordFile, &c.SSLMode, &c.SSLRootCert, &c.PaginationKey, &c.PaginationKeyFile} {
+		v, err := expandEnv(*f)
+		if err != nil {
+			return Config{}, err
+		}
+		*f = v
+	}
+	return c, nil
+}
+
+// resolvePasswordFile reads c.PasswordFile, if set, into c.Password.
+func resolvePasswordFile(c *Config) error {
+	if c.PasswordFile == "" {
+		return nil
+	}
+	if c.Password != "" {
+		return errors.New("password and password_file are mutually exclusive")
+	}
+	b, err := ioutil.ReadFile(c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("failed to read password file, err: %v", err)
+	}
+	c.Password = strings.TrimSpace(string(b))
+	return nil
+}
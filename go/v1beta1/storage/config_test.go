@@ -0,0 +1,174 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/net/context"
+)
+
+func TestExpandConfigEnv(t *testing.T) {
+	os.Setenv("GRAFEAS_PG_TEST_HOST", "db.internal")
+	os.Setenv("GRAFEAS_PG_TEST_USER", "grafeas")
+	os.Setenv("GRAFEAS_PG_TEST_PASSWORD", "s3cr3t")
+	os.Unsetenv("GRAFEAS_PG_TEST_UNSET")
+	defer func() {
+		os.Unsetenv("GRAFEAS_PG_TEST_HOST")
+		os.Unsetenv("GRAFEAS_PG_TEST_USER")
+		os.Unsetenv("GRAFEAS_PG_TEST_PASSWORD")
+	}()
+
+	got, err := expandConfigEnv(Config{
+		Host:     "${GRAFEAS_PG_TEST_HOST}:5432",
+		DBName:   "grafeas",
+		User:     "${GRAFEAS_PG_TEST_USER}",
+		Password: "${GRAFEAS_PG_TEST_PASSWORD}",
+	})
+	if err != nil {
+		t.Fatalf("expandConfigEnv() error = %v", err)
+	}
+	if got.Host != "db.internal:5432" || got.User != "grafeas" || got.Password != "s3cr3t" || got.DBName != "grafeas" {
+		t.Errorf("expandConfigEnv() = %+v", got)
+	}
+
+	// A literal '$' that is not a ${NAME} reference is left untouched.
+	got, err = expandConfigEnv(Config{Password: "pa$$word$GRAFEAS_PG_TEST_USER"})
+	if err != nil {
+		t.Fatalf("expandConfigEnv() error = %v", err)
+	}
+	if got.Password != "pa$$word$GRAFEAS_PG_TEST_USER" {
+		t.Errorf("expandConfigEnv() password = %q, want it unchanged", got.Password)
+	}
+
+	if _, err := expandConfigEnv(Config{Password: "${GRAFEAS_PG_TEST_UNSET}"}); err == nil {
+		t.Errorf("expandConfigEnv() with unset variable succeeded, want error")
+	}
+}
+
+func TestResolvePasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgpassword-*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(path, []byte("  s3cr3t\n"), 0600); err != nil {
+		t.Fatalf("failed to write password file: %v", err)
+	}
+
+	c := Config{PasswordFile: path}
+	if err := resolvePasswordFile(&c); err != nil {
+		t.Fatalf("resolvePasswordFile() error = %v", err)
+	}
+	if c.Password != "s3cr3t" {
+		t.Errorf("resolvePasswordFile() password = %q, want %q", c.Password, "s3cr3t")
+	}
+
+	c = Config{Password: "inline", PasswordFile: path}
+	if err := resolvePasswordFile(&c); err == nil {
+		t.Errorf("resolvePasswordFile() with both password and password_file succeeded, want error")
+	}
+
+	c = Config{PasswordFile: filepath.Join(dir, "missing")}
+	if err := resolvePasswordFile(&c); err == nil {
+		t.Errorf("resolvePasswordFile() with missing file succeeded, want error")
+	}
+}
+
+func TestFetchPaginationKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgpaginationkey-*")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(path, []byte(paginationKey+"\n"), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	invalidPath := filepath.Join(dir, "invalid")
+	if err := ioutil.WriteFile(invalidPath, []byte("INVALID_VALUE"), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	os.Setenv("GRAFEAS_PG_TEST_KEY", paginationKey)
+	defer os.Unsetenv("GRAFEAS_PG_TEST_KEY")
+
+	for _, c := range []Config{
+		{PaginationKey: paginationKey},
+		{PaginationKeyFile: path},
+		{PaginationKeyProvider: EnvKey("GRAFEAS_PG_TEST_KEY")},
+	} {
+		key, err := fetchPaginationKey(context.Background(), &c)
+		if err != nil {
+			t.Fatalf("fetchPaginationKey(%+v) error = %v", c, err)
+		}
+		if key != paginationKey {
+			t.Errorf("fetchPaginationKey(%+v) = %q, want %q", c, key, paginationKey)
+		}
+	}
+
+	// Without a configured key, one is generated.
+	if key, err := fetchPaginationKey(context.Background(), &Config{}); err != nil || key != "" {
+		t.Errorf("fetchPaginationKey() = %q, %v; want no key", key, err)
+	}
+
+	for label, c := range map[string]Config{
+		"invalid key file":      {PaginationKeyFile: invalidPath},
+		"missing key file":      {PaginationKeyFile: filepath.Join(dir, "missing")},
+		"unset variable":        {PaginationKeyProvider: EnvKey("GRAFEAS_PG_TEST_UNSET")},
+		"key and key file":      {PaginationKey: paginationKey, PaginationKeyFile: path},
+		"key file and provider": {PaginationKeyFile: path, PaginationKeyProvider: StaticKey(paginationKey)},
+	} {
+		if _, err := fetchPaginationKey(context.Background(), &c); err == nil {
+			t.Errorf("%s: fetchPaginationKey() succeeded, want error", label)
+		}
+	}
+}
+
+// stubKeyProvider provides a fixed key, counting the calls.
+type stubKeyProvider struct {
+	key   string
+	calls int
+}
+
+func (p *stubKeyProvider) PaginationKey(context.Context) (string, error) {
+	p.calls++
+	return p.key, nil
+}
+
+func TestNewStoreWithCustomConnectorConfig_KeyProvider(t *testing.T) {
+	db, mock, err := sqlmock.NewWithDSN("key-provider")
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS projects").WillReturnResult(sqlmock.NewResult(0, 0))
+	p := &stubKeyProvider{key: paginationKey}
+
+	s, err := NewStoreWithCustomConnectorConfig(context.Background(), &mockConnector{dsn: "key-provider", drv: db.Driver()}, &Config{
+		PaginationKeyProvider: p,
+	})
+	if err != nil {
+		t.Fatalf("NewStoreWithCustomConnectorConfig() error = %v", err)
+	}
+	defer s.Close()
+	if p.calls != 1 || s.paginationKey != paginationKey {
+		t.Errorf("store key = %q after %d provider calls, want %q after 1", s.paginationKey, p.calls, paginationKey)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ConnWaitObserver is called with the store operation, e.g. "ListOccurrences", and the time it
+// waited for a database connection, each time it waits beyond the connection wait threshold or
+// times out, as reported by timedOut, e.g. to count pool saturation in a metric.
+type ConnWaitObserver func(op string, waited time.Duration, timedOut bool)
+
+// SetConnWaitObserver sets the observer of connection waits, in addition to their being
+// logged. It must be called before the store is used; a nil observer removes it. Waits are
+// only timed if the store is configured with MaxConnWait or ConnWaitThreshold.
+func (pg *PgSQLStore) SetConnWaitObserver(o ConnWaitObserver) {
+	pg.connWaitObserver = o
+}
+
+// querier runs queries, on the connection pool, *sql.DB, or on a single connection, *sql.Conn.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// conn returns the querier to run a query with and the function to call once it is done. If
+// connection waits are timed, it is a connection taken from the pool, waiting for it no
+// longer than maxConnWait, and the function returns it to the pool; otherwise, it is the
+// pool itself. Waits beyond the threshold and timeouts are reported as waits of the store
+// operation ctx is tagged with.
+func (pg *PgSQLStore) conn(ctx context.Context) (querier, func(), error) {
+	if pg.maxConnWait <= 0 && pg.connWaitThreshold <= 0 {
+		return pg.db, func() {}, nil
+	}
+	waitCtx := ctx
+	if pg.maxConnWait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, pg.maxConnWait)
+		defer cancel()
+	}
+	start := time.Now()
+	c, err := pg.db.Conn(waitCtx)
+	waited := time.Since(start)
+	// Only the wait bounded by maxConnWait times out; callers whose own context is done fail as usual.
+	timedOut := err != nil && waitCtx.Err() != nil && ctx.Err() == nil
+	if timedOut || (pg.connWaitThreshold > 0 && waited >= pg.connWaitThreshold) {
+		op := queryOperation(ctx)
+		log.Printf("%s waited %v for a database connection (timed out: %v)", op, waited, timedOut)
+		if pg.connWaitObserver != nil {
+			pg.connWaitObserver(op, waited, timedOut)
+		}
+	}
+	if timedOut {
+		return nil, nil, resourceExhausted(pg.retryDelay, "Timed out after %v waiting for a database connection", pg.maxConnWait)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, func() { c.Close() }, nil
+}
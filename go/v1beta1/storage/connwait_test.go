@@ -0,0 +1,102 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStore_ConnWait(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	s := newStore(db, &Config{PaginationKey: paginationKey, MaxConnWait: "50ms", ConnWaitThreshold: "10ms", RetryDelay: "3s"})
+	type wait struct {
+		op       string
+		waited   time.Duration
+		timedOut bool
+	}
+	var waits []wait
+	s.SetConnWaitObserver(func(op string, waited time.Duration, timedOut bool) {
+		waits = append(waits, wait{op, waited, timedOut})
+	})
+	ctx := context.Background()
+
+	// The pool is saturated while its only connection is held.
+	held, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Conn() error = %v", err)
+	}
+	if err := s.DeleteProject(ctx, "p1"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("DeleteProject() error = %v, want ResourceExhausted", err)
+	} else if d := retryDelay(err); d != 3*time.Second {
+		t.Errorf("DeleteProject() retry delay = %v, want 3s", d)
+	}
+	if len(waits) != 1 || waits[0].op != "DeleteProject" || !waits[0].timedOut || waits[0].waited < 50*time.Millisecond {
+		t.Errorf("observed waits = %+v, want a timed out wait of DeleteProject", waits)
+	}
+
+	// A query waiting beyond the threshold, but not timing out, is reported too.
+	waits = nil
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		held.Close()
+	}()
+	mock.ExpectExec("DELETE FROM projects").WithArgs("projects/p1").WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.DeleteProject(ctx, "p1"); err != nil {
+		t.Errorf("DeleteProject() error = %v", err)
+	}
+	if len(waits) != 1 || waits[0].op != "DeleteProject" || waits[0].timedOut || waits[0].waited < 10*time.Millisecond {
+		t.Errorf("observed waits = %+v, want a wait of DeleteProject beyond the threshold", waits)
+	}
+
+	// Queries finding a free connection are not reported.
+	waits = nil
+	mock.ExpectExec("DELETE FROM projects").WithArgs("projects/p1").WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.DeleteProject(ctx, "p1"); err != nil {
+		t.Errorf("DeleteProject() error = %v", err)
+	}
+	if len(waits) != 0 {
+		t.Errorf("observed waits = %+v, want none", waits)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestValidateConfig_ConnWait(t *testing.T) {
+	for _, c := range []*Config{
+		{MaxConnWait: "soon"},
+		{MaxConnWait: "0s"},
+		{RetryDelay: "-1s"},
+		{ConnWaitThreshold: "-1ms"},
+	} {
+		if err := validateConfig(c); err == nil {
+			t.Errorf("validateConfig(%+v) succeeded, want error", c)
+		}
+	}
+	if err := validateConfig(&Config{MaxConnWait: "2s", ConnWaitThreshold: "100ms"}); err != nil {
+		t.Errorf("validateConfig() error = %v", err)
+	}
+}
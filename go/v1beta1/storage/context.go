@@ -0,0 +1,126 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+
+	"golang.org/x/net/context"
+)
+
+// contextKey is the type of the keys of the per-call options carried by a context.
+type contextKey int
+
+const (
+	idempotencyKeyKey contextKey = iota
+	strongConsistencyKey
+	isolationLevelKey
+	occurrenceViewKey
+	queryTagsKey
+	occurrenceOrderKey
+	tenantKey
+	deletedOccurrencesKey
+)
+
+// WithIdempotencyKey returns a copy of ctx carrying the client-supplied idempotency key of a create.
+// CreateOccurrence called with a key already used in the project returns the occurrence created
+// by the first call instead of creating a duplicate, so retries after a timeout are safe.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey, key)
+}
+
+// idempotencyKey returns the idempotency key carried by ctx, or the empty string if none.
+func idempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyKey).(string)
+	return key
+}
+
+// WithStrongConsistency returns a copy of ctx requesting reads that observe every write
+// completed before them, e.g. for a UI listing what it just created. Such reads bypass
+// the note cache. The store reads from a single database, the primary, so no other
+// routing is needed.
+func WithStrongConsistency(ctx context.Context) context.Context {
+	return context.WithValue(ctx, strongConsistencyKey, true)
+}
+
+// strongConsistency reports whether ctx requests strongly consistent reads.
+func strongConsistency(ctx context.Context) bool {
+	strong, _ := ctx.Value(strongConsistencyKey).(bool)
+	return strong
+}
+
+// WithIsolationLevel returns a copy of ctx requesting that the transactions WithTransaction
+// runs with it use isolation level, overriding the IsolationLevel of the store, e.g.
+// sql.LevelSerializable for sensitive writes spanning several entities.
+func WithIsolationLevel(ctx context.Context, level sql.IsolationLevel) context.Context {
+	return context.WithValue(ctx, isolationLevelKey, level)
+}
+
+// isolationLevel returns the isolation level requested by ctx, or def if none.
+func isolationLevel(ctx context.Context, def sql.IsolationLevel) sql.IsolationLevel {
+	if level, ok := ctx.Value(isolationLevelKey).(sql.IsolationLevel); ok {
+		return level
+	}
+	return def
+}
+
+// WithOccurrenceView returns a copy of ctx requesting that ListOccurrences return occurrences
+// in view, e.g. OccurrenceViewBasic for a summary table.
+func WithOccurrenceView(ctx context.Context, view OccurrenceView) context.Context {
+	return context.WithValue(ctx, occurrenceViewKey, view)
+}
+
+// occurrenceView returns the occurrence view requested by ctx, OccurrenceViewFull if none.
+func occurrenceView(ctx context.Context) OccurrenceView {
+	view, _ := ctx.Value(occurrenceViewKey).(OccurrenceView)
+	return view
+}
+
+// WithOccurrenceOrder returns a copy of ctx requesting that ListOccurrences return occurrences
+// in order, e.g. OccurrenceOrderCreateTime for oldest first.
+func WithOccurrenceOrder(ctx context.Context, order OccurrenceOrder) context.Context {
+	return context.WithValue(ctx, occurrenceOrderKey, order)
+}
+
+// occurrenceOrder returns the occurrence order requested by ctx, OccurrenceOrderInsertion if none.
+func occurrenceOrder(ctx context.Context) OccurrenceOrder {
+	order, _ := ctx.Value(occurrenceOrderKey).(OccurrenceOrder)
+	return order
+}
+
+// WithTenant returns a copy of ctx issuing queries on behalf of tenant, whose concurrent
+// connections are bounded by TenantMaxConns or its entry in TenantConnLimits.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// tenant returns the tenant carried by ctx, or the empty string if none.
+func tenant(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey).(string)
+	return t
+}
+
+// WithDeletedOccurrences returns a copy of ctx requesting that GetOccurrence and
+// ListOccurrences also return the occurrences soft-deleted by a store configured with
+// SoftDeleteOccurrences, e.g. for audits. OccurrenceDeleteTimes tells which ones are deleted.
+func WithDeletedOccurrences(ctx context.Context) context.Context {
+	return context.WithValue(ctx, deletedOccurrencesKey, true)
+}
+
+// deletedOccurrences reports whether ctx requests soft-deleted occurrences.
+func deletedOccurrences(ctx context.Context) bool {
+	deleted, _ := ctx.Value(deletedOccurrencesKey).(bool)
+	return deleted
+}
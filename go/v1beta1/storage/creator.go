@@ -0,0 +1,53 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OccurrenceCreator returns the ID of the user that created the specified occurrence, as
+// passed to CreateOccurrence or BatchCreateOccurrences, or "" if it was created anonymously
+// or imported. The occurrence name is matched exactly.
+func (pg *PgSQLStore) OccurrenceCreator(ctx context.Context, pID, oID string) (string, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	var uID sql.NullString
+	switch err := pg.queryRowContext(ctx, occurrenceCreator, pID, oID).Scan(&uID); {
+	case err == sql.ErrNoRows:
+		return "", status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+	case err != nil:
+		return "", dbError(err, "Failed to query Occurrence from database")
+	}
+	return uID.String, nil
+}
+
+// NoteCreator returns the ID of the user that created the specified note, as passed to
+// CreateNote or BatchCreateNotes, or "" if it was created anonymously or imported. The note
+// name is matched exactly.
+func (pg *PgSQLStore) NoteCreator(ctx context.Context, pID, nID string) (string, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	var uID sql.NullString
+	switch err := pg.queryRowContext(ctx, noteCreator, pID, nID).Scan(&uID); {
+	case err == sql.ErrNoRows:
+		return "", status.Errorf(codes.NotFound, "Note with name %q/%q does not Exist", pID, nID)
+	case err != nil:
+		return "", dbError(err, "Failed to query Note from database")
+	}
+	return uID.String, nil
+}
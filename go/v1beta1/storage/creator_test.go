@@ -0,0 +1,93 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql/driver"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// uIDArg captures the created_by argument of an insert, to return it from a later select.
+type uIDArg struct {
+	got *interface{}
+}
+
+func (a uIDArg) Match(v driver.Value) bool {
+	*a.got = v
+	return true
+}
+
+func TestStore_CreatorRoundTrip(t *testing.T) {
+	for _, uID := range []string{"alice", ""} {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		s := newStore(db, &Config{PaginationKey: paginationKey})
+		ctx := context.Background()
+
+		var noteBy, occBy interface{}
+		mock.ExpectExec("INSERT INTO notes").WithArgs(pid, nid, sqlmock.AnyArg(), uIDArg{&noteBy}).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery("INSERT INTO occurrences").
+			WithArgs(pid, sqlmock.AnyArg(), pid, nid, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg(), nil, uIDArg{&occBy}, nil).
+			WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+		if _, err := s.CreateNote(ctx, pid, nid, uID, &pb.Note{}); err != nil {
+			t.Fatalf("CreateNote() error = %v", err)
+		}
+		o, err := s.CreateOccurrence(ctx, pid, uID, &pb.Occurrence{NoteName: name.FormatNote(pid, nid)})
+		if err != nil {
+			t.Fatalf("CreateOccurrence() error = %v", err)
+		}
+		_, oID, _ := name.ParseOccurrence(o.Name)
+
+		mock.ExpectQuery(regexp.QuoteMeta(noteCreator)).WithArgs(pid, nid).
+			WillReturnRows(sqlmock.NewRows([]string{"created_by"}).AddRow(noteBy))
+		mock.ExpectQuery(regexp.QuoteMeta(occurrenceCreator)).WithArgs(pid, oID).
+			WillReturnRows(sqlmock.NewRows([]string{"created_by"}).AddRow(occBy))
+		if got, err := s.NoteCreator(ctx, pid, nid); err != nil || got != uID {
+			t.Errorf("NoteCreator() = %q, %v, want %q", got, err, uID)
+		}
+		if got, err := s.OccurrenceCreator(ctx, pid, oID); err != nil || got != uID {
+			t.Errorf("OccurrenceCreator() = %q, %v, want %q", got, err, uID)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unfulfilled expectations: %v", err)
+		}
+		db.Close()
+	}
+}
+
+func TestStore_CreatorNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	mock.ExpectQuery(regexp.QuoteMeta(occurrenceCreator)).WillReturnRows(sqlmock.NewRows([]string{"created_by"}))
+	if _, err := s.OccurrenceCreator(context.Background(), pid, "missing"); status.Code(err) != codes.NotFound {
+		t.Errorf("OccurrenceCreator() error = %v, want NotFound", err)
+	}
+}
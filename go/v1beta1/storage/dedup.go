@@ -0,0 +1,43 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// contentHash returns the hex SHA-256 of the content of o, identifying occurrences submitted
+// with the same content. Every field contributes to the hash, including the resource, the
+// note name, the kind, the remediation and the details, except the output-only name, creation
+// time and update time, which differ between submissions of the same content. The content is
+// hashed in its stored JSON form, which is deterministic, so equal occurrences hash alike
+// whatever the order of their map entries.
+func contentHash(o *pb.Occurrence) (sql.NullString, error) {
+	o = proto.Clone(o).(*pb.Occurrence)
+	o.Name = ""
+	o.CreateTime = nil
+	o.UpdateTime = nil
+	b, err := marshalJSON(o)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	sum := sha256.Sum256(b)
+	return sql.NullString{String: hex.EncodeToString(sum[:]), Valid: true}, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	vpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestContentHash(t *testing.T) {
+	base := &pb.Occurrence{
+		Name:     "projects/pid/occurrences/o1",
+		NoteName: "projects/pid/notes/n1",
+		Resource: &pb.Resource{Uri: "https://gcr.io/p/image@sha256:abc"},
+		Details:  &pb.Occurrence_Vulnerability{Vulnerability: &vpb.Details{Severity: vpb.Severity_HIGH}},
+	}
+	hash := func(o *pb.Occurrence) string {
+		h, err := contentHash(o)
+		if err != nil || !h.Valid {
+			t.Fatalf("contentHash() = %v, %v", h, err)
+		}
+		return h.String
+	}
+	want := hash(base)
+
+	// The output-only fields do not contribute to the hash.
+	same := proto.Clone(base).(*pb.Occurrence)
+	same.Name = "projects/pid/occurrences/o2"
+	same.CreateTime = timestamppb.Now()
+	same.UpdateTime = timestamppb.Now()
+	if got := hash(same); got != want {
+		t.Errorf("contentHash() of the same content = %s, want %s", got, want)
+	}
+
+	for label, change := range map[string]func(*pb.Occurrence){
+		"resource":    func(o *pb.Occurrence) { o.Resource.Uri = "https://gcr.io/p/image@sha256:def" },
+		"note name":   func(o *pb.Occurrence) { o.NoteName = "projects/pid/notes/n2" },
+		"details":     func(o *pb.Occurrence) { o.GetVulnerability().Severity = vpb.Severity_LOW },
+		"remediation": func(o *pb.Occurrence) { o.Remediation = "upgrade" },
+	} {
+		o := proto.Clone(base).(*pb.Occurrence)
+		change(o)
+		if hash(o) == want {
+			t.Errorf("%s: contentHash() did not change with the content", label)
+		}
+	}
+}
+
+func TestStore_CreateOccurrenceDuplicateContent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, DeduplicateOccurrences: true})
+	ctx := context.Background()
+	o := &pb.Occurrence{NoteName: name.FormatNote(pid, nid), Resource: &pb.Resource{Uri: "https://gcr.io/p/image"}}
+	hash, err := contentHash(o)
+	if err != nil {
+		t.Fatalf("contentHash() error = %v", err)
+	}
+
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WithArgs(pid, sqlmock.AnyArg(), pid, nid, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg(), hash.String, nil, "https://gcr.io/p/image").
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	first, err := s.CreateOccurrence(ctx, pid, "", o)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() error = %v", err)
+	}
+	firstJSON, err := marshalJSON(first)
+	if err != nil {
+		t.Fatalf("failed to marshal occurrence: %v", err)
+	}
+	_, oID, err := name.ParseOccurrence(first.Name)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() returned invalid name %q: %v", first.Name, err)
+	}
+
+	// Re-submitting the same content returns the first occurrence.
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WithArgs(pid, sqlmock.AnyArg(), pid, nid, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg(), hash.String, nil, "https://gcr.io/p/image").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "occurrences_content_hash_idx"})
+	mock.ExpectQuery(regexp.QuoteMeta(duplicateOccurrence)).WithArgs(pid, hash.String).
+		WillReturnRows(sqlmock.NewRows([]string{"occurrence_name", "data"}).AddRow(oID, firstJSON))
+	second, err := s.CreateOccurrence(ctx, pid, "", o)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() of duplicate content error = %v", err)
+	}
+	if !proto.Equal(second, first) {
+		t.Errorf("CreateOccurrence() of duplicate content = %v, want %v", second, first)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
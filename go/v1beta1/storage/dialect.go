@@ -0,0 +1,75 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Dialects of the Dialect config value. CockroachDB speaks the PostgreSQL wire protocol and
+// runs the store's queries as is; the cockroach dialect adapts what differs:
+//
+//   - SERIAL primary keys are declared as INT8 DEFAULT unique_rowid(), which is what
+//     CockroachDB makes of them by default, whatever the serial_normalization session setting.
+//     The ids are unique and increase over time, as page tokens require, but are not
+//     consecutive.
+//   - Schema statements are executed one at a time, since CockroachDB runs the statements of
+//     a single query in an implicit transaction, in which schema changes are restricted.
+//   - AnalyzeTables analyzes one table per statement, as CockroachDB's ANALYZE takes one.
+//   - Tablespaces, which CockroachDB does not support, cannot be configured.
+//
+// CockroachDB always runs transactions as serializable, so the IsolationLevel of the store
+// and per-call isolation levels are upgraded to serializable by the database.
+const (
+	dialectPostgres  = "postgres"
+	dialectCockroach = "cockroach"
+)
+
+// dialectDDL adapts ddl, written for PostgreSQL, to dialect.
+func dialectDDL(ddl, dialect string) string {
+	if dialect != dialectCockroach {
+		return ddl
+	}
+	return strings.ReplaceAll(ddl, "SERIAL PRIMARY KEY", "INT8 DEFAULT unique_rowid() PRIMARY KEY")
+}
+
+// ddlStatements returns the statements to execute ddl, adapted to dialect: ddl as a whole
+// or, for CockroachDB, each of its statements.
+func ddlStatements(ddl, dialect string) []string {
+	ddl = dialectDDL(ddl, dialect)
+	if dialect != dialectCockroach {
+		return []string{ddl}
+	}
+	var stmts []string
+	for _, s := range strings.Split(ddl, ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts
+}
+
+// execDDL executes the schema statements ddl in dialect.
+func execDDL(ctx context.Context, db *sql.DB, ddl, dialect string) error {
+	for _, stmt := range ddlStatements(ddl, dialect) {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/net/context"
+)
+
+func TestDDLStatements(t *testing.T) {
+	ddl := createTablesDDL("")
+	for _, dialect := range []string{"", dialectPostgres} {
+		if got := ddlStatements(ddl, dialect); len(got) != 1 || got[0] != ddl {
+			t.Errorf("ddlStatements(%q) = %q, want the DDL as is", dialect, got)
+		}
+	}
+
+	stmts := ddlStatements(ddl, dialectCockroach)
+	if want := strings.Count(ddl, ";"); len(stmts) != want {
+		t.Fatalf("ddlStatements(cockroach) returned %d statements, want %d", len(stmts), want)
+	}
+	var tables int
+	for _, stmt := range stmts {
+		if strings.Contains(stmt, ";") || stmt != strings.TrimSpace(stmt) {
+			t.Errorf("ddlStatements(cockroach) returned %q, want a single trimmed statement", stmt)
+		}
+		if strings.Contains(stmt, "SERIAL") {
+			t.Errorf("ddlStatements(cockroach) returned %q, want no SERIAL column", stmt)
+		}
+		if strings.HasPrefix(stmt, "CREATE TABLE") {
+			tables++
+			if !strings.Contains(stmt, "id INT8 DEFAULT unique_rowid() PRIMARY KEY") {
+				t.Errorf("ddlStatements(cockroach) created table %q, want a unique_rowid() primary key", stmt)
+			}
+		}
+	}
+	if tables != 4 {
+		t.Errorf("ddlStatements(cockroach) created %d tables, want 4", tables)
+	}
+}
+
+func TestNewStoreWithCustomConnectorConfig_CockroachDialect(t *testing.T) {
+	db, mock, err := sqlmock.NewWithDSN("cockroach-dialect")
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	for _, stmt := range ddlStatements(createTablesDDL(""), dialectCockroach) {
+		mock.ExpectExec(regexp.QuoteMeta(stmt)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	s, err := NewStoreWithCustomConnectorConfig(context.Background(), &mockConnector{dsn: "cockroach-dialect", drv: db.Driver()}, &Config{
+		PaginationKey: paginationKey,
+		Dialect:       dialectCockroach,
+	})
+	if err != nil {
+		t.Fatalf("NewStoreWithCustomConnectorConfig() error = %v", err)
+	}
+	defer s.Close()
+
+	// ANALYZE takes a single table.
+	for _, query := range []string{analyzeProjects, analyzeNotes, analyzeOccurrences} {
+		mock.ExpectExec(regexp.QuoteMeta(query)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	if err := s.AnalyzeTables(context.Background()); err != nil {
+		t.Fatalf("AnalyzeTables() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestValidateConfig_Dialect(t *testing.T) {
+	for _, c := range []Config{{}, {Dialect: dialectPostgres}, {Dialect: dialectCockroach}, {Dialect: dialectPostgres, Tablespace: "fast_ssd"}} {
+		if err := validateConfig(&c); err != nil {
+			t.Errorf("validateConfig(%+v) error = %v", c, err)
+		}
+	}
+	for _, c := range []Config{{Dialect: "mysql"}, {Dialect: dialectCockroach, Tablespace: "fast_ssd"}} {
+		if err := validateConfig(&c); err == nil {
+			t.Errorf("validateConfig(%+v) succeeded, want error", c)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"sort"
+
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// OccurrenceChangeObserver is called after an occurrence is updated with the names of its
+// top-level fields whose values changed, e.g. to record who changed what in an audit log.
+type OccurrenceChangeObserver func(ctx context.Context, pID, oID string, changed []string)
+
+// SetOccurrenceChangeObserver sets the observer of occurrence updates. It must be called
+// before the store is used; a nil observer removes it. While an observer is set,
+// UpdateOccurrence also reads back the value it replaces.
+func (pg *PgSQLStore) SetOccurrenceChangeObserver(o OccurrenceChangeObserver) {
+	pg.occurrenceChanges = o
+}
+
+// changedFields returns the sorted names of the top-level fields that differ between old and
+// updated, which must be of the same type. Fields listed in ignored are skipped.
+func changedFields(old, updated proto.Message, ignored ...string) []string {
+	skip := map[string]bool{}
+	for _, f := range ignored {
+		skip[f] = true
+	}
+	oldMsg, newMsg := old.ProtoReflect(), updated.ProtoReflect()
+	changed := []string{}
+	fields := oldMsg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if !skip[string(fd.Name())] && !fieldEqual(oldMsg, newMsg, fd) {
+			changed = append(changed, string(fd.Name()))
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// fieldEqual reports whether field fd has the same value in a and b.
+func fieldEqual(a, b protoreflect.Message, fd protoreflect.FieldDescriptor) bool {
+	if a.Has(fd) != b.Has(fd) {
+		return false
+	}
+	if !a.Has(fd) {
+		return true
+	}
+	// Compare messages holding only the field, so that lists, maps and nested
+	// messages are compared by proto.Equal.
+	onlyA, onlyB := a.Type().New(), b.Type().New()
+	onlyA.Set(fd, a.Get(fd))
+	onlyB.Set(fd, b.Get(fd))
+	return proto.Equal(onlyA.Interface(), onlyB.Interface())
+}
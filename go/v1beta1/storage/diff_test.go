@@ -0,0 +1,107 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestChangedFields(t *testing.T) {
+	old := &pb.Occurrence{
+		NoteName:    "projects/pid/notes/nid",
+		Remediation: "upgrade",
+		Resource:    &pb.Resource{Uri: "https://example.com/a"},
+		UpdateTime:  timestamppb.New(time.Unix(1, 0)),
+	}
+	tests := []struct {
+		desc    string
+		updated *pb.Occurrence
+		want    []string
+	}{
+		{
+			desc:    "unchanged",
+			updated: &pb.Occurrence{NoteName: old.NoteName, Remediation: old.Remediation, Resource: &pb.Resource{Uri: old.Resource.Uri}},
+			want:    []string{},
+		},
+		{
+			desc:    "scalar and nested",
+			updated: &pb.Occurrence{NoteName: old.NoteName, Remediation: "pin", Resource: &pb.Resource{Uri: "https://example.com/b"}},
+			want:    []string{"remediation", "resource"},
+		},
+		{
+			desc:    "cleared",
+			updated: &pb.Occurrence{Remediation: old.Remediation, Resource: old.Resource},
+			want:    []string{"note_name"},
+		},
+	}
+	for _, tt := range tests {
+		if got := changedFields(old, tt.updated, "update_time"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: changedFields() = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestStore_UpdateOccurrenceChanges(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	var got []string
+	calls := 0
+	s.SetOccurrenceChangeObserver(func(_ context.Context, pID, oID string, changed []string) {
+		calls++
+		if pID != pid || oID != "oid" {
+			t.Errorf("observed update of %s/%s, want %s/oid", pID, oID, pid)
+		}
+		got = changed
+	})
+
+	// A partial update of the remediation leaves the other fields as they were.
+	mock.ExpectQuery(regexp.QuoteMeta(updateOccurrenceReturningOld)).WithArgs(sqlmock.AnyArg(), pid, "oid", nil, sqlmock.AnyArg(), nil).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).
+			AddRow(`{"noteName":"projects/pid/notes/nid","remediation":"upgrade","updateTime":"2021-01-01T00:00:00Z"}`))
+	o := &pb.Occurrence{NoteName: "projects/pid/notes/nid", Remediation: "pin"}
+	if _, err := s.UpdateOccurrence(ctx, pid, "oid", o, nil); err != nil {
+		t.Fatalf("UpdateOccurrence() error = %v", err)
+	}
+	if want := []string{"remediation"}; calls != 1 || !reflect.DeepEqual(got, want) {
+		t.Errorf("observed %d updates changing %v, want 1 changing %v", calls, got, want)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(updateOccurrenceReturningOld)).WithArgs(sqlmock.AnyArg(), pid, "oid", nil, sqlmock.AnyArg(), nil).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	if _, err := s.UpdateOccurrence(ctx, pid, "oid", o, nil); status.Code(err) != codes.NotFound {
+		t.Errorf("UpdateOccurrence() error = %v, want NotFound", err)
+	}
+	if calls != 1 {
+		t.Errorf("observed %d updates, want 1", calls)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// tooManyConnections is the SQLSTATE of the connections refused by the server once
+// max_connections is reached.
+const tooManyConnections = "53300"
+
+// defaultRetryDelay is the delay after which clients are told to retry when the database
+// runs out of connections, and when the store does unless it is configured with RetryDelay.
+const defaultRetryDelay = time.Second
+
+// resourceExhausted returns a ResourceExhausted error with the message formatted from format
+// and args, carrying a RetryInfo detail telling clients to retry after delay.
+func resourceExhausted(delay time.Duration, format string, args ...interface{}) error {
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf(format, args...))
+	if withInfo, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)}); err == nil {
+		st = withInfo
+	}
+	return st.Err()
+}
+
+// dbError converts err, returned by the database to a store method, into the error the method
+// fails with: an Internal error with message msg, unless err has a cause operators can act on.
+// Connections refused by the server for lack of connection slots are ResourceExhausted and
+// point at the connection limits; clients are told to retry after defaultRetryDelay. Errors
+// of the queries the store fails itself, e.g. on a tenant connection limit, are returned as is.
+func dbError(err error, msg string) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == tooManyConnections {
+		log.Println(msg, err)
+		return resourceExhausted(defaultRetryDelay, "Database connection limit reached; lower max_open_conns across store instances or raise max_connections")
+	}
+	return status.Error(codes.Internal, msg)
+}
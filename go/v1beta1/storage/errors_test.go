@@ -0,0 +1,68 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDBError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want codes.Code
+	}{
+		{err: &pq.Error{Code: "53300"}, want: codes.ResourceExhausted},
+		{err: fmt.Errorf("connecting: %w", &pq.Error{Code: "53300"}), want: codes.ResourceExhausted},
+		{err: &pq.Error{Code: "42P01"}, want: codes.Internal},
+		{err: errors.New("connection reset by peer"), want: codes.Internal},
+	}
+	for _, tt := range tests {
+		if got := status.Code(dbError(tt.err, "Failed")); got != tt.want {
+			t.Errorf("dbError(%v) code = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestStore_TooManyConnections(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+
+	tooMany := &pq.Error{Code: "53300", Message: "sorry, too many clients already"}
+	mock.ExpectQuery("SELECT data FROM occurrences").WillReturnError(tooMany)
+	mock.ExpectQuery("SELECT id, note_name, data FROM notes").WillReturnError(tooMany)
+	_, err = s.GetOccurrence(context.Background(), pid, "o1")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("GetOccurrence() error = %v, want ResourceExhausted", err)
+	}
+	_, _, err = s.ListNotes(context.Background(), pid, "", "", 10)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("ListNotes() error = %v, want ResourceExhausted", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// exportRecord is a line of a project export, holding either a note or an occurrence
+// in the JSON encoding of its proto.
+type exportRecord struct {
+	Note       json.RawMessage `json:"note,omitempty"`
+	Occurrence json.RawMessage `json:"occurrence,omitempty"`
+}
+
+// ExportProject writes the notes, then the occurrences, of project pID to w as newline-delimited
+// JSON, one {"note": ...} or {"occurrence": ...} object per line, e.g. for backup or migration
+// to another store. Entities are streamed as they are read, from a single snapshot.
+func (pg *PgSQLStore) ExportProject(ctx context.Context, pID string, w io.Writer) error {
+	ctx = pg.withQueryTags(ctx, pID)
+	if _, err := pg.GetProject(ctx, pID); err != nil {
+		return err
+	}
+	q, release, err := pg.acquireConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	tx, err := q.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		log.Println("Failed to begin transaction", err)
+		return dbError(err, "Failed to begin transaction")
+	}
+	// The transaction only reads, so it is never committed.
+	defer tx.Rollback()
+
+	enc := json.NewEncoder(w)
+	err = exportEntities(ctx, tx, exportNotes, pID, enc, func(nID string, data []byte) (*exportRecord, error) {
+		var n pb.Note
+		if err := protojson.Unmarshal(data, &n); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to unmarshal Note from database")
+		}
+		n.Name = name.FormatNote(pID, nID)
+		out, err := marshalExported(&n)
+		return &exportRecord{Note: out}, err
+	})
+	if err != nil {
+		return err
+	}
+	return exportEntities(ctx, tx, exportOccurrences, pID, enc, func(oID string, data []byte) (*exportRecord, error) {
+		var o pb.Occurrence
+		if err := protojson.Unmarshal(data, &o); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+		}
+		o.Name = name.FormatOccurrence(pID, oID)
+		out, err := marshalExported(&o)
+		return &exportRecord{Occurrence: out}, err
+	})
+}
+
+// exportEntities writes the records built by record from the (id, data) rows of query to enc.
+func exportEntities(ctx context.Context, tx *sql.Tx, query, pID string, enc *json.Encoder, record func(id string, data []byte) (*exportRecord, error)) error {
+	rows, err := tx.QueryContext(ctx, query, pID)
+	if err != nil {
+		log.Println("Failed to query entities to export", err)
+		return dbError(err, "Failed to query entities to export")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return status.Error(codes.Internal, "Failed to scan exported row")
+		}
+		r, err := record(id, data)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(r); err != nil {
+			log.Println("Failed to write export", err)
+			return status.Error(codes.Internal, "Failed to write export")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Failed to read entities to export", err)
+		return dbError(err, "Failed to read entities to export")
+	}
+	return nil
+}
+
+// marshalExported returns the JSON encoding of m in an export.
+func marshalExported(m proto.Message) (json.RawMessage, error) {
+	out, err := marshalJSON(m)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to marshal exported entity")
+	}
+	return out, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// expectExport sets up mock to serve the export of the notes and occurrences of project pid.
+func expectExport(mock sqlmock.Sqlmock, notes, occurrences map[string]string) {
+	mock.ExpectQuery(regexp.QuoteMeta(projectExists)).WithArgs(name.FormatProject(pid)).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	nRows := sqlmock.NewRows([]string{"note_name", "data"})
+	for _, id := range sortedKeys(notes) {
+		nRows.AddRow(id, notes[id])
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(exportNotes)).WithArgs(pid).WillReturnRows(nRows)
+	oRows := sqlmock.NewRows([]string{"occurrence_name", "data"})
+	for _, id := range sortedKeys(occurrences) {
+		oRows.AddRow(id, occurrences[id])
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(exportOccurrences)).WithArgs(pid).WillReturnRows(oRows)
+	mock.ExpectRollback()
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestStore_ExportProject(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	expectExport(mock,
+		map[string]string{"n1": `{"shortDescription":"first"}`, "n2": `{"shortDescription":"second"}`},
+		map[string]string{"o1": `{"noteName":"projects/pid/notes/n1","remediation":"upgrade"}`})
+
+	var buf bytes.Buffer
+	if err := s.ExportProject(context.Background(), pid, &buf); err != nil {
+		t.Fatalf("ExportProject() error = %v", err)
+	}
+	var notes []*pb.Note
+	var occurrences []*pb.Occurrence
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var r exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid export line %q: %v", scanner.Text(), err)
+		}
+		switch {
+		case r.Note != nil:
+			if len(occurrences) > 0 {
+				t.Errorf("note exported after occurrences: %s", r.Note)
+			}
+			var n pb.Note
+			if err := protojson.Unmarshal(r.Note, &n); err != nil {
+				t.Fatalf("invalid exported note %s: %v", r.Note, err)
+			}
+			notes = append(notes, &n)
+		case r.Occurrence != nil:
+			var o pb.Occurrence
+			if err := protojson.Unmarshal(r.Occurrence, &o); err != nil {
+				t.Fatalf("invalid exported occurrence %s: %v", r.Occurrence, err)
+			}
+			occurrences = append(occurrences, &o)
+		default:
+			t.Errorf("export line %q holds neither a note nor an occurrence", scanner.Text())
+		}
+	}
+	wantNotes := []*pb.Note{
+		{Name: "projects/pid/notes/n1", ShortDescription: "first"},
+		{Name: "projects/pid/notes/n2", ShortDescription: "second"},
+	}
+	wantOccurrences := []*pb.Occurrence{
+		{Name: "projects/pid/occurrences/o1", NoteName: "projects/pid/notes/n1", Remediation: "upgrade"},
+	}
+	if len(notes) != len(wantNotes) || len(occurrences) != len(wantOccurrences) {
+		t.Fatalf("exported %d notes and %d occurrences, want %d and %d", len(notes), len(occurrences), len(wantNotes), len(wantOccurrences))
+	}
+	for i := range wantNotes {
+		if !proto.Equal(notes[i], wantNotes[i]) {
+			t.Errorf("exported note %d = %v, want %v", i, notes[i], wantNotes[i])
+		}
+	}
+	for i := range wantOccurrences {
+		if !proto.Equal(occurrences[i], wantOccurrences[i]) {
+			t.Errorf("exported occurrence %d = %v, want %v", i, occurrences[i], wantOccurrences[i])
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_ExportProjectNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	mock.ExpectQuery(regexp.QuoteMeta(projectExists)).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	var buf bytes.Buffer
+	if err := s.ExportProject(context.Background(), pid, &buf); status.Code(err) != codes.NotFound {
+		t.Errorf("ExportProject() error = %v, want NotFound", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("ExportProject() wrote %q for a missing project", buf.String())
+	}
+}
@@ -17,19 +17,198 @@ package storage
 import (
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"time"
 
 	expr "github.com/grafeas/grafeas/cel"
 	"github.com/grafeas/grafeas/go/filtering/common"
 	"github.com/grafeas/grafeas/go/filtering/operators"
 	"github.com/grafeas/grafeas/go/filtering/parser"
+	"github.com/grafeas/grafeas/go/name"
+	vpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// FilterSQL translates a Grafeas filter expression into a SQL predicate over the JSONB data column.
+//
+// Fields absent from a row's data extract as NULL. So that AND/OR combinations do not
+// silently drop rows through NULL propagation, comparisons never evaluate to NULL:
+// a positive comparison (=, <, <=, >, >=) against an absent field is false, while
+// != against an absent field is true, i.e. a row missing the field is "not equal".
+//
+// NOT negates a restriction, treating a row missing the field as not matching the positive
+// restriction, so NOT kind = "BUILD" includes rows without a kind. The filter grammar has no
+// IN: set membership is tested with an OR of equalities, e.g. kind = "BUILD" OR kind = "IMAGE".
+//
+// The has operator (:) matches a field against a pattern in which '*' stands for any
+// sequence of characters, e.g. resource.uri:"https://gcr.io/*". The pattern is bound
+// as a LIKE parameter.
+//
+// Absent fields are found in two ways. field = null matches rows in which the field is
+// null, i.e. missing or set to JSON null, and field != null the others. field:"*" tests the
+// presence of the field's key, even if its value is JSON null, so NOT resource.uri:"*"
+// matches rows whose resource has no uri key, including those without a resource.
+//
+// Fields of the JSONB data compared with numbers are cast to numeric, and those compared
+// with true or false to boolean, so that e.g. resource.min_value > 10 compares numbers rather
+// than text. Values of another type, such as strings, do not match such comparisons. The
+// parser reads null, true and false as identifiers: they are keywords rather than fields, so
+// top-level fields with these names cannot be filtered.
+//
+// Top-level fields promoted to columns of the filtered table are compared against the
+// column rather than the JSONB data. Timestamp columns accept RFC 3339 string constants
+// with either a 'Z' or a numeric UTC offset; the constant is bound as a timestamptz
+// parameter so the comparison is between instants, independent of the session time zone.
+// They also accept times relative to the current time: now(), and ago("...") for the time a
+// duration of Go syntax, such as "24h" or "90m", before it, e.g. create_time > ago("24h") for
+// the occurrences created in the last day. These are evaluated by the database, as of the
+// start of the transaction.
+// Equality tests of the note name of occurrences are translated into tests of the indexed
+// note_id column. Enum columns, such as the severity of vulnerability occurrences, accept the
+// enum value names as string constants, compared by their numeric values, so that e.g.
+// severity >= "HIGH" matches HIGH and CRITICAL vulnerabilities. The created_by field of
+// occurrences, which is not part of their data, matches the user that created them, e.g.
+// created_by = "alice"; occurrences created anonymously have none, i.e. NOT created_by:"*".
+// Likewise, labels.key matches the value of the label key set by SetOccurrenceLabels, e.g.
+// labels.team = "payments".
+//
+// With foldCase set, string comparisons ignore case: equality tests compare the field and the
+// string constant lowercased with lower(), and the has operator uses ILIKE, e.g.
+// resource.uri = "GCR.io/x" matches the URI gcr.io/x. Note names, enums and timestamps are
+// still compared as they are.
+//
+// Filters calling functions, such as size(), are rejected: only the operators listed in
+// supportedOperators, and now() and ago() in relative times, are translated.
+//
+// Filters nested deeper than maxDepth or made of more than maxNodes expression nodes are
+// rejected, so that hostile filters cannot produce arbitrarily large SQL.
 type FilterSQL struct {
 	selects int
+	// maxDepth and maxNodes bound the depth and size of the translated expression; 0 means no bound.
+	maxDepth, maxNodes int
+	// depth and nodes are the current depth and the number of nodes translated so far.
+	depth, nodes int
+	// columns maps top-level filter fields to the promoted columns of the filtered table.
+	columns map[string]string
+	// argOffset is the number of arguments taken by the enclosing query. Placeholders
+	// for values bound by the predicate are numbered after them.
+	argOffset int
+	// args holds the values bound by the predicate, in placeholder order.
+	args []interface{}
+	// foldCase makes string comparisons case-insensitive.
+	foldCase bool
+	// err records the first part of the filter that could not be translated.
+	err error
+}
+
+// supportedOperators lists the filter operators, for error messages; filters may call no other
+// functions.
+const supportedOperators = "=, !=, <, <=, >, >=, : (has), AND, OR, NOT and indexing"
+
+// projectColumns maps filter fields to the columns of the projects table.
+var projectColumns = map[string]string{
+	"name": "name",
+}
+
+// occurrenceColumns maps filter fields to the promoted columns of the occurrences table.
+var occurrenceColumns = map[string]string{
+	"create_time": "created_at",
+	"createTime":  "created_at",
+	"created_by":  createdByColumn,
+	"labels":      labelsColumn,
+	"note_name":   noteIDColumn,
+	"noteName":    noteIDColumn,
+	"severity":    severityColumn,
+}
+
+const (
+	// labelsColumn is the JSONB column of the occurrences table holding their labels, set by
+	// SetOccurrenceLabels. It is not part of the occurrence data either.
+	labelsColumn = "labels"
+	// createdByColumn is the column of the occurrences table holding the user that created
+	// them. It is not part of the occurrence data, so only filters can refer to it.
+	createdByColumn = "created_by"
+	// noteIDColumn is the column of the occurrences table referencing their note.
+	// Equality tests of the note name are translated into tests of this column.
+	noteIDColumn = "note_id"
+	// noteNameData extracts the note name from the data column, for the other tests.
+	noteNameData = "data->>'noteName'"
+)
+
+const (
+	// nullIdent is the identifier fields are compared with to test whether they are null.
+	nullIdent = "null"
+	// trueIdent and falseIdent are the identifiers of the boolean values.
+	trueIdent  = "true"
+	falseIdent = "false"
+)
+
+// jsonbColumns is the set of promoted columns holding JSONB objects, whose fields are
+// selected like those of the data column, e.g. labels.env.
+var jsonbColumns = map[string]bool{
+	labelsColumn: true,
+}
+
+// timestampColumns is the set of promoted columns holding timestamps.
+var timestampColumns = map[string]bool{
+	"created_at": true,
+}
+
+// enumColumns maps the promoted columns holding enum values to the values of the enum names.
+var enumColumns = map[string]map[string]int32{
+	severityColumn: vpb.Severity_value,
+}
+
+const (
+	// defaultMaxFilterDepth is the default bound on the nesting depth of filters.
+	defaultMaxFilterDepth = 64
+	// defaultMaxFilterNodes is the default bound on the number of expression nodes of filters.
+	defaultMaxFilterNodes = 1024
+)
+
+// filterClause translates filter into a predicate to append to the WHERE clause of a query
+// taking argOffset arguments. It returns the predicate, parenthesized and prefixed with
+// " AND " so that it narrows the base condition whatever its top-level operator, and the
+// arguments it binds; both are empty if filter is empty.
+func (pg *PgSQLStore) filterClause(filter string, columns map[string]string, argOffset int) (string, []interface{}, error) {
+	if filter == "" {
+		return "", nil, nil
+	}
+	sql, args, err := pg.filterPredicate(filter, columns, argOffset)
+	if err != nil {
+		return "", nil, err
+	}
+	return " AND (" + sql + ")", args, nil
+}
+
+// filterPredicate translates filter into a predicate for a query taking argOffset arguments,
+// and returns it with the arguments it binds. Invalid filters, including those exceeding the
+// store's complexity limits, are rejected with InvalidArgument.
+func (pg *PgSQLStore) filterPredicate(filter string, columns map[string]string, argOffset int) (string, []interface{}, error) {
+	fs := FilterSQL{columns: columns, argOffset: argOffset, maxDepth: pg.maxFilterDepth, maxNodes: pg.maxFilterNodes, foldCase: pg.foldFilterCase}
+	sql, err := fs.translate(filter)
+	if err != nil {
+		log.Println(err)
+		return "", nil, status.Errorf(codes.InvalidArgument, "Invalid filter: %v", err)
+	}
+	return sql, fs.args, nil
+}
+
+// bind records v as an argument of the predicate and returns its placeholder.
+func (fs *FilterSQL) bind(v interface{}) string {
+	fs.args = append(fs.args, v)
+	return fmt.Sprintf("$%d", fs.argOffset+len(fs.args))
 }
 
 func (fs *FilterSQL) sqlFromCall(funcName string, args []*expr.Expr) string {
+	if funcName == operators.Global {
+		return fs.sqlFromGlobal(args)
+	}
+	if (funcName == operators.Equals || funcName == operators.NotEquals) && len(args) == 2 && isNull(args[1]) {
+		return fs.sqlFromNullTest(funcName, args[0])
+	}
 	var sqlOp string
 	switch funcName {
 	case operators.Equals:
@@ -48,21 +227,173 @@ func (fs *FilterSQL) sqlFromCall(funcName string, args []*expr.Expr) string {
 		sqlOp = "AND"
 	case operators.LogicalOr:
 		sqlOp = "OR"
+	case operators.LogicalNot:
+		sqlOp = "NOT"
 	case operators.Index:
 		sqlOp = "["
+	case operators.Has:
+		sqlOp = "LIKE"
 	default:
-		sqlOp = ""
+		fs.fail(fmt.Errorf("unsupported function %q; filters support only the operators %s", funcName, supportedOperators))
+		return "NULL"
 	}
 	var argNames []string
-	for _, arg := range args {
+	for i, arg := range args {
+		if i == 1 && timestampColumns[argNames[0]] {
+			if sql, ok := fs.relativeTime(arg); ok {
+				argNames = append(argNames, sql)
+				continue
+			}
+		}
 		argNames = append(argNames, fs.makeSQL(arg))
 	}
-	if sqlOp == "[" {
+	operands := 2
+	if sqlOp == "NOT" {
+		operands = 1
+	}
+	if len(argNames) != operands {
+		fs.fail(fmt.Errorf("operator %s takes %d operands, got %d", funcName, operands, len(argNames)))
+		return "NULL"
+	}
+	if len(args) == 2 && timestampColumns[argNames[0]] {
+		if t, ok := timestampConstant(args[1]); ok {
+			argNames[1] = fs.bind(t)
+		}
+	}
+	if values, ok := enumColumns[argNames[0]]; ok && len(args) == 2 && args[1].GetConstExpr() != nil {
+		v, ok := fs.enumConstant(argNames[0], values, args[1])
+		if !ok {
+			return "NULL"
+		}
+		argNames[1] = fs.bind(v)
+	}
+	if len(args) == 2 && isComparison(sqlOp) {
+		argNames[0] = castField(argNames[0], args[1])
+	}
+	if len(args) == 2 && argNames[0] == noteIDColumn {
+		if sqlOp == "=" || sqlOp == "!=" {
+			argNames[1] = fs.noteIDQuery(args[1])
+		} else {
+			argNames[0] = noteNameData
+		}
+	}
+	if (sqlOp == "=" || sqlOp == "!=") && len(args) == 2 && fs.foldsCase(argNames[0], args[1]) {
+		argNames[0], argNames[1] = "lower("+argNames[0]+")", "lower("+argNames[1]+")"
+	}
+	switch sqlOp {
+	case "LIKE":
+		pattern, ok := likePattern(args[1])
+		if !ok {
+			fs.fail(fmt.Errorf("operator %s takes a string pattern", funcName))
+			return "NULL"
+		}
+		if pattern == "%" {
+			return keyExists(argNames[0])
+		}
+		if fs.foldCase {
+			sqlOp = "ILIKE"
+		}
+		return fmt.Sprintf("COALESCE(%s %s %s, FALSE)", argNames[0], sqlOp, fs.bind(pattern))
+	case "[":
 		return fmt.Sprintf("%s[%s]", argNames[0], argNames[1])
-	} else if sqlOp != "" {
+	case "AND", "OR":
 		return fmt.Sprintf("(%s %s %s)", argNames[0], sqlOp, argNames[1])
+	case "NOT":
+		// Comparisons never evaluate to NULL, so negating them is null-safe.
+		return fmt.Sprintf("(NOT %s)", argNames[0])
+	case "!=":
+		return fmt.Sprintf("(%s IS DISTINCT FROM %s)", argNames[0], argNames[1])
 	}
-	return fmt.Sprintf("%s(%s)", funcName, strings.Join(argNames, ", "))
+	return fmt.Sprintf("COALESCE(%s %s %s, FALSE)", argNames[0], sqlOp, argNames[1])
+}
+
+// sqlFromGlobal translates the global restriction the parser wraps the terms which are not
+// restrictions in: parenthesized expressions, translated as they are, and function calls,
+// rejected by the name the filter calls them. Bare values, such as BUILD, which would search
+// every field, are rejected too.
+func (fs *FilterSQL) sqlFromGlobal(args []*expr.Expr) string {
+	if len(args) != 1 || args[0].GetCallExpr() == nil {
+		fs.fail(fmt.Errorf("bare values are not supported; filters must compare fields, e.g. kind = \"BUILD\""))
+		return "NULL"
+	}
+	return fs.makeSQL(args[0])
+}
+
+// foldsCase reports whether field is compared with the constant node regardless of case:
+// whether the filter folds case, node is a string and field holds text other than a note
+// name, an enum or a timestamp.
+func (fs *FilterSQL) foldsCase(field string, node *expr.Expr) bool {
+	if !fs.foldCase {
+		return false
+	}
+	if _, ok := node.GetConstExpr().GetConstantKind().(*expr.Constant_StringValue); !ok {
+		return false
+	}
+	_, isEnum := enumColumns[field]
+	return !isEnum && !timestampColumns[field] && field != noteIDColumn && field != noteNameData
+}
+
+// sqlFromNullTest translates field = null and field != null, testing whether field is null,
+// i.e. missing or set to JSON null.
+func (fs *FilterSQL) sqlFromNullTest(funcName string, field *expr.Expr) string {
+	sql := fs.makeSQL(field)
+	if funcName == operators.NotEquals {
+		return fmt.Sprintf("(%s IS NOT NULL)", sql)
+	}
+	return fmt.Sprintf("(%s IS NULL)", sql)
+}
+
+// isNull reports whether node is null, which the parser reads as an identifier.
+func isNull(node *expr.Expr) bool {
+	return node.GetIdentExpr().GetName() == nullIdent
+}
+
+// keyExists returns a predicate testing whether the object holding the field extracted by
+// field, e.g. data->'resource'->>'uri', has its key, e.g. uri, whatever its value. Promoted
+// columns have no key: they are tested for a value.
+func keyExists(field string) string {
+	i := strings.LastIndex(field, "->>")
+	if i < 0 {
+		return fmt.Sprintf("(%s IS NOT NULL)", field)
+	}
+	return fmt.Sprintf("COALESCE(%s ? %s, FALSE)", field[:i], field[i+len("->>"):])
+}
+
+// isComparison reports whether sqlOp compares two values.
+func isComparison(sqlOp string) bool {
+	switch sqlOp {
+	case "=", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+// numericText matches the text of JSON numbers, and of the strings protojson encodes 64-bit
+// integers as, which can be cast to numeric.
+const numericText = `'^-?[0-9]+([.][0-9]+)?([eE][+-]?[0-9]+)?$'`
+
+// castField returns field, if it extracts text from the JSONB data, cast to the type of the
+// number, true or false node it is compared with, so that numbers are compared as numbers
+// rather than as text. Values which do not have that type extract as NULL rather than fail
+// the cast. Other fields, including promoted columns, are returned unchanged.
+func castField(field string, node *expr.Expr) string {
+	if !strings.Contains(field, "->>") {
+		return field
+	}
+	if isBool(node) {
+		return fmt.Sprintf("(CASE WHEN %[1]s IN ('true', 'false') THEN (%[1]s)::boolean END)", field)
+	}
+	switch node.GetConstExpr().GetConstantKind().(type) {
+	case *expr.Constant_Int64Value, *expr.Constant_Uint64Value, *expr.Constant_DoubleValue:
+		return fmt.Sprintf("(CASE WHEN %[1]s ~ %[2]s THEN (%[1]s)::numeric END)", field, numericText)
+	}
+	return field
+}
+
+// isBool reports whether node is true or false, which the parser reads as identifiers.
+func isBool(node *expr.Expr) bool {
+	name := node.GetIdentExpr().GetName()
+	return name == trueIdent || name == falseIdent
 }
 
 func (fs *FilterSQL) sqlFromSelect(selectNode *expr.Expr_Select) string {
@@ -80,12 +411,163 @@ func (fs *FilterSQL) getConstantValue(constExpr *expr.Constant) string {
 	case *expr.Constant_DoubleValue:
 		return fmt.Sprintf("%f", constExpr.GetDoubleValue())
 	case *expr.Constant_StringValue:
-		return fmt.Sprintf("'%s'", constExpr.GetStringValue())
+		v := constExpr.GetStringValue()
+		if strings.ContainsRune(v, 0) {
+			fs.fail(fmt.Errorf("string constant %q contains a NUL byte", v))
+			return "NULL"
+		}
+		return quoteLiteral(v)
+	}
+	fs.fail(fmt.Errorf("unsupported constant %v", constExpr))
+	return "NULL"
+}
+
+// quoteLiteral quotes s as a PostgreSQL string literal. Single quotes are doubled. If s
+// contains backslashes, they are doubled too and the literal is written in the escape
+// string syntax (E'...'), so it denotes s whatever the standard_conforming_strings setting.
+// Newlines and other characters need no escaping; s must not contain NUL bytes.
+func quoteLiteral(s string) string {
+	s = strings.ReplaceAll(s, "'", "''")
+	if !strings.Contains(s, `\`) {
+		return "'" + s + "'"
+	}
+	return "E'" + strings.ReplaceAll(s, `\`, `\\`) + "'"
+}
+
+// countNodes counts n more translated expression nodes and reports whether the filter
+// now exceeds maxNodes.
+func (fs *FilterSQL) countNodes(n int) bool {
+	fs.nodes += n
+	if fs.maxNodes > 0 && fs.nodes > fs.maxNodes {
+		fs.fail(fmt.Errorf("filter has more than %d expression nodes", fs.maxNodes))
+		return true
+	}
+	return false
+}
+
+// fail records err as the reason the filter could not be translated, unless one is already recorded.
+func (fs *FilterSQL) fail(err error) {
+	if fs.err == nil {
+		fs.err = err
+	}
+}
+
+// noteIDQuery returns a subquery selecting the id of the note named by the string
+// constant node, e.g. "projects/p1/notes/n1".
+func (fs *FilterSQL) noteIDQuery(node *expr.Expr) string {
+	c := node.GetConstExpr()
+	if _, ok := c.GetConstantKind().(*expr.Constant_StringValue); !ok {
+		fs.fail(fmt.Errorf("note name must be a string"))
+		return "NULL"
+	}
+	pID, nID, err := name.ParseNote(c.GetStringValue())
+	if err != nil {
+		fs.fail(fmt.Errorf("invalid note name %q", c.GetStringValue()))
+		return "NULL"
+	}
+	return fmt.Sprintf("(SELECT id FROM notes WHERE project_name = %s AND note_name = %s)", fs.bind(pID), fs.bind(nID))
+}
+
+// enumConstant returns the value of the enum constant node compared with column, which may
+// be given as the name of the value or as a number.
+func (fs *FilterSQL) enumConstant(column string, values map[string]int32, node *expr.Expr) (int64, bool) {
+	c := node.GetConstExpr()
+	switch c.GetConstantKind().(type) {
+	case *expr.Constant_StringValue:
+		if v, ok := values[c.GetStringValue()]; ok {
+			return int64(v), true
+		}
+		fs.fail(fmt.Errorf("unknown %s %q", column, c.GetStringValue()))
+	case *expr.Constant_Int64Value:
+		return c.GetInt64Value(), true
+	default:
+		fs.fail(fmt.Errorf("%s must be compared with an enum name or number", column))
 	}
-	return "NO CONST"
+	return 0, false
+}
+
+// likePattern returns the LIKE pattern for the has operator (:) value node if it is
+// a string constant. '*' matches any sequence of characters; every other character,
+// including the LIKE wildcards '%' and '_', matches itself.
+func likePattern(node *expr.Expr) (string, bool) {
+	c := node.GetConstExpr()
+	if c == nil {
+		return "", false
+	}
+	if _, ok := c.GetConstantKind().(*expr.Constant_StringValue); !ok {
+		return "", false
+	}
+	var b strings.Builder
+	for _, r := range c.GetStringValue() {
+		switch r {
+		case '*':
+			b.WriteRune('%')
+		case '%', '_', '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String(), true
+}
+
+// timestampConstant returns the instant denoted by node if it is an RFC 3339 string constant.
+func timestampConstant(node *expr.Expr) (time.Time, bool) {
+	c := node.GetConstExpr()
+	if c == nil {
+		return time.Time{}, false
+	}
+	if _, ok := c.GetConstantKind().(*expr.Constant_StringValue); !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, c.GetStringValue())
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// relativeTime translates node if it is a time relative to the current time, now() or
+// ago("..."), e.g. ago("24h"), whose duration is written as an interval literal, e.g.
+// now() - interval '86400 seconds'.
+func (fs *FilterSQL) relativeTime(node *expr.Expr) (string, bool) {
+	switch {
+	case isCall(node, "now", 0):
+		return "now()", true
+	case isCall(node, "ago", 1):
+	default:
+		return "", false
+	}
+	c := node.GetCallExpr().GetArgs()[0].GetConstExpr()
+	if _, ok := c.GetConstantKind().(*expr.Constant_StringValue); !ok {
+		fs.fail(fmt.Errorf("ago() takes a duration string, e.g. \"24h\""))
+		return "NULL", true
+	}
+	d, err := time.ParseDuration(c.GetStringValue())
+	if err != nil {
+		fs.fail(fmt.Errorf("invalid duration %q", c.GetStringValue()))
+		return "NULL", true
+	}
+	return fmt.Sprintf("(now() - interval '%s seconds')", strconv.FormatFloat(d.Seconds(), 'f', -1, 64)), true
+}
+
+// isCall reports whether node calls the function named fn with n arguments.
+func isCall(node *expr.Expr, fn string, n int) bool {
+	call := node.GetCallExpr()
+	return call != nil && call.GetFunction() == fn && len(call.GetArgs()) == n
 }
 
 func (fs *FilterSQL) makeSQL(node *expr.Expr) string {
+	fs.depth++
+	defer func() { fs.depth-- }()
+	if fs.maxDepth > 0 && fs.depth > fs.maxDepth {
+		fs.fail(fmt.Errorf("filter is nested deeper than %d levels", fs.maxDepth))
+		return "NULL"
+	}
+	if fs.countNodes(1) {
+		return "NULL"
+	}
 	switch node.GetExprKind().(type) {
 	case *expr.Expr_CallExpr:
 		funcNode := *node.GetCallExpr()
@@ -98,13 +580,16 @@ func (fs *FilterSQL) makeSQL(node *expr.Expr) string {
 		if fs.selects == 0 {
 			spl := strings.Split(retStr, ".")
 			retVal := "data"
-			sep := "->'"
-			sep2 := "->>'"
+			if col, ok := fs.columns[spl[0]]; ok && jsonbColumns[col] {
+				retVal, spl = col, spl[1:]
+			}
+			sep := "->"
+			sep2 := "->>"
 			for i := 0; i < len(spl); i++ {
 				if i != len(spl)-1 {
-					retVal = retVal + sep + spl[i] + "'"
+					retVal = retVal + sep + quoteLiteral(spl[i])
 				} else {
-					retVal = retVal + sep2 + spl[i] + "'"
+					retVal = retVal + sep2 + quoteLiteral(spl[i])
 				}
 			}
 
@@ -120,25 +605,56 @@ func (fs *FilterSQL) makeSQL(node *expr.Expr) string {
 		if fs.selects > 0 {
 			return i_expr.Name
 		}
+		switch i_expr.Name {
+		case nullIdent:
+			fs.fail(fmt.Errorf("null can only be compared with = and !="))
+			return "NULL"
+		case trueIdent:
+			return "TRUE"
+		case falseIdent:
+			return "FALSE"
+		}
+		if col, ok := fs.columns[i_expr.Name]; ok {
+			return col
+		}
 		//return "data->'$." + i_expr.Name + "'"
-		return "data->>'" + i_expr.Name + "'"
+		return "data->>" + quoteLiteral(i_expr.Name)
 	case *expr.Expr_ConstExpr:
 		c_expr := *node.GetConstExpr()
 		return fs.getConstantValue(&c_expr)
 	}
 
-	return "NO SQL"
-
+	fs.fail(fmt.Errorf("unsupported expression %v", node))
+	return "NULL"
 }
 
-// ParseFilter parses the incoming filter and returns a formatted SQL query.
+// ParseFilter parses the incoming filter and returns a formatted SQL query,
+// or the empty string if the filter is invalid.
 func (fs *FilterSQL) ParseFilter(filter string) string {
-	s := common.NewStringSource(filter, "urlParam") // function
-	result, err := parser.Parse(s)
+	sql, err := fs.translate(filter)
 	if err != nil {
 		log.Println(err)
 		return ""
 	}
-	sql := fs.makeSQL(result.Expr)
 	return sql
 }
+
+// translate parses filter and translates it into a SQL predicate.
+func (fs *FilterSQL) translate(filter string) (sql string, err error) {
+	// The parser panics on some malformed filters, e.g. "a.", rather than reporting them.
+	defer func() {
+		if r := recover(); r != nil {
+			sql, err = "", fmt.Errorf("invalid filter %q: %v", filter, r)
+		}
+	}()
+	s := common.NewStringSource(filter, "urlParam") // function
+	result, errs := parser.Parse(s)
+	if errs != nil {
+		return "", fmt.Errorf("invalid filter %q: %s", filter, errs.String())
+	}
+	sql = fs.makeSQL(result.Expr)
+	if fs.err != nil {
+		return "", fmt.Errorf("invalid filter %q: %v", filter, fs.err)
+	}
+	return sql, nil
+}
@@ -15,8 +15,18 @@
 package storage
 
 import (
+	"fmt"
 	"log"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestPgsqlFilterSql_ParseFilter(t *testing.T) {
@@ -27,11 +37,23 @@ func TestPgsqlFilterSql_ParseFilter(t *testing.T) {
 	}{
 		"check if resource uri equal to either one of the values": {
 			filter: `resource.uri="a.rpm" OR resource.uri="https://a.com/b/c/a.rpm"`,
-			want:   `((data->'resource'->>'uri' = 'a.rpm') OR (data->'resource'->>'uri' = 'https://a.com/b/c/a.rpm'))`,
+			want:   `(COALESCE(data->'resource'->>'uri' = 'a.rpm', FALSE) OR COALESCE(data->'resource'->>'uri' = 'https://a.com/b/c/a.rpm', FALSE))`,
 		},
 		"greater than": {
 			filter: `resource.min_value>10 AND resource.max_value<100`,
-			want:   `((data->'resource'->>'min_value' > 10) AND (data->'resource'->>'max_value' < 100))`,
+			want:   `(COALESCE((CASE WHEN data->'resource'->>'min_value' ~ '^-?[0-9]+([.][0-9]+)?([eE][+-]?[0-9]+)?$' THEN (data->'resource'->>'min_value')::numeric END) > 10, FALSE) AND COALESCE((CASE WHEN data->'resource'->>'max_value' ~ '^-?[0-9]+([.][0-9]+)?([eE][+-]?[0-9]+)?$' THEN (data->'resource'->>'max_value')::numeric END) < 100, FALSE))`,
+		},
+		"possibly missing field combined with AND": {
+			filter: `kind="VULNERABILITY" AND remediation="upgrade"`,
+			want:   `(COALESCE(data->>'kind' = 'VULNERABILITY', FALSE) AND COALESCE(data->>'remediation' = 'upgrade', FALSE))`,
+		},
+		"possibly missing field combined with OR": {
+			filter: `remediation="upgrade" OR kind="VULNERABILITY"`,
+			want:   `(COALESCE(data->>'remediation' = 'upgrade', FALSE) OR COALESCE(data->>'kind' = 'VULNERABILITY', FALSE))`,
+		},
+		"not equal matches missing field": {
+			filter: `remediation!="upgrade" AND kind="BUILD"`,
+			want:   `((data->>'remediation' IS DISTINCT FROM 'upgrade') AND COALESCE(data->>'kind' = 'BUILD', FALSE))`,
 		},
 	}
 	for label, tt := range tests {
@@ -45,3 +67,621 @@ func TestPgsqlFilterSql_ParseFilter(t *testing.T) {
 		})
 	}
 }
+
+func TestFilterSQL_TimestampColumns(t *testing.T) {
+	// US daylight saving time began on 2021-03-14 at 02:00 local time, so the two
+	// bounds are written with different offsets but are only an hour apart.
+	fs := FilterSQL{columns: occurrenceColumns, argOffset: 3}
+	got := fs.ParseFilter(`create_time >= "2021-03-14T01:30:00-05:00" AND createTime < "2021-03-14T03:30:00-04:00"`)
+	want := `(COALESCE(created_at >= $4, FALSE) AND COALESCE(created_at < $5, FALSE))`
+	if got != want {
+		t.Fatalf("ParseFilter() = %q, want %q", got, want)
+	}
+	wantArgs := []time.Time{
+		time.Date(2021, 3, 14, 6, 30, 0, 0, time.UTC),
+		time.Date(2021, 3, 14, 7, 30, 0, 0, time.UTC),
+	}
+	if len(fs.args) != len(wantArgs) {
+		t.Fatalf("ParseFilter() bound %d args, want %d", len(fs.args), len(wantArgs))
+	}
+	for i, arg := range fs.args {
+		if ts, ok := arg.(time.Time); !ok || !ts.Equal(wantArgs[i]) {
+			t.Errorf("ParseFilter() arg %d = %v, want %v", i, arg, wantArgs[i])
+		}
+	}
+
+	fs = FilterSQL{columns: occurrenceColumns}
+	got = fs.ParseFilter(`create_time > "2021-11-07T05:59:59Z"`)
+	if want := `COALESCE(created_at > $1, FALSE)`; got != want {
+		t.Fatalf("ParseFilter() = %q, want %q", got, want)
+	}
+	if ts, ok := fs.args[0].(time.Time); !ok || !ts.Equal(time.Date(2021, 11, 7, 5, 59, 59, 0, time.UTC)) {
+		t.Errorf("ParseFilter() arg = %v, want 2021-11-07T05:59:59Z", fs.args[0])
+	}
+}
+
+func TestFilterSQL_RelativeTime(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{`create_time > ago("24h")`, `COALESCE(created_at > (now() - interval '86400 seconds'), FALSE)`},
+		{`createTime >= ago("90m") AND create_time < ago("1.5s")`, `(COALESCE(created_at >= (now() - interval '5400 seconds'), FALSE) AND COALESCE(created_at < (now() - interval '1.5 seconds'), FALSE))`},
+		{`create_time <= now()`, `COALESCE(created_at <= now(), FALSE)`},
+	}
+	for _, tt := range tests {
+		fs := FilterSQL{columns: occurrenceColumns}
+		if got := fs.ParseFilter(tt.filter); got != tt.want {
+			t.Errorf("ParseFilter(%q) = %q, want %q", tt.filter, got, tt.want)
+		}
+		if len(fs.args) != 0 {
+			t.Errorf("ParseFilter(%q) bound %v, want no args", tt.filter, fs.args)
+		}
+	}
+
+	for _, filter := range []string{
+		`create_time > ago("1 day")`,
+		`create_time > ago(24)`,
+		`create_time > ago("24h", "1h")`,
+		`kind > ago("24h")`,
+	} {
+		fs := FilterSQL{columns: occurrenceColumns}
+		if sql, err := fs.translate(filter); err == nil {
+			t.Errorf("translate(%q) = %q, want error", filter, sql)
+		}
+	}
+}
+
+func TestFilterSQL_TimestampFieldsWithoutColumns(t *testing.T) {
+	// Tables without promoted columns keep comparing the JSONB data.
+	var fs FilterSQL
+	got := fs.ParseFilter(`create_time >= "2021-03-14T00:00:00Z"`)
+	if want := `COALESCE(data->>'create_time' >= '2021-03-14T00:00:00Z', FALSE)`; got != want {
+		t.Errorf("ParseFilter() = %q, want %q", got, want)
+	}
+	if len(fs.args) != 0 {
+		t.Errorf("ParseFilter() bound %v, want no args", fs.args)
+	}
+}
+
+func TestFilterSQL_QuotesInFilter(t *testing.T) {
+	tests := map[string]struct {
+		filter string
+		want   string
+	}{
+		"quote in value": {
+			filter: `resource.uri="x' OR '1'='1"`,
+			want:   `COALESCE(data->'resource'->>'uri' = 'x'' OR ''1''=''1', FALSE)`,
+		},
+		"quote in field": {
+			// Single quotes do not delimit strings: 'VULNERABILITY' is the name of a field.
+			filter: `kind='VULNERABILITY' AND note_name!="it's"`,
+			want:   `(COALESCE(data->>'kind' = data->>'''VULNERABILITY''', FALSE) AND (data->>'note_name' IS DISTINCT FROM 'it''s'))`,
+		},
+	}
+	for label, tt := range tests {
+		var fs FilterSQL
+		if got := fs.ParseFilter(tt.filter); got != tt.want {
+			t.Errorf("%s: ParseFilter() = %q, want %q", label, got, tt.want)
+		}
+	}
+}
+
+func TestFilterSQL_HasPattern(t *testing.T) {
+	tests := map[string]struct {
+		filter   string
+		wantArgs []interface{}
+	}{
+		"no quotes": {
+			filter:   `resource.uri:"https://gcr.io/*"`,
+			wantArgs: []interface{}{`https://gcr.io/%`},
+		},
+		"quotes": {
+			filter:   `resource.uri:"*it's 'quoted'*"`,
+			wantArgs: []interface{}{`%it's 'quoted'%`},
+		},
+		"like wildcards match themselves": {
+			filter:   `resource.uri:"100%_\\*"`,
+			wantArgs: []interface{}{`100\%\_\\%`},
+		},
+	}
+	for label, tt := range tests {
+		fs := FilterSQL{argOffset: 1}
+		got, err := fs.translate(tt.filter)
+		if err != nil {
+			t.Errorf("%s: translate() error = %v", label, err)
+			continue
+		}
+		if want := `COALESCE(data->'resource'->>'uri' LIKE $2, FALSE)`; got != want {
+			t.Errorf("%s: translate() = %q, want %q", label, got, want)
+		}
+		if !reflect.DeepEqual(fs.args, tt.wantArgs) {
+			t.Errorf("%s: translate() bound %q, want %q", label, fs.args, tt.wantArgs)
+		}
+	}
+
+	var fs FilterSQL
+	if _, err := fs.translate(`resource.uri:10`); err == nil {
+		t.Error("translate() with a numeric pattern succeeded, want error")
+	}
+}
+
+func TestFilterSQL_InvalidFilter(t *testing.T) {
+	// The parser panics on selections missing their field.
+	for _, filter := range []string{`kind="VULNERABILITY`, `kind=`, "kind=\"a\x00b\"", `a.`, `kind.`, `x=1 AND y.`} {
+		var fs FilterSQL
+		if sql, err := fs.translate(filter); err == nil {
+			t.Errorf("translate(%q) = %q, want error", filter, sql)
+		}
+	}
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{in: "", want: "''"},
+		{in: "plain", want: "'plain'"},
+		{in: "it's", want: "'it''s'"},
+		{in: "''", want: "''''''"},
+		{in: `C:\dir`, want: `E'C:\\dir'`},
+		{in: `\'; DROP TABLE notes; --`, want: `E'\\''; DROP TABLE notes; --'`},
+		{in: "line1\nline2", want: "'line1\nline2'"},
+		{in: "tab\tand \\n", want: "E'tab\tand \\\\n'"},
+	}
+	for _, tt := range tests {
+		if got := quoteLiteral(tt.in); got != tt.want {
+			t.Errorf("quoteLiteral(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// sqlLiteralRE matches a SQL string literal in the form written by quoteLiteral.
+var sqlLiteralRE = regexp.MustCompile(`E?'(?:[^'\\]|''|\\\\)*'`)
+
+func FuzzParseFilter(f *testing.F) {
+	for _, seed := range []string{
+		`resource.uri="a.rpm" OR resource.uri="https://a.com/b/c/a.rpm"`,
+		`resource.min_value>10 AND resource.max_value<100`,
+		`remediation!="upgrade" AND kind="BUILD"`,
+		`create_time >= "2021-03-14T00:00:00Z"`,
+		`kind="x' OR '1'='1"`,
+		`a.b.c="'"`,
+		`f(a, "b")`,
+		`a[0]=1`,
+		`resource.uri:"*it's*"`,
+		`a.`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, filter string) {
+		fs := FilterSQL{columns: occurrenceColumns}
+		sql, err := fs.translate(filter)
+		if err != nil {
+			return
+		}
+		// Every quote from the filter must be escaped inside a string literal.
+		if rest := sqlLiteralRE.ReplaceAllString(sql, ""); strings.Contains(rest, "'") {
+			t.Fatalf("translate(%q) = %q, has an unterminated string literal", filter, sql)
+		}
+
+		// Used as a constant, any text free of the filter's own escapes is a single literal. The
+		// parser reads runes, replacing invalid UTF-8.
+		if strings.ContainsAny(filter, "\\\"") || !utf8.ValidString(filter) {
+			return
+		}
+		fs = FilterSQL{}
+		sql, err = fs.translate(`kind="` + filter + `"`)
+		if err != nil {
+			t.Fatalf("translate() of constant %q failed: %v", filter, err)
+		}
+		if want := "COALESCE(data->>'kind' = " + quoteLiteral(filter) + ", FALSE)"; sql != want {
+			t.Fatalf("translate() of constant %q = %q, want %q", filter, sql, want)
+		}
+	})
+}
+
+func TestFilterSQL_ComplexityLimits(t *testing.T) {
+	// A pathologically nested filter: ((((... kind="x" ...)))) with 1000 levels of parentheses.
+	nested := strings.Repeat("(", 1000) + `kind="x"` + strings.Repeat(")", 1000)
+	// A flat but enormous filter: kind="x0" OR kind="x1" OR ...
+	var terms []string
+	for i := 0; i < 300; i++ {
+		terms = append(terms, `kind="x`+strings.Repeat("y", i%3)+`"`)
+	}
+	wide := strings.Join(terms, " OR ")
+
+	tests := map[string]struct {
+		filter             string
+		maxDepth, maxNodes int
+		wantErr            bool
+	}{
+		"deep AND chain within limits": {
+			filter:   `a=1 AND b=2 AND c=3`,
+			maxDepth: defaultMaxFilterDepth,
+			maxNodes: defaultMaxFilterNodes,
+		},
+		"nested parentheses add no depth": {
+			filter:   nested,
+			maxDepth: defaultMaxFilterDepth,
+			maxNodes: defaultMaxFilterNodes,
+		},
+		"too many terms": {
+			filter:   wide,
+			maxDepth: 1000,
+			maxNodes: defaultMaxFilterNodes,
+			wantErr:  true,
+		},
+		"too deep": {
+			filter:   wide,
+			maxDepth: defaultMaxFilterDepth,
+			maxNodes: 10000,
+			wantErr:  true,
+		},
+		"unbounded": {
+			filter: wide,
+		},
+	}
+	for label, tt := range tests {
+		fs := FilterSQL{maxDepth: tt.maxDepth, maxNodes: tt.maxNodes}
+		_, err := fs.translate(tt.filter)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: translate() error = %v, want error %v", label, err, tt.wantErr)
+		}
+	}
+}
+
+func TestStore_FilterComplexityLimits(t *testing.T) {
+	terms := make([]string, 20)
+	for i := range terms {
+		terms[i] = `kind="BUILD"`
+	}
+	filter := strings.Join(terms, " OR ")
+	s := newStore(nil, &Config{PaginationKey: paginationKey, MaxFilterNodes: 16})
+	_, _, err := s.ListOccurrences(context.Background(), "p1", filter, "", 10)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListOccurrences() error = %v, want InvalidArgument", err)
+	}
+	_, _, err = s.ListNotes(context.Background(), "p1", filter, "", 10)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListNotes() error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestFilterSQL_SetMembership(t *testing.T) {
+	// The filter grammar has no IN: set membership is an OR of equalities, and comparisons
+	// never evaluate to NULL, so its negation includes rows missing the field.
+	var fs FilterSQL
+	got, err := fs.translate(`kind="VULNERABILITY" OR kind="BUILD"`)
+	if err != nil {
+		t.Fatalf("translate() error = %v", err)
+	}
+	if want := `(COALESCE(data->>'kind' = 'VULNERABILITY', FALSE) OR COALESCE(data->>'kind' = 'BUILD', FALSE))`; got != want {
+		t.Errorf("translate() = %q, want %q", got, want)
+	}
+}
+
+func TestFilterSQL_NoteNameColumn(t *testing.T) {
+	tests := map[string]struct {
+		filter   string
+		want     string
+		wantArgs []interface{}
+	}{
+		"equals": {
+			filter:   `note_name="projects/cve-feed/notes/CVE-2021-44228"`,
+			want:     `COALESCE(note_id = (SELECT id FROM notes WHERE project_name = $4 AND note_name = $5), FALSE)`,
+			wantArgs: []interface{}{"cve-feed", "CVE-2021-44228"},
+		},
+		"not equals": {
+			filter:   `noteName!="projects/p1/notes/n1"`,
+			want:     `(note_id IS DISTINCT FROM (SELECT id FROM notes WHERE project_name = $4 AND note_name = $5))`,
+			wantArgs: []interface{}{"p1", "n1"},
+		},
+		"pattern uses the data": {
+			filter:   `note_name:"projects/cve-feed/*"`,
+			want:     `COALESCE(data->>'noteName' LIKE $4, FALSE)`,
+			wantArgs: []interface{}{"projects/cve-feed/%"},
+		},
+	}
+	for label, tt := range tests {
+		fs := FilterSQL{columns: occurrenceColumns, argOffset: 3}
+		got, err := fs.translate(tt.filter)
+		if err != nil {
+			t.Errorf("%s: translate() error = %v", label, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: translate() = %q, want %q", label, got, tt.want)
+		}
+		if !reflect.DeepEqual(fs.args, tt.wantArgs) {
+			t.Errorf("%s: translate() bound %v, want %v", label, fs.args, tt.wantArgs)
+		}
+	}
+
+	fs := FilterSQL{columns: occurrenceColumns}
+	if _, err := fs.translate(`note_name="n1"`); err == nil {
+		t.Error("translate() with an invalid note name succeeded, want error")
+	}
+}
+
+func TestFilterSQL_UnsupportedFunction(t *testing.T) {
+	for _, filter := range []string{`size(resource.uri) > 3`, `matches(kind, "BUILD")`} {
+		var fs FilterSQL
+		sql, err := fs.translate(filter)
+		if err == nil {
+			t.Errorf("translate(%q) = %q, want error", filter, sql)
+			continue
+		}
+		fn := filter[:strings.Index(filter, "(")]
+		if !strings.Contains(err.Error(), fmt.Sprintf("unsupported function %q", fn)) {
+			t.Errorf("translate(%q) error = %v, want it to name %s", filter, err, fn)
+		}
+	}
+
+	s := newStore(nil, &Config{PaginationKey: paginationKey})
+	_, _, err := s.ListOccurrences(context.Background(), pid, `size(resource.uri) > 3`, "", 10)
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "size") {
+		t.Errorf("ListOccurrences() error = %v, want InvalidArgument naming size", err)
+	}
+}
+
+func TestFilterSQL_Casts(t *testing.T) {
+	const (
+		number  = `(CASE WHEN data->>'count' ~ '^-?[0-9]+([.][0-9]+)?([eE][+-]?[0-9]+)?$' THEN (data->>'count')::numeric END)`
+		boolean = `(CASE WHEN data->>'enabled' IN ('true', 'false') THEN (data->>'enabled')::boolean END)`
+	)
+	tests := map[string]struct {
+		filter string
+		want   string
+	}{
+		"integer":   {filter: `count >= 2`, want: `COALESCE(` + number + ` >= 2, FALSE)`},
+		"double":    {filter: `count < 2.5`, want: `COALESCE(` + number + ` < 2.500000, FALSE)`},
+		"not equal": {filter: `count != 2`, want: `(` + number + ` IS DISTINCT FROM 2)`},
+		"true":      {filter: `enabled = true`, want: `COALESCE(` + boolean + ` = TRUE, FALSE)`},
+		"false":     {filter: `enabled != false`, want: `(` + boolean + ` IS DISTINCT FROM FALSE)`},
+		// Strings and promoted columns are compared as they are.
+		"string": {filter: `count = "2"`, want: `COALESCE(data->>'count' = '2', FALSE)`},
+		"column": {filter: `severity < 3`, want: `COALESCE(severity < $2, FALSE)`},
+	}
+	for label, tt := range tests {
+		fs := FilterSQL{columns: occurrenceColumns, argOffset: 1}
+		got, err := fs.translate(tt.filter)
+		if err != nil {
+			t.Errorf("%s: translate() error = %v", label, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: translate() = %q, want %q", label, got, tt.want)
+		}
+	}
+}
+
+func TestFilterSQL_CreatedByColumn(t *testing.T) {
+	tests := map[string]struct {
+		filter   string
+		want     string
+		wantArgs []interface{}
+	}{
+		"equal": {
+			filter: `created_by = "alice"`,
+			want:   `COALESCE(created_by = 'alice', FALSE)`,
+		},
+		// Occurrences created anonymously have no creator.
+		"anonymous": {
+			filter: `NOT created_by:"*"`,
+			want:   `(NOT (created_by IS NOT NULL))`,
+		},
+		"anonymous compared with null": {
+			filter: `created_by = null`,
+			want:   `(created_by IS NULL)`,
+		},
+	}
+	for label, tt := range tests {
+		fs := FilterSQL{columns: occurrenceColumns, argOffset: 1}
+		got, err := fs.translate(tt.filter)
+		if err != nil {
+			t.Errorf("%s: translate() error = %v", label, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: translate() = %q, want %q", label, got, tt.want)
+		}
+		if !reflect.DeepEqual(fs.args, tt.wantArgs) {
+			t.Errorf("%s: translate() bound %v, want %v", label, fs.args, tt.wantArgs)
+		}
+	}
+}
+
+func TestFilterSQL_SeverityColumn(t *testing.T) {
+	tests := map[string]struct {
+		filter   string
+		want     string
+		wantArgs []interface{}
+	}{
+		"at least high": {
+			filter:   `severity >= "HIGH"`,
+			want:     `COALESCE(severity >= $2, FALSE)`,
+			wantArgs: []interface{}{int64(4)}, // HIGH
+		},
+		"range": {
+			filter:   `severity > "LOW" AND severity <= "HIGH"`,
+			want:     `(COALESCE(severity > $2, FALSE) AND COALESCE(severity <= $3, FALSE))`,
+			wantArgs: []interface{}{int64(2), int64(4)},
+		},
+		"number": {
+			filter:   `severity < 3`,
+			want:     `COALESCE(severity < $2, FALSE)`,
+			wantArgs: []interface{}{int64(3)},
+		},
+	}
+	for label, tt := range tests {
+		fs := FilterSQL{columns: occurrenceColumns, argOffset: 1}
+		got, err := fs.translate(tt.filter)
+		if err != nil {
+			t.Errorf("%s: translate() error = %v", label, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: translate() = %q, want %q", label, got, tt.want)
+		}
+		if !reflect.DeepEqual(fs.args, tt.wantArgs) {
+			t.Errorf("%s: translate() bound %v, want %v", label, fs.args, tt.wantArgs)
+		}
+	}
+
+	for _, filter := range []string{`severity >= "SEVERE"`, `severity >= 1.5`} {
+		fs := FilterSQL{columns: occurrenceColumns}
+		if _, err := fs.translate(filter); err == nil {
+			t.Errorf("translate(%q) succeeded, want error", filter)
+		}
+	}
+}
+
+func TestFilterSQL_Absence(t *testing.T) {
+	tests := map[string]struct {
+		filter string
+		want   string
+	}{
+		// A missing key and a JSON null both extract as NULL.
+		"field is null": {
+			filter: `resource.uri = null`,
+			want:   `(data->'resource'->>'uri' IS NULL)`,
+		},
+		"field is not null": {
+			filter: `remediation != null`,
+			want:   `(data->>'remediation' IS NOT NULL)`,
+		},
+		"promoted column is null": {
+			filter: `create_time = null`,
+			want:   `(created_at IS NULL)`,
+		},
+		// A missing parent makes the key test NULL, hence FALSE: the key does not exist.
+		"key does not exist": {
+			filter: `NOT resource.uri:"*"`,
+			want:   `(NOT COALESCE(data->'resource' ? 'uri', FALSE))`,
+		},
+		"top-level key exists": {
+			filter: `remediation:"*"`,
+			want:   `COALESCE(data ? 'remediation', FALSE)`,
+		},
+		"combined": {
+			filter: `kind = "VULNERABILITY" AND NOT resource.uri:"*"`,
+			want:   `(COALESCE(data->>'kind' = 'VULNERABILITY', FALSE) AND (NOT COALESCE(data->'resource' ? 'uri', FALSE)))`,
+		},
+	}
+	for label, tt := range tests {
+		fs := FilterSQL{columns: occurrenceColumns}
+		got, err := fs.translate(tt.filter)
+		if err != nil {
+			t.Errorf("%s: translate() error = %v", label, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: translate() = %q, want %q", label, got, tt.want)
+		}
+	}
+
+	// Patterns other than "*" still match values.
+	fs := FilterSQL{}
+	if got, want := fs.ParseFilter(`resource.uri:"https://*"`), `COALESCE(data->'resource'->>'uri' LIKE $1, FALSE)`; got != want {
+		t.Errorf("ParseFilter() = %q, want %q", got, want)
+	}
+
+	for _, filter := range []string{`resource.uri > null`, `null = "x"`} {
+		var fs FilterSQL
+		if _, err := fs.translate(filter); err == nil {
+			t.Errorf("translate(%q) succeeded, want error", filter)
+		}
+	}
+}
+
+func TestFilterSQL_FoldCase(t *testing.T) {
+	tests := map[string]struct {
+		filter   string
+		want     string
+		wantArgs []interface{}
+	}{
+		"equal": {
+			filter: `resource.uri = "GCR.io/x"`,
+			want:   `COALESCE(lower(data->'resource'->>'uri') = lower('GCR.io/x'), FALSE)`,
+		},
+		"not equal": {
+			filter: `kind != "Build"`,
+			want:   `(lower(data->>'kind') IS DISTINCT FROM lower('Build'))`,
+		},
+		"has": {
+			filter:   `resource.uri:"GCR.io/*"`,
+			want:     `COALESCE(data->'resource'->>'uri' ILIKE $2, FALSE)`,
+			wantArgs: []interface{}{"GCR.io/%"},
+		},
+		// Numbers, enums and note names are compared as they are.
+		"number": {
+			filter: `count = 2`,
+			want:   `COALESCE(` + `(CASE WHEN data->>'count' ~ ` + numericText + ` THEN (data->>'count')::numeric END) = 2, FALSE)`,
+		},
+		"enum": {
+			filter:   `severity = "HIGH"`,
+			want:     `COALESCE(severity = $2, FALSE)`,
+			wantArgs: []interface{}{int64(4)}, // HIGH
+		},
+		"note name": {
+			filter:   `note_name = "projects/p/notes/N"`,
+			want:     `COALESCE(note_id = (SELECT id FROM notes WHERE project_name = $2 AND note_name = $3), FALSE)`,
+			wantArgs: []interface{}{"p", "N"},
+		},
+	}
+	for label, tt := range tests {
+		fs := FilterSQL{columns: occurrenceColumns, argOffset: 1, foldCase: true}
+		got, err := fs.translate(tt.filter)
+		if err != nil {
+			t.Errorf("%s: translate() error = %v", label, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: translate() = %q, want %q", label, got, tt.want)
+		}
+		if !reflect.DeepEqual(fs.args, tt.wantArgs) {
+			t.Errorf("%s: translate() bound %v, want %v", label, fs.args, tt.wantArgs)
+		}
+	}
+
+	// Comparisons are case-sensitive by default.
+	fs := FilterSQL{columns: occurrenceColumns, argOffset: 1}
+	if got, _ := fs.translate(`resource.uri = "GCR.io/x"`); strings.Contains(got, "lower(") {
+		t.Errorf("translate() without foldCase = %q, want a case-sensitive comparison", got)
+	}
+}
+
+func TestFilterSQL_Grouping(t *testing.T) {
+	tests := map[string]struct {
+		filter string
+		want   string
+	}{
+		"or within and": {
+			filter: `(kind="BUILD" OR kind="IMAGE") AND resource.uri="a.rpm"`,
+			want:   `((COALESCE(data->>'kind' = 'BUILD', FALSE) OR COALESCE(data->>'kind' = 'IMAGE', FALSE)) AND COALESCE(data->'resource'->>'uri' = 'a.rpm', FALSE))`,
+		},
+		"negated set": {
+			filter: `NOT (kind="BUILD" OR kind="IMAGE")`,
+			want:   `(NOT (COALESCE(data->>'kind' = 'BUILD', FALSE) OR COALESCE(data->>'kind' = 'IMAGE', FALSE)))`,
+		},
+	}
+	for label, tt := range tests {
+		var fs FilterSQL
+		got, err := fs.translate(tt.filter)
+		if err != nil {
+			t.Errorf("%s: translate() error = %v", label, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: translate() = %q, want %q", label, got, tt.want)
+		}
+	}
+
+	for _, filter := range []string{`BUILD`, `kind="BUILD" AND resource`} {
+		var fs FilterSQL
+		if sql, err := fs.translate(filter); err == nil {
+			t.Errorf("translate(%q) = %q, want error", filter, sql)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"log"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/proto"
+)
+
+// OccurrenceCreatedHook is called with each occurrence created by CreateOccurrence and
+// BatchCreateOccurrences, e.g. to publish an event to a message bus. It is called
+// synchronously once the insert is committed, so rolled-back writes emit no events, and not
+// for creates returning an existing occurrence, nor for imported occurrences. The store's
+// state does not depend on the hook: it is called with a copy of the occurrence, and if it
+// panics, the panic is logged and the create still succeeds.
+type OccurrenceCreatedHook func(ctx context.Context, o *pb.Occurrence)
+
+// SetOnOccurrenceCreated sets the hook called with created occurrences. It must be called
+// before the store is used; a nil hook removes it.
+func (pg *PgSQLStore) SetOnOccurrenceCreated(h OccurrenceCreatedHook) {
+	pg.onOccurrenceCreated = h
+}
+
+// occurrenceCreated calls the OccurrenceCreatedHook of the store, if any, with a copy of o.
+func (pg *PgSQLStore) occurrenceCreated(ctx context.Context, o *pb.Occurrence) {
+	if pg.onOccurrenceCreated == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Occurrence created hook panicked for %q: %v", o.Name, r)
+		}
+	}()
+	pg.onOccurrenceCreated(ctx, proto.Clone(o).(*pb.Occurrence))
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+)
+
+func TestStore_OnOccurrenceCreated(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	var created []string
+	s.SetOnOccurrenceCreated(func(ctx context.Context, o *pb.Occurrence) {
+		created = append(created, o.Name)
+		// Mutations of the hook do not leak into the returned occurrence.
+		o.Remediation = "mutated"
+	})
+	o := &pb.Occurrence{NoteName: name.FormatNote(pid, nid)}
+
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	got, err := s.CreateOccurrence(context.Background(), pid, "", o)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() error = %v", err)
+	}
+	if len(created) != 1 || created[0] != got.Name || got.Remediation != "" {
+		t.Fatalf("hook called with %v for %v, want one call for %q", created, got, got.Name)
+	}
+
+	// In a batch, the hook fires for each created occurrence only.
+	created = nil
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	mock.ExpectQuery("INSERT INTO occurrences").WillReturnError(&pq.Error{Code: "23503"})
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	occs, _ := s.BatchCreateOccurrences(context.Background(), pid, "", []*pb.Occurrence{o, o, o})
+	if len(occs) != 2 || len(created) != 2 {
+		t.Errorf("BatchCreateOccurrences() created %d occurrences and fired the hook %d times, want 2 and 2", len(occs), len(created))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_OnOccurrenceCreatedPanics(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	s.SetOnOccurrenceCreated(func(context.Context, *pb.Occurrence) { panic("bus unavailable") })
+
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	if _, err := s.CreateOccurrence(context.Background(), pid, "", &pb.Occurrence{NoteName: name.FormatNote(pid, nid)}); err != nil {
+		t.Fatalf("CreateOccurrence() with a panicking hook error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
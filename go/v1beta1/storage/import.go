@@ -0,0 +1,298 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// ImportConflict selects what ImportProject does with entities that already exist.
+type ImportConflict int
+
+const (
+	// ImportFailOnConflict aborts the import if an entity already exists.
+	ImportFailOnConflict ImportConflict = iota
+	// ImportSkipExisting keeps existing entities as they are. Soft-deleted occurrences exist until
+	// they are purged, so they are kept deleted rather than restored.
+	ImportSkipExisting
+	// ImportOverwriteExisting replaces existing entities with the imported ones, restoring
+	// soft-deleted occurrences. Occurrences lose their labels and creator, which are not exported.
+	ImportOverwriteExisting
+)
+
+// conflictClauses maps the import conflict policies to the ON CONFLICT clauses of the
+// notes and occurrences inserts.
+var conflictClauses = map[ImportConflict][2]string{
+	ImportFailOnConflict: {"", ""},
+	ImportSkipExisting: {
+		"ON CONFLICT (project_name, note_name) DO NOTHING",
+		"ON CONFLICT (project_name, occurrence_name) DO NOTHING",
+	},
+	ImportOverwriteExisting: {
+		"ON CONFLICT (project_name, note_name) DO UPDATE SET data = EXCLUDED.data",
+		"ON CONFLICT (project_name, occurrence_name) DO UPDATE SET data = EXCLUDED.data, note_id = EXCLUDED.note_id, created_at = EXCLUDED.created_at, severity = EXCLUDED.severity, updated_at = EXCLUDED.updated_at, resource_uri = EXCLUDED.resource_uri, content_hash = NULL, deleted_at = NULL, labels = NULL, created_by = NULL",
+	},
+}
+
+// ImportRecordError describes a record of a best-effort import that was not imported.
+type ImportRecordError struct {
+	// Line is the line number of the record in the import.
+	Line int
+	// Err is the reason the record was not imported.
+	Err error
+}
+
+func (e ImportRecordError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// ImportProject reads the newline-delimited JSON written by ExportProject from r and inserts
+// its notes and occurrences into the existing project pID in a single transaction, so that
+// either all of them are imported or none. Entities keep their IDs and, unless a note named by
+// an occurrence is also imported, their note references. Occurrences may precede the notes
+// they reference in r. Since r cannot be read twice, the transaction is not retried.
+func (pg *PgSQLStore) ImportProject(ctx context.Context, pID string, r io.Reader, onConflict ImportConflict) error {
+	ctx = pg.withQueryTags(ctx, pID)
+	_, err := pg.importProject(ctx, pID, r, onConflict, false)
+	return err
+}
+
+// ImportProjectBestEffort is like ImportProject, but imports all the valid records of r and
+// returns the errors of the others, by line, instead of failing the whole import. A record is
+// invalid if it cannot be parsed, or if its entity already exists, as per onConflict, or, for
+// an occurrence, names a note that does not exist. Other errors still abort the import.
+func (pg *PgSQLStore) ImportProjectBestEffort(ctx context.Context, pID string, r io.Reader, onConflict ImportConflict) ([]ImportRecordError, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	return pg.importProject(ctx, pID, r, onConflict, true)
+}
+
+func (pg *PgSQLStore) importProject(ctx context.Context, pID string, r io.Reader, onConflict ImportConflict, bestEffort bool) ([]ImportRecordError, error) {
+	clauses, ok := conflictClauses[onConflict]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid import conflict policy %d", onConflict)
+	}
+	if _, err := pg.GetProject(ctx, pID); err != nil {
+		return nil, err
+	}
+	var imported []string
+	var failed []ImportRecordError
+	err := pg.runTransaction(ctx, func(tx *sql.Tx) error {
+		imp := &importer{ctx: ctx, tx: tx, pg: pg, pID: pID, noteQuery: fmt.Sprintf(importNote, clauses[0]),
+			occurrenceQuery: fmt.Sprintf(importOccurrence, clauses[1]), notes: map[string]bool{}, bestEffort: bestEffort}
+		br := bufio.NewReader(r)
+		for line := 1; ; line++ {
+			b, err := br.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				log.Println("Failed to read import", err)
+				return status.Errorf(codes.InvalidArgument, "Failed to read import record %d", line)
+			}
+			if len(bytes.TrimSpace(b)) > 0 {
+				var rec exportRecord
+				if err := json.Unmarshal(b, &rec); err != nil {
+					err = status.Errorf(codes.InvalidArgument, "Invalid import record %d: %v", line, err)
+					if err := imp.fail(line, err); err != nil {
+						return err
+					}
+				} else if err := imp.importRecord(line, &rec); err != nil {
+					if err := imp.fail(line, err); err != nil {
+						return err
+					}
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+		}
+		// Import the occurrences read before the notes they reference.
+		for _, d := range imp.deferred {
+			if err := imp.importOccurrence(d.line, d.o); err != nil {
+				if err := imp.fail(d.line, err); err != nil {
+					return err
+				}
+			}
+		}
+		for nID := range imp.notes {
+			imported = append(imported, nID)
+		}
+		failed = imp.failed
+		return nil
+	})
+	if isSerializationFailure(err) {
+		return nil, status.Error(codes.Aborted, "Import aborted by a concurrent transaction")
+	}
+	// Overwritten notes may be cached.
+	for _, nID := range imported {
+		pg.notes.remove(pg.noteCacheKey(pID, nID))
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Line < failed[j].Line })
+	return failed, nil
+}
+
+// importer inserts the records of an import in its transaction.
+type importer struct {
+	ctx                        context.Context
+	tx                         *sql.Tx
+	pg                         *PgSQLStore
+	pID                        string
+	noteQuery, occurrenceQuery string
+	// notes is the set of the IDs of the notes imported so far.
+	notes map[string]bool
+	// deferred holds the occurrences read before the notes of the project they reference.
+	deferred []deferredOccurrence
+	// bestEffort is set if invalid records are collected in failed rather than failing the import.
+	bestEffort bool
+	failed     []ImportRecordError
+}
+
+// fail handles the error importing the record read at line. Unless the import is best-effort
+// and err is specific to the record, it returns err.
+func (imp *importer) fail(line int, err error) error {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.AlreadyExists, codes.FailedPrecondition:
+		if imp.bestEffort {
+			imp.failed = append(imp.failed, ImportRecordError{Line: line, Err: err})
+			return nil
+		}
+	}
+	return err
+}
+
+// exec runs the insert query of a record. In a best-effort import the insert runs under a
+// savepoint, so that its failure does not abort the transaction.
+func (imp *importer) exec(query string, args ...interface{}) error {
+	if !imp.bestEffort {
+		_, err := imp.pg.txExecContext(imp.ctx, imp.tx, query, args...)
+		return err
+	}
+	if _, err := imp.tx.ExecContext(imp.ctx, importSavepoint); err != nil {
+		return dbError(err, "Failed to import record")
+	}
+	if _, err := imp.pg.txExecContext(imp.ctx, imp.tx, query, args...); err != nil {
+		if _, rbErr := imp.tx.ExecContext(imp.ctx, rollbackImportSavepoint); rbErr != nil {
+			return dbError(rbErr, "Failed to import record")
+		}
+		return err
+	}
+	if _, err := imp.tx.ExecContext(imp.ctx, releaseImportSavepoint); err != nil {
+		return dbError(err, "Failed to import record")
+	}
+	return nil
+}
+
+type deferredOccurrence struct {
+	line int
+	o    *pb.Occurrence
+}
+
+// importRecord imports the note or occurrence of rec, read at line.
+func (imp *importer) importRecord(line int, rec *exportRecord) error {
+	switch {
+	case rec.Note != nil:
+		var n pb.Note
+		if err := protojson.Unmarshal(rec.Note, &n); err != nil {
+			return status.Errorf(codes.InvalidArgument, "Invalid note in import record %d: %v", line, err)
+		}
+		return imp.importNote(line, &n)
+	case rec.Occurrence != nil:
+		var o pb.Occurrence
+		if err := protojson.Unmarshal(rec.Occurrence, &o); err != nil {
+			return status.Errorf(codes.InvalidArgument, "Invalid occurrence in import record %d: %v", line, err)
+		}
+		if nPID, nID, err := name.ParseNote(o.NoteName); err == nil && nPID == imp.pID && !imp.notes[nID] {
+			imp.deferred = append(imp.deferred, deferredOccurrence{line: line, o: &o})
+			return nil
+		}
+		return imp.importOccurrence(line, &o)
+	default:
+		return status.Errorf(codes.InvalidArgument, "Import record %d holds neither a note nor an occurrence", line)
+	}
+}
+
+func (imp *importer) importNote(line int, n *pb.Note) error {
+	_, nID, err := name.ParseNote(n.Name)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid note name %q in import record %d", n.Name, line)
+	}
+	n.Name = name.FormatNote(imp.pID, nID)
+	data, err := marshalJSON(n)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Failed to marshal note in import record %d", line)
+	}
+	if err := imp.pg.checkEntitySize("Note", data); err != nil {
+		return err
+	}
+	if err := imp.exec(imp.noteQuery, imp.pID, nID, data); err != nil {
+		return importError(err, "Note", n.Name)
+	}
+	imp.notes[nID] = true
+	return nil
+}
+
+func (imp *importer) importOccurrence(line int, o *pb.Occurrence) error {
+	_, oID, err := name.ParseOccurrence(o.Name)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid occurrence name %q in import record %d", o.Name, line)
+	}
+	nPID, nID, err := name.ParseNote(o.NoteName)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid note name %q in import record %d", o.NoteName, line)
+	}
+	o.Name = name.FormatOccurrence(imp.pID, oID)
+	data, err := marshalJSON(o)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Failed to marshal occurrence in import record %d", line)
+	}
+	if err := imp.pg.checkEntitySize("Occurrence", data); err != nil {
+		return err
+	}
+	var createdAt interface{}
+	if o.CreateTime != nil {
+		createdAt = o.CreateTime.AsTime()
+	}
+	if err := imp.exec(imp.occurrenceQuery, imp.pID, oID, nPID, nID, data, createdAt, occurrenceSeverity(o), occurrenceUpdatedAt(o), occurrenceResourceURI(o)); err != nil {
+		if err, ok := err.(*pq.Error); ok && isMissingNote(err) {
+			return status.Errorf(codes.FailedPrecondition, "Note %q of imported occurrence %q does not exist", o.NoteName, o.Name)
+		}
+		return importError(err, "Occurrence", o.Name)
+	}
+	return nil
+}
+
+// importError converts the error inserting the imported entity of kind named n.
+func importError(err error, kind, n string) error {
+	if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
+		return status.Errorf(codes.AlreadyExists, "%s with name %q already exists", kind, n)
+	}
+	log.Printf("Failed to import %s %q: %v", kind, n, err)
+	return status.Errorf(codes.Internal, "Failed to import %s", kind)
+}
@@ -0,0 +1,383 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// protoArg matches a JSON-encoded proto argument equal to want.
+type protoArg struct {
+	want proto.Message
+}
+
+func (a protoArg) Match(v driver.Value) bool {
+	b, ok := v.([]byte)
+	if !ok {
+		return false
+	}
+	got := a.want.ProtoReflect().New().Interface()
+	return protojson.Unmarshal(b, got) == nil && proto.Equal(got, a.want)
+}
+
+func expectProject(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta(projectExists)).WithArgs(name.FormatProject(pid)).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+}
+
+func TestStore_ImportProjectRoundTrip(t *testing.T) {
+	exportDB, exportMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer exportDB.Close()
+	expectExport(exportMock,
+		map[string]string{"n1": `{"shortDescription":"first"}`},
+		map[string]string{"o1": `{"noteName":"projects/pid/notes/n1","createTime":"2021-06-01T12:00:00Z"}`})
+	var buf bytes.Buffer
+	if err := newStore(exportDB, &Config{PaginationKey: paginationKey}).ExportProject(context.Background(), pid, &buf); err != nil {
+		t.Fatalf("ExportProject() error = %v", err)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	o := &pb.Occurrence{
+		Name:       "projects/pid/occurrences/o1",
+		NoteName:   "projects/pid/notes/n1",
+		CreateTime: timestamppb.New(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)),
+	}
+	expectProject(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf(importNote, ""))).
+		WithArgs(pid, "n1", protoArg{&pb.Note{Name: "projects/pid/notes/n1", ShortDescription: "first"}}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf(importOccurrence, ""))).
+		WithArgs(pid, "o1", pid, "n1", protoArg{o}, o.CreateTime.AsTime(), nil, o.CreateTime.AsTime(), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := s.ImportProject(context.Background(), pid, &buf, ImportFailOnConflict); err != nil {
+		t.Fatalf("ImportProject() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_ImportProjectNoteOrdering(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	// The occurrence of n1 is read first, and the one of a note of another project is
+	// imported right away.
+	in := strings.Join([]string{
+		`{"occurrence":{"name":"projects/pid/occurrences/o1","noteName":"projects/pid/notes/n1"}}`,
+		`{"occurrence":{"name":"projects/pid/occurrences/o2","noteName":"projects/vendor/notes/cve"}}`,
+		`{"note":{"name":"projects/pid/notes/n1"}}`,
+	}, "\n")
+	expectProject(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO occurrences")).WithArgs(pid, "o2", "vendor", "cve", sqlmock.AnyArg(), nil, nil, nil, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO notes")).WithArgs(pid, "n1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO occurrences")).WithArgs(pid, "o1", pid, "n1", sqlmock.AnyArg(), nil, nil, nil, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := s.ImportProject(context.Background(), pid, strings.NewReader(in), ImportFailOnConflict); err != nil {
+		t.Fatalf("ImportProject() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_ImportProjectConflicts(t *testing.T) {
+	const in = `{"note":{"name":"projects/pid/notes/n1"}}`
+	tests := []struct {
+		desc       string
+		onConflict ImportConflict
+		err        error
+		want       codes.Code
+	}{
+		{desc: "fail", onConflict: ImportFailOnConflict, err: &pq.Error{Code: "23505"}, want: codes.AlreadyExists},
+		{desc: "skip", onConflict: ImportSkipExisting, want: codes.OK},
+		{desc: "overwrite", onConflict: ImportOverwriteExisting, want: codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey})
+			expectProject(mock)
+			mock.ExpectBegin()
+			exec := mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf(importNote, conflictClauses[tt.onConflict][0])))
+			if tt.err != nil {
+				exec.WillReturnError(tt.err)
+				mock.ExpectRollback()
+			} else {
+				exec.WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+			err = s.ImportProject(context.Background(), pid, strings.NewReader(in), tt.onConflict)
+			if status.Code(err) != tt.want {
+				t.Errorf("ImportProject() error = %v, want %v", err, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestStore_ImportProjectInvalid(t *testing.T) {
+	for _, in := range []string{
+		`{"note":`,
+		`{"project":{}}`,
+		`{"note":{"name":"n1"}}`,
+		`{"occurrence":{"name":"projects/pid/occurrences/o1","noteName":"n1"}}`,
+	} {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		s := newStore(db, &Config{PaginationKey: paginationKey})
+		expectProject(mock)
+		mock.ExpectBegin()
+		mock.ExpectRollback()
+		if err := s.ImportProject(context.Background(), pid, strings.NewReader(in), ImportFailOnConflict); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ImportProject(%s) error = %v, want InvalidArgument", in, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("ImportProject(%s): unfulfilled expectations: %v", in, err)
+		}
+		db.Close()
+	}
+}
+
+func TestStore_ImportProjectBestEffort(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	in := strings.Join([]string{
+		`{"note":{"name":"projects/pid/notes/n1"}}`,
+		`{"note":`,
+		``,
+		`{"note":{"name":"n2"}}`,
+		`{"note":{"name":"projects/pid/notes/n3"}}`,
+		`{"occurrence":{"name":"projects/pid/occurrences/o1","noteName":"projects/pid/notes/n1"}}`,
+		`{"occurrence":{"name":"projects/pid/occurrences/o2","noteName":"projects/other/notes/missing"}}`,
+		`{"project":{}}`,
+	}, "\n")
+	expectInsert := func(table, id string, err error) {
+		args := []driver.Value{pid, id, sqlmock.AnyArg()}
+		if table == "occurrences" {
+			args = append(args, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg())
+		}
+		mock.ExpectExec(regexp.QuoteMeta(importSavepoint)).WillReturnResult(sqlmock.NewResult(0, 0))
+		exec := mock.ExpectExec(regexp.QuoteMeta("INSERT INTO " + table)).WithArgs(args...)
+		if err != nil {
+			exec.WillReturnError(err)
+			mock.ExpectExec(regexp.QuoteMeta(rollbackImportSavepoint)).WillReturnResult(sqlmock.NewResult(0, 0))
+			return
+		}
+		exec.WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(releaseImportSavepoint)).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	expectProject(mock)
+	mock.ExpectBegin()
+	expectInsert("notes", "n1", nil)
+	expectInsert("notes", "n3", &pq.Error{Code: "23505"})
+	expectInsert("occurrences", "o1", nil)
+	expectInsert("occurrences", "o2", &pq.Error{Code: "23502", Column: "note_id"})
+	mock.ExpectCommit()
+
+	failed, err := s.ImportProjectBestEffort(context.Background(), pid, strings.NewReader(in), ImportFailOnConflict)
+	if err != nil {
+		t.Fatalf("ImportProjectBestEffort() error = %v", err)
+	}
+	want := []struct {
+		line int
+		code codes.Code
+	}{
+		{2, codes.InvalidArgument},
+		{4, codes.InvalidArgument},
+		{5, codes.AlreadyExists},
+		{7, codes.FailedPrecondition},
+		{8, codes.InvalidArgument},
+	}
+	if len(failed) != len(want) {
+		t.Fatalf("ImportProjectBestEffort() failed = %v, want %d errors", failed, len(want))
+	}
+	for i, w := range want {
+		if failed[i].Line != w.line || status.Code(failed[i].Err) != w.code {
+			t.Errorf("ImportProjectBestEffort() failed[%d] = %v, want line %d %v", i, failed[i], w.line, w.code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_ImportProjectBestEffortAborts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	expectProject(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(importSavepoint)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO notes")).WillReturnError(errors.New("connection reset"))
+	mock.ExpectExec(regexp.QuoteMeta(rollbackImportSavepoint)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	in := `{"note":{"name":"projects/pid/notes/n1"}}`
+	if _, err := s.ImportProjectBestEffort(context.Background(), pid, strings.NewReader(in), ImportFailOnConflict); status.Code(err) != codes.Internal {
+		t.Errorf("ImportProjectBestEffort() error = %v, want Internal", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// importRecords returns an import of n occurrences of a note of another project.
+func importRecords(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, `{"occurrence":{"name":"projects/pid/occurrences/o%d","noteName":"projects/vendor/notes/cve"}}`+"\n", i)
+	}
+	return b.String()
+}
+
+func TestStore_ImportProjectPreparesInserts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, PrepareTxStatements: true})
+	expectProject(mock)
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare(regexp.QuoteMeta(fmt.Sprintf(importOccurrence, ""))).WillBeClosed()
+	for i := 0; i < 3; i++ {
+		prep.ExpectExec().WithArgs(pid, fmt.Sprintf("o%d", i), "vendor", "cve", sqlmock.AnyArg(), nil, nil, nil, nil).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+	if err := s.ImportProject(context.Background(), pid, strings.NewReader(importRecords(3)), ImportFailOnConflict); err != nil {
+		t.Fatalf("ImportProject() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_ImportProjectOverwritesDeleted(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, SoftDeleteOccurrences: true})
+	// The overwritten occurrence is restored if it was soft-deleted.
+	clause := conflictClauses[ImportOverwriteExisting][1]
+	for _, reset := range []string{"deleted_at = NULL", "labels = NULL", "created_by = NULL"} {
+		if !strings.Contains(clause, reset) {
+			t.Errorf("overwrite clause %q does not set %s", clause, reset)
+		}
+	}
+	expectProject(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(fmt.Sprintf(importOccurrence, clause))).
+		WithArgs(pid, "o0", "vendor", "cve", sqlmock.AnyArg(), nil, nil, nil, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := s.ImportProject(context.Background(), pid, strings.NewReader(importRecords(1)), ImportOverwriteExisting); err != nil {
+		t.Fatalf("ImportProject() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func benchmarkImportProject(b *testing.B, prepared bool) {
+	const records = 100
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		b.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	s := newStore(db, &Config{PaginationKey: paginationKey, PrepareTxStatements: prepared})
+	query := regexp.QuoteMeta(fmt.Sprintf(importOccurrence, ""))
+	for i := 0; i < b.N; i++ {
+		expectProject(mock)
+		mock.ExpectBegin()
+		if prepared {
+			prep := mock.ExpectPrepare(query)
+			for j := 0; j < records; j++ {
+				prep.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+		} else {
+			for j := 0; j < records; j++ {
+				mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+		}
+		mock.ExpectCommit()
+	}
+	in := importRecords(records)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.ImportProject(context.Background(), pid, strings.NewReader(in), ImportFailOnConflict); err != nil {
+			b.Fatalf("ImportProject() error = %v", err)
+		}
+	}
+}
+
+func BenchmarkImportProject(b *testing.B) {
+	b.Run("unprepared", func(b *testing.B) { benchmarkImportProject(b, false) })
+	b.Run("prepared", func(b *testing.B) { benchmarkImportProject(b, true) })
+}
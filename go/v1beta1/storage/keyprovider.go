@@ -0,0 +1,104 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/fernet/fernet-go"
+	"golang.org/x/net/context"
+)
+
+// KeyProvider obtains the pagination key, e.g. from a KMS or a secret manager. The store calls
+// it once, at startup. It must return a 256-bit URL-safe base64 fernet key.
+type KeyProvider interface {
+	PaginationKey(ctx context.Context) (string, error)
+}
+
+// StaticKey is a KeyProvider returning itself; it provides the PaginationKey of Config.
+type StaticKey string
+
+// PaginationKey returns k.
+func (k StaticKey) PaginationKey(context.Context) (string, error) {
+	return string(k), nil
+}
+
+// KeyFile is a KeyProvider reading the key from the file at its path, e.g. a mounted secret;
+// it provides the PaginationKeyFile of Config. Surrounding whitespace is trimmed.
+type KeyFile string
+
+// PaginationKey reads and validates the key in the file f.
+func (f KeyFile) PaginationKey(context.Context) (string, error) {
+	b, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return "", fmt.Errorf("failed to read pagination key file, err: %v", err)
+	}
+	key := strings.TrimSpace(string(b))
+	if _, err := fernet.DecodeKey(key); err != nil {
+		return "", fmt.Errorf("invalid pagination key in %s; must be 256-bit URL-safe base64", string(f))
+	}
+	return key, nil
+}
+
+// EnvKey is a KeyProvider reading the key from the environment variable it names.
+type EnvKey string
+
+// PaginationKey returns the value of the environment variable e, which must be set.
+func (e EnvKey) PaginationKey(context.Context) (string, error) {
+	key, ok := os.LookupEnv(string(e))
+	if !ok {
+		return "", fmt.Errorf("environment variable %q holding the pagination key is not set", string(e))
+	}
+	return key, nil
+}
+
+// keyProvider returns the provider of the pagination key configured in c, or nil if none is,
+// in which case a key is generated.
+func keyProvider(c *Config) (KeyProvider, error) {
+	var providers []KeyProvider
+	if c.PaginationKeyProvider != nil {
+		providers = append(providers, c.PaginationKeyProvider)
+	}
+	if c.PaginationKeyFile != "" {
+		providers = append(providers, KeyFile(c.PaginationKeyFile))
+	}
+	if c.PaginationKey != "" {
+		providers = append(providers, StaticKey(c.PaginationKey))
+	}
+	switch len(providers) {
+	case 0:
+		return nil, nil
+	case 1:
+		return providers[0], nil
+	}
+	return nil, errors.New("pagination_key, pagination_key_file and the pagination key provider are mutually exclusive")
+}
+
+// fetchPaginationKey obtains the pagination key configured in c, or "" if none is.
+func fetchPaginationKey(ctx context.Context, c *Config) (string, error) {
+	p, err := keyProvider(c)
+	if err != nil || p == nil {
+		return "", err
+	}
+	key, err := p.PaginationKey(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to obtain pagination key, err: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SetOccurrenceLabels replaces the labels of the specified occurrence, e.g. for users'
+// own categorization. Labels are stored alongside the occurrence rather than in it, so
+// they are not returned by GetOccurrence, nor change its update time, but list filters
+// match them as labels.key. An empty labels removes them all.
+func (pg *PgSQLStore) SetOccurrenceLabels(ctx context.Context, pID, oID string, labels map[string]string) error {
+	ctx = pg.withQueryTags(ctx, pID)
+	// No labels are stored as NULL.
+	var data interface{}
+	if len(labels) > 0 {
+		for k := range labels {
+			if k == "" {
+				return status.Error(codes.InvalidArgument, "Label keys must not be empty")
+			}
+		}
+		b, err := json.Marshal(labels)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, "Failed to marshal labels to json")
+		}
+		data = b
+	}
+	result, err := pg.execContext(ctx, updateOccurrenceLabels, pID, oID, data)
+	if err != nil {
+		log.Println("Failed to update Occurrence labels", err)
+		return dbError(err, "Failed to update Occurrence labels")
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return status.Error(codes.Internal, "Failed to update Occurrence labels")
+	}
+	if count == 0 {
+		return status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+	}
+	return nil
+}
+
+// OccurrenceLabels returns the labels of the specified occurrence set by SetOccurrenceLabels.
+func (pg *PgSQLStore) OccurrenceLabels(ctx context.Context, pID, oID string) (map[string]string, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	var data []byte
+	switch err := pg.queryRowContext(ctx, occurrenceLabels, pID, oID).Scan(&data); {
+	case err == sql.ErrNoRows:
+		return nil, status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+	case err != nil:
+		return nil, dbError(err, "Failed to query Occurrence labels from database")
+	}
+	labels := map[string]string{}
+	if data != nil {
+		if err := json.Unmarshal(data, &labels); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to unmarshal Occurrence labels from database")
+		}
+	}
+	return labels, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStore_SetOccurrenceLabels(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	ctx := context.Background()
+	labels := map[string]string{"team": "payments", "env": "prod"}
+
+	mock.ExpectExec(regexp.QuoteMeta(updateOccurrenceLabels)).
+		WithArgs(pid, "o1", []byte(`{"env":"prod","team":"payments"}`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.SetOccurrenceLabels(ctx, pid, "o1", labels); err != nil {
+		t.Fatalf("SetOccurrenceLabels() error = %v", err)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(occurrenceLabels)).WithArgs(pid, "o1").
+		WillReturnRows(sqlmock.NewRows([]string{"labels"}).AddRow(`{"env":"prod","team":"payments"}`))
+	got, err := s.OccurrenceLabels(ctx, pid, "o1")
+	if err != nil || !reflect.DeepEqual(got, labels) {
+		t.Errorf("OccurrenceLabels() = %v, %v, want %v", got, err, labels)
+	}
+
+	// Clearing the labels stores NULL.
+	mock.ExpectExec(regexp.QuoteMeta(updateOccurrenceLabels)).WithArgs(pid, "o1", nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.SetOccurrenceLabels(ctx, pid, "o1", nil); err != nil {
+		t.Fatalf("SetOccurrenceLabels(nil) error = %v", err)
+	}
+	mock.ExpectExec(regexp.QuoteMeta(updateOccurrenceLabels)).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := s.SetOccurrenceLabels(ctx, pid, "missing", labels); status.Code(err) != codes.NotFound {
+		t.Errorf("SetOccurrenceLabels() of a missing occurrence error = %v, want NotFound", err)
+	}
+	if err := s.SetOccurrenceLabels(ctx, pid, "o1", map[string]string{"": "x"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("SetOccurrenceLabels() with an empty key error = %v, want InvalidArgument", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestFilterSQL_Labels(t *testing.T) {
+	tests := map[string]struct {
+		filter string
+		want   string
+	}{
+		"equal":   {filter: `labels.team = "payments"`, want: `COALESCE(labels->>'team' = 'payments', FALSE)`},
+		"present": {filter: `labels.team:"*"`, want: `COALESCE(labels ? 'team', FALSE)`},
+		"unset":   {filter: `NOT labels.team:"*"`, want: `(NOT COALESCE(labels ? 'team', FALSE))`},
+		"null":    {filter: `labels.team = null`, want: `(labels->>'team' IS NULL)`},
+		// Fields named labels within the data are still found there.
+		"nested": {filter: `resource.labels.team = "payments"`, want: `COALESCE(data->'resource'->'labels'->>'team' = 'payments', FALSE)`},
+	}
+	for label, tt := range tests {
+		fs := FilterSQL{columns: occurrenceColumns, argOffset: 1}
+		got, err := fs.translate(tt.filter)
+		if err != nil {
+			t.Errorf("%s: translate() error = %v", label, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: translate() = %q, want %q", label, got, tt.want)
+		}
+	}
+	// Notes have no labels.
+	fs := FilterSQL{argOffset: 1}
+	if got, err := fs.translate(`labels.team = "payments"`); err != nil || got != `COALESCE(data->'labels'->>'team' = 'payments', FALSE)` {
+		t.Errorf("translate() of notes = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// LinkDirection selects the occurrences returned by GetRelatedOccurrences.
+type LinkDirection int
+
+const (
+	// LinkedTo returns the occurrences an occurrence links to, e.g. the artifacts built by a
+	// build occurrence.
+	LinkedTo LinkDirection = iota
+	// LinkedFrom returns the occurrences linking to an occurrence, e.g. the build occurrence
+	// which produced an artifact.
+	LinkedFrom
+)
+
+// LinkOccurrences links the specified occurrence to the occurrence named to, e.g.
+// "projects/p2/occurrences/o2", which may belong to another project, so that provenance
+// graphs can be traversed with GetRelatedOccurrences. Links have a direction, from the
+// occurrence to to, and linking occurrences already linked does nothing. Links are removed
+// with either occurrence when it is purged; links of soft-deleted occurrences are hidden.
+// Names are matched exactly, even if the store is configured with CaseInsensitiveIDs.
+func (pg *PgSQLStore) LinkOccurrences(ctx context.Context, pID, oID, to string) error {
+	ctx = pg.withQueryTags(ctx, pID)
+	toPID, toOID, err := name.ParseOccurrence(to)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid occurrence name %q", to)
+	}
+	if toPID == pID && toOID == oID {
+		return status.Error(codes.InvalidArgument, "An occurrence cannot be linked to itself")
+	}
+	var fromExists, toExists bool
+	if err := pg.queryRowContext(ctx, linkOccurrences, pID, oID, toPID, toOID).Scan(&fromExists, &toExists); err != nil {
+		log.Println("Failed to link Occurrences", err)
+		return dbError(err, "Failed to link Occurrences")
+	}
+	if !fromExists {
+		return status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+	}
+	if !toExists {
+		return status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", toPID, toOID)
+	}
+	return nil
+}
+
+// GetRelatedOccurrences returns the occurrences the specified occurrence links to, or those
+// linking to it, as per dir, one hop away, in the order they were stored.
+func (pg *PgSQLStore) GetRelatedOccurrences(ctx context.Context, pID, oID string, dir LinkDirection) ([]*pb.Occurrence, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	var query string
+	switch dir {
+	case LinkedTo:
+		query = listLinkedOccurrences
+	case LinkedFrom:
+		query = listLinkingOccurrences
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid link direction %d", dir)
+	}
+	// Verify that the occurrence exists, and find its stored IDs.
+	pID, oID, _, err := pg.searchOccurrence(ctx, pID, oID)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+	case err != nil:
+		return nil, dbError(err, "Failed to query Occurrence from database")
+	}
+	rows, err := pg.queryContext(ctx, query, pID, oID)
+	if err != nil {
+		return nil, dbError(err, "Failed to list related Occurrences from database")
+	}
+	defer rows.Close()
+
+	var os []*pb.Occurrence
+	for rows.Next() {
+		var rPID, rOID string
+		var data []byte
+		if err := rows.Scan(&rPID, &rOID, &data); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to scan Occurrences row")
+		}
+		var o pb.Occurrence
+		if err := protojson.Unmarshal(data, &o); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+		}
+		// Set the output-only field before returning
+		o.Name = name.FormatOccurrence(rPID, rOID)
+		os = append(os, &o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err, "Failed to list related Occurrences from database")
+	}
+	return os, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/grafeas/grafeas/go/name"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStore_LinkOccurrences(t *testing.T) {
+	tests := []struct {
+		desc               string
+		to                 string
+		query              bool
+		fromExists, exists bool
+		want               codes.Code
+	}{
+		{desc: "linked", to: "projects/p2/occurrences/o2", query: true, fromExists: true, exists: true, want: codes.OK},
+		{desc: "missing occurrence", to: "projects/p2/occurrences/o2", query: true, exists: true, want: codes.NotFound},
+		{desc: "missing linked occurrence", to: "projects/p2/occurrences/o2", query: true, fromExists: true, want: codes.NotFound},
+		{desc: "invalid name", to: "projects/p2/notes/o2", want: codes.InvalidArgument},
+		{desc: "self link", to: name.FormatOccurrence(pid, "o1"), want: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey})
+			if tt.query {
+				mock.ExpectQuery(regexp.QuoteMeta(linkOccurrences)).
+					WithArgs(pid, "o1", "p2", "o2").
+					WillReturnRows(sqlmock.NewRows([]string{"f", "t"}).AddRow(tt.fromExists, tt.exists))
+			}
+			err = s.LinkOccurrences(context.Background(), pid, "o1", tt.to)
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("LinkOccurrences() = %v, want code %v", err, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestStore_GetRelatedOccurrences(t *testing.T) {
+	tests := []struct {
+		desc  string
+		dir   LinkDirection
+		query string
+	}{
+		{desc: "linked to", dir: LinkedTo, query: listLinkedOccurrences},
+		{desc: "linked from", dir: LinkedFrom, query: listLinkingOccurrences},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey})
+			mock.ExpectQuery(regexp.QuoteMeta(searchOccurrence)).
+				WithArgs(pid, "o1").
+				WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{}`))
+			mock.ExpectQuery(regexp.QuoteMeta(tt.query)).
+				WithArgs(pid, "o1").
+				WillReturnRows(sqlmock.NewRows([]string{"project_name", "occurrence_name", "data"}).
+					AddRow(pid, "o2", `{"resource":{"uri":"a"}}`).
+					AddRow("p2", "o3", `{"resource":{"uri":"b"}}`))
+			os, err := s.GetRelatedOccurrences(context.Background(), pid, "o1", tt.dir)
+			if err != nil {
+				t.Fatalf("GetRelatedOccurrences() got error %v", err)
+			}
+			want := []string{name.FormatOccurrence(pid, "o2"), name.FormatOccurrence("p2", "o3")}
+			if len(os) != len(want) {
+				t.Fatalf("GetRelatedOccurrences() returned %d occurrences, want %d", len(os), len(want))
+			}
+			for i, o := range os {
+				if o.Name != want[i] {
+					t.Errorf("GetRelatedOccurrences()[%d].Name = %q, want %q", i, o.Name, want[i])
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestStore_GetRelatedOccurrencesNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	mock.ExpectQuery(regexp.QuoteMeta(searchOccurrence)).
+		WithArgs(pid, "o1").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	_, err = s.GetRelatedOccurrences(context.Background(), pid, "o1", LinkedTo)
+	if got := status.Code(err); got != codes.NotFound {
+		t.Errorf("GetRelatedOccurrences() = %v, want code NotFound", err)
+	}
+	if _, err := s.GetRelatedOccurrences(context.Background(), pid, "o1", LinkDirection(7)); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GetRelatedOccurrences() with invalid direction = %v, want code InvalidArgument", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestMarshalJSON_Deterministic(t *testing.T) {
+	fields := map[string]interface{}{}
+	for i := 0; i < 32; i++ {
+		fields[fmt.Sprintf("key%d", i)] = i
+	}
+	s, err := structpb.NewStruct(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []proto.Message{
+		s,
+		&pb.Occurrence{
+			Name:        "projects/pid/occurrences/oid",
+			NoteName:    "projects/pid/notes/nid",
+			Remediation: "upgrade",
+			Resource:    &pb.Resource{Uri: "https://example.com/image"},
+			CreateTime:  timestamppb.Now(),
+		},
+	} {
+		want, err := marshalJSON(m)
+		if err != nil {
+			t.Fatalf("marshalJSON() error = %v", err)
+		}
+		if bytes.ContainsAny(want, " \n") {
+			t.Errorf("marshalJSON() = %s, want compact JSON", want)
+		}
+		for i := 0; i < 10; i++ {
+			// Marshal an equal copy, whose maps are iterated in a different order.
+			got, err := marshalJSON(proto.Clone(m))
+			if err != nil {
+				t.Fatalf("marshalJSON() error = %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("marshalJSON() of equal messages differ:\n%s\n%s", got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"time"
+
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// ListOccurrencesModifiedSince lists the occurrences of project pID created or updated at or
+// after since, ordered by their update time, for incremental consumers such as replicators.
+//
+// since is inclusive, so that a consumer passing the latest update time it has seen does not
+// miss occurrences updated within the same microsecond; it may see again those it already
+// has. Occurrences sharing an update time are ordered by id, and page tokens resume after
+// the last occurrence of their page, so paging neither skips nor repeats them. Update times
+// are taken when the update is issued, so an update committing after a later one may be
+// missed by a consumer which has already passed its time: consumers needing every change
+// should overlap their syncs by more than the longest write. Deletions are not listed.
+//
+// Invalid and expired page tokens are rejected with InvalidArgument rather than restarting the
+// list, which would list every occurrence. Occurrences written before the update time was
+// promoted to its column are not listed until RebuildDerivedColumns is run.
+func (pg *PgSQLStore) ListOccurrencesModifiedSince(ctx context.Context, pID string, since time.Time, pageSize int32, pageToken string) ([]*pb.Occurrence, string, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	if pageSize <= 0 {
+		return nil, "", status.Error(codes.InvalidArgument, "Page size must be positive")
+	}
+	// The first page starts before the first occurrence updated at since.
+	cursor := pageCursor{UpdatedAt: &since}
+	if pageToken != "" {
+		cursor = decryptCursor(pageToken, pg.paginationKey, pg.pageTokenTTL("ListOccurrencesModifiedSince"))
+		if cursor.UpdatedAt == nil {
+			return nil, "", status.Error(codes.InvalidArgument, "Invalid page token")
+		}
+	}
+	// One more occurrence than requested is read to tell whether there is a next page.
+	rows, err := pg.queryContext(ctx, listOccurrencesModifiedSince, pID, *cursor.UpdatedAt, cursor.ID, pageSize+1)
+	if err != nil {
+		return nil, "", dbError(err, "Failed to list Occurrences from database")
+	}
+	defer rows.Close()
+
+	var os []*pb.Occurrence
+	var last pageCursor
+	budget := pageBudget{max: pg.maxPageBytes}
+	var full bool
+	for rows.Next() {
+		if full || len(os) == int(pageSize) {
+			encryptedPage, err := encryptCursor(last, pg.paginationKey)
+			if err != nil {
+				return nil, "", status.Error(codes.Internal, "Failed to paginate occurrences")
+			}
+			return os, encryptedPage, nil
+		}
+		var oID string
+		var data []byte
+		var updatedAt time.Time
+		if err := rows.Scan(&last.ID, &oID, &data, &updatedAt); err != nil {
+			return nil, "", status.Error(codes.Internal, "Failed to scan Occurrences row")
+		}
+		last.UpdatedAt = &updatedAt
+		var o pb.Occurrence
+		if err := protojson.Unmarshal(data, &o); err != nil {
+			return nil, "", status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+		}
+		// Set the output-only field before returning
+		o.Name = name.FormatOccurrence(pID, oID)
+		os = append(os, &o)
+		full = budget.spend(len(data))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", dbError(err, "Failed to list Occurrences from database")
+	}
+	return os, "", nil
+}
+
+// occurrenceUpdatedAt returns the time o was last written, its update time or, if it was
+// never updated, its creation time, or nil if it has neither.
+func occurrenceUpdatedAt(o *pb.Occurrence) interface{} {
+	switch {
+	case o.UpdateTime != nil:
+		return o.UpdateTime.AsTime()
+	case o.CreateTime != nil:
+		return o.CreateTime.AsTime()
+	}
+	return nil
+}
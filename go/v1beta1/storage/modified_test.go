@@ -0,0 +1,130 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStore_ListOccurrencesModifiedSince(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	ctx := context.Background()
+	since := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	t1 := since.Add(time.Second)
+	cols := []string{"id", "occurrence_name", "data", "updated_at"}
+
+	// o1 to o3 share an update time and straddle the page boundary.
+	mock.ExpectQuery(regexp.QuoteMeta(listOccurrencesModifiedSince)).WithArgs(pid, since, 0, 3).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(1, "o1", "{}", t1).
+			AddRow(2, "o2", "{}", t1).
+			AddRow(3, "o3", "{}", t1))
+	os, token, err := s.ListOccurrencesModifiedSince(ctx, pid, since, 2, "")
+	if err != nil {
+		t.Fatalf("ListOccurrencesModifiedSince() error = %v", err)
+	}
+	if len(os) != 2 || os[1].Name != "projects/"+pid+"/occurrences/o2" || token == "" {
+		t.Fatalf("ListOccurrencesModifiedSince() = %v, %q; want o1, o2 and a page token", os, token)
+	}
+
+	// The next page resumes after o2, at the same update time.
+	mock.ExpectQuery(regexp.QuoteMeta(listOccurrencesModifiedSince)).WithArgs(pid, t1, 2, 3).
+		WillReturnRows(sqlmock.NewRows(cols).AddRow(3, "o3", "{}", t1))
+	os, token, err = s.ListOccurrencesModifiedSince(ctx, pid, since, 2, token)
+	if err != nil {
+		t.Fatalf("ListOccurrencesModifiedSince() error = %v", err)
+	}
+	if len(os) != 1 || os[0].Name != "projects/"+pid+"/occurrences/o3" || token != "" {
+		t.Fatalf("ListOccurrencesModifiedSince() = %v, %q; want o3 and no page token", os, token)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_ListOccurrencesModifiedSinceInvalidArguments(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	// A page token of another list, holding only an id, does not resume this one.
+	idToken, err := encryptCursor(pageCursor{ID: 5}, paginationKey)
+	if err != nil {
+		t.Fatalf("encryptCursor() error = %v", err)
+	}
+	tests := map[string]struct {
+		pageSize int32
+		token    string
+	}{
+		"zero page size": {pageSize: 0},
+		"invalid token":  {pageSize: 10, token: "garbage"},
+		"id-only token":  {pageSize: 10, token: idToken},
+	}
+	for label, tt := range tests {
+		_, _, err := s.ListOccurrencesModifiedSince(context.Background(), pid, time.Now(), tt.pageSize, tt.token)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: ListOccurrencesModifiedSince() error = %v, want InvalidArgument", label, err)
+		}
+	}
+}
+
+func TestRebuildDerivedColumnsQuery_UpdatedAt(t *testing.T) {
+	query := rebuildDerivedColumnsQuery("occurrences", occurrenceDerivedColumns)
+	// Occurrences never updated are backfilled with their creation time.
+	want := `"updated_at" = COALESCE((data->>'updateTime')::timestamptz, (data->>'createTime')::timestamptz)`
+	if !strings.Contains(query, want) {
+		t.Errorf("rebuild query does not backfill updated_at: %s", query)
+	}
+}
+
+func TestStore_ListOccurrencesModifiedSinceMaxPageBytes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, MaxPageBytes: 10})
+	since := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(regexp.QuoteMeta(listOccurrencesModifiedSince)).WithArgs(pid, since, 0, 11).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "data", "updated_at"}).
+			AddRow(1, "o1", `{"remediation":"upgrade"}`, since).
+			AddRow(2, "o2", `{}`, since))
+	os, token, err := s.ListOccurrencesModifiedSince(context.Background(), pid, since, 10, "")
+	if err != nil {
+		t.Fatalf("ListOccurrencesModifiedSince() error = %v", err)
+	}
+	if len(os) != 1 || token == "" {
+		t.Fatalf("ListOccurrencesModifiedSince() returned %d occurrences and token %q, want 1 and a token", len(os), token)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// noteCache is a size-bounded LRU cache of notes keyed by their full note name.
+// Notes are cloned on the way in and out so callers never share cached instances.
+// A nil *noteCache is valid and caches nothing.
+//
+// Readers take the generation before reading a note from the database and pass it to add,
+// so that a note read before a concurrent write is not cached after the write removed it.
+type noteCache struct {
+	mu      sync.Mutex
+	size    int
+	ll      *list.List
+	entries map[string]*list.Element
+	// gen is bumped by every removal.
+	gen uint64
+}
+
+type noteCacheEntry struct {
+	key  string
+	note *pb.Note
+}
+
+func newNoteCache(size int) *noteCache {
+	return &noteCache{
+		size:    size,
+		ll:      list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// get returns a copy of the cached note for pID and nID, if present.
+func (c *noteCache) get(pID, nID string) (*pb.Note, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name.FormatNote(pID, nID)]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return proto.Clone(e.Value.(*noteCacheEntry).note).(*pb.Note), true
+}
+
+// generation returns the current generation of the cache, to be passed to add.
+func (c *noteCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// add caches a copy of n for pID and nID, evicting the least recently used note if full.
+// n is not cached if notes were removed since generation gen, as it may be stale.
+func (c *noteCache) add(pID, nID string, n *pb.Note, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	key := name.FormatNote(pID, nID)
+	n = proto.Clone(n).(*pb.Note)
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*noteCacheEntry).note = n
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.ll.PushFront(&noteCacheEntry{key: key, note: n})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*noteCacheEntry).key)
+	}
+}
+
+// remove drops the cached note for pID and nID, if present.
+func (c *noteCache) remove(pID, nID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	key := name.FormatNote(pID, nID)
+	if e, ok := c.entries[key]; ok {
+		c.ll.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// removeProject drops the cached notes of project pID.
+func (c *noteCache) removeProject(pID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	prefix := name.FormatNote(pID, "")
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.ll.Remove(e)
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+)
+
+func TestNoteCache_Eviction(t *testing.T) {
+	c := newNoteCache(2)
+	c.add(pid, "n1", &pb.Note{ShortDescription: "1"}, c.generation())
+	c.add(pid, "n2", &pb.Note{ShortDescription: "2"}, c.generation())
+	// Touch n1 so that n2 becomes the least recently used entry.
+	if _, ok := c.get(pid, "n1"); !ok {
+		t.Fatalf("expected n1 to be cached")
+	}
+	c.add(pid, "n3", &pb.Note{ShortDescription: "3"}, c.generation())
+	if _, ok := c.get(pid, "n2"); ok {
+		t.Errorf("expected n2 to be evicted")
+	}
+	for _, nID := range []string{"n1", "n3"} {
+		if _, ok := c.get(pid, nID); !ok {
+			t.Errorf("expected %s to be cached", nID)
+		}
+	}
+}
+
+func TestNoteCache_ReturnsCopies(t *testing.T) {
+	c := newNoteCache(1)
+	c.add(pid, nid, &pb.Note{ShortDescription: "original"}, c.generation())
+	n, _ := c.get(pid, nid)
+	n.ShortDescription = "mutated"
+	if n, _ := c.get(pid, nid); n.ShortDescription != "original" {
+		t.Errorf("cached note was mutated through a returned copy: %q", n.ShortDescription)
+	}
+}
+
+func TestNoteCache_StaleAdd(t *testing.T) {
+	c := newNoteCache(2)
+	// A note read before a concurrent update removed it must not be cached.
+	gen := c.generation()
+	c.remove(pid, nid)
+	c.add(pid, nid, &pb.Note{ShortDescription: "stale"}, gen)
+	if n, ok := c.get(pid, nid); ok {
+		t.Errorf("stale note %q was cached after its removal", n.ShortDescription)
+	}
+	gen = c.generation()
+	c.removeProject("other")
+	c.add(pid, nid, &pb.Note{ShortDescription: "stale"}, gen)
+	if _, ok := c.get(pid, nid); ok {
+		t.Errorf("note read before a project removal was cached")
+	}
+	c.add(pid, nid, &pb.Note{ShortDescription: "fresh"}, c.generation())
+	if _, ok := c.get(pid, nid); !ok {
+		t.Errorf("expected the note read after the removals to be cached")
+	}
+}
+
+func TestStore_GetNoteCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{NoteCacheSize: 10})
+
+	// Miss: the note is read from the database.
+	mock.ExpectQuery(regexp.QuoteMeta(searchNote)).WithArgs(pid, nid).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{"shortDescription":"v1"}`))
+	// Hit: the second read is served from the cache, no query expected.
+	for i := 0; i < 2; i++ {
+		n, err := s.GetNote(ctx, pid, nid)
+		if err != nil {
+			t.Fatalf("GetNote() error = %v", err)
+		}
+		if n.ShortDescription != "v1" {
+			t.Errorf("GetNote() = %q, want %q", n.ShortDescription, "v1")
+		}
+	}
+
+	// Invalidation on update: the next read goes back to the database.
+	mock.ExpectExec(regexp.QuoteMeta(updateNote)).WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err := s.UpdateNote(ctx, pid, nid, &pb.Note{ShortDescription: "v2"}, nil); err != nil {
+		t.Fatalf("UpdateNote() error = %v", err)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(searchNote)).WithArgs(pid, nid).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{"shortDescription":"v2"}`))
+	if n, err := s.GetNote(ctx, pid, nid); err != nil || n.ShortDescription != "v2" {
+		t.Fatalf("GetNote() after update = %v, %v; want v2", n, err)
+	}
+
+	// Invalidation on delete: the next read reports NotFound from the database.
+	mock.ExpectExec(regexp.QuoteMeta(deleteNote)).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.DeleteNote(ctx, pid, nid); err != nil {
+		t.Fatalf("DeleteNote() error = %v", err)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(searchNote)).WithArgs(pid, nid).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	if _, err := s.GetNote(ctx, pid, nid); err == nil {
+		t.Fatalf("GetNote() after delete succeeded, want NotFound")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_GetNoteStrongConsistency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{NoteCacheSize: 10})
+
+	// Another instance updates the note after it is cached here.
+	mock.ExpectQuery(regexp.QuoteMeta(searchNote)).WithArgs(pid, nid).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{"shortDescription":"v1"}`))
+	mock.ExpectQuery(regexp.QuoteMeta(searchNote)).WithArgs(pid, nid).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{"shortDescription":"v2"}`))
+	if _, err := s.GetNote(ctx, pid, nid); err != nil {
+		t.Fatalf("GetNote() error = %v", err)
+	}
+	n, err := s.GetNote(WithStrongConsistency(ctx), pid, nid)
+	if err != nil || n.ShortDescription != "v2" {
+		t.Fatalf("strongly consistent GetNote() = %v, %v; want v2", n, err)
+	}
+	// The fresh read refreshes the cache for later reads.
+	if n, err := s.GetNote(ctx, pid, nid); err != nil || n.ShortDescription != "v2" {
+		t.Fatalf("GetNote() = %v, %v; want v2", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
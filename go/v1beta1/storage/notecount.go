@@ -0,0 +1,89 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// NoteOccurrenceCount is a note and the number of occurrences referencing it.
+type NoteOccurrenceCount struct {
+	Note        *pb.Note
+	Occurrences int64
+}
+
+// ListNotesByOccurrenceCount lists the notes of project pID with the number of occurrences
+// referencing them, most referenced first, e.g. to prioritize the vulnerabilities affecting
+// the most resources. Occurrences of every project are counted, as notes are commonly shared
+// by a provider project, while soft-deleted occurrences are not. Notes with the same count
+// are ordered by id.
+//
+// Counts are computed for all the notes of the project on every page. As they change while
+// paging, a note whose count changes may be skipped or listed twice. Invalid and expired page
+// tokens are rejected with InvalidArgument.
+func (pg *PgSQLStore) ListNotesByOccurrenceCount(ctx context.Context, pID string, pageSize int32, pageToken string) ([]*NoteOccurrenceCount, string, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	if pageSize <= 0 {
+		return nil, "", status.Error(codes.InvalidArgument, "Page size must be positive")
+	}
+	var cursor pageCursor
+	if pageToken != "" {
+		cursor = decryptCursor(pageToken, pg.paginationKey, pg.pageTokenTTL("ListNotesByOccurrenceCount"))
+		if cursor.Count == nil {
+			return nil, "", status.Error(codes.InvalidArgument, "Invalid page token")
+		}
+	}
+	// One more note than requested is read to tell whether there is a next page.
+	rows, err := pg.queryContext(ctx, listNotesByOccurrenceCount, pID, cursor.Count, cursor.ID, pageSize+1)
+	if err != nil {
+		return nil, "", dbError(err, "Failed to list Notes from database")
+	}
+	defer rows.Close()
+
+	var counts []*NoteOccurrenceCount
+	var last pageCursor
+	for rows.Next() {
+		if len(counts) == int(pageSize) {
+			encryptedPage, err := encryptCursor(last, pg.paginationKey)
+			if err != nil {
+				return nil, "", status.Error(codes.Internal, "Failed to paginate notes")
+			}
+			return counts, encryptedPage, nil
+		}
+		var nID string
+		var data []byte
+		var count int64
+		if err := rows.Scan(&last.ID, &nID, &data, &count); err != nil {
+			return nil, "", status.Error(codes.Internal, "Failed to scan Notes row")
+		}
+		last.Count = &count
+		var n pb.Note
+		if err := protojson.Unmarshal(data, &n); err != nil {
+			return nil, "", status.Error(codes.Internal, "Failed to unmarshal Note from database")
+		}
+		// Set the output-only field before returning
+		n.Name = name.FormatNote(pID, nID)
+		counts = append(counts, &NoteOccurrenceCount{Note: &n, Occurrences: count})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", dbError(err, "Failed to list Notes from database")
+	}
+	return counts, "", nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStore_ListNotesByOccurrenceCount(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	ctx := context.Background()
+	cols := []string{"id", "note_name", "data", "occurrences"}
+
+	// Occurrences are counted across projects: only the notes are of project pid.
+	if strings.Contains(listNotesByOccurrenceCount, "o.project_name") {
+		t.Fatalf("listNotesByOccurrenceCount only counts occurrences of the project: %s", listNotesByOccurrenceCount)
+	}
+
+	// n2 and n3 share a count and straddle the page boundary.
+	mock.ExpectQuery(regexp.QuoteMeta(listNotesByOccurrenceCount)).WithArgs(pid, nil, 0, 3).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(4, "n4", "{}", 9).
+			AddRow(2, "n2", "{}", 5).
+			AddRow(3, "n3", "{}", 5))
+	got, token, err := s.ListNotesByOccurrenceCount(ctx, pid, 2, "")
+	if err != nil {
+		t.Fatalf("ListNotesByOccurrenceCount() error = %v", err)
+	}
+	if len(got) != 2 || token == "" {
+		t.Fatalf("ListNotesByOccurrenceCount() = %v, %q; want 2 notes and a page token", got, token)
+	}
+	for i, want := range []struct {
+		name  string
+		count int64
+	}{{"projects/pid/notes/n4", 9}, {"projects/pid/notes/n2", 5}} {
+		if got[i].Note.Name != want.name || got[i].Occurrences != want.count {
+			t.Errorf("ListNotesByOccurrenceCount()[%d] = %s with %d occurrences, want %s with %d", i, got[i].Note.Name, got[i].Occurrences, want.name, want.count)
+		}
+	}
+
+	// The next page resumes after n2, at the same count.
+	mock.ExpectQuery(regexp.QuoteMeta(listNotesByOccurrenceCount)).WithArgs(pid, 5, 2, 3).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(3, "n3", "{}", 5).
+			AddRow(1, "n1", "{}", 0))
+	got, token, err = s.ListNotesByOccurrenceCount(ctx, pid, 2, token)
+	if err != nil {
+		t.Fatalf("ListNotesByOccurrenceCount() error = %v", err)
+	}
+	if len(got) != 2 || got[0].Note.Name != "projects/pid/notes/n3" || got[1].Occurrences != 0 || token != "" {
+		t.Errorf("ListNotesByOccurrenceCount() = %v, %q; want n3 and n1 and no page token", got, token)
+	}
+
+	// Tokens of other lists do not hold a count.
+	other, err := encryptCursor(pageCursor{ID: 2}, paginationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.ListNotesByOccurrenceCount(ctx, pid, 2, other); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListNotesByOccurrenceCount() with a ListNotes token error = %v, want InvalidArgument", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"log"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OccurrenceIDGenerator returns the id of occurrence o about to be created in project pID.
+// Ids must match occurrenceIDRE. If the id is taken, CreateOccurrence generates another, up to
+// OccurrenceIDRetries times, and fails with AlreadyExists if it gets the same id again.
+type OccurrenceIDGenerator func(pID string, o *pb.Occurrence) (string, error)
+
+// occurrenceIDRE matches the occurrence ids accepted by CreateOccurrence.
+var occurrenceIDRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._~-]{0,127}$`)
+
+// RandomOccurrenceIDs generates random UUIDs. It is the default OccurrenceIDGenerator.
+func RandomOccurrenceIDs(string, *pb.Occurrence) (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", status.Error(codes.Internal, "Failed to generate UUID")
+	}
+	return id.String(), nil
+}
+
+// ClientOccurrenceIDs honors the occurrence id of the name set by the client, e.g. for
+// deterministic re-creation, and generates a random UUID for occurrences without a name.
+func ClientOccurrenceIDs(pID string, o *pb.Occurrence) (string, error) {
+	if o.Name == "" {
+		return RandomOccurrenceIDs(pID, o)
+	}
+	oPID, oID, err := name.ParseOccurrence(o.Name)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "Invalid occurrence name %q", o.Name)
+	}
+	if oPID != pID {
+		return "", status.Errorf(codes.InvalidArgument, "Occurrence name %q is not in project %q", o.Name, pID)
+	}
+	return oID, nil
+}
+
+// SetOccurrenceIDGenerator sets how CreateOccurrence picks occurrence ids. It must be
+// called before the store is used; a nil gen restores RandomOccurrenceIDs.
+func (pg *PgSQLStore) SetOccurrenceIDGenerator(gen OccurrenceIDGenerator) {
+	pg.occurrenceIDs = gen
+}
+
+// OccurrenceNameFormatter returns the name of occurrence o about to be created in project pID
+// with the id picked by the OccurrenceIDGenerator, e.g. to prefix the id with the kind of the
+// occurrence. Names must be accepted by name.ParseOccurrence, belong to project pID, and their
+// occurrence ids must match occurrenceIDRE; CreateOccurrence fails with Internal otherwise.
+type OccurrenceNameFormatter func(pID, id string, o *pb.Occurrence) string
+
+// SetOccurrenceNameFormatter sets how CreateOccurrence names occurrences. It must be called
+// before the store is used; a nil format restores the projects/{pID}/occurrences/{id} names.
+func (pg *PgSQLStore) SetOccurrenceNameFormatter(format OccurrenceNameFormatter) {
+	pg.occurrenceNames = format
+}
+
+// newOccurrenceID returns the id of occurrence o about to be created in project pID, i.e.
+// the id generated for it, unless the name formatter of the store names it otherwise.
+func (pg *PgSQLStore) newOccurrenceID(pID string, o *pb.Occurrence) (string, error) {
+	gen := pg.occurrenceIDs
+	if gen == nil {
+		gen = RandomOccurrenceIDs
+	}
+	id, err := gen(pID, o)
+	if err != nil {
+		return "", err
+	}
+	if !occurrenceIDRE.MatchString(id) {
+		return "", status.Errorf(codes.InvalidArgument, "Invalid occurrence id %q", id)
+	}
+	if pg.occurrenceNames == nil {
+		return id, nil
+	}
+	oName := pg.occurrenceNames(pID, id, o)
+	oPID, oID, err := name.ParseOccurrence(oName)
+	if err != nil || oPID != pID || !occurrenceIDRE.MatchString(oID) {
+		log.Printf("Invalid formatted occurrence name %q in project %q", oName, pID)
+		return "", status.Error(codes.Internal, "Failed to name occurrence")
+	}
+	return oID, nil
+}
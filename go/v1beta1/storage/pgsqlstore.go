@@ -17,14 +17,17 @@ package storage
 import (
 	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fernet/fernet-go"
-	"github.com/google/uuid"
 	"github.com/grafeas/grafeas/go/config"
 	"github.com/grafeas/grafeas/go/name"
 	"github.com/grafeas/grafeas/go/v1beta1/storage"
@@ -43,6 +46,7 @@ import (
 // Config is the configuration for PostgreSQL store.
 // json tags are required because
 // config.ConvertGenericConfigToSpecificType internally uses json package.
+// The connection fields and PaginationKey may reference environment variables as ${NAME}.
 type Config struct {
 	Host string `json:"host"`
 	Port int    `json:"port"`
@@ -50,10 +54,16 @@ type Config struct {
 	DBName   string `json:"db_name"`
 	User     string `json:"user"`
 	Password string `json:"password"`
+	// PasswordFile is the path of a file holding the password, e.g. a mounted secret.
+	// Surrounding whitespace is trimmed. It cannot be combined with Password.
+	PasswordFile string `json:"password_file"`
 	// Valid sslmodes: disable, allow, prefer, require, verify-ca, verify-full.
 	// See https://www.postgresql.org/docs/current/static/libpq-connect.html for details
 	SSLMode     string `json:"ssl_mode"`
 	SSLRootCert string `json:"ssl_root_cert"`
+	// ConnectTimeoutSeconds bounds each attempt to connect to the database, so that an
+	// unreachable host fails fast instead of after the OS TCP timeout. It defaults to 10.
+	ConnectTimeoutSeconds int `json:"connect_timeout_seconds"`
 	// PaginationKey is a 32-bit URL-safe base64 key used to encrypt pagination tokens.
 	// If one is not provided, it will be generated.
 	// Multiple grafeas instances in the same cluster need the same value,
@@ -64,12 +74,258 @@ type Config struct {
 	// the encrypted page returned by one instance cannot be successfully decrypted by another instance.
 	// As a result, if requests are routed to different Grafeas instances, pagination will be broken.
 	PaginationKey string `json:"pagination_key"`
+	// PaginationKeyFile is the path of a file holding the pagination key.
+	// Surrounding whitespace is trimmed. It cannot be combined with PaginationKey.
+	PaginationKeyFile string `json:"pagination_key_file"`
+	// PaginationKeyProvider, if set, obtains the pagination key at startup, e.g. from a KMS.
+	// It can only be set programmatically and cannot be combined with PaginationKey or
+	// PaginationKeyFile, which are provided by StaticKey and KeyFile.
+	PaginationKeyProvider KeyProvider `json:"-"`
+	// PrepareStatements enables caching of prepared statements for the store's static queries.
+	// Queries carrying a user filter are never prepared.
+	PrepareStatements bool `json:"prepare_statements"`
+	// PrepareTxStatements prepares the statements the store runs repeatedly in a transaction,
+	// such as the inserts of ImportProject and the updates of BatchUpdateOccurrences, once per
+	// transaction rather than on each run. Unlike PrepareStatements, it also applies when
+	// MaxConnWait or ConnWaitThreshold is set, since the statements last only as long as
+	// their transaction.
+	PrepareTxStatements bool `json:"prepare_tx_statements"`
+	// NoteCacheSize is the maximum number of notes kept in an in-process LRU cache
+	// used by GetNote and GetOccurrenceNote. Zero disables the cache.
+	NoteCacheSize int `json:"note_cache_size"`
+	// Tablespace, if set, is the existing tablespace the tables and their indexes are created in.
+	Tablespace string `json:"tablespace"`
+	// AnalyzeAfterBatch issues ANALYZE on the affected table after a batch create
+	// so planner statistics are fresh for subsequent filtered lists.
+	AnalyzeAfterBatch bool `json:"analyze_after_batch"`
+	// PageTokenTTL is how long page tokens stay valid, as a Go duration string, an hour if it is
+	// not set. PageTokenTTLs overrides it per list method, e.g. {"ListOccurrences": "12h"} for
+	// long-running exports.
+	//
+	// A zero duration, e.g. "0", makes page tokens never expire, e.g. for bookmarkable cursors.
+	// Such tokens only resume a list where it left off and grant no access by themselves, but
+	// a leaked token remains usable, and tokens can then only be revoked by rotating the
+	// pagination key, which invalidates all of them.
+	PageTokenTTL  string            `json:"page_token_ttl"`
+	PageTokenTTLs map[string]string `json:"page_token_ttls"`
+	// MaxFilterDepth and MaxFilterNodes bound the nesting depth and the number of expression nodes of
+	// list filters; more complex filters are rejected. Zero values select the defaults of
+	// 64 levels and 1024 nodes.
+	MaxFilterDepth int `json:"max_filter_depth"`
+	MaxFilterNodes int `json:"max_filter_nodes"`
+	// EnableDiagnostics enables the diagnostics methods, such as GetRawOccurrence,
+	// which expose stored data as is.
+	EnableDiagnostics bool `json:"enable_diagnostics"`
+	// OccurrenceRateLimit is the number of occurrences each project may create per second,
+	// in bursts of up to OccurrenceRateBurst (by default, one second's worth). Projects
+	// listed in ProjectOccurrenceRateLimits get their own rate. Ingestion is not throttled
+	// if neither is set.
+	OccurrenceRateLimit         float64            `json:"occurrence_rate_limit"`
+	OccurrenceRateBurst         int                `json:"occurrence_rate_burst"`
+	ProjectOccurrenceRateLimits map[string]float64 `json:"project_occurrence_rate_limits"`
+	// MaxOpenConns limits the number of open connections to the database; 0 means no limit.
+	MaxOpenConns int `json:"max_open_conns"`
+	// MaxConnWait bounds how long a query waits for a connection once MaxOpenConns are in use,
+	// e.g. "2s"; queries waiting longer fail with ResourceExhausted. Queries wait until their
+	// context is done if it is not set. Waits longer than ConnWaitThreshold, e.g. "100ms", and
+	// timeouts are logged and reported to the observer set with SetConnWaitObserver, so that
+	// pool saturation is noticed before queries fail. When either is set, queries run on a
+	// connection taken from the pool for them and are not prepared, even with
+	// PrepareStatements.
+	MaxConnWait       string `json:"max_conn_wait"`
+	ConnWaitThreshold string `json:"conn_wait_threshold"`
+	// PrewarmConns is the number of connections opened at startup, up to MaxOpenConns,
+	// so that the pool is filled before serving.
+	PrewarmConns int `json:"prewarm_conns"`
+	// TxRetries is the number of times WithTransaction retries a transaction failing
+	// with a serialization failure.
+	TxRetries int `json:"tx_retries"`
+	// IsolationLevel is the default isolation level of the transactions run by WithTransaction:
+	// "read committed", "repeatable read" or "serializable". The database default is used if
+	// it is not set. It may be overridden per transaction with WithIsolationLevel.
+	IsolationLevel string `json:"isolation_level"`
+	// CaseInsensitiveIDs makes GetProject, GetNote and GetOccurrence match project, note and
+	// occurrence IDs regardless of case, backed by indexes on the lowercased names. Names
+	// are still stored as given, and lookups prefer an exact match.
+	CaseInsensitiveIDs bool `json:"case_insensitive_ids"`
+	// SlowQueryThreshold is the duration, e.g. "500ms", beyond which queries are logged
+	// along with the store operation issuing them. Queries are not timed if it is not set.
+	SlowQueryThreshold string `json:"slow_query_threshold"`
+	// OccurrenceTTL is the age, e.g. "720h", beyond which occurrences are deleted by
+	// PurgeExpiredOccurrences. Occurrences do not expire if it is not set.
+	OccurrenceTTL string `json:"occurrence_ttl"`
+	// ValidateOccurrenceKinds rejects created occurrences without details of a known kind,
+	// or whose kind does not match their details, with InvalidArgument.
+	ValidateOccurrenceKinds bool `json:"validate_occurrence_kinds"`
+	// SoftDeleteOccurrences makes DeleteOccurrence mark occurrences as deleted, hiding them
+	// from reads unless requested with WithDeletedOccurrences, rather than remove them.
+	// PurgeDeletedOccurrences removes them once they have been deleted for
+	// DeletedOccurrenceRetention, e.g. "8760h"; they are retained indefinitely if it is not
+	// set. Note that the name of a soft-deleted occurrence cannot be reused, and its note
+	// cannot be deleted, until it is purged.
+	SoftDeleteOccurrences      bool   `json:"soft_delete_occurrences"`
+	DeletedOccurrenceRetention string `json:"deleted_occurrence_retention"`
+	// SessionSettings are the run-time parameters set on every connection when it is opened,
+	// e.g. {"jit": "off", "search_path": "grafeas, public"}. Values are written as in
+	// postgresql.conf.
+	SessionSettings map[string]string `json:"session_settings"`
+	// DeduplicateOccurrences makes CreateOccurrence return the existing occurrence of the project
+	// with the same content, rather than create a duplicate, when an occurrence is re-submitted.
+	// Occurrences have the same content if they differ only in their name, creation time and
+	// update time. Occurrences created before it is enabled, updated or imported are not matched.
+	DeduplicateOccurrences bool `json:"deduplicate_occurrences"`
+	// Dialect is the SQL dialect of the database: "postgres", the default, or "cockroach" for
+	// CockroachDB, for which primary keys default to unique_rowid(), schema statements are run
+	// one at a time and tablespaces are not supported.
+	Dialect string `json:"dialect"`
+	// MaxPageBytes is a soft bound on the size of the stored data of the entities returned by a
+	// page of ListOccurrences, in the full view, ListNotes, ListNoteOccurrences and
+	// ListOccurrencesModifiedSince.
+	// Once it is reached, the page ends, with a page token, even if it holds fewer entities
+	// than requested. A page holds at least one entity however large. Zero means no bound.
+	MaxPageBytes int `json:"max_page_bytes"`
+	// BatchDuplicates selects how BatchCreateOccurrences and BatchCreateNotes handle entities of
+	// a batch with the same name, including, with CaseInsensitiveIDs, names differing in case:
+	// "keep_first", the default, creates the first one and reports the others as AlreadyExists
+	// errors, while "reject" fails the whole batch with InvalidArgument before creating anything.
+	// Notes are created in the order of their IDs, so the first note is the least ID.
+	BatchDuplicates string `json:"batch_duplicates"`
+	// TagQueries prefixes queries with a comment naming the store operation and project issuing
+	// them, e.g. "/* op=ListOccurrences project=p1 */", shown in pg_stat_activity and
+	// pg_stat_statements. Tagged queries are not prepared, even with PrepareStatements, and
+	// queries run in transactions are not tagged.
+	TagQueries bool `json:"tag_queries"`
+	// BatchSize is the number of rows covered by each statement of PurgeExpiredOccurrences,
+	// PurgeDeletedOccurrences, PurgeProject and RebuildDerivedColumns, 1000 if it is not set. Smaller
+	// batches hold row locks for less time, larger ones complete the operation faster.
+	// ImportProject inserts each record with its own statement, in a single transaction, so
+	// it is not batched.
+	BatchSize int `json:"batch_size"`
+	// OccurrenceIDRetries is how many times CreateOccurrence and BatchCreateOccurrences retry
+	// with a new id when the id generated for an occurrence is taken, 3 if it is not set. Ids
+	// generated the same on retry, such as those specified by the client with
+	// ClientOccurrenceIDs, are not retried and fail with AlreadyExists.
+	OccurrenceIDRetries int `json:"occurrence_id_retries"`
+	// TenantMaxConns bounds the number of connections each tenant, named with WithTenant, holds
+	// at once, so that one tenant cannot exhaust the pool shared with the others. Tenants
+	// listed in TenantConnLimits get their own limit. Queries wait for a connection of their
+	// tenant until their context is done, and then fail with ResourceExhausted. Zero means no
+	// limit, and queries without a tenant are not limited.
+	TenantMaxConns   int            `json:"tenant_max_conns"`
+	TenantConnLimits map[string]int `json:"tenant_conn_limits"`
+	// NullsOrder places the entities without a value for the field they are listed by, such as
+	// the occurrences without a severity listed with OccurrenceOrderSeverity: "last", the
+	// default, or "first".
+	NullsOrder string `json:"nulls_order"`
+	// TextSearchConfig enables SearchOccurrences with the named PostgreSQL text search
+	// configuration, e.g. "english", or "simple" to index words as they are. Every string value
+	// of an occurrence, such as its resource URI, note name and package names, feeds a tsvector
+	// column, generated by the database and indexed with GIN. Adding the column rewrites the
+	// occurrences table; the configuration of an existing column is not changed, so changing
+	// it requires dropping the search_vector column first. It is not supported by the cockroach
+	// dialect.
+	TextSearchConfig string `json:"text_search_config"`
+	// MaxEntitySizeBytes bounds the size of the JSON encoding of the notes and occurrences
+	// created, updated or imported; larger ones, such as occurrences embedding a whole SBOM, are
+	// rejected with InvalidArgument. Zero means no bound.
+	MaxEntitySizeBytes int `json:"max_entity_size_bytes"`
+	// CaseInsensitiveFilters makes the string comparisons of list filters ignore case, e.g.
+	// resource.uri = "GCR.io/x" matches the URI gcr.io/x, by comparing the lowercased values.
+	// Such comparisons cannot use the indexes on the compared columns.
+	CaseInsensitiveFilters bool `json:"case_insensitive_filters"`
+	// RetryDelay is the delay, e.g. "500ms", after which clients are told to retry by the
+	// RetryInfo detail of the ResourceExhausted errors of queries timing out on MaxConnWait or
+	// on their tenant's connection limit, 1s if it is not set. Rate limited creates are told
+	// when the rate of their project allows them instead, if the rate limiter can tell (see
+	// RetryAfterLimiter), and connections refused by the server are retried after 1s.
+	RetryDelay string `json:"retry_delay"`
+	// SchemaVersion is the version of the database schema the binary expects, as recorded in
+	// the schema_migrations table by the migration tool managing the schema, e.g.
+	// golang-migrate. If it is set, the store fails to start unless the schema is at this
+	// version, with no migration left half-applied, so that a binary rolled out before or
+	// after its migration fails fast rather than with confusing query errors. Zero skips the
+	// check.
+	SchemaVersion int64 `json:"schema_version"`
 }
 
 // PgSQLStore provides functionalities to use PostgreSQL DB as a data store.
 type PgSQLStore struct {
-	*sql.DB
+	db            *sql.DB
 	paginationKey string
+	stmts         *stmtCache
+	// txStmts holds the statement caches of the running transactions, if PrepareTxStatements
+	// is set.
+	txStmts *txStmtCaches
+	notes   *noteCache
+	// analyzeAfterBatch refreshes planner statistics after batch creates.
+	analyzeAfterBatch bool
+	// defaultTokenTTL is the page token lifetime, and pageTokenTTLs holds those overridden per
+	// list method. Zero means tokens never expire.
+	defaultTokenTTL time.Duration
+	pageTokenTTLs   map[string]time.Duration
+	// occurrenceIDs picks the ids of created occurrences; nil means RandomOccurrenceIDs.
+	occurrenceIDs OccurrenceIDGenerator
+	// occurrenceNames names created occurrences after their id, if not nil.
+	occurrenceNames OccurrenceNameFormatter
+	// maxFilterDepth and maxFilterNodes bound the complexity of list filters.
+	maxFilterDepth, maxFilterNodes int
+	// diagnostics enables the diagnostics methods.
+	diagnostics bool
+	// limiter throttles occurrence creates per project, if not nil.
+	limiter RateLimiter
+	// tenants bounds the connections of each tenant, if not nil.
+	tenants *tenantLimiter
+	// nullsOrder places the entities without a value for their ordering field; see Config.NullsOrder.
+	nullsOrder string
+	// textSearchConfig is the text search configuration of SearchOccurrences; empty disables it.
+	textSearchConfig string
+	// maxEntitySize bounds the size of the stored data of entities; 0 means no bound.
+	maxEntitySize int
+	// foldFilterCase makes the string comparisons of filters case-insensitive.
+	foldFilterCase bool
+	// retryDelay is the delay after which clients are told to retry on resource exhaustion.
+	retryDelay time.Duration
+	// txRetries is the retry budget of WithTransaction.
+	txRetries int
+	// isolation is the default isolation level of WithTransaction.
+	isolation sql.IsolationLevel
+	// foldIDs makes ID lookups case-insensitive.
+	foldIDs bool
+	// slowQueryThreshold is the duration beyond which queries are reported; 0 disables timing.
+	slowQueryThreshold time.Duration
+	// validateKinds checks the kind and details of created occurrences.
+	validateKinds bool
+	// softDelete marks deleted occurrences rather than removing them.
+	softDelete bool
+	// dedup returns existing occurrences with the content of created ones.
+	dedup bool
+	// dialect is the SQL dialect of the database.
+	dialect string
+	// maxPageBytes bounds the size of list pages; 0 means no bound.
+	maxPageBytes int
+	// rejectBatchDuplicates fails batches with duplicate names rather than keep the first.
+	rejectBatchDuplicates bool
+	// deletedRetention is how long soft-deleted occurrences are retained; 0 means forever.
+	deletedRetention time.Duration
+	// occurrenceTTL is the age of expired occurrences; 0 means they never expire.
+	occurrenceTTL time.Duration
+	// batchSize is the number of rows per statement of the batched maintenance operations.
+	batchSize int64
+	// occurrenceIDRetries is how many times a taken generated occurrence id is regenerated.
+	occurrenceIDRetries int
+	// tagQueries prefixes queries with the operation and project issuing them.
+	tagQueries bool
+	// slowQueryObserver is also called with slow queries, if not nil.
+	slowQueryObserver SlowQueryObserver
+	// maxConnWait bounds the wait for a connection, and waits beyond connWaitThreshold are
+	// reported, also to connWaitObserver if not nil; 0 disables either.
+	maxConnWait       time.Duration
+	connWaitThreshold time.Duration
+	connWaitObserver  ConnWaitObserver
+	// occurrenceChanges is called with the fields changed by occurrence updates, if not nil.
+	occurrenceChanges OccurrenceChangeObserver
+	// onOccurrenceCreated is called with created occurrences, if not nil.
+	onOccurrenceCreated OccurrenceCreatedHook
 }
 
 // PostgresqlStorageTypeProvider creates and initializes a new grafeas v1beta1 storage compatible PgSQL store based on the specified config.
@@ -93,7 +349,20 @@ func PostgresqlStorageTypeProvider(_ string, ci *config.StorageConfiguration) (*
 
 // NewPgSQLStore creates a new PgSQL store based on the passed-in config.
 func NewPgSQLStore(config *Config) (*PgSQLStore, error) {
-	return NewStoreWithCustomConnector(newDSNConnector(*config), config.PaginationKey)
+	return NewPgSQLStoreContext(context.Background(), config)
+}
+
+// NewPgSQLStoreContext is like NewPgSQLStore, but gives up connecting to the database
+// and creating the tables when ctx is done, e.g. to bound startup with a deadline.
+func NewPgSQLStoreContext(ctx context.Context, config *Config) (*PgSQLStore, error) {
+	c, err := expandConfigEnv(*config)
+	if err != nil {
+		return nil, err
+	}
+	if err := resolvePasswordFile(&c); err != nil {
+		return nil, err
+	}
+	return newPgSQLStore(ctx, newDSNConnector(c), &c)
 }
 
 // dsnConnector references the implementation of sql.dsnConnector.
@@ -112,9 +381,16 @@ func newDSNConnector(conf Config) *dsnConnector {
 	return connector
 }
 
+// defaultConnectTimeoutSeconds is the connect timeout used unless ConnectTimeoutSeconds is set.
+const defaultConnectTimeoutSeconds = 10
+
 func assembleDSN(c Config) string {
-	dsn := fmt.Sprintf("host=%s dbname=%s user=%s password=%s sslmode=%s",
-		c.Host, c.DBName, c.User, c.Password, c.SSLMode,
+	timeout := c.ConnectTimeoutSeconds
+	if timeout == 0 {
+		timeout = defaultConnectTimeoutSeconds
+	}
+	dsn := fmt.Sprintf("host=%s dbname=%s user=%s password=%s sslmode=%s connect_timeout=%d",
+		c.Host, c.DBName, c.User, c.Password, c.SSLMode, timeout,
 	)
 	if c.SSLRootCert != "" {
 		dsn = fmt.Sprintf("%s sslrootcert=%s", dsn, c.SSLRootCert)
@@ -132,6 +408,27 @@ func (c *dsnConnector) Driver() driver.Driver {
 
 // NewStoreWithCustomConnector creates a new PgSQL store using the custom connector.
 func NewStoreWithCustomConnector(connector driver.Connector, paginationKey string) (*PgSQLStore, error) {
+	return NewStoreWithCustomConnectorContext(context.Background(), connector, paginationKey)
+}
+
+// NewStoreWithCustomConnectorContext is like NewStoreWithCustomConnector, but gives up connecting
+// to the database and creating the tables when ctx is done.
+func NewStoreWithCustomConnectorContext(ctx context.Context, connector driver.Connector, paginationKey string) (*PgSQLStore, error) {
+	return newPgSQLStore(ctx, connector, &Config{PaginationKey: paginationKey})
+}
+
+// NewStoreWithCustomConnectorConfig is like NewStoreWithCustomConnectorContext, but takes the
+// pagination key and the other store options from config. Its connection fields are ignored.
+func NewStoreWithCustomConnectorConfig(ctx context.Context, connector driver.Connector, config *Config) (*PgSQLStore, error) {
+	return newPgSQLStore(ctx, connector, config)
+}
+
+// newPgSQLStore creates a new PgSQL store using the connector and the store options in config.
+func newPgSQLStore(ctx context.Context, connector driver.Connector, config *Config) (*PgSQLStore, error) {
+	paginationKey, err := fetchPaginationKey(ctx, config)
+	if err != nil {
+		return nil, err
+	}
 	if paginationKey == "" {
 		log.Println("pagination key is empty, generating...")
 		var key fernet.Key
@@ -146,40 +443,242 @@ func NewStoreWithCustomConnector(connector driver.Connector, paginationKey strin
 			return nil, errors.New("invalid pagination key; must be 256-bit URL-safe base64")
 		}
 	}
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	if len(config.SessionSettings) > 0 {
+		connector = newSessionConnector(connector, config.SessionSettings)
+	}
 	db := sql.OpenDB(connector)
-	if err := db.Ping(); err != nil {
+	if config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to ping the database server, err: %v", err)
 	}
-	if _, err := db.Exec(createTables); err != nil {
+	if config.SchemaVersion > 0 {
+		if err := checkSchemaVersion(ctx, db, config.SchemaVersion); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if err := execDDL(ctx, db, createTablesDDL(config.Tablespace), config.Dialect); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to create tables, err: %v", err)
 	}
-	return &PgSQLStore{
-		DB:            db,
-		paginationKey: paginationKey,
-	}, nil
+	if config.CaseInsensitiveIDs {
+		if err := execDDL(ctx, db, indexesDDL(createFoldedIndexes, config.Tablespace), config.Dialect); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create case-insensitive indexes, err: %v", err)
+		}
+	}
+	if config.OccurrenceTTL != "" {
+		if err := execDDL(ctx, db, indexesDDL(createExpiryIndex, config.Tablespace), config.Dialect); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create occurrence expiry index, err: %v", err)
+		}
+	}
+	if config.SoftDeleteOccurrences {
+		if err := execDDL(ctx, db, indexesDDL(createDeletedIndex, config.Tablespace), config.Dialect); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create deleted occurrence index, err: %v", err)
+		}
+	}
+	if config.DeduplicateOccurrences {
+		if err := execDDL(ctx, db, indexesDDL(createContentHashIndex, config.Tablespace), config.Dialect); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create occurrence content hash index, err: %v", err)
+		}
+	}
+	if config.TextSearchConfig != "" {
+		if err := execDDL(ctx, db, textSearchDDL(config.TextSearchConfig, config.Tablespace), config.Dialect); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create occurrence text search index, err: %v", err)
+		}
+	}
+	if config.PrewarmConns > 0 {
+		prewarm(ctx, db, config.PrewarmConns, config.MaxOpenConns)
+	}
+	c := *config
+	c.PaginationKey = paginationKey
+	return newStore(db, &c), nil
+}
+
+// prewarm opens and pings n connections, or maxOpen if it is lower and not 0, and returns
+// them to the pool, so that the first requests do not pay for connection establishment.
+// Failures are logged, not returned, since the pool still fills lazily.
+func prewarm(ctx context.Context, db *sql.DB, n, maxOpen int) {
+	if maxOpen > 0 && n > maxOpen {
+		n = maxOpen
+	}
+	// Keep the prewarmed connections when they are returned; by default only 2 idle ones are.
+	db.SetMaxIdleConns(n)
+	var conns []*sql.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	// Hold every connection until all are open, so that each is a distinct one.
+	for i := 0; i < n; i++ {
+		c, err := db.Conn(ctx)
+		if err != nil {
+			log.Printf("Failed to prewarm connection %d of %d: %v", i+1, n, err)
+			return
+		}
+		conns = append(conns, c)
+		if err := c.PingContext(ctx); err != nil {
+			log.Printf("Failed to prewarm connection %d of %d: %v", i+1, n, err)
+			return
+		}
+	}
+}
+
+// newStore wraps db in a store configured by the store options in config.
+// config must have passed validateConfig and config.PaginationKey must be a valid key.
+func newStore(db *sql.DB, config *Config) *PgSQLStore {
+	s := &PgSQLStore{
+		db:                    db,
+		paginationKey:         config.PaginationKey,
+		analyzeAfterBatch:     config.AnalyzeAfterBatch,
+		diagnostics:           config.EnableDiagnostics,
+		txRetries:             config.TxRetries,
+		isolation:             isolationLevels[strings.ToLower(config.IsolationLevel)],
+		foldIDs:               config.CaseInsensitiveIDs,
+		validateKinds:         config.ValidateOccurrenceKinds,
+		softDelete:            config.SoftDeleteOccurrences,
+		dedup:                 config.DeduplicateOccurrences,
+		dialect:               config.Dialect,
+		maxPageBytes:          config.MaxPageBytes,
+		rejectBatchDuplicates: config.BatchDuplicates == batchDuplicatesReject,
+		tagQueries:            config.TagQueries,
+		batchSize:             defaultBatchSize,
+		occurrenceIDRetries:   defaultOccurrenceIDRetries,
+		defaultTokenTTL:       defaultPageTokenTTL,
+		nullsOrder:            nullsOrderLast,
+		textSearchConfig:      config.TextSearchConfig,
+		maxEntitySize:         config.MaxEntitySizeBytes,
+		foldFilterCase:        config.CaseInsensitiveFilters,
+		retryDelay:            defaultRetryDelay,
+		pageTokenTTLs:         map[string]time.Duration{},
+		maxFilterDepth:        defaultMaxFilterDepth,
+		maxFilterNodes:        defaultMaxFilterNodes,
+	}
+	if config.OccurrenceIDRetries > 0 {
+		s.occurrenceIDRetries = config.OccurrenceIDRetries
+	}
+	if config.BatchSize > 0 {
+		s.batchSize = int64(config.BatchSize)
+	}
+	if config.MaxFilterDepth > 0 {
+		s.maxFilterDepth = config.MaxFilterDepth
+	}
+	if config.MaxFilterNodes > 0 {
+		s.maxFilterNodes = config.MaxFilterNodes
+	}
+	if config.NullsOrder != "" {
+		s.nullsOrder = config.NullsOrder
+	}
+	if config.PageTokenTTL != "" {
+		s.defaultTokenTTL, _ = time.ParseDuration(config.PageTokenTTL)
+	}
+	for op, v := range config.PageTokenTTLs {
+		s.pageTokenTTLs[op], _ = time.ParseDuration(v)
+	}
+	if config.SlowQueryThreshold != "" {
+		s.slowQueryThreshold, _ = time.ParseDuration(config.SlowQueryThreshold)
+	}
+	if config.MaxConnWait != "" {
+		s.maxConnWait, _ = time.ParseDuration(config.MaxConnWait)
+	}
+	if config.RetryDelay != "" {
+		s.retryDelay, _ = time.ParseDuration(config.RetryDelay)
+	}
+	if config.ConnWaitThreshold != "" {
+		s.connWaitThreshold, _ = time.ParseDuration(config.ConnWaitThreshold)
+	}
+	if config.OccurrenceTTL != "" {
+		s.occurrenceTTL, _ = time.ParseDuration(config.OccurrenceTTL)
+	}
+	if config.DeletedOccurrenceRetention != "" {
+		s.deletedRetention, _ = time.ParseDuration(config.DeletedOccurrenceRetention)
+	}
+	if config.TenantMaxConns > 0 || len(config.TenantConnLimits) > 0 {
+		s.tenants = newTenantLimiter(config.TenantMaxConns, config.TenantConnLimits, s.retryDelay)
+	}
+	if config.OccurrenceRateLimit > 0 || len(config.ProjectOccurrenceRateLimits) > 0 {
+		burst := config.OccurrenceRateBurst
+		if burst == 0 {
+			burst = int(math.Max(1, math.Ceil(config.OccurrenceRateLimit)))
+		}
+		s.limiter = NewTokenBucketLimiter(config.OccurrenceRateLimit, burst, config.ProjectOccurrenceRateLimits)
+	}
+	if config.PrepareStatements {
+		s.stmts = newStmtCache(db)
+	}
+	if config.PrepareTxStatements {
+		s.txStmts = &txStmtCaches{caches: map[*sql.Tx]map[string]*sql.Stmt{}}
+	}
+	if config.NoteCacheSize > 0 {
+		s.notes = newNoteCache(config.NoteCacheSize)
+	}
+	return s
+}
+
+// Close closes the cached prepared statements, if any, and the underlying database.
+func (pg *PgSQLStore) Close() error {
+	if pg.stmts != nil {
+		if err := pg.stmts.close(); err != nil {
+			log.Printf("Failed to close prepared statements: %v", err)
+		}
+	}
+	return pg.db.Close()
+}
+
+// PoolStats returns the connection pool statistics, e.g. for export to monitoring.
+func (pg *PgSQLStore) PoolStats() sql.DBStats {
+	return pg.db.Stats()
+}
+
+// HealthCheck verifies that the database is reachable.
+func (pg *PgSQLStore) HealthCheck(ctx context.Context) error {
+	if err := pg.db.PingContext(ctx); err != nil {
+		log.Println("Database health check failed", err)
+		return status.Error(codes.Unavailable, "Database is unreachable")
+	}
+	return nil
 }
 
 // CreateProject adds the specified project to the store
 func (pg *PgSQLStore) CreateProject(ctx context.Context, pID string, p *prpb.Project) (*prpb.Project, error) {
-	_, err := pg.DB.ExecContext(ctx, insertProject, name.FormatProject(pID))
+	ctx = pg.withQueryTags(ctx, pID)
+	if p == nil {
+		return nil, nilError("Project")
+	}
+	_, err := pg.execContext(ctx, insertProject, name.FormatProject(pID))
 	if err, ok := err.(*pq.Error); ok {
 		// Check for unique_violation
 		if err.Code == "23505" {
 			return nil, status.Errorf(codes.AlreadyExists, "Project with name %q already exists", pID)
 		}
 		log.Println("Failed to insert Project in database", err)
-		return nil, status.Error(codes.Internal, "Failed to insert Project in database")
+		return nil, dbError(err, "Failed to insert Project in database")
+	}
+	if err != nil {
+		return nil, dbError(err, "Failed to insert Project in database")
 	}
 	return p, nil
 }
 
-// DeleteProject deletes the project with the given pID from the store
+// DeleteProject deletes the project with the given pID from the store. Its notes and
+// occurrences are kept; see PurgeProject.
 func (pg *PgSQLStore) DeleteProject(ctx context.Context, pID string) error {
+	ctx = pg.withQueryTags(ctx, pID)
 	pName := name.FormatProject(pID)
-	result, err := pg.DB.ExecContext(ctx, deleteProject, pName)
+	result, err := pg.execContext(ctx, deleteProject, pName)
 	if err != nil {
-		return status.Error(codes.Internal, "Failed to delete Project from database")
+		return dbError(err, "Failed to delete Project from database")
 	}
 	count, err := result.RowsAffected()
 	if err != nil {
@@ -191,13 +690,53 @@ func (pg *PgSQLStore) DeleteProject(ctx context.Context, pID string) error {
 	return nil
 }
 
+// PurgeProject deletes the occurrences, then the notes, then the project with the given pID,
+// and returns how many occurrences and notes were deleted. Unlike DeleteProject, which would
+// delete them all in a single statement, entities are deleted BatchSize at a time, each batch
+// committing on its own, so that deleting a huge project does not hold long locks. Should the
+// purge be interrupted, the project remains until its entities are gone, and running
+// PurgeProject again resumes where it stopped. Notes referenced by occurrences of other
+// projects are not deleted, and fail the purge with FailedPrecondition. The project need not
+// exist, so that the entities left by DeleteProject can be purged.
+func (pg *PgSQLStore) PurgeProject(ctx context.Context, pID string) (occurrences, notes int64, err error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	occurrences, err = pg.purgeInBatches(ctx, "Occurrences", purgeProjectOccurrences, pID)
+	log.Printf("Purged %d occurrences of project %q", occurrences, pID)
+	if err != nil {
+		return occurrences, 0, err
+	}
+	notes, err = pg.purgeInBatches(ctx, "Notes", purgeProjectNotes, pID)
+	log.Printf("Purged %d notes of project %q", notes, pID)
+	cachedPID, _ := pg.noteCacheKey(pID, "")
+	pg.notes.removeProject(cachedPID)
+	if err != nil {
+		return occurrences, notes, err
+	}
+	if _, err := pg.execContext(ctx, deleteProject, name.FormatProject(pID)); err != nil {
+		return occurrences, notes, dbError(err, "Failed to delete Project from database")
+	}
+	return occurrences, notes, nil
+}
+
 // GetProject returns the project with the given pID from the store
 func (pg *PgSQLStore) GetProject(ctx context.Context, pID string) (*prpb.Project, error) {
+	ctx = pg.withQueryTags(ctx, pID)
 	pName := name.FormatProject(pID)
+	if pg.foldIDs {
+		var stored string
+		err := pg.queryRowContext(ctx, searchProjectFolded, pName).Scan(&stored)
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, status.Errorf(codes.NotFound, "Project with name %q does not Exist", pName)
+		case err != nil:
+			return nil, dbError(err, "Failed to query Project from database")
+		}
+		return &prpb.Project{Name: stored}, nil
+	}
 	var exists bool
-	err := pg.DB.QueryRowContext(ctx, projectExists, pName).Scan(&exists)
+	err := pg.queryRowContext(ctx, projectExists, pName).Scan(&exists)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to query Project from database")
+		return nil, dbError(err, "Failed to query Project from database")
 	}
 	if !exists {
 		return nil, status.Errorf(codes.NotFound, "Project with name %q does not Exist", pName)
@@ -205,23 +744,59 @@ func (pg *PgSQLStore) GetProject(ctx context.Context, pID string) (*prpb.Project
 	return &prpb.Project{Name: pName}, nil
 }
 
+// GetProjectWithFilter returns the project with the given pID and whether it matches filter,
+// so that callers can tell a project that is absent, reported as NotFound, from one that is
+// filtered out. The project is returned in both of the latter cases. An empty filter matches
+// every project.
+func (pg *PgSQLStore) GetProjectWithFilter(ctx context.Context, pID, filter string) (*prpb.Project, bool, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	pName := name.FormatProject(pID)
+	predicate := "TRUE"
+	var filterArgs []interface{}
+	if filter != "" {
+		var err error
+		if predicate, filterArgs, err = pg.filterPredicate(filter, projectColumns, 1); err != nil {
+			return nil, false, err
+		}
+	}
+	var matched bool
+	err := pg.queryRowContext(ctx, fmt.Sprintf(matchProject, predicate), append([]interface{}{pName}, filterArgs...)...).Scan(&matched)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, false, status.Errorf(codes.NotFound, "Project with name %q does not Exist", pName)
+	case err != nil:
+		log.Println("Failed to query Project from database", err)
+		return nil, false, dbError(err, "Failed to query Project from database")
+	}
+	return &prpb.Project{Name: pName}, matched, nil
+}
+
 // ListProjects returns up to pageSize number of projects beginning at pageToken (or from
 // start if pageToken is the empty string).
 func (pg *PgSQLStore) ListProjects(ctx context.Context, filter string, pageSize int, pageToken string) ([]*prpb.Project, string, error) {
-	var filterQuery string
-	if filter != "" {
-		var fs FilterSQL
-		filterQuery = " AND " + fs.ParseFilter(filter)
+	ctx = pg.withQueryTags(ctx, "")
+	filterQuery, filterArgs, err := pg.filterClause(filter, projectColumns, 2)
+	if err != nil {
+		return nil, "", err
 	}
 	query := fmt.Sprintf(listProjects, filterQuery)
-	id := decryptInt64(pageToken, pg.paginationKey, 0)
-	rows, err := pg.DB.QueryContext(ctx, query, id, pageSize)
+	id := decryptCursor(pageToken, pg.paginationKey, pg.pageTokenTTL("ListProjects")).ID
+	rows, err := pg.queryContext(ctx, query, append([]interface{}{id, pageLimit(int64(pageSize))}, filterArgs...)...)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to list Projects from database")
+		return nil, "", dbError(err, "Failed to list Projects from database")
 	}
+	defer rows.Close()
+
 	var projects []*prpb.Project
 	var lastID int64
 	for rows.Next() {
+		if len(projects) == pageSize {
+			encryptedPage, err := encryptCursor(pageCursor{ID: lastID}, pg.paginationKey)
+			if err != nil {
+				return nil, "", status.Error(codes.Internal, "Failed to paginate projects")
+			}
+			return projects, encryptedPage, nil
+		}
 		var name string
 		err := rows.Scan(&lastID, &name)
 		if err != nil {
@@ -229,39 +804,68 @@ func (pg *PgSQLStore) ListProjects(ctx context.Context, filter string, pageSize
 		}
 		projects = append(projects, &prpb.Project{Name: name})
 	}
-	if len(projects) == 0 {
-		return projects, "", nil
-	}
-	maxQuery := projectsMaxID
-	if filterQuery != "" {
-		maxQuery = fmt.Sprintf("%s WHERE %s", maxQuery, filterQuery)
+	if err := rows.Err(); err != nil {
+		return nil, "", dbError(err, "Failed to list Projects from database")
 	}
-	maxID, err := pg.max(ctx, maxQuery)
-	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to query max project id from database")
+	return projects, "", nil
+}
+
+// CreateOccurrence adds the specified occurrence. If ctx carries an idempotency key (see
+// WithIdempotencyKey) already used in the project, the previously created occurrence is returned,
+// as is, if the store deduplicates occurrences, an existing occurrence with the same content.
+func (pg *PgSQLStore) CreateOccurrence(ctx context.Context, pID, uID string, o *pb.Occurrence) (*pb.Occurrence, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	if o == nil {
+		return nil, nilError("Occurrence")
 	}
-	if lastID >= maxID {
-		return projects, "", nil
+	if err := pg.allowOccurrences(pID, 1); err != nil {
+		return nil, err
 	}
-	encryptedPage, err := encryptInt64(lastID, pg.paginationKey)
+	return pg.createOccurrence(ctx, pID, uID, o)
+}
+
+// createOccurrence adds the specified occurrence, regardless of the project's rate limit.
+func (pg *PgSQLStore) createOccurrence(ctx context.Context, pID, uID string, o *pb.Occurrence) (*pb.Occurrence, error) {
+	id, err := pg.newOccurrenceID(pID, o)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to paginate projects")
+		return nil, err
 	}
-	return projects, encryptedPage, nil
+	return pg.createOccurrenceRetryingID(ctx, pID, uID, id, o)
 }
 
-// CreateOccurrence adds the specified occurrence
-func (pg *PgSQLStore) CreateOccurrence(ctx context.Context, pID, uID string, o *pb.Occurrence) (*pb.Occurrence, error) {
-	o = proto.Clone(o).(*pb.Occurrence)
-	o.CreateTime = timestamppb.Now()
+// defaultOccurrenceIDRetries is how many times a create retries with a new id when a
+// generated occurrence id is taken, unless the store is configured with OccurrenceIDRetries.
+const defaultOccurrenceIDRetries = 3
 
-	var id string
-	if nr, err := uuid.NewRandom(); err != nil {
-		return nil, status.Error(codes.Internal, "Failed to generate UUID")
-	} else {
-		id = nr.String()
+// createOccurrenceRetryingID is createOccurrenceWithID retrying with a new id should id be
+// taken. Ids generated again as they were, such as those specified by the client, are
+// genuinely taken and fail with AlreadyExists, while random ids colliding are regenerated.
+func (pg *PgSQLStore) createOccurrenceRetryingID(ctx context.Context, pID, uID, id string, o *pb.Occurrence) (*pb.Occurrence, error) {
+	for retries := 0; ; retries++ {
+		created, err := pg.createOccurrenceWithID(ctx, pID, uID, id, o)
+		if status.Code(err) != codes.AlreadyExists || retries == pg.occurrenceIDRetries {
+			return created, err
+		}
+		next, genErr := pg.newOccurrenceID(pID, o)
+		if genErr != nil || next == id {
+			return nil, err
+		}
+		log.Printf("Generated occurrence id %q is taken in project %q, retrying with %q", id, pID, next)
+		id = next
+	}
+}
+
+// createOccurrenceWithID adds the specified occurrence with id, picked by newOccurrenceID.
+func (pg *PgSQLStore) createOccurrenceWithID(ctx context.Context, pID, uID, id string, o *pb.Occurrence) (*pb.Occurrence, error) {
+	if pg.validateKinds {
+		if err := validateKind(o); err != nil {
+			return nil, err
+		}
 	}
-	o.Name = fmt.Sprintf("projects/%s/occurrences/%s", pID, id)
+	o = proto.Clone(o).(*pb.Occurrence)
+	// Timestamps are stored with microsecond precision.
+	o.CreateTime = timestamppb.New(time.Now().Truncate(time.Microsecond))
+	o.Name = name.FormatOccurrence(pID, id)
 
 	nPID, nID, err := name.ParseNote(o.NoteName)
 	if err != nil {
@@ -269,52 +873,180 @@ func (pg *PgSQLStore) CreateOccurrence(ctx context.Context, pID, uID string, o *
 		return nil, status.Error(codes.InvalidArgument, "Invalid note name")
 	}
 
-	occurrenceJson, err := protojson.Marshal(o)
+	occurrenceJson, err := marshalJSON(o)
 	if err != nil {
 		log.Printf("Failed to marshal occurrence to json")
 		return nil, status.Error(codes.InvalidArgument, "Failed to marshal occurrence to json")
 	}
+	if err := pg.checkEntitySize("Occurrence", occurrenceJson); err != nil {
+		return nil, err
+	}
 
-	_, err = pg.DB.ExecContext(ctx, insertOccurrence, pID, id, nPID, nID, occurrenceJson)
+	var key sql.NullString
+	if k := idempotencyKey(ctx); k != "" {
+		key = sql.NullString{String: k, Valid: true}
+	}
+	var hash sql.NullString
+	if pg.dedup {
+		if hash, err = contentHash(o); err != nil {
+			log.Printf("Failed to hash occurrence content")
+			return nil, status.Error(codes.InvalidArgument, "Failed to marshal occurrence to json")
+		}
+	}
+	// The creating user is recorded for filtering by created_by, unless anonymous.
+	createdBy := sql.NullString{String: uID, Valid: uID != ""}
+	var createdAt time.Time
+	err = pg.queryRowContext(ctx, insertOccurrence, pID, id, nPID, nID, occurrenceJson, o.CreateTime.AsTime(), key, occurrenceSeverity(o), occurrenceUpdatedAt(o), hash, createdBy, occurrenceResourceURI(o)).Scan(&createdAt)
 	if err, ok := err.(*pq.Error); ok {
 		// Check for unique_violation
+		if err.Code == "23505" && key.Valid && err.Constraint == "occurrences_idempotency_key_idx" {
+			return pg.existingOccurrence(ctx, idempotentOccurrence, pID, key.String)
+		}
+		if err.Code == "23505" && hash.Valid && err.Constraint == "occurrences_content_hash_idx" {
+			return pg.existingOccurrence(ctx, duplicateOccurrence, pID, hash.String)
+		}
 		if err.Code == "23505" {
 			return nil, status.Errorf(codes.AlreadyExists, "Occurrence with name %q already exists", o.Name)
 		}
+		if isMissingNote(err) {
+			return nil, status.Errorf(codes.FailedPrecondition, "Note %q of the occurrence does not exist", o.NoteName)
+		}
 		log.Println("Failed to insert Occurrence in database", err)
-		return nil, status.Error(codes.Internal, "Failed to insert Occurrence in database")
+		return nil, dbError(err, "Failed to insert Occurrence in database")
 	}
+	if err != nil {
+		log.Println("Failed to insert Occurrence in database", err)
+		return nil, dbError(err, "Failed to insert Occurrence in database")
+	}
+	// Return the stored creation time.
+	o.CreateTime = timestamppb.New(createdAt)
+	pg.occurrenceCreated(ctx, o)
 	return o, nil
 }
 
+// isMissingNote reports whether err fails an occurrence insert because its note does not exist.
+// The note reference is enforced by the foreign key of the note_id column rather than checked
+// beforehand: the note id looked up by the insert is NULL if the note is absent, and otherwise
+// the foreign key check locks the note row until the insert commits, so that a concurrent
+// DeleteNote either waits for the insert and then fails, or wins and makes the check fail.
+// A separate existence check would race with such deletes.
+func isMissingNote(err *pq.Error) bool {
+	// not_null_violation of note_id, or foreign_key_violation.
+	return err.Code == "23502" || err.Code == "23503"
+}
+
+// SetRateLimiter sets the limiter throttling occurrence creates per project, replacing the
+// one configured with OccurrenceRateLimit. It must be called before the store is used;
+// a nil limiter disables throttling.
+func (pg *PgSQLStore) SetRateLimiter(l RateLimiter) {
+	pg.limiter = l
+}
+
+// allowOccurrences checks that project pID may create n occurrences now.
+func (pg *PgSQLStore) allowOccurrences(pID string, n int) error {
+	if pg.limiter == nil || pg.limiter.Allow(pID, n) {
+		return nil
+	}
+	delay := pg.retryDelay
+	if l, ok := pg.limiter.(RetryAfterLimiter); ok {
+		delay = l.RetryAfter(pID, n)
+	}
+	return resourceExhausted(delay, "Occurrence creation rate limit exceeded for project %q", pID)
+}
+
+// existingOccurrence returns the occurrence of project pID found by query, idempotentOccurrence
+// or duplicateOccurrence, with key, the idempotency key or the content hash of a create.
+func (pg *PgSQLStore) existingOccurrence(ctx context.Context, query, pID, key string) (*pb.Occurrence, error) {
+	var oID string
+	var data []byte
+	if err := pg.queryRowContext(ctx, query, pID, key).Scan(&oID, &data); err != nil {
+		log.Println("Failed to query existing Occurrence", err)
+		return nil, dbError(err, "Failed to query Occurrence from database")
+	}
+	var o pb.Occurrence
+	if err := protojson.Unmarshal(data, &o); err != nil {
+		return nil, status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+	}
+	o.Name = name.FormatOccurrence(pID, oID)
+	return &o, nil
+}
+
 // BatchCreateOccurrences batch creates the specified occurrences in PostreSQL.
+// Nil occurrences are not created, and reported as InvalidArgument errors; occurrences no
+// id can be picked for are reported with the error of the OccurrenceIDGenerator. Occurrences
+// that already exist are skipped; the other ones that fail to be created, e.g. for their size,
+// are reported with their error.
 func (pg *PgSQLStore) BatchCreateOccurrences(ctx context.Context, pID string, uID string, occs []*pb.Occurrence) ([]*pb.Occurrence, []error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	var itemErrs []error
 	clonedOccs := []*pb.Occurrence{}
-	for _, o := range occs {
+	// positions holds the index in the batch of each cloned occurrence, for errors.
+	positions := []int{}
+	for i, o := range occs {
+		if o == nil {
+			itemErrs = append(itemErrs, status.Errorf(codes.InvalidArgument, "Occurrence %d of the batch must not be nil", i))
+			continue
+		}
 		clonedOccs = append(clonedOccs, proto.Clone(o).(*pb.Occurrence))
+		positions = append(positions, i)
 	}
 	occs = clonedOccs
 
-	errs := []error{}
-	created := []*pb.Occurrence{}
-	for _, o := range occs {
-		occ, err := pg.CreateOccurrence(ctx, pID, uID, o)
+	// Ids are picked up front, so that occurrences of the batch with the same name are
+	// handled per BatchDuplicates rather than depend on which insert runs first.
+	ids := make([]string, len(occs))
+	dups := pg.newBatchDuplicates("Occurrence")
+	for i, o := range occs {
+		id, err := pg.newOccurrenceID(pID, o)
 		if err != nil {
+			itemErrs = append(itemErrs, status.Errorf(status.Code(err), "Occurrence %d of the batch: %s", positions[i], status.Convert(err).Message()))
+			continue
+		}
+		if dups.check(name.FormatOccurrence(pID, id)) {
+			ids[i] = id
+		}
+	}
+	if err := dups.rejected(); err != nil {
+		return nil, []error{err}
+	}
+
+	if err := pg.allowOccurrences(pID, len(occs)); err != nil {
+		return nil, []error{err}
+	}
+
+	errs := append(itemErrs, dups.errs...)
+	created := []*pb.Occurrence{}
+	for i, o := range occs {
+		if ids[i] == "" {
+			continue
+		}
+		occ, err := pg.createOccurrenceRetryingID(ctx, pID, uID, ids[i], o)
+		if status.Code(err) == codes.AlreadyExists {
 			// Occurrence already exists, skipping.
 			continue
+		} else if err != nil {
+			errs = append(errs, status.Errorf(status.Code(err), "Occurrence %d of the batch: %s", positions[i], status.Convert(err).Message()))
 		} else {
 			created = append(created, occ)
 		}
 	}
+	if pg.analyzeAfterBatch && len(created) > 0 {
+		pg.analyze(ctx, analyzeOccurrences)
+	}
 
 	return created, errs
 }
 
 // DeleteOccurrence deletes the occurrence with the given pID and oID
 func (pg *PgSQLStore) DeleteOccurrence(ctx context.Context, pID, oID string) error {
-	result, err := pg.DB.ExecContext(ctx, deleteOccurrence, pID, oID)
+	ctx = pg.withQueryTags(ctx, pID)
+	query := deleteOccurrence
+	if pg.softDelete {
+		query = softDeleteOccurrence
+	}
+	result, err := pg.execContext(ctx, query, pID, oID)
 	if err != nil {
-		return status.Error(codes.Internal, "Failed to delete Occurrence from database")
+		return dbError(err, "Failed to delete Occurrence from database")
 	}
 	count, err := result.RowsAffected()
 	if err != nil {
@@ -326,21 +1058,49 @@ func (pg *PgSQLStore) DeleteOccurrence(ctx context.Context, pID, oID string) err
 	return nil
 }
 
-// UpdateOccurrence updates the existing occurrence with the given projectID and occurrenceID
+// UpdateOccurrence updates the existing occurrence with the given projectID and occurrenceID.
+// The fields it changes are reported to the OccurrenceChangeObserver, if one is set.
 func (pg *PgSQLStore) UpdateOccurrence(ctx context.Context, pID, oID string, o *pb.Occurrence, mask *fieldmaskpb.FieldMask) (*pb.Occurrence, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	if o == nil {
+		return nil, nilError("Occurrence")
+	}
 	o = proto.Clone(o).(*pb.Occurrence)
 	// TODO(#312): implement the update operation
-	o.UpdateTime = timestamppb.Now()
+	// Timestamps are stored with microsecond precision.
+	o.UpdateTime = timestamppb.New(time.Now().Truncate(time.Microsecond))
 
-	occurrenceJson, err := protojson.Marshal(o)
+	occurrenceJson, err := marshalJSON(o)
 	if err != nil {
 		log.Printf("Failed to marshal occurrence to json")
 		return nil, status.Error(codes.InvalidArgument, "Failed to marshal occurrence to json")
 	}
+	if err := pg.checkEntitySize("Occurrence", occurrenceJson); err != nil {
+		return nil, err
+	}
 
-	result, err := pg.DB.ExecContext(ctx, updateOccurrence, occurrenceJson, pID, oID)
+	if pg.occurrenceChanges != nil {
+		var oldData []byte
+		err := pg.queryRowContext(ctx, updateOccurrenceReturningOld, occurrenceJson, pID, oID, occurrenceSeverity(o), o.UpdateTime.AsTime(), occurrenceResourceURI(o)).Scan(&oldData)
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+		case err != nil:
+			return nil, dbError(err, "Failed to update Occurrence")
+		}
+		var old pb.Occurrence
+		if err := protojson.Unmarshal(oldData, &old); err != nil {
+			log.Printf("Failed to unmarshal replaced occurrence %q/%q, not reporting changes: %v", pID, oID, err)
+			return o, nil
+		}
+		// The update time always changes and is not reported.
+		pg.occurrenceChanges(ctx, pID, oID, changedFields(&old, o, "update_time"))
+		return o, nil
+	}
+
+	result, err := pg.execContext(ctx, updateOccurrence, occurrenceJson, pID, oID, occurrenceSeverity(o), o.UpdateTime.AsTime(), occurrenceResourceURI(o))
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to update Occurrence")
+		return nil, dbError(err, "Failed to update Occurrence")
 	}
 	count, err := result.RowsAffected()
 	if err != nil {
@@ -352,15 +1112,69 @@ func (pg *PgSQLStore) UpdateOccurrence(ctx context.Context, pID, oID string, o *
 	return o, nil
 }
 
-// GetOccurrence returns the occurrence with pID and oID
+// defaultBatchSize is the number of rows covered by each statement of the batched maintenance
+// operations unless the store is configured with BatchSize.
+const defaultBatchSize = 1000
+
+// PurgeExpiredOccurrences deletes the occurrences of all projects created more than the
+// OccurrenceTTL of the store ago, and returns how many were deleted. It is meant to be run
+// on a schedule and does nothing if the store has no OccurrenceTTL. Occurrences without a
+// creation time, which predate it being promoted to its column, never expire; see
+// RebuildDerivedColumns.
+func (pg *PgSQLStore) PurgeExpiredOccurrences(ctx context.Context) (int64, error) {
+	ctx = pg.withQueryTags(ctx, "")
+	if pg.occurrenceTTL <= 0 {
+		return 0, nil
+	}
+	return pg.purgeInBatches(ctx, "Occurrences", purgeExpiredOccurrences, time.Now().Add(-pg.occurrenceTTL))
+}
+
+// PurgeDeletedOccurrences deletes the occurrences soft-deleted more than the
+// DeletedOccurrenceRetention of the store ago, and returns how many were deleted. It is meant
+// to be run on a schedule and does nothing if the store has no DeletedOccurrenceRetention.
+func (pg *PgSQLStore) PurgeDeletedOccurrences(ctx context.Context) (int64, error) {
+	ctx = pg.withQueryTags(ctx, "")
+	if pg.deletedRetention <= 0 {
+		return 0, nil
+	}
+	return pg.purgeInBatches(ctx, "Occurrences", purgeDeletedOccurrences, time.Now().Add(-pg.deletedRetention))
+}
+
+// purgeInBatches runs the purge query, deleting the entities of kind, e.g. "Occurrences",
+// selected by arg, such as a cutoff time, in batches until the rows to purge are exhausted, and
+// returns how many were deleted.
+func (pg *PgSQLStore) purgeInBatches(ctx context.Context, kind, query string, arg interface{}) (int64, error) {
+	var purged int64
+	for {
+		result, err := pg.execContext(ctx, query, arg, pg.batchSize)
+		if err, ok := err.(*pq.Error); ok && err.Code == "23503" {
+			return purged, status.Errorf(codes.FailedPrecondition, "%s to purge are referenced by entities which are not", kind)
+		}
+		if err != nil {
+			log.Printf("Failed to purge %s: %v", kind, err)
+			return purged, dbError(err, "Failed to purge "+kind)
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			return purged, status.Error(codes.Internal, "Failed to purge "+kind)
+		}
+		purged += count
+		if count < pg.batchSize {
+			return purged, nil
+		}
+	}
+}
+
+// GetOccurrence returns the occurrence with pID and oID. Soft-deleted occurrences are only
+// returned if ctx requests them with WithDeletedOccurrences.
 func (pg *PgSQLStore) GetOccurrence(ctx context.Context, pID, oID string) (*pb.Occurrence, error) {
-	var data []byte
-	err := pg.DB.QueryRowContext(ctx, searchOccurrence, pID, oID).Scan(&data)
+	ctx = pg.withQueryTags(ctx, pID)
+	pID, oID, data, err := pg.searchOccurrence(ctx, pID, oID)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
 	case err != nil:
-		return nil, status.Error(codes.Internal, "Failed to query Occurrence from database")
+		return nil, dbError(err, "Failed to query Occurrence from database")
 	}
 	var o pb.Occurrence
 	if err = protojson.Unmarshal(data, &o); err != nil {
@@ -371,106 +1185,319 @@ func (pg *PgSQLStore) GetOccurrence(ctx context.Context, pID, oID string) (*pb.O
 	return &o, nil
 }
 
+// searchOccurrence returns the stored project and occurrence IDs and the data of the
+// occurrence with pID and oID, matched case-insensitively if the store folds IDs.
+func (pg *PgSQLStore) searchOccurrence(ctx context.Context, pID, oID string) (string, string, []byte, error) {
+	var data []byte
+	if pg.foldIDs {
+		err := pg.queryRowContext(ctx, occurrenceQuery(ctx, searchOccurrenceFolded), pID, oID).Scan(&pID, &oID, &data)
+		return pID, oID, data, err
+	}
+	err := pg.queryRowContext(ctx, occurrenceQuery(ctx, searchOccurrence), pID, oID).Scan(&data)
+	return pID, oID, data, err
+}
+
+// livePredicate is the predicate of the occurrence queries hiding soft-deleted occurrences.
+const livePredicate = " AND deleted_at IS NULL"
+
+// occurrenceQuery returns query, reading live occurrences, without its livePredicate if ctx
+// requests soft-deleted occurrences too.
+func occurrenceQuery(ctx context.Context, query string) string {
+	if !deletedOccurrences(ctx) {
+		return query
+	}
+	return strings.Replace(query, livePredicate, "", 1)
+}
+
+// OccurrenceDeleteTimes returns the deletion times of those of the occurrences oIDs of
+// project pID that are soft-deleted, in a single query, e.g. to mark the deleted ones among
+// the occurrences listed with WithDeletedOccurrences.
+func (pg *PgSQLStore) OccurrenceDeleteTimes(ctx context.Context, pID string, oIDs []string) (map[string]time.Time, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	deleted := map[string]time.Time{}
+	if len(oIDs) == 0 {
+		return deleted, nil
+	}
+	query, keys := occurrenceDeleteTimes, oIDs
+	if pg.foldIDs {
+		query, keys = occurrenceDeleteTimesFolded, make([]string, len(oIDs))
+		for i, oID := range oIDs {
+			keys[i] = strings.ToLower(oID)
+		}
+	}
+	rows, err := pg.queryContext(ctx, query, pID, pq.Array(keys))
+	if err != nil {
+		return nil, dbError(err, "Failed to query Occurrences from database")
+	}
+	defer rows.Close()
+	found := map[string]time.Time{}
+	for rows.Next() {
+		var oID string
+		var deletedAt time.Time
+		if err := rows.Scan(&oID, &deletedAt); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to scan Occurrences rows")
+		}
+		found[oID] = deletedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err, "Failed to query Occurrences from database")
+	}
+	for i, oID := range oIDs {
+		if deletedAt, ok := found[keys[i]]; ok {
+			deleted[oID] = deletedAt
+		}
+	}
+	return deleted, nil
+}
+
+// DecodeCursor returns the id of the last entity of the page that the page token was issued
+// for, i.e. the id the next page resumes after, to diagnose pagination without handing the
+// pagination key to whoever debugs it. Expired tokens are decoded too. It fails with
+// InvalidArgument if the token was not issued with the pagination key of the store, and with
+// PermissionDenied unless the store is configured with EnableDiagnostics.
+func (pg *PgSQLStore) DecodeCursor(token string) (int64, error) {
+	if !pg.diagnostics {
+		return 0, status.Error(codes.PermissionDenied, "Diagnostics are disabled")
+	}
+	c, ok := decodeCursor(token, pg.paginationKey, 0)
+	if !ok {
+		return 0, status.Error(codes.InvalidArgument, "Invalid page token")
+	}
+	return c.ID, nil
+}
+
+// GetRawOccurrence returns the data column of the occurrence with pID and oID as stored,
+// without the proto round trip, e.g. to troubleshoot why a filter does not match it.
+// It fails with PermissionDenied unless the store is configured with EnableDiagnostics.
+func (pg *PgSQLStore) GetRawOccurrence(ctx context.Context, pID, oID string) (string, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	if !pg.diagnostics {
+		return "", status.Error(codes.PermissionDenied, "Diagnostics are disabled")
+	}
+	_, _, data, err := pg.searchOccurrence(ctx, pID, oID)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+	case err != nil:
+		return "", dbError(err, "Failed to query Occurrence from database")
+	}
+	return string(data), nil
+}
+
 // ListOccurrences returns up to pageSize number of occurrences for this project beginning
-// at pageToken, or from start if pageToken is the empty string.
+// at pageToken, or from start if pageToken is the empty string. The occurrences are complete
+// unless ctx requests another view with WithOccurrenceView, and listed in insertion order
+// unless ctx requests another order with WithOccurrenceOrder. Page tokens resume a list in the
+// order they were issued for; those of another order are rejected with InvalidArgument.
+// Soft-deleted occurrences are only listed if ctx requests them with WithDeletedOccurrences.
 func (pg *PgSQLStore) ListOccurrences(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, error) {
-	var filterQuery string
-	if filter != "" {
-		var fs FilterSQL
-		filterQuery = " AND " + fs.ParseFilter(filter)
+	ctx = pg.withQueryTags(ctx, pID)
+	view, order := occurrenceView(ctx), occurrenceOrder(ctx)
+	if view != OccurrenceViewFull && view != OccurrenceViewBasic {
+		return nil, "", status.Errorf(codes.InvalidArgument, "Invalid occurrence view %d", view)
+	}
+	cursor := decryptCursor(pageToken, pg.paginationKey, pg.pageTokenTTL("ListOccurrences"))
+	args := []interface{}{pID, cursor.ID, pageLimit(int64(pageSize))}
+	queries := [2]string{listOccurrences, listOccurrencesBasic}
+	var orderClauses []interface{}
+	switch order {
+	case OccurrenceOrderInsertion:
+		if cursor.CreatedAt != nil || cursor.Severity != nil || cursor.NullSeverity {
+			return nil, "", status.Error(codes.InvalidArgument, "Invalid page token")
+		}
+	case OccurrenceOrderCreateTime:
+		if pageToken != "" && cursor.CreatedAt == nil {
+			return nil, "", status.Error(codes.InvalidArgument, "Invalid page token")
+		}
+		args = []interface{}{pID, cursor.CreatedAt, cursor.ID, pageLimit(int64(pageSize))}
+		queries = [2]string{listOccurrencesByCreateTime, listOccurrencesBasicByCreateTime}
+	case OccurrenceOrderSeverity:
+		// The last occurrence of a page may have no severity, so a token resuming after it has none.
+		if pageToken != "" && cursor.Severity == nil && !cursor.NullSeverity {
+			return nil, "", status.Error(codes.InvalidArgument, "Invalid page token")
+		}
+		args = []interface{}{pID, pageToken != "", cursor.Severity, cursor.ID, pageLimit(int64(pageSize))}
+		queries = [2]string{listOccurrencesBySeverity, listOccurrencesBasicBySeverity}
+		nulls := severityNullsOrders[pg.nullsOrder]
+		orderClauses = []interface{}{nulls[0], nulls[1]}
+	default:
+		return nil, "", status.Errorf(codes.InvalidArgument, "Invalid occurrence order %d", order)
+	}
+	filterQuery, filterArgs, err := pg.filterClause(filter, occurrenceColumns, len(args))
+	if err != nil {
+		return nil, "", err
 	}
-
-	query := fmt.Sprintf(listOccurrences, filterQuery)
-	id := decryptInt64(pageToken, pg.paginationKey, 0)
-	rows, err := pg.DB.QueryContext(ctx, query, pID, id, pageSize)
+	query := fmt.Sprintf(occurrenceQuery(ctx, queries[view]), append([]interface{}{filterQuery}, orderClauses...)...)
+	rows, err := pg.queryContext(ctx, query, append(args, filterArgs...)...)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to list Occurrences from database")
+		return nil, "", dbError(err, "Failed to list Occurrences from database")
 	}
+	defer rows.Close()
 
 	var os []*pb.Occurrence
-	var lastID int64
+	var last pageCursor
+	budget := pageBudget{max: pg.maxPageBytes}
+	var full bool
 	for rows.Next() {
+		if full || len(os) == int(pageSize) {
+			if order != OccurrenceOrderCreateTime {
+				last.CreatedAt = nil
+			}
+			encryptedPage, err := encryptCursor(last, pg.paginationKey)
+			if err != nil {
+				return nil, "", status.Error(codes.Internal, "Failed to paginate occurrences")
+			}
+			return os, encryptedPage, nil
+		}
+		if view == OccurrenceViewBasic {
+			var o *pb.Occurrence
+			if last.ID, o, err = scanBasicOccurrence(rows.Rows, pID); err != nil {
+				return nil, "", err
+			}
+			if o.CreateTime != nil {
+				createdAt := o.CreateTime.AsTime()
+				last.CreatedAt = &createdAt
+			}
+			if order == OccurrenceOrderSeverity {
+				last.setSeverity(occurrenceSeverity(o))
+			}
+			os = append(os, o)
+			continue
+		}
+		var oID string
 		var data []byte
-		err := rows.Scan(&lastID, &data)
+		var severity sql.NullInt64
+		dest := []interface{}{&last.ID, &oID, &data}
+		switch order {
+		case OccurrenceOrderCreateTime:
+			dest = append(dest, &last.CreatedAt)
+		case OccurrenceOrderSeverity:
+			dest = append(dest, &severity)
+		}
+		err := rows.Scan(dest...)
 		if err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to scan Occurrences row")
 		}
+		if order == OccurrenceOrderSeverity {
+			last.setSeverity(severity)
+		}
 		var o pb.Occurrence
 		if err = protojson.Unmarshal(data, &o); err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
 		}
+		// Set the output-only field before returning
+		o.Name = name.FormatOccurrence(pID, oID)
 		os = append(os, &o)
+		full = budget.spend(len(data))
 	}
-	if len(os) == 0 {
-		return os, "", nil
-	}
-	maxQuery := fmt.Sprintf(occurrenceMaxID, filterQuery)
-	maxID, err := pg.max(ctx, maxQuery, pID)
-	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to query max occurrence id from database")
-	}
-	if lastID >= maxID {
-		return os, "", nil
-	}
-	encryptedPage, err := encryptInt64(lastID, pg.paginationKey)
-	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to paginate occurrences")
+	if err := rows.Err(); err != nil {
+		return nil, "", dbError(err, "Failed to list Occurrences from database")
 	}
-	return os, encryptedPage, nil
+	return os, "", nil
 }
 
 // CreateNote adds the specified note
 func (pg *PgSQLStore) CreateNote(ctx context.Context, pID, nID, uID string, n *pb.Note) (*pb.Note, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	if n == nil {
+		return nil, nilError("Note")
+	}
 	n = proto.Clone(n).(*pb.Note)
 	nName := name.FormatNote(pID, nID)
 	n.Name = nName
 	n.CreateTime = timestamppb.Now()
 
-	noteJson, err := protojson.Marshal(n)
+	noteJson, err := marshalJSON(n)
 	if err != nil {
 		log.Printf("Failed to marshal note to json")
 		return nil, status.Error(codes.InvalidArgument, "Failed to marshal note to json")
 	}
+	if err := pg.checkEntitySize("Note", noteJson); err != nil {
+		return nil, err
+	}
 
-	_, err = pg.DB.ExecContext(ctx, insertNote, pID, nID, noteJson)
+	createdBy := sql.NullString{String: uID, Valid: uID != ""}
+	_, err = pg.execContext(ctx, insertNote, pID, nID, noteJson, createdBy)
 	if err, ok := err.(*pq.Error); ok {
 		// Check for unique_violation
 		if err.Code == "23505" {
 			return nil, status.Errorf(codes.AlreadyExists, "Note with name %q already exists", n.Name)
 		}
 		log.Println("Failed to insert Note in database", err)
-		return nil, status.Error(codes.Internal, "Failed to insert Note in database")
+		return nil, dbError(err, "Failed to insert Note in database")
+	}
+	if err != nil {
+		return nil, dbError(err, "Failed to insert Note in database")
 	}
 	return n, nil
 }
 
 // BatchCreateNotes batch creates the specified notes in memstore.
+// Nil notes are not created, and reported as InvalidArgument errors. Notes that already exist
+// are skipped; the other notes that fail to be created are reported with their error.
 func (pg *PgSQLStore) BatchCreateNotes(ctx context.Context, pID, uID string, notes map[string]*pb.Note) ([]*pb.Note, []error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	var nilIDs []string
 	clonedNotes := map[string]*pb.Note{}
 	for nID, n := range notes {
+		if n == nil {
+			nilIDs = append(nilIDs, nID)
+			continue
+		}
 		clonedNotes[nID] = proto.Clone(n).(*pb.Note)
 	}
 	notes = clonedNotes
 
-	errs := []error{}
+	nIDs := make([]string, 0, len(notes))
+	for nID := range notes {
+		nIDs = append(nIDs, nID)
+	}
+	sort.Strings(nIDs)
+	dups := pg.newBatchDuplicates("Note")
+	unique := nIDs[:0]
+	for _, nID := range nIDs {
+		if dups.check(name.FormatNote(pID, nID)) {
+			unique = append(unique, nID)
+		}
+	}
+	if err := dups.rejected(); err != nil {
+		return nil, []error{err}
+	}
+
+	sort.Strings(nilIDs)
+	var errs []error
+	for _, nID := range nilIDs {
+		errs = append(errs, status.Errorf(codes.InvalidArgument, "Note %q must not be nil", name.FormatNote(pID, nID)))
+	}
+	errs = append(errs, dups.errs...)
 	created := []*pb.Note{}
-	for nID, n := range notes {
-		note, err := pg.CreateNote(ctx, pID, nID, uID, n)
-		if err != nil {
+	for _, nID := range unique {
+		note, err := pg.CreateNote(ctx, pID, nID, uID, notes[nID])
+		if status.Code(err) == codes.AlreadyExists {
 			// Note already exists, skipping.
 			continue
+		} else if err != nil {
+			errs = append(errs, status.Errorf(status.Code(err), "Note %q of the batch: %s", name.FormatNote(pID, nID), status.Convert(err).Message()))
 		} else {
 			created = append(created, note)
 		}
 	}
+	if pg.analyzeAfterBatch && len(created) > 0 {
+		pg.analyze(ctx, analyzeNotes)
+	}
 	return created, errs
 }
 
 // DeleteNote deletes the note with the given pID and nID
 func (pg *PgSQLStore) DeleteNote(ctx context.Context, pID, nID string) error {
-	result, err := pg.DB.ExecContext(ctx, deleteNote, pID, nID)
+	ctx = pg.withQueryTags(ctx, pID)
+	result, err := pg.execContext(ctx, deleteNote, pID, nID)
+	pg.notes.remove(pg.noteCacheKey(pID, nID))
+	if err, ok := err.(*pq.Error); ok && err.Code == "23503" {
+		return status.Errorf(codes.FailedPrecondition, "Note with name %q/%q is referenced by occurrences", pID, nID)
+	}
 	if err != nil {
-		return status.Error(codes.Internal, "Failed to delete Note from database")
+		return dbError(err, "Failed to delete Note from database")
 	}
 	count, err := result.RowsAffected()
 	if err != nil {
@@ -484,21 +1511,29 @@ func (pg *PgSQLStore) DeleteNote(ctx context.Context, pID, nID string) error {
 
 // UpdateNote updates the existing note with the given pID and nID
 func (pg *PgSQLStore) UpdateNote(ctx context.Context, pID, nID string, n *pb.Note, mask *fieldmaskpb.FieldMask) (*pb.Note, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	if n == nil {
+		return nil, nilError("Note")
+	}
 	n = proto.Clone(n).(*pb.Note)
 	nName := name.FormatNote(pID, nID)
 	n.Name = nName
 	// TODO(#312): implement the update operation
 	n.UpdateTime = timestamppb.Now()
 
-	noteJson, err := protojson.Marshal(n)
+	noteJson, err := marshalJSON(n)
 	if err != nil {
 		log.Printf("Failed to marshal note to json")
 		return nil, status.Error(codes.InvalidArgument, "Failed to marshal note to json")
 	}
+	if err := pg.checkEntitySize("Note", noteJson); err != nil {
+		return nil, err
+	}
 
-	result, err := pg.DB.ExecContext(ctx, updateNote, noteJson, pID, nID)
+	result, err := pg.execContext(ctx, updateNote, noteJson, pID, nID)
+	pg.notes.remove(pg.noteCacheKey(pID, nID))
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to update Note")
+		return nil, dbError(err, "Failed to update Note")
 	}
 	count, err := result.RowsAffected()
 	if err != nil {
@@ -510,15 +1545,29 @@ func (pg *PgSQLStore) UpdateNote(ctx context.Context, pID, nID string, n *pb.Not
 	return n, nil
 }
 
-// GetNote returns the note with project (pID) and note ID (nID)
+// GetNote returns the note with project (pID) and note ID (nID). The note may be served from
+// the note cache, unless ctx requests strong consistency (see WithStrongConsistency).
 func (pg *PgSQLStore) GetNote(ctx context.Context, pID, nID string) (*pb.Note, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	cPID, cNID := pg.noteCacheKey(pID, nID)
+	if !strongConsistency(ctx) {
+		if n, ok := pg.notes.get(cPID, cNID); ok {
+			return n, nil
+		}
+	}
+	gen := pg.notes.generation()
 	var data []byte
-	err := pg.DB.QueryRowContext(ctx, searchNote, pID, nID).Scan(&data)
+	var err error
+	if pg.foldIDs {
+		err = pg.queryRowContext(ctx, searchNoteFolded, pID, nID).Scan(&pID, &nID, &data)
+	} else {
+		err = pg.queryRowContext(ctx, searchNote, pID, nID).Scan(&data)
+	}
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, status.Errorf(codes.NotFound, "Note with name %q/%q does not Exist", pID, nID)
 	case err != nil:
-		return nil, status.Error(codes.Internal, "Failed to query Note from database")
+		return nil, dbError(err, "Failed to query Note from database")
 	}
 	var note pb.Note
 	if err = protojson.Unmarshal(data, &note); err != nil {
@@ -526,11 +1575,60 @@ func (pg *PgSQLStore) GetNote(ctx context.Context, pID, nID string) (*pb.Note, e
 	}
 	// Set the output-only field before returning
 	note.Name = name.FormatNote(pID, nID)
+	pg.notes.add(cPID, cNID, &note, gen)
 	return &note, nil
 }
 
-// GetOccurrenceNote gets the note for the specified occurrence from PostgreSQL.
+// noteCacheKey returns the IDs the note with pID and nID is cached under. They are
+// lowercased if the store folds IDs, so that all case variants share one entry.
+func (pg *PgSQLStore) noteCacheKey(pID, nID string) (string, string) {
+	if pg.foldIDs {
+		return strings.ToLower(pID), strings.ToLower(nID)
+	}
+	return pID, nID
+}
+
+// NotesExist reports, for each of the note IDs nIDs, whether the note exists in project pID,
+// in a single query, e.g. to validate the notes referenced by a batch of occurrences.
+func (pg *PgSQLStore) NotesExist(ctx context.Context, pID string, nIDs []string) (map[string]bool, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	exist := make(map[string]bool, len(nIDs))
+	if len(nIDs) == 0 {
+		return exist, nil
+	}
+	query, keys := notesExist, nIDs
+	if pg.foldIDs {
+		query, keys = notesExistFolded, make([]string, len(nIDs))
+		for i, nID := range nIDs {
+			keys[i] = strings.ToLower(nID)
+		}
+	}
+	rows, err := pg.queryContext(ctx, query, pID, pq.Array(keys))
+	if err != nil {
+		return nil, dbError(err, "Failed to query Notes from database")
+	}
+	defer rows.Close()
+	found := map[string]bool{}
+	for rows.Next() {
+		var nID string
+		if err := rows.Scan(&nID); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to scan Notes rows")
+		}
+		found[nID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err, "Failed to query Notes from database")
+	}
+	for i, nID := range nIDs {
+		exist[nID] = found[keys[i]]
+	}
+	return exist, nil
+}
+
+// GetOccurrenceNote gets the note for the specified occurrence from PostgreSQL. It fails with
+// NotFound if the occurrence does not exist, and with FailedPrecondition if its note does not.
 func (pg *PgSQLStore) GetOccurrenceNote(ctx context.Context, pID, oID string) (*pb.Note, error) {
+	ctx = pg.withQueryTags(ctx, pID)
 	o, err := pg.GetOccurrence(ctx, pID, oID)
 	if err != nil {
 		return nil, err
@@ -541,6 +1639,10 @@ func (pg *PgSQLStore) GetOccurrenceNote(ctx context.Context, pID, oID string) (*
 		return nil, status.Error(codes.InvalidArgument, "Invalid Note name")
 	}
 	n, err := pg.GetNote(ctx, nPID, nID)
+	if status.Code(err) == codes.NotFound {
+		// The occurrence exists: report the dangling reference rather than a missing entity.
+		return nil, status.Errorf(codes.FailedPrecondition, "Occurrence %q references missing note %q", o.Name, o.NoteName)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -552,24 +1654,35 @@ func (pg *PgSQLStore) GetOccurrenceNote(ctx context.Context, pID, oID string) (*
 // ListNotes returns up to pageSize number of notes for this project (pID) beginning
 // at pageToken (or from start if pageToken is the empty string).
 func (pg *PgSQLStore) ListNotes(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Note, string, error) {
-	var filterQuery string
-	if filter != "" {
-		var fs FilterSQL
-		filterQuery = " AND " + fs.ParseFilter(filter)
+	ctx = pg.withQueryTags(ctx, pID)
+	filterQuery, filterArgs, err := pg.filterClause(filter, nil, 3)
+	if err != nil {
+		return nil, "", err
 	}
 
 	query := fmt.Sprintf(listNotes, filterQuery)
-	id := decryptInt64(pageToken, pg.paginationKey, 0)
-	rows, err := pg.DB.QueryContext(ctx, query, pID, id, pageSize)
+	id := decryptCursor(pageToken, pg.paginationKey, pg.pageTokenTTL("ListNotes")).ID
+	rows, err := pg.queryContext(ctx, query, append([]interface{}{pID, id, pageLimit(int64(pageSize))}, filterArgs...)...)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to list Notes from database")
+		return nil, "", dbError(err, "Failed to list Notes from database")
 	}
+	defer rows.Close()
 
 	var ns []*pb.Note
 	var lastID int64
+	budget := pageBudget{max: pg.maxPageBytes}
+	var full bool
 	for rows.Next() {
+		if full || len(ns) == int(pageSize) {
+			encryptedPage, err := encryptCursor(pageCursor{ID: lastID}, pg.paginationKey)
+			if err != nil {
+				return nil, "", status.Error(codes.Internal, "Failed to paginate notes")
+			}
+			return ns, encryptedPage, nil
+		}
+		var nID string
 		var data []byte
-		err := rows.Scan(&lastID, &data)
+		err := rows.Scan(&lastID, &nID, &data)
 		if err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to scan Notes row")
 		}
@@ -577,44 +1690,48 @@ func (pg *PgSQLStore) ListNotes(ctx context.Context, pID, filter, pageToken stri
 		if err = protojson.Unmarshal(data, &n); err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to unmarshal Note from database")
 		}
+		// Set the output-only field before returning
+		n.Name = name.FormatNote(pID, nID)
 		ns = append(ns, &n)
+		full = budget.spend(len(data))
 	}
-	if len(ns) == 0 {
-		return ns, "", nil
-	}
-	maxQuery := fmt.Sprintf(notesMaxID, filterQuery)
-	maxID, err := pg.max(ctx, maxQuery, pID)
-	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to query max note id from database")
-	}
-	if lastID >= maxID {
-		return ns, "", nil
-	}
-	encryptedPage, err := encryptInt64(lastID, pg.paginationKey)
-	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to paginate notes")
+	if err := rows.Err(); err != nil {
+		return nil, "", dbError(err, "Failed to list Notes from database")
 	}
-	return ns, encryptedPage, nil
+	return ns, "", nil
 }
 
 // ListNoteOccurrences returns up to pageSize number of occurrences on the particular note (nID)
 // for this project (pID) projects beginning at pageToken (or from start if pageToken is the empty string).
+// The occurrences may belong to any project, e.g. for a vulnerability note shared by many projects.
 func (pg *PgSQLStore) ListNoteOccurrences(ctx context.Context, pID, nID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, error) {
+	ctx = pg.withQueryTags(ctx, pID)
 	// Verify that note exists
 	if _, err := pg.GetNote(ctx, pID, nID); err != nil {
 		return nil, "", err
 	}
-	id := decryptInt64(pageToken, pg.paginationKey, 0)
-	rows, err := pg.DB.QueryContext(ctx, listNoteOccurrences, pID, nID, id, pageSize)
+	id := decryptCursor(pageToken, pg.paginationKey, pg.pageTokenTTL("ListNoteOccurrences")).ID
+	rows, err := pg.queryContext(ctx, listNoteOccurrences, pID, nID, id, pageLimit(int64(pageSize)))
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to list Occurrences from database")
+		return nil, "", dbError(err, "Failed to list Occurrences from database")
 	}
+	defer rows.Close()
 
 	var os []*pb.Occurrence
 	var lastID int64
+	budget := pageBudget{max: pg.maxPageBytes}
+	var full bool
 	for rows.Next() {
+		if full || len(os) == int(pageSize) {
+			encryptedPage, err := encryptCursor(pageCursor{ID: lastID}, pg.paginationKey)
+			if err != nil {
+				return nil, "", status.Error(codes.Internal, "Failed to paginate note occurrences")
+			}
+			return os, encryptedPage, nil
+		}
+		var oPID, oID string
 		var data []byte
-		err := rows.Scan(&lastID, &data)
+		err := rows.Scan(&lastID, &oPID, &oID, &data)
 		if err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to scan Occurrences row")
 		}
@@ -622,33 +1739,106 @@ func (pg *PgSQLStore) ListNoteOccurrences(ctx context.Context, pID, nID, filter,
 		if err = protojson.Unmarshal(data, &o); err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
 		}
+		// Set the output-only field before returning
+		o.Name = name.FormatOccurrence(oPID, oID)
 		os = append(os, &o)
+		full = budget.spend(len(data))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", dbError(err, "Failed to list Occurrences from database")
 	}
-	if len(os) == 0 {
-		return os, "", nil
+	return os, "", nil
+}
+
+// GetVulnerabilityOccurrencesSummary gets a summary of vulnerability occurrences from storage.
+func (pg *PgSQLStore) GetVulnerabilityOccurrencesSummary(ctx context.Context, projectID, filter string) (*pb.VulnerabilityOccurrencesSummary, error) {
+	return &pb.VulnerabilityOccurrencesSummary{}, nil
+}
+
+// AggregateOccurrences counts the occurrences of project pID matching filter, grouped by the
+// value of groupByField. groupByField must be one of "kind", "resource_uri" or "note_name".
+// Occurrences that lack the field are counted under the empty string.
+func (pg *PgSQLStore) AggregateOccurrences(ctx context.Context, pID, groupByField, filter string) (map[string]int64, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	grouping, ok := occurrenceGroupings[groupByField]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "Occurrences cannot be grouped by %q", groupByField)
+	}
+	filterQuery, filterArgs, err := pg.filterClause(filter, occurrenceColumns, 1)
+	if err != nil {
+		return nil, err
 	}
-	maxID, err := pg.max(ctx, NoteOccurrencesMaxID, pID, nID)
+	query := fmt.Sprintf(aggregateOccurrences, grouping, filterQuery)
+	rows, err := pg.queryContext(ctx, query, append([]interface{}{pID}, filterArgs...)...)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to query max NoteOccurrences from database")
+		log.Println("Failed to aggregate Occurrences", err)
+		return nil, dbError(err, "Failed to aggregate Occurrences from database")
+	}
+	defer rows.Close()
+
+	counts := map[string]int64{}
+	for rows.Next() {
+		var key string
+		var count int64
+		if err := rows.Scan(&key, &count); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to scan aggregated Occurrences row")
+		}
+		counts[key] = count
 	}
-	if lastID >= maxID {
-		return os, "", nil
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err, "Failed to aggregate Occurrences from database")
 	}
-	encryptedPage, err := encryptInt64(lastID, pg.paginationKey)
+	return counts, nil
+}
+
+// RebuildDerivedColumns repopulates the columns promoted out of the data blobs,
+// e.g. after a column is added or its derivation changes. Rows are updated in
+// batches of consecutive ids, each in its own statement, to avoid holding long locks.
+// Batches that completed before an interruption are skipped when re-run.
+func (pg *PgSQLStore) RebuildDerivedColumns(ctx context.Context) error {
+	ctx = pg.withQueryTags(ctx, "")
+	maxID, err := pg.max(ctx, occurrencesTableMaxID)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to paginate note occurrences")
+		return dbError(err, "Failed to query max occurrence id from database")
+	}
+	query := rebuildDerivedColumnsQuery("occurrences", occurrenceDerivedColumns)
+	for lo := int64(0); lo < maxID; lo += pg.batchSize {
+		if _, err := pg.execContext(ctx, query, lo, lo+pg.batchSize); err != nil {
+			log.Println("Failed to rebuild derived occurrence columns", err)
+			return dbError(err, fmt.Sprintf("Failed to rebuild derived occurrence columns after id %d", lo))
+		}
+	}
+	return nil
+}
+
+// AnalyzeTables refreshes the planner statistics of all store tables.
+// It is useful after bulk ingestion or deletion, before autovacuum catches up.
+func (pg *PgSQLStore) AnalyzeTables(ctx context.Context) error {
+	ctx = pg.withQueryTags(ctx, "")
+	queries := []string{analyzeTables}
+	if pg.dialect == dialectCockroach {
+		queries = []string{analyzeProjects, analyzeNotes, analyzeOccurrences}
+	}
+	for _, query := range queries {
+		if _, err := pg.execContext(ctx, query); err != nil {
+			log.Println("Failed to analyze tables", err)
+			return dbError(err, "Failed to analyze tables")
+		}
 	}
-	return os, encryptedPage, nil
+	return nil
 }
 
-// GetVulnerabilityOccurrencesSummary gets a summary of vulnerability occurrences from storage.
-func (pg *PgSQLStore) GetVulnerabilityOccurrencesSummary(ctx context.Context, projectID, filter string) (*pb.VulnerabilityOccurrencesSummary, error) {
-	return &pb.VulnerabilityOccurrencesSummary{}, nil
+// analyze runs the ANALYZE statement query. Failures are logged, not returned,
+// since the preceding batch has already been written.
+func (pg *PgSQLStore) analyze(ctx context.Context, query string) {
+	if _, err := pg.execContext(ctx, query); err != nil {
+		log.Println("Failed to analyze table after batch", err)
+	}
 }
 
 // max returns the max ID of entries for the specified query (assuming SELECT(*) is used)
 func (pg *PgSQLStore) max(ctx context.Context, query string, args ...interface{}) (int64, error) {
-	row := pg.DB.QueryRowContext(ctx, query, args...)
+	row := pg.queryRowContext(ctx, query, args...)
 	var count int64
 	err := row.Scan(&count)
 	if err != nil {
@@ -657,32 +1847,112 @@ func (pg *PgSQLStore) max(ctx context.Context, query string, args ...interface{}
 	return count, err
 }
 
-// encryptInt64 encrypts int64 using provided key
-func encryptInt64(v int64, key string) (string, error) {
+// pageTokenTTL returns how long the page tokens issued by the list method op stay valid,
+// zero if they never expire, which fernet.VerifyAndDecrypt takes as not checking their age.
+func (pg *PgSQLStore) pageTokenTTL(op string) time.Duration {
+	if ttl, ok := pg.pageTokenTTLs[op]; ok {
+		return ttl
+	}
+	return pg.defaultTokenTTL
+}
+
+// pageLimit returns the LIMIT of the query of a list page of pageSize entities.
+//
+// Lists are paginated by keyset: rows are read in id order, and the page token holds the id of
+// the last row of the page, after which the next page resumes. One more row than requested is
+// read, and there is a next page if and only if it is found, so that gaps in the id sequence,
+// left by rolled-back inserts and deletes, cause neither skipped nor repeated rows, whatever
+// the filter. Since ids are assigned on insert rather than on commit, a row committed after a
+// page with a greater id was read is only listed by lists started after.
+func pageLimit(pageSize int64) int64 {
+	if pageSize <= 0 {
+		return pageSize
+	}
+	return pageSize + 1
+}
+
+// pageBudget tracks the size of the stored data of the entities of a list page against the
+// MaxPageBytes of the store.
+type pageBudget struct {
+	max, used int
+}
+
+// spend counts an entity of n bytes and reports whether the page is full. A page always
+// has room for one entity, however large.
+func (b *pageBudget) spend(n int) bool {
+	b.used += n
+	return b.max > 0 && b.used >= b.max
+}
+
+// pageCursor is the position a page token resumes a list at: after the row with id ID or,
+// for lists ordered by creation or update time, after the row created at CreatedAt or updated
+// at UpdatedAt with id ID, so that rows sharing a time are neither skipped nor repeated. Lists
+// ordered by a count resume after the row with Count and id ID, and lists of distinct values
+// after the value Key.
+type pageCursor struct {
+	ID        int64      `json:"id"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	Count     *int64     `json:"count,omitempty"`
+	Key       *string    `json:"key,omitempty"`
+	// Severity is the severity of the last entity of a page ordered by severity, and
+	// NullSeverity is set instead if it has none.
+	Severity     *int64 `json:"severity,omitempty"`
+	NullSeverity bool   `json:"null_severity,omitempty"`
+}
+
+// setSeverity sets the severity of c, or NullSeverity if s is NULL.
+func (c *pageCursor) setSeverity(s sql.NullInt64) {
+	c.Severity, c.NullSeverity = nil, !s.Valid
+	if s.Valid {
+		c.Severity = &s.Int64
+	}
+}
+
+// encryptCursor encrypts c using provided key. Cursors holding only an id are encoded as a bare
+// integer, as page tokens were before cursors became composite, so that instances of either
+// version accept them.
+func encryptCursor(c pageCursor, key string) (string, error) {
 	k, err := fernet.DecodeKey(key)
 	if err != nil {
 		return "", err
 	}
-	bytes, err := fernet.EncryptAndSign([]byte(strconv.FormatInt(v, 10)), k)
+	plain := []byte(strconv.FormatInt(c.ID, 10))
+	if c.CreatedAt != nil || c.UpdatedAt != nil || c.Count != nil || c.Key != nil || c.Severity != nil || c.NullSeverity {
+		if plain, err = json.Marshal(c); err != nil {
+			return "", err
+		}
+	}
+	bytes, err := fernet.EncryptAndSign(plain, k)
 	if err != nil {
 		return "", err
 	}
 	return string(bytes), nil
 }
 
-// decryptInt64 decrypts encrypted int64 using provided key. Returns defaultValue if decryption fails.
-func decryptInt64(encrypted string, key string, defaultValue int64) int64 {
+// decryptCursor decrypts the cursor encrypted using provided key. Returns the zero cursor, the
+// start of the list, if decryption fails or if encrypted was issued more than ttl ago.
+func decryptCursor(encrypted string, key string, ttl time.Duration) pageCursor {
+	c, _ := decodeCursor(encrypted, key, ttl)
+	return c
+}
+
+// decodeCursor is decryptCursor also reporting whether encrypted could be decrypted.
+func decodeCursor(encrypted string, key string, ttl time.Duration) (pageCursor, bool) {
 	k, err := fernet.DecodeKey(key)
 	if err != nil {
-		return defaultValue
+		return pageCursor{}, false
 	}
-	bytes := fernet.VerifyAndDecrypt([]byte(encrypted), time.Hour, []*fernet.Key{k})
+	bytes := fernet.VerifyAndDecrypt([]byte(encrypted), ttl, []*fernet.Key{k})
 	if bytes == nil {
-		return defaultValue
+		return pageCursor{}, false
 	}
-	decryptedValue, err := strconv.ParseInt(string(bytes), 10, 64)
-	if err != nil {
-		return defaultValue
+	if id, err := strconv.ParseInt(string(bytes), 10, 64); err == nil {
+		return pageCursor{ID: id}, true
+	}
+	var c pageCursor
+	if err := json.Unmarshal(bytes, &c); err != nil {
+		return pageCursor{}, false
 	}
-	return decryptedValue
+	return c, true
 }
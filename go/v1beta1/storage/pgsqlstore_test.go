@@ -1,15 +1,30 @@
 package storage
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/fernet/fernet-go"
 	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
 	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"github.com/lib/pq"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -65,12 +80,11 @@ func TestStore_ListProjects(t *testing.T) {
 				}
 				mock.ExpectQuery("SELECT id, name FROM projects").
 					WillReturnRows(rows)
-				mock.ExpectQuery(`SELECT MAX\(id\) FROM projects`).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(len(projectsData))))
-				s := &PgSQLStore{DB: db}
+				s := newStore(db, &Config{})
 				return s, func() { db.Close() }
 			},
-			want: projects,
+			pageSize: 10,
+			want:     projects,
 		},
 		{
 			name: "pagination",
@@ -80,20 +94,40 @@ func TestStore_ListProjects(t *testing.T) {
 					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 				}
 
+				// One more project than requested tells that there is a next page.
 				rows := sqlmock.NewRows([]string{"id", "data"})
-				for i := 0; i < 2; i++ {
+				for i := 0; i < 3; i++ {
 					rows = rows.AddRow(i+1, projectsData[i]) // index id starts from 1
 				}
-				mock.ExpectQuery("SELECT id, name FROM projects").
+				mock.ExpectQuery("SELECT id, name FROM projects").WithArgs(0, 3).
 					WillReturnRows(rows)
-				mock.ExpectQuery(`SELECT MAX\(id\) FROM projects`).
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(len(projectsData))))
-				s := &PgSQLStore{DB: db, paginationKey: paginationKey}
+				s := newStore(db, &Config{PaginationKey: paginationKey})
 				return s, func() { db.Close() }
 			},
+			pageSize:        2,
 			want:            projects[0:2],
 			wantDecryptedID: 2,
 		},
+		{
+			name: "filter",
+			getStore: func(t *testing.T) (*PgSQLStore, func()) {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+
+				// The filter is a conjunct of the WHERE clause, following the cursor.
+				rows := sqlmock.NewRows([]string{"id", "data"}).AddRow(1, projectsData[0])
+				query := fmt.Sprintf("SELECT id, name FROM projects WHERE id > $1 AND (COALESCE(name = '%s', FALSE)) ORDER BY id LIMIT $2", projects[0].Name)
+				mock.ExpectQuery("^"+regexp.QuoteMeta(query)+"$").WithArgs(0, 11).
+					WillReturnRows(rows)
+				s := newStore(db, &Config{PaginationKey: paginationKey})
+				return s, func() { db.Close() }
+			},
+			filter:   fmt.Sprintf("name = %q", projects[0].Name),
+			pageSize: 10,
+			want:     projects[0:1],
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -107,10 +141,1853 @@ func TestStore_ListProjects(t *testing.T) {
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("ListProjects() got = %v, want %v", got, tt.want)
 			}
-			decryptedTokenID := decryptInt64(nextToken, s.paginationKey, 0)
+			decryptedTokenID := decryptCursor(nextToken, s.paginationKey, defaultPageTokenTTL).ID
 			if decryptedTokenID != tt.wantDecryptedID {
 				t.Errorf("ListProjects() got1 = %v, want %v", nextToken, tt.wantDecryptedID)
 			}
 		})
 	}
 }
+
+func TestStore_PreparedStatementCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// The statement is prepared once and reused by both calls.
+	prep := mock.ExpectPrepare(regexp.QuoteMeta(searchOccurrence))
+	for i := 0; i < 2; i++ {
+		prep.ExpectQuery().WithArgs(pid, "oid").
+			WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{}`))
+	}
+	s := newStore(db, &Config{PrepareStatements: true})
+	for i := 0; i < 2; i++ {
+		o, err := s.GetOccurrence(ctx, pid, "oid")
+		if err != nil {
+			t.Fatalf("GetOccurrence() error = %v", err)
+		}
+		if want := name.FormatOccurrence(pid, "oid"); o.Name != want {
+			t.Errorf("GetOccurrence() name = %q, want %q", o.Name, want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_PreparedStatementCacheSkipsFilteredQueries(t *testing.T) {
+	if cacheableQueries[fmt.Sprintf(listOccurrences, " AND (data->>'kind' = 'BUILD')")] {
+		t.Errorf("filtered queries must not be cacheable")
+	}
+	if !cacheableQueries[fmt.Sprintf(listOccurrences, "")] {
+		t.Errorf("unfiltered list query should be cacheable")
+	}
+}
+
+func benchmarkGetOccurrence(b *testing.B, prepared bool) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		b.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	s := newStore(db, &Config{PrepareStatements: prepared})
+	if prepared {
+		prep := mock.ExpectPrepare(regexp.QuoteMeta(searchOccurrence))
+		for i := 0; i < b.N; i++ {
+			prep.ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{}`))
+		}
+	} else {
+		for i := 0; i < b.N; i++ {
+			mock.ExpectQuery(regexp.QuoteMeta(searchOccurrence)).
+				WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{}`))
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.GetOccurrence(ctx, pid, "oid"); err != nil {
+			b.Fatalf("GetOccurrence() error = %v", err)
+		}
+	}
+}
+
+func BenchmarkGetOccurrence(b *testing.B) {
+	b.Run("unprepared", func(b *testing.B) { benchmarkGetOccurrence(b, false) })
+	b.Run("prepared", func(b *testing.B) { benchmarkGetOccurrence(b, true) })
+}
+
+func TestCreateTablesDDL(t *testing.T) {
+	ddl := createTablesDDL("")
+	if strings.Contains(ddl, "TABLESPACE") || strings.Contains(ddl, "%") {
+		t.Errorf("createTablesDDL(\"\") = %s, want no tablespace clause", ddl)
+	}
+
+	ddl = createTablesDDL("fast_ssd")
+	// Every created table and index is placed in the tablespace.
+	created := strings.Count(ddl, "CREATE TABLE") + strings.Count(ddl, "CREATE INDEX") + strings.Count(ddl, "CREATE UNIQUE INDEX")
+	if got := strings.Count(ddl, `) TABLESPACE "fast_ssd";`); got != created {
+		t.Errorf("createTablesDDL() has %d tablespace clauses, want %d:\n%s", got, created, ddl)
+	}
+	// So is the index backing every primary key and unique constraint.
+	constraints := strings.Count(ddl, "PRIMARY KEY") + strings.Count(ddl, "UNIQUE") - strings.Count(ddl, "UNIQUE INDEX")
+	if got := strings.Count(ddl, `USING INDEX TABLESPACE "fast_ssd"`); got != constraints {
+		t.Errorf("createTablesDDL() has %d index tablespace clauses, want %d:\n%s", got, constraints, ddl)
+	}
+}
+
+func TestCreateTablesDDL_ReservedTablespace(t *testing.T) {
+	// Reserved words are quoted, and names folded to lower case as when unquoted.
+	for _, ddl := range []string{createTablesDDL("User"), indexesDDL(createFoldedIndexes, "User")} {
+		if strings.Contains(ddl, "TABLESPACE User") || strings.Contains(ddl, "TABLESPACE user") || !strings.Contains(ddl, `TABLESPACE "user"`) {
+			t.Errorf("DDL does not quote reserved tablespace user:\n%s", ddl)
+		}
+	}
+	if err := validateConfig(&Config{Tablespace: "user"}); err != nil {
+		t.Errorf("validateConfig() with tablespace user error = %v, want nil", err)
+	}
+}
+
+func TestNewPgSQLStore_InvalidTablespace(t *testing.T) {
+	for _, ts := range []string{"fast ssd", "ssd; DROP TABLE notes", `"quoted"`, "1ssd"} {
+		// The tablespace is validated before connecting, so no connector is needed.
+		if _, err := newPgSQLStore(context.Background(), nil, &Config{PaginationKey: paginationKey, Tablespace: ts}); err == nil {
+			t.Errorf("newPgSQLStore() with tablespace %q succeeded, want error", ts)
+		}
+	}
+}
+
+func TestStore_ListNotesSetsName(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// The stored blobs carry an empty and a stale name respectively.
+	mock.ExpectQuery("SELECT id, note_name, data FROM notes").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "note_name", "data"}).
+			AddRow(1, "n1", `{}`).
+			AddRow(2, "n2", `{"name":"projects/other/notes/stale"}`))
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	got, _, err := s.ListNotes(ctx, pid, "", "", 10)
+	if err != nil {
+		t.Fatalf("ListNotes() error = %v", err)
+	}
+	want := []string{name.FormatNote(pid, "n1"), name.FormatNote(pid, "n2")}
+	if len(got) != len(want) {
+		t.Fatalf("ListNotes() returned %d notes, want %d", len(got), len(want))
+	}
+	for i, n := range got {
+		if n.Name != want[i] {
+			t.Errorf("ListNotes()[%d].Name = %q, want %q", i, n.Name, want[i])
+		}
+	}
+}
+
+func TestStore_ListOccurrencesSetsName(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// The stored blobs carry an empty and a drifted name respectively.
+	mock.ExpectQuery("SELECT id, occurrence_name, data FROM occurrences").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "data"}).
+			AddRow(1, "o1", `{}`).
+			AddRow(2, "o2", `{"name":"projects/imported/occurrences/old"}`))
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	got, _, err := s.ListOccurrences(ctx, pid, "", "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() error = %v", err)
+	}
+	want := []string{name.FormatOccurrence(pid, "o1"), name.FormatOccurrence(pid, "o2")}
+	if len(got) != len(want) {
+		t.Fatalf("ListOccurrences() returned %d occurrences, want %d", len(got), len(want))
+	}
+	for i, o := range got {
+		if o.Name != want[i] {
+			t.Errorf("ListOccurrences()[%d].Name = %q, want %q", i, o.Name, want[i])
+		}
+	}
+}
+
+func TestStore_AnalyzeAfterBatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, enabled := range []bool{false, true} {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		mock.ExpectExec("INSERT INTO notes").WillReturnResult(sqlmock.NewResult(1, 1))
+		if enabled {
+			mock.ExpectExec(regexp.QuoteMeta(analyzeNotes)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		s := newStore(db, &Config{AnalyzeAfterBatch: enabled})
+		created, _ := s.BatchCreateNotes(ctx, pid, "", map[string]*pb.Note{nid: {}})
+		if len(created) != 1 {
+			t.Errorf("BatchCreateNotes() created %d notes, want 1", len(created))
+		}
+		// With analyze disabled, an unexpected ANALYZE would fail the mock.
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("analyzeAfterBatch=%v: unfulfilled expectations: %v", enabled, err)
+		}
+		db.Close()
+	}
+}
+
+func TestStore_AnalyzeTables(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	mock.ExpectExec(regexp.QuoteMeta(analyzeTables)).WillReturnResult(sqlmock.NewResult(0, 0))
+	s := newStore(db, &Config{})
+	if err := s.AnalyzeTables(context.Background()); err != nil {
+		t.Fatalf("AnalyzeTables() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// timeArg matches a time.Time argument denoting the same instant.
+type timeArg time.Time
+
+func (a timeArg) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	return ok && t.Equal(time.Time(a))
+}
+
+func TestStore_ListOccurrencesCreateTimeFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	start := timeArg(time.Date(2021, 3, 14, 5, 0, 0, 0, time.UTC))
+	end := timeArg(time.Date(2021, 3, 15, 4, 0, 0, 0, time.UTC))
+	mock.ExpectQuery(regexp.QuoteMeta("AND ((COALESCE(created_at >= $4, FALSE) AND COALESCE(created_at < $5, FALSE)))")).
+		WithArgs(pid, int64(0), int64(11), start, end).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "data"}).AddRow(1, "o1", `{}`))
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	filter := `create_time >= "2021-03-14T00:00:00-05:00" AND create_time < "2021-03-15T00:00:00-04:00"`
+	got, _, err := s.ListOccurrences(ctx, pid, filter, "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() error = %v", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("ListOccurrences() returned %d occurrences, want 1", len(got))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_RebuildDerivedColumns(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	query := rebuildDerivedColumnsQuery("occurrences", occurrenceDerivedColumns)
+	// Nulled columns are stale and get repopulated from the data blob.
+	if !strings.Contains(query, `"created_at" = (data->>'createTime')::timestamptz`) ||
+		!strings.Contains(query, `"created_at" IS DISTINCT FROM (data->>'createTime')::timestamptz`) {
+		t.Fatalf("unexpected rebuild query: %s", query)
+	}
+	// The severity of existing vulnerability occurrences is backfilled from their data.
+	if !strings.Contains(query, `"severity" = `+severityDerivation) {
+		t.Fatalf("rebuild query does not backfill severity: %s", query)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(occurrencesTableMaxID)).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(int64(2500)))
+	for lo := int64(0); lo < 2500; lo += defaultBatchSize {
+		mock.ExpectExec(regexp.QuoteMeta(query)).
+			WithArgs(lo, lo+defaultBatchSize).
+			WillReturnResult(sqlmock.NewResult(0, defaultBatchSize))
+	}
+	s := newStore(db, &Config{})
+	if err := s.RebuildDerivedColumns(context.Background()); err != nil {
+		t.Fatalf("RebuildDerivedColumns() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_BatchSize(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, OccurrenceTTL: "24h", BatchSize: 10})
+
+	query := rebuildDerivedColumnsQuery("occurrences", occurrenceDerivedColumns)
+	mock.ExpectQuery(regexp.QuoteMeta(occurrencesTableMaxID)).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(int64(25)))
+	for _, lo := range []int64{0, 10, 20} {
+		mock.ExpectExec(regexp.QuoteMeta(query)).WithArgs(lo, lo+10).WillReturnResult(sqlmock.NewResult(0, 10))
+	}
+	if err := s.RebuildDerivedColumns(context.Background()); err != nil {
+		t.Fatalf("RebuildDerivedColumns() error = %v", err)
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta(purgeExpiredOccurrences)).WithArgs(sqlmock.AnyArg(), 10).
+		WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectExec(regexp.QuoteMeta(purgeExpiredOccurrences)).WithArgs(sqlmock.AnyArg(), 10).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	if purged, err := s.PurgeExpiredOccurrences(context.Background()); err != nil || purged != 14 {
+		t.Errorf("PurgeExpiredOccurrences() = %d, %v, want 14", purged, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	if err := validateConfig(&Config{BatchSize: -1}); err == nil {
+		t.Error("validateConfig() with a negative batch_size succeeded, want error")
+	}
+}
+
+func TestStore_PoolStats(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(7)
+	s := newStore(db, &Config{})
+	if got := s.PoolStats().MaxOpenConnections; got != 7 {
+		t.Errorf("PoolStats().MaxOpenConnections = %d, want 7", got)
+	}
+}
+
+func TestStore_HealthCheck(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{})
+
+	mock.ExpectPing()
+	if err := s.HealthCheck(context.Background()); err != nil {
+		t.Errorf("HealthCheck() error = %v", err)
+	}
+	mock.ExpectPing().WillReturnError(fmt.Errorf("connection refused"))
+	if err := s.HealthCheck(context.Background()); status.Code(err) != codes.Unavailable {
+		t.Errorf("HealthCheck() error = %v, want Unavailable", err)
+	}
+}
+
+func TestStore_PageTokenTTLPerOperation(t *testing.T) {
+	s := newStore(nil, &Config{
+		PaginationKey: paginationKey,
+		// A token is stale as soon as it is issued for ListNotes, and valid for a day for ListOccurrences.
+		PageTokenTTLs: map[string]string{"ListNotes": "1ns", "ListOccurrences": "24h"},
+	})
+	token, err := encryptCursor(pageCursor{ID: 42}, paginationKey)
+	if err != nil {
+		t.Fatalf("encryptCursor() error = %v", err)
+	}
+	tests := map[string]int64{
+		"ListOccurrences": 42,
+		"ListProjects":    42, // default TTL
+		"ListNotes":       0,  // expired, falls back to the first page
+	}
+	for op, want := range tests {
+		if got := decryptCursor(token, paginationKey, s.pageTokenTTL(op)).ID; got != want {
+			t.Errorf("%s: decryptCursor() = %d, want %d", op, got, want)
+		}
+	}
+}
+
+func TestStore_PageTokenTTLZero(t *testing.T) {
+	token, err := encryptCursor(pageCursor{ID: 42}, paginationKey)
+	if err != nil {
+		t.Fatalf("encryptCursor() error = %v", err)
+	}
+	token = backdateToken(t, token, time.Now().AddDate(0, 0, -30))
+	tests := []struct {
+		desc   string
+		config Config
+		want   int64
+	}{
+		{"default TTL", Config{}, 0},
+		{"no expiry", Config{PageTokenTTL: "0"}, 42},
+		{"no expiry for ListOccurrences", Config{PageTokenTTLs: map[string]string{"ListOccurrences": "0s"}}, 42},
+		{"overridden for ListOccurrences", Config{PageTokenTTL: "0", PageTokenTTLs: map[string]string{"ListOccurrences": "1h"}}, 0},
+	}
+	for _, tt := range tests {
+		tt.config.PaginationKey = paginationKey
+		if err := validateConfig(&tt.config); err != nil {
+			t.Errorf("%s: validateConfig() error = %v", tt.desc, err)
+		}
+		s := newStore(nil, &tt.config)
+		if got := decryptCursor(token, paginationKey, s.pageTokenTTL("ListOccurrences")).ID; got != tt.want {
+			t.Errorf("%s: decryptCursor() = %d, want %d", tt.desc, got, tt.want)
+		}
+	}
+}
+
+// backdateToken returns the fernet token tok as if it had been issued at ts.
+func backdateToken(t *testing.T, tok string, ts time.Time) string {
+	k, err := fernet.DecodeKey(paginationKey)
+	if err != nil {
+		t.Fatalf("DecodeKey() error = %v", err)
+	}
+	b, err := base64.URLEncoding.DecodeString(tok)
+	if err != nil {
+		t.Fatalf("DecodeString() error = %v", err)
+	}
+	// The timestamp follows the version byte, and the HMAC of the rest ends the token.
+	binary.BigEndian.PutUint64(b[1:9], uint64(ts.Unix()))
+	mac := hmac.New(sha256.New, k[:16])
+	mac.Write(b[:len(b)-sha256.Size])
+	copy(b[len(b)-sha256.Size:], mac.Sum(nil))
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+func TestValidateConfig_PageTokenTTL(t *testing.T) {
+	for _, v := range []string{"forever", "-1h"} {
+		if err := validateConfig(&Config{PageTokenTTL: v}); err == nil {
+			t.Errorf("validateConfig() with page_token_ttl %q succeeded, want error", v)
+		}
+	}
+	for _, v := range []string{"0", "30m"} {
+		if err := validateConfig(&Config{PageTokenTTL: v}); err != nil {
+			t.Errorf("validateConfig() with page_token_ttl %q error = %v", v, err)
+		}
+	}
+}
+
+func TestValidateConfig_PageTokenTTLs(t *testing.T) {
+	for _, ttls := range []map[string]string{
+		{"ListOccurrences": "forever"},
+		{"ListOccurrences": "-1h"},
+		{"GetNote": "1h"},
+	} {
+		if err := validateConfig(&Config{PageTokenTTLs: ttls}); err == nil {
+			t.Errorf("validateConfig() with page_token_ttls %v succeeded, want error", ttls)
+		}
+	}
+	if err := validateConfig(&Config{PageTokenTTLs: map[string]string{"ListNoteOccurrences": "90m"}}); err != nil {
+		t.Errorf("validateConfig() error = %v", err)
+	}
+}
+
+func TestValidateConfig_SlowQueryThreshold(t *testing.T) {
+	for _, v := range []string{"slow", "-1s", "0s"} {
+		if err := validateConfig(&Config{SlowQueryThreshold: v}); err == nil {
+			t.Errorf("validateConfig() with slow_query_threshold %q succeeded, want error", v)
+		}
+	}
+	if err := validateConfig(&Config{SlowQueryThreshold: "250ms"}); err != nil {
+		t.Errorf("validateConfig() error = %v", err)
+	}
+}
+
+func TestPgSQLStore_AggregateOccurrences(t *testing.T) {
+	tests := []struct {
+		desc    string
+		field   string
+		filter  string
+		grouped string
+		args    []driver.Value
+		rows    *sqlmock.Rows
+		want    map[string]int64
+	}{
+		{
+			desc:    "by kind",
+			field:   "kind",
+			grouped: "data->>'kind'",
+			args:    []driver.Value{"p1"},
+			rows: sqlmock.NewRows([]string{"key", "count"}).
+				AddRow("VULNERABILITY", 3).
+				AddRow("BUILD", 1).
+				AddRow("", 2),
+			want: map[string]int64{"VULNERABILITY": 3, "BUILD": 1, "": 2},
+		},
+		{
+			desc:    "by resource_uri with filter",
+			field:   "resource_uri",
+			filter:  `create_time >= "2024-01-01T00:00:00Z"`,
+			grouped: "data->'resource'->>'uri'",
+			args:    []driver.Value{"p1", timeArg(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))},
+			rows: sqlmock.NewRows([]string{"key", "count"}).
+				AddRow("https://gcr.io/p1/image@sha256:abc", 5),
+			want: map[string]int64{"https://gcr.io/p1/image@sha256:abc": 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey})
+
+			mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf("SELECT COALESCE(%s, ''), COUNT(*) FROM occurrences", tt.grouped))).
+				WithArgs(tt.args...).
+				WillReturnRows(tt.rows)
+
+			got, err := s.AggregateOccurrences(context.Background(), "p1", tt.field, tt.filter)
+			if err != nil {
+				t.Fatalf("AggregateOccurrences() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AggregateOccurrences() = %v, want %v", got, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestPgSQLStore_AggregateOccurrencesUnsupportedField(t *testing.T) {
+	s := newStore(nil, &Config{PaginationKey: paginationKey})
+	_, err := s.AggregateOccurrences(context.Background(), "p1", "details", "")
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("AggregateOccurrences() error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestPgSQLStore_CreateOccurrenceIdempotencyKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	ctx := WithIdempotencyKey(context.Background(), "scan-42")
+	o := &pb.Occurrence{NoteName: "projects/p1/notes/n1"}
+
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WithArgs("p1", sqlmock.AnyArg(), "p1", "n1", sqlmock.AnyArg(), sqlmock.AnyArg(), "scan-42", nil, sqlmock.AnyArg(), nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	first, err := s.CreateOccurrence(ctx, "p1", "", o)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() error = %v", err)
+	}
+	firstJSON, err := protojson.Marshal(first)
+	if err != nil {
+		t.Fatalf("failed to marshal occurrence: %v", err)
+	}
+	_, oID, err := name.ParseOccurrence(first.Name)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() returned invalid name %q: %v", first.Name, err)
+	}
+
+	// The retry collides with the key of the first create and returns its occurrence.
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "occurrences_idempotency_key_idx"})
+	mock.ExpectQuery(regexp.QuoteMeta(idempotentOccurrence)).
+		WithArgs("p1", "scan-42").
+		WillReturnRows(sqlmock.NewRows([]string{"occurrence_name", "data"}).AddRow(oID, firstJSON))
+	retried, err := s.CreateOccurrence(ctx, "p1", "", o)
+	if err != nil {
+		t.Fatalf("retried CreateOccurrence() error = %v", err)
+	}
+	if !proto.Equal(retried, first) {
+		t.Errorf("retried CreateOccurrence() = %v, want %v", retried, first)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPgSQLStore_CreateOccurrenceWithoutIdempotencyKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WithArgs("p1", sqlmock.AnyArg(), "p1", "n1", sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg(), nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	if _, err := s.CreateOccurrence(context.Background(), "p1", "", &pb.Occurrence{NoteName: "projects/p1/notes/n1"}); err != nil {
+		t.Fatalf("CreateOccurrence() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPgSQLStore_CreateOccurrenceRecordsUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WithArgs("p1", sqlmock.AnyArg(), "p1", "n1", sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg(), nil, "alice", nil).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	if _, err := s.CreateOccurrence(context.Background(), "p1", "alice", &pb.Occurrence{NoteName: "projects/p1/notes/n1"}); err != nil {
+		t.Fatalf("CreateOccurrence() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestPgSQLStore_CreateOccurrenceIDs(t *testing.T) {
+	uuidRE := regexp.MustCompile(`^projects/p1/occurrences/[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	tests := []struct {
+		desc     string
+		gen      OccurrenceIDGenerator
+		format   OccurrenceNameFormatter
+		name     string
+		wantName *regexp.Regexp
+		wantCode codes.Code
+	}{
+		{
+			desc:     "random by default",
+			name:     "projects/p1/occurrences/ignored",
+			wantName: uuidRE,
+		},
+		{
+			desc:     "client supplied",
+			gen:      ClientOccurrenceIDs,
+			name:     "projects/p1/occurrences/sha256-abc",
+			wantName: regexp.MustCompile(`^projects/p1/occurrences/sha256-abc$`),
+		},
+		{
+			desc:     "client generator falls back to random",
+			gen:      ClientOccurrenceIDs,
+			wantName: uuidRE,
+		},
+		{
+			desc:     "client supplied in another project",
+			gen:      ClientOccurrenceIDs,
+			name:     "projects/p2/occurrences/o1",
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc: "invalid generated id",
+			gen: func(string, *pb.Occurrence) (string, error) {
+				return "a/b", nil
+			},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			desc: "custom name format",
+			gen:  ClientOccurrenceIDs,
+			format: func(pID, id string, o *pb.Occurrence) string {
+				return name.FormatOccurrence(pID, strings.ToLower(o.Kind.String())+"-"+id)
+			},
+			name:     "projects/p1/occurrences/o1",
+			wantName: regexp.MustCompile(`^projects/p1/occurrences/note_kind_unspecified-o1$`),
+		},
+		{
+			desc: "formatted name in another project",
+			format: func(_, id string, _ *pb.Occurrence) string {
+				return name.FormatOccurrence("p2", id)
+			},
+			wantCode: codes.Internal,
+		},
+		{
+			desc: "unparsable formatted name",
+			format: func(pID, id string, _ *pb.Occurrence) string {
+				return "occurrences/" + id
+			},
+			wantCode: codes.Internal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey})
+			s.SetOccurrenceIDGenerator(tt.gen)
+			s.SetOccurrenceNameFormatter(tt.format)
+			if tt.wantCode == codes.OK {
+				mock.ExpectQuery("INSERT INTO occurrences").WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+			}
+
+			got, err := s.CreateOccurrence(context.Background(), "p1", "", &pb.Occurrence{Name: tt.name, NoteName: "projects/p1/notes/n1"})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("CreateOccurrence() error = %v, want code %v", err, tt.wantCode)
+			}
+			if err == nil && !tt.wantName.MatchString(got.Name) {
+				t.Errorf("CreateOccurrence() name = %q, want match for %s", got.Name, tt.wantName)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+// recordArg matches any argument, recording it in got.
+type recordArg struct {
+	got *[]driver.Value
+}
+
+func (a recordArg) Match(v driver.Value) bool {
+	*a.got = append(*a.got, v)
+	return true
+}
+
+func TestPgSQLStore_CreateOccurrenceIDCollision(t *testing.T) {
+	taken := &pq.Error{Code: "23505", Constraint: "occurrences_project_name_occurrence_name_key"}
+	tests := []struct {
+		desc       string
+		gen        OccurrenceIDGenerator
+		retries    int
+		collisions int
+		wantCode   codes.Code
+	}{
+		{desc: "random id retried", collisions: 1},
+		{desc: "random id retried up to the limit", retries: 2, collisions: 3, wantCode: codes.AlreadyExists},
+		{desc: "client supplied id not retried", gen: ClientOccurrenceIDs, collisions: 1, wantCode: codes.AlreadyExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey, OccurrenceIDRetries: tt.retries})
+			s.SetOccurrenceIDGenerator(tt.gen)
+			var ids []driver.Value
+			args := []driver.Value{"p1", recordArg{&ids}}
+			for i := 0; i < 10; i++ {
+				args = append(args, sqlmock.AnyArg())
+			}
+			for i := 0; i < tt.collisions; i++ {
+				mock.ExpectQuery("INSERT INTO occurrences").WithArgs(args...).WillReturnError(taken)
+			}
+			if tt.wantCode == codes.OK {
+				mock.ExpectQuery("INSERT INTO occurrences").WithArgs(args...).WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+			}
+
+			o := &pb.Occurrence{Name: "projects/p1/occurrences/o1", NoteName: "projects/p1/notes/n1"}
+			got, err := s.CreateOccurrence(context.Background(), "p1", "", o)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("CreateOccurrence() error = %v, want code %v", err, tt.wantCode)
+			}
+			if err == nil && got.Name != name.FormatOccurrence("p1", ids[len(ids)-1].(string)) {
+				t.Errorf("CreateOccurrence() name = %q, want the last id tried of %v", got.Name, ids)
+			}
+			// Every retry uses a new id.
+			seen := map[driver.Value]bool{}
+			for _, id := range ids {
+				if seen[id] {
+					t.Errorf("CreateOccurrence() tried id %v twice", id)
+				}
+				seen[id] = true
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+// blockingConnector is a connector that never connects, as for a database host dropping packets.
+type blockingConnector struct{}
+
+func (blockingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingConnector) Driver() driver.Driver {
+	return nil
+}
+
+func TestNewStoreWithCustomConnectorContext_CanceledDuringPing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewStoreWithCustomConnectorContext(ctx, blockingConnector{}, paginationKey)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("NewStoreWithCustomConnectorContext() succeeded, want error")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("NewStoreWithCustomConnectorContext() did not return after its context expired")
+	}
+}
+
+func TestStore_ListNoteOccurrencesAcrossProjects(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// A vulnerability note published in one project, referenced by occurrences in three.
+	mock.ExpectQuery("SELECT data FROM notes").
+		WithArgs("cve-feed", "CVE-2021-44228").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{}`))
+	mock.ExpectQuery(regexp.QuoteMeta(listNoteOccurrences)).
+		WithArgs("cve-feed", "CVE-2021-44228", int64(0), int64(11)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "project_name", "occurrence_name", "data"}).
+			AddRow(3, "team-a", "o1", `{"noteName":"projects/cve-feed/notes/CVE-2021-44228"}`).
+			AddRow(7, "team-b", "o2", `{"noteName":"projects/cve-feed/notes/CVE-2021-44228"}`).
+			AddRow(9, "team-c", "o3", `{"noteName":"projects/cve-feed/notes/CVE-2021-44228"}`))
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	got, token, err := s.ListNoteOccurrences(ctx, "cve-feed", "CVE-2021-44228", "", "", 10)
+	if err != nil {
+		t.Fatalf("ListNoteOccurrences() error = %v", err)
+	}
+	if token != "" {
+		t.Errorf("ListNoteOccurrences() token = %q, want none", token)
+	}
+	want := []string{
+		name.FormatOccurrence("team-a", "o1"),
+		name.FormatOccurrence("team-b", "o2"),
+		name.FormatOccurrence("team-c", "o3"),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ListNoteOccurrences() returned %d occurrences, want %d", len(got), len(want))
+	}
+	for i, o := range got {
+		if o.Name != want[i] {
+			t.Errorf("ListNoteOccurrences()[%d].Name = %q, want %q", i, o.Name, want[i])
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestStore_DecodeCursor(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, EnableDiagnostics: true})
+
+	at := time.Unix(1600000000, 0)
+	for _, c := range []pageCursor{{ID: 42}, {ID: 7, CreatedAt: &at}} {
+		token, err := encryptCursor(c, paginationKey)
+		if err != nil {
+			t.Fatalf("encryptCursor() error = %v", err)
+		}
+		if got, err := s.DecodeCursor(token); err != nil || got != c.ID {
+			t.Errorf("DecodeCursor(encryptCursor(%+v)) = %d, %v; want %d", c, got, err, c.ID)
+		}
+	}
+	otherKey := fernet.Key{}
+	if err := otherKey.Generate(); err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	foreign, err := encryptCursor(pageCursor{ID: 42}, otherKey.Encode())
+	if err != nil {
+		t.Fatalf("encryptCursor() error = %v", err)
+	}
+	for _, token := range []string{"garbage", foreign} {
+		if _, err := s.DecodeCursor(token); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("DecodeCursor(%q) = %v, want code InvalidArgument", token, err)
+		}
+	}
+
+	s = newStore(db, &Config{PaginationKey: paginationKey})
+	if _, err := s.DecodeCursor("garbage"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("DecodeCursor() without diagnostics = %v, want code PermissionDenied", err)
+	}
+}
+
+func TestStore_GetRawOccurrence(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Returned verbatim, including fields unknown to the proto and the original spacing.
+	stored := `{"kind": "VULNERABILITY", "legacyField": 1, "noteName": "projects/p1/notes/n1"}`
+	mock.ExpectQuery(regexp.QuoteMeta(searchOccurrence)).
+		WithArgs("p1", "o1").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(stored))
+	s := newStore(db, &Config{PaginationKey: paginationKey, EnableDiagnostics: true})
+	got, err := s.GetRawOccurrence(context.Background(), "p1", "o1")
+	if err != nil {
+		t.Fatalf("GetRawOccurrence() error = %v", err)
+	}
+	if got != stored {
+		t.Errorf("GetRawOccurrence() = %s, want %s", got, stored)
+	}
+
+	s = newStore(db, &Config{PaginationKey: paginationKey})
+	if _, err := s.GetRawOccurrence(context.Background(), "p1", "o1"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("GetRawOccurrence() without diagnostics error = %v, want PermissionDenied", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestStore_ListOccurrencesOrFilterScopedToProject(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Without the parentheses, project_name = $1 AND a OR b would match b in every project.
+	predicate := "project_name = $1 AND deleted_at IS NULL  AND ((COALESCE(data->>'kind' = 'BUILD', FALSE) OR COALESCE(data->>'kind' = 'DEPLOYMENT', FALSE)))"
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE "+predicate+" AND id > $2")).
+		WithArgs(pid, int64(0), int64(11)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "data"}).AddRow(1, "o1", `{}`))
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	if _, _, err := s.ListOccurrences(ctx, pid, `kind="BUILD" OR kind="DEPLOYMENT"`, "", 10); err != nil {
+		t.Fatalf("ListOccurrences() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestStore_GetProjectWithFilter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	ctx := context.Background()
+
+	// Absent.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT TRUE FROM projects WHERE name = $1")).
+		WithArgs("projects/absent").
+		WillReturnRows(sqlmock.NewRows([]string{"match"}))
+	if _, _, err := s.GetProjectWithFilter(ctx, "absent", ""); status.Code(err) != codes.NotFound {
+		t.Errorf("GetProjectWithFilter() of an absent project error = %v, want NotFound", err)
+	}
+
+	// Present, filtered out and matching.
+	predicate := "SELECT COALESCE(name = 'projects/other', FALSE) FROM projects WHERE name = $1"
+	mock.ExpectQuery(regexp.QuoteMeta(predicate)).
+		WithArgs("projects/p1").
+		WillReturnRows(sqlmock.NewRows([]string{"match"}).AddRow(false))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT TRUE FROM projects WHERE name = $1")).
+		WithArgs("projects/p1").
+		WillReturnRows(sqlmock.NewRows([]string{"match"}).AddRow(true))
+	for _, want := range []bool{false, true} {
+		filter := `name="projects/other"`
+		if want {
+			filter = ""
+		}
+		p, matched, err := s.GetProjectWithFilter(ctx, "p1", filter)
+		if err != nil {
+			t.Fatalf("GetProjectWithFilter(%q) error = %v", filter, err)
+		}
+		if p.GetName() != "projects/p1" || matched != want {
+			t.Errorf("GetProjectWithFilter(%q) = %v, %v, want projects/p1, %v", filter, p, matched, want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// countingConnector connects to a sqlmock database, counting the connections opened.
+type countingConnector struct {
+	dsn   string
+	drv   driver.Driver
+	count int32
+}
+
+func (c *countingConnector) Connect(context.Context) (driver.Conn, error) {
+	atomic.AddInt32(&c.count, 1)
+	return c.drv.Open(c.dsn)
+}
+
+func (c *countingConnector) Driver() driver.Driver {
+	return c.drv
+}
+
+func TestNewStoreWithCustomConnectorConfig_PrewarmConns(t *testing.T) {
+	tests := []struct {
+		prewarm, maxOpen int
+		want             int32
+	}{
+		// Without prewarming, only the startup ping connects.
+		{prewarm: 0, maxOpen: 0, want: 1},
+		{prewarm: 5, maxOpen: 0, want: 5},
+		{prewarm: 5, maxOpen: 3, want: 3},
+	}
+	for i, tt := range tests {
+		dsn := fmt.Sprintf("prewarm-%d", i)
+		db, mock, err := sqlmock.NewWithDSN(dsn)
+		if err != nil {
+			t.Fatalf("failed to create sqlmock: %v", err)
+		}
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS projects").WillReturnResult(sqlmock.NewResult(0, 0))
+		connector := &countingConnector{dsn: dsn, drv: db.Driver()}
+
+		s, err := NewStoreWithCustomConnectorConfig(context.Background(), connector, &Config{
+			PaginationKey: paginationKey,
+			PrewarmConns:  tt.prewarm,
+			MaxOpenConns:  tt.maxOpen,
+		})
+		if err != nil {
+			t.Fatalf("NewStoreWithCustomConnectorConfig() error = %v", err)
+		}
+		if got := atomic.LoadInt32(&connector.count); got != tt.want {
+			t.Errorf("prewarm %d, max open %d: opened %d connections, want %d", tt.prewarm, tt.maxOpen, got, tt.want)
+		}
+		if got := int32(s.PoolStats().Idle); got != tt.want {
+			t.Errorf("prewarm %d, max open %d: %d idle connections, want %d", tt.prewarm, tt.maxOpen, got, tt.want)
+		}
+		s.Close()
+		db.Close()
+	}
+}
+
+func TestStore_CreateOccurrenceReturnsStoredCreateTime(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+
+	stored := time.Date(2021, 6, 1, 12, 30, 0, 123456000, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta("RETURNING created_at")).
+		WithArgs("p1", sqlmock.AnyArg(), "p1", "n1", sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg(), nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(stored))
+	got, err := s.CreateOccurrence(context.Background(), "p1", "", &pb.Occurrence{NoteName: "projects/p1/notes/n1"})
+	if err != nil {
+		t.Fatalf("CreateOccurrence() error = %v", err)
+	}
+	if !got.CreateTime.AsTime().Equal(stored) {
+		t.Errorf("CreateOccurrence().CreateTime = %v, want %v", got.CreateTime.AsTime(), stored)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestStore_CaseInsensitiveIDs(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, NoteCacheSize: 10, CaseInsensitiveIDs: true})
+
+	mock.ExpectQuery(regexp.QuoteMeta(searchProjectFolded)).WithArgs("projects/PID").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("projects/pid"))
+	p, err := s.GetProject(ctx, "PID")
+	if err != nil || p.Name != "projects/pid" {
+		t.Errorf("GetProject() = %v, %v; want projects/pid", p, err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(searchOccurrenceFolded)).WithArgs("PID", "OID").
+		WillReturnRows(sqlmock.NewRows([]string{"project_name", "occurrence_name", "data"}).AddRow("pid", "oid", "{}"))
+	o, err := s.GetOccurrence(ctx, "PID", "OID")
+	if err != nil || o.Name != name.FormatOccurrence("pid", "oid") {
+		t.Errorf("GetOccurrence() = %v, %v; want pid/oid", o, err)
+	}
+
+	// Case variants of a note ID resolve to the same row and share a cache entry.
+	mock.ExpectQuery(regexp.QuoteMeta(searchNoteFolded)).WithArgs(pid, "CVE-2021-1234").
+		WillReturnRows(sqlmock.NewRows([]string{"project_name", "note_name", "data"}).AddRow(pid, "cve-2021-1234", "{}"))
+	for _, nID := range []string{"CVE-2021-1234", "cve-2021-1234"} {
+		n, err := s.GetNote(ctx, pid, nID)
+		if err != nil || n.Name != name.FormatNote(pid, "cve-2021-1234") {
+			t.Errorf("GetNote(%q) = %v, %v; want cve-2021-1234", nID, n, err)
+		}
+	}
+	// Updating any case variant invalidates the shared entry.
+	mock.ExpectExec(regexp.QuoteMeta(updateNote)).WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err := s.UpdateNote(ctx, pid, "Cve-2021-1234", &pb.Note{}, nil); err != nil {
+		t.Fatalf("UpdateNote() error = %v", err)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(searchNoteFolded)).WithArgs(pid, "cve-2021-1234").
+		WillReturnRows(sqlmock.NewRows([]string{"project_name", "note_name", "data"}))
+	if _, err := s.GetNote(ctx, pid, "cve-2021-1234"); status.Code(err) != codes.NotFound {
+		t.Errorf("GetNote() error = %v, want NotFound", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestNewStoreWithCustomConnectorConfig_CaseInsensitiveIDs(t *testing.T) {
+	for i, fold := range []bool{false, true} {
+		dsn := fmt.Sprintf("fold-%d", i)
+		db, mock, err := sqlmock.NewWithDSN(dsn)
+		if err != nil {
+			t.Fatalf("failed to create sqlmock: %v", err)
+		}
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS projects").WillReturnResult(sqlmock.NewResult(0, 0))
+		if fold {
+			mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX IF NOT EXISTS projects_folded_name_idx")).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		connector := &countingConnector{dsn: dsn, drv: db.Driver()}
+		s, err := NewStoreWithCustomConnectorConfig(context.Background(), connector, &Config{
+			PaginationKey:      paginationKey,
+			CaseInsensitiveIDs: fold,
+		})
+		if err != nil {
+			t.Fatalf("NewStoreWithCustomConnectorConfig() error = %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("case-insensitive %v: unfulfilled expectations: %v", fold, err)
+		}
+		s.Close()
+		db.Close()
+	}
+}
+
+func TestStore_NotesExist(t *testing.T) {
+	tests := []struct {
+		desc  string
+		fold  bool
+		query string
+		nIDs  []string
+		arg   string
+		rows  []string
+		want  map[string]bool
+	}{
+		{
+			desc:  "mixed",
+			query: notesExist,
+			nIDs:  []string{"n1", "n2", "n3"},
+			arg:   `{"n1","n2","n3"}`,
+			rows:  []string{"n1", "n3"},
+			want:  map[string]bool{"n1": true, "n2": false, "n3": true},
+		},
+		{
+			desc:  "none exist",
+			query: notesExist,
+			nIDs:  []string{"n1"},
+			arg:   `{"n1"}`,
+			want:  map[string]bool{"n1": false},
+		},
+		{
+			desc:  "case-insensitive",
+			fold:  true,
+			query: notesExistFolded,
+			nIDs:  []string{"CVE-1", "cve-2"},
+			arg:   `{"cve-1","cve-2"}`,
+			rows:  []string{"cve-1"},
+			want:  map[string]bool{"CVE-1": true, "cve-2": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey, CaseInsensitiveIDs: tt.fold})
+			rows := sqlmock.NewRows([]string{"note_name"})
+			for _, r := range tt.rows {
+				rows.AddRow(r)
+			}
+			mock.ExpectQuery(regexp.QuoteMeta(tt.query)).WithArgs(pid, tt.arg).WillReturnRows(rows)
+			got, err := s.NotesExist(context.Background(), pid, tt.nIDs)
+			if err != nil {
+				t.Fatalf("NotesExist() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NotesExist() = %v, want %v", got, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestStore_NotesExistEmpty(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	got, err := s.NotesExist(context.Background(), pid, nil)
+	if err != nil || len(got) != 0 {
+		t.Errorf("NotesExist(nil) = %v, %v; want empty", got, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// cutoffArg matches a time argument within the window of [from, to], recording it.
+type cutoffArg struct {
+	from, to time.Time
+	got      *time.Time
+}
+
+func (a cutoffArg) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	*a.got = t
+	return ok && !t.Before(a.from) && !t.After(a.to)
+}
+
+func TestStore_PurgeExpiredOccurrences(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, OccurrenceTTL: "24h"})
+
+	start := time.Now()
+	var cutoff time.Time
+	arg := cutoffArg{from: start.Add(-24 * time.Hour), to: start.Add(-24*time.Hour + time.Minute), got: &cutoff}
+	// A full batch is followed by another until fewer rows are left.
+	mock.ExpectExec(regexp.QuoteMeta(purgeExpiredOccurrences)).WithArgs(arg, defaultBatchSize).
+		WillReturnResult(sqlmock.NewResult(0, defaultBatchSize))
+	mock.ExpectExec(regexp.QuoteMeta(purgeExpiredOccurrences)).WithArgs(arg, defaultBatchSize).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	purged, err := s.PurgeExpiredOccurrences(context.Background())
+	if err != nil {
+		t.Fatalf("PurgeExpiredOccurrences() error = %v", err)
+	}
+	if purged != defaultBatchSize+3 {
+		t.Errorf("PurgeExpiredOccurrences() = %d, want %d", purged, defaultBatchSize+3)
+	}
+	for _, age := range []struct {
+		age     time.Duration
+		expired bool
+	}{
+		{age: time.Minute, expired: false},
+		{age: 23 * time.Hour, expired: false},
+		{age: 25 * time.Hour, expired: true},
+		{age: 30 * 24 * time.Hour, expired: true},
+	} {
+		if expired := start.Add(-age.age).Before(cutoff); expired != age.expired {
+			t.Errorf("occurrence created %v ago: expired = %v, want %v", age.age, expired, age.expired)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_PurgeProject(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, BatchSize: 2, NoteCacheSize: 10})
+	s.notes.add(pid, nid, &pb.Note{}, s.notes.generation())
+	s.notes.add("other", nid, &pb.Note{}, s.notes.generation())
+
+	// Occurrences, then notes, are deleted in batches until fewer rows than a batch are left.
+	for _, n := range []int64{2, 2, 1} {
+		mock.ExpectExec(regexp.QuoteMeta(purgeProjectOccurrences)).WithArgs(pid, 2).
+			WillReturnResult(sqlmock.NewResult(0, n))
+	}
+	for _, n := range []int64{2, 0} {
+		mock.ExpectExec(regexp.QuoteMeta(purgeProjectNotes)).WithArgs(pid, 2).
+			WillReturnResult(sqlmock.NewResult(0, n))
+	}
+	mock.ExpectExec(regexp.QuoteMeta(deleteProject)).WithArgs("projects/" + pid).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	occurrences, notes, err := s.PurgeProject(context.Background(), pid)
+	if err != nil {
+		t.Fatalf("PurgeProject() error = %v", err)
+	}
+	if occurrences != 5 || notes != 2 {
+		t.Errorf("PurgeProject() = %d occurrences, %d notes; want 5, 2", occurrences, notes)
+	}
+	if _, ok := s.notes.get(pid, nid); ok {
+		t.Error("PurgeProject() left a purged note in the cache")
+	}
+	if _, ok := s.notes.get("other", nid); !ok {
+		t.Error("PurgeProject() removed the note of another project from the cache")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_PurgeProjectInterrupted(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, BatchSize: 2})
+
+	// The first batch is kept when the second fails, and the project is not deleted.
+	mock.ExpectExec(regexp.QuoteMeta(purgeProjectOccurrences)).WithArgs(pid, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(purgeProjectOccurrences)).WithArgs(pid, 2).
+		WillReturnError(&pq.Error{Code: "57014"})
+	occurrences, _, err := s.PurgeProject(context.Background(), pid)
+	if status.Code(err) != codes.Internal || occurrences != 2 {
+		t.Errorf("PurgeProject() = %d occurrences, %v; want 2, Internal", occurrences, err)
+	}
+
+	// A rerun resumes; notes referenced by other projects stop it.
+	mock.ExpectExec(regexp.QuoteMeta(purgeProjectOccurrences)).WithArgs(pid, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(purgeProjectNotes)).WithArgs(pid, 2).
+		WillReturnError(&pq.Error{Code: "23503"})
+	occurrences, _, err = s.PurgeProject(context.Background(), pid)
+	if status.Code(err) != codes.FailedPrecondition || occurrences != 1 {
+		t.Errorf("PurgeProject() = %d occurrences, %v; want 1, FailedPrecondition", occurrences, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_PurgeExpiredOccurrencesWithoutTTL(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	if purged, err := s.PurgeExpiredOccurrences(context.Background()); purged != 0 || err != nil {
+		t.Errorf("PurgeExpiredOccurrences() = %d, %v; want 0, nil", purged, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+	if err := validateConfig(&Config{OccurrenceTTL: "-1h"}); err == nil {
+		t.Errorf("validateConfig() with occurrence_ttl -1h succeeded, want error")
+	}
+}
+
+func TestStore_CreateOccurrenceMissingNote(t *testing.T) {
+	// A note absent at insert time leaves note_id NULL; a note deleted concurrently
+	// fails the foreign key check.
+	for _, code := range []pq.ErrorCode{"23502", "23503"} {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		s := newStore(db, &Config{PaginationKey: paginationKey})
+		mock.ExpectQuery("INSERT INTO occurrences").WillReturnError(&pq.Error{Code: code})
+		o := &pb.Occurrence{NoteName: name.FormatNote(pid, nid)}
+		if _, err := s.CreateOccurrence(context.Background(), pid, "", o); status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("CreateOccurrence() with error %s = %v, want FailedPrecondition", code, err)
+		}
+		db.Close()
+	}
+}
+
+func TestStore_ConcurrentCreateOccurrenceAndDeleteNote(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	mock.MatchExpectationsInOrder(false)
+
+	// The database serializes the racing statements through the note row lock taken by the
+	// foreign key check: whichever statement runs second fails, whatever the order.
+	const creates = 8
+	for i := 0; i < creates; i++ {
+		mock.ExpectQuery("INSERT INTO occurrences").
+			WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	}
+	mock.ExpectExec(regexp.QuoteMeta(deleteNote)).WithArgs(pid, nid).WillReturnError(&pq.Error{Code: "23503"})
+
+	errs := make(chan error, creates+1)
+	for i := 0; i < creates; i++ {
+		go func() {
+			_, err := s.CreateOccurrence(context.Background(), pid, "", &pb.Occurrence{NoteName: name.FormatNote(pid, nid)})
+			errs <- err
+		}()
+	}
+	go func() { errs <- s.DeleteNote(context.Background(), pid, nid) }()
+	failed := 0
+	for i := 0; i < creates+1; i++ {
+		switch err := <-errs; status.Code(err) {
+		case codes.OK:
+		case codes.FailedPrecondition:
+			failed++
+		default:
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("%d calls failed with FailedPrecondition, want only DeleteNote", failed)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestAssembleDSN(t *testing.T) {
+	base := Config{Host: "db", DBName: "grafeas", User: "u", Password: "p", SSLMode: "disable"}
+	withTimeout := base
+	withTimeout.ConnectTimeoutSeconds = 3
+	withCert := base
+	withCert.SSLRootCert = "/etc/ca.pem"
+	tests := []struct {
+		desc string
+		c    Config
+		want string
+	}{
+		{"default timeout", base, "host=db dbname=grafeas user=u password=p sslmode=disable connect_timeout=10"},
+		{"timeout", withTimeout, "host=db dbname=grafeas user=u password=p sslmode=disable connect_timeout=3"},
+		{"root cert", withCert, "host=db dbname=grafeas user=u password=p sslmode=disable connect_timeout=10 sslrootcert=/etc/ca.pem"},
+	}
+	for _, tt := range tests {
+		if got := assembleDSN(tt.c); got != tt.want {
+			t.Errorf("%s: assembleDSN() = %q, want %q", tt.desc, got, tt.want)
+		}
+	}
+	if err := validateConfig(&Config{ConnectTimeoutSeconds: -1}); err == nil {
+		t.Errorf("validateConfig() with connect_timeout_seconds -1 succeeded, want error")
+	}
+}
+
+func TestPageCursor(t *testing.T) {
+	// Rows sharing a creation time are told apart by their ids.
+	ts := time.Date(2021, 6, 1, 12, 0, 0, 123456000, time.UTC)
+	cursors := []pageCursor{
+		{ID: 7},
+		{ID: 7, CreatedAt: &ts},
+		{ID: 8, CreatedAt: &ts},
+	}
+	tokens := map[string]bool{}
+	for _, c := range cursors {
+		token, err := encryptCursor(c, paginationKey)
+		if err != nil {
+			t.Fatalf("encryptCursor(%v) error = %v", c, err)
+		}
+		got := decryptCursor(token, paginationKey, defaultPageTokenTTL)
+		if !reflect.DeepEqual(got, c) {
+			t.Errorf("decryptCursor(encryptCursor(%v)) = %v", c, got)
+		}
+		tokens[fmt.Sprint(got.ID, got.CreatedAt)] = true
+	}
+	if len(tokens) != len(cursors) {
+		t.Errorf("%d cursors decrypted to %d distinct positions", len(cursors), len(tokens))
+	}
+}
+
+func TestPageCursor_LegacyTokens(t *testing.T) {
+	k, err := fernet.DecodeKey(paginationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Page tokens issued before cursors became composite hold a bare id.
+	legacy, err := fernet.EncryptAndSign([]byte("42"), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decryptCursor(string(legacy), paginationKey, defaultPageTokenTTL); !reflect.DeepEqual(got, pageCursor{ID: 42}) {
+		t.Errorf("decryptCursor(legacy token) = %v, want id 42", got)
+	}
+	// Id-only cursors are still issued in that form.
+	token, err := encryptCursor(pageCursor{ID: 42}, paginationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fernet.VerifyAndDecrypt([]byte(token), defaultPageTokenTTL, []*fernet.Key{k})); got != "42" {
+		t.Errorf("encryptCursor() encrypted %q, want %q", got, "42")
+	}
+	garbled, err := fernet.EncryptAndSign([]byte(`{"id":`), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decryptCursor(string(garbled), paginationKey, defaultPageTokenTTL); !reflect.DeepEqual(got, pageCursor{}) {
+		t.Errorf("decryptCursor(garbled token) = %v, want the zero cursor", got)
+	}
+}
+
+func TestStore_SoftDeleteOccurrence(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	s := newStore(db, &Config{PaginationKey: paginationKey, SoftDeleteOccurrences: true})
+
+	mock.ExpectExec(regexp.QuoteMeta(softDeleteOccurrence)).WithArgs(pid, "o1").WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.DeleteOccurrence(ctx, pid, "o1"); err != nil {
+		t.Fatalf("DeleteOccurrence() error = %v", err)
+	}
+	// Deleting it again finds no visible occurrence.
+	mock.ExpectExec(regexp.QuoteMeta(softDeleteOccurrence)).WithArgs(pid, "o1").WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := s.DeleteOccurrence(ctx, pid, "o1"); status.Code(err) != codes.NotFound {
+		t.Errorf("DeleteOccurrence() of a deleted occurrence error = %v, want NotFound", err)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(searchOccurrence)).WithArgs(pid, "o1").WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	if _, err := s.GetOccurrence(ctx, pid, "o1"); status.Code(err) != codes.NotFound {
+		t.Errorf("GetOccurrence() of a deleted occurrence error = %v, want NotFound", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestSoftDeletedOccurrencesHidden(t *testing.T) {
+	// Every query reading or changing occurrences on behalf of clients skips soft-deleted ones.
+	for name, query := range map[string]string{
+		"searchOccurrence":                 searchOccurrence,
+		"searchOccurrenceFolded":           searchOccurrenceFolded,
+		"updateOccurrence":                 updateOccurrence,
+		"updateOccurrenceReturningOld":     updateOccurrenceReturningOld,
+		"lockOccurrence":                   lockOccurrence,
+		"deleteOccurrence":                 deleteOccurrence,
+		"softDeleteOccurrence":             softDeleteOccurrence,
+		"listOccurrences":                  listOccurrences,
+		"listNoteOccurrences":              listNoteOccurrences,
+		"listOccurrencesByNotes":           listOccurrencesByNotes,
+		"updateOccurrenceLabels":           updateOccurrenceLabels,
+		"occurrenceLabels":                 occurrenceLabels,
+		"listNotesByOccurrenceCount":       listNotesByOccurrenceCount,
+		"listResourceURIs":                 listResourceURIs,
+		"listOccurrencesByCreateTime":      listOccurrencesByCreateTime,
+		"listOccurrencesBasicByCreateTime": listOccurrencesBasicByCreateTime,
+		"listOccurrencesBySeverity":        listOccurrencesBySeverity,
+		"listOccurrencesBasicBySeverity":   listOccurrencesBasicBySeverity,
+		"exportOccurrences":                exportOccurrences,
+		"aggregateOccurrences":             aggregateOccurrences,
+		"occurrenceSeverityHistogram":      occurrenceSeverityHistogram,
+		"searchOccurrences":                searchOccurrences,
+		"streamRawOccurrences":             streamRawOccurrences,
+		"linkOccurrences":                  linkOccurrences,
+		"listLinkedOccurrences":            listLinkedOccurrences,
+		"listLinkingOccurrences":           listLinkingOccurrences,
+	} {
+		if !strings.Contains(query, "deleted_at IS NULL") {
+			t.Errorf("%s does not filter out soft-deleted occurrences: %s", name, query)
+		}
+	}
+}
+
+func TestStore_PurgeDeletedOccurrences(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, SoftDeleteOccurrences: true, DeletedOccurrenceRetention: "720h"})
+	var cutoff time.Time
+	start := time.Now()
+	arg := cutoffArg{from: start.Add(-720 * time.Hour), to: start.Add(-720*time.Hour + time.Minute), got: &cutoff}
+	mock.ExpectExec(regexp.QuoteMeta(purgeDeletedOccurrences)).WithArgs(arg, defaultBatchSize).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	if purged, err := s.PurgeDeletedOccurrences(context.Background()); purged != 2 || err != nil {
+		t.Errorf("PurgeDeletedOccurrences() = %d, %v; want 2, nil", purged, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_WithDeletedOccurrences(t *testing.T) {
+	tests := []struct {
+		desc string
+		ctx  context.Context
+		get  string
+		list string
+	}{
+		{
+			desc: "live only",
+			ctx:  context.Background(),
+			get:  searchOccurrence,
+			list: fmt.Sprintf(listOccurrences, ""),
+		},
+		{
+			desc: "including deleted",
+			ctx:  WithDeletedOccurrences(context.Background()),
+			get:  `SELECT data FROM occurrences WHERE project_name = $1 AND occurrence_name = $2`,
+			list: `SELECT id, occurrence_name, data FROM occurrences WHERE project_name = $1  AND id > $2 ORDER BY id LIMIT $3`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey, SoftDeleteOccurrences: true})
+			mock.ExpectQuery("^"+regexp.QuoteMeta(tt.get)+"$").WithArgs(pid, "o1").
+				WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow("{}"))
+			if _, err := s.GetOccurrence(tt.ctx, pid, "o1"); err != nil {
+				t.Errorf("GetOccurrence() error = %v", err)
+			}
+			mock.ExpectQuery("^"+regexp.QuoteMeta(tt.list)+"$").WithArgs(pid, 0, 101).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "data"}).AddRow(1, "o1", "{}"))
+			if os, _, err := s.ListOccurrences(tt.ctx, pid, "", "", 100); err != nil || len(os) != 1 {
+				t.Errorf("ListOccurrences() = %v, %v, want one occurrence", os, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestOccurrenceQueriesHideDeleted(t *testing.T) {
+	// The queries of the reads WithDeletedOccurrences applies to drop their livePredicate.
+	for name, query := range map[string]string{
+		"searchOccurrence":                 searchOccurrence,
+		"searchOccurrenceFolded":           searchOccurrenceFolded,
+		"listOccurrences":                  listOccurrences,
+		"listOccurrencesBasic":             listOccurrencesBasic,
+		"listOccurrencesByCreateTime":      listOccurrencesByCreateTime,
+		"listOccurrencesBasicByCreateTime": listOccurrencesBasicByCreateTime,
+		"listOccurrencesBySeverity":        listOccurrencesBySeverity,
+		"listOccurrencesBasicBySeverity":   listOccurrencesBasicBySeverity,
+	} {
+		if got := occurrenceQuery(WithDeletedOccurrences(context.Background()), query); strings.Contains(got, "deleted_at") {
+			t.Errorf("%s still filters out soft-deleted occurrences: %s", name, got)
+		}
+	}
+}
+
+func TestStore_OccurrenceDeleteTimes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, SoftDeleteOccurrences: true})
+	deletedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(occurrenceDeleteTimes)).WithArgs(pid, `{"o1","o2"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"occurrence_name", "deleted_at"}).AddRow("o2", deletedAt))
+	got, err := s.OccurrenceDeleteTimes(context.Background(), pid, []string{"o1", "o2"})
+	if err != nil {
+		t.Fatalf("OccurrenceDeleteTimes() error = %v", err)
+	}
+	if len(got) != 1 || !got["o2"].Equal(deletedAt) {
+		t.Errorf("OccurrenceDeleteTimes() = %v, want only o2 deleted at %v", got, deletedAt)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_GetOccurrenceNoteMissingNote(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	ctx := context.Background()
+
+	// The occurrence exists but its note does not.
+	mock.ExpectQuery(regexp.QuoteMeta(searchOccurrence)).WithArgs(pid, "o1").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(`{"noteName":"projects/vendor/notes/cve"}`))
+	mock.ExpectQuery(regexp.QuoteMeta(searchNote)).WithArgs("vendor", "cve").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	_, err = s.GetOccurrenceNote(ctx, pid, "o1")
+	if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), "projects/vendor/notes/cve") {
+		t.Errorf("GetOccurrenceNote() error = %v, want FailedPrecondition naming the note", err)
+	}
+
+	// The occurrence does not exist.
+	mock.ExpectQuery(regexp.QuoteMeta(searchOccurrence)).WithArgs(pid, "o2").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}))
+	if _, err := s.GetOccurrenceNote(ctx, pid, "o2"); status.Code(err) != codes.NotFound {
+		t.Errorf("GetOccurrenceNote() of missing occurrence error = %v, want NotFound", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_ListOccurrencesIDGaps(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+
+	// The ids skipped by rolled-back inserts and deletes are neither waited for nor listed:
+	// each page reads one more row than requested, which starts the next page.
+	pages := []struct {
+		after int64
+		rows  [][2]interface{}
+	}{
+		{after: 0, rows: [][2]interface{}{{1, "o1"}, {5, "o5"}, {9, "o9"}}},
+		{after: 5, rows: [][2]interface{}{{9, "o9"}, {20, "o20"}}},
+	}
+	for _, p := range pages {
+		rows := sqlmock.NewRows([]string{"id", "occurrence_name", "data"})
+		for _, r := range p.rows {
+			rows.AddRow(r[0], r[1], `{}`)
+		}
+		mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(listOccurrences, ""))).WithArgs(pid, p.after, 3).WillReturnRows(rows)
+	}
+	var got []string
+	token := ""
+	for i := 0; i < len(pages); i++ {
+		var os []*pb.Occurrence
+		os, token, err = s.ListOccurrences(context.Background(), pid, "", token, 2)
+		if err != nil {
+			t.Fatalf("ListOccurrences() error = %v", err)
+		}
+		for _, o := range os {
+			got = append(got, o.Name)
+		}
+	}
+	if token != "" {
+		t.Errorf("ListOccurrences() returned token %q on the last page, want none", token)
+	}
+	want := []string{"o1", "o5", "o9", "o20"}
+	if len(got) != len(want) {
+		t.Fatalf("ListOccurrences() listed %v, want %v", got, want)
+	}
+	for i, oID := range want {
+		if got[i] != name.FormatOccurrence(pid, oID) {
+			t.Errorf("ListOccurrences() listed %v, want %v", got, want)
+			break
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_ListOccurrencesMaxPageBytes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, MaxPageBytes: 100})
+	large := fmt.Sprintf(`{"remediation":%q}`, strings.Repeat("x", 60))
+
+	// The second row exhausts the budget: the page ends there, below the page size, and the
+	// third row is left for the next page.
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(listOccurrences, ""))).WithArgs(pid, 0, 11).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "data"}).
+			AddRow(1, "o1", large).
+			AddRow(2, "o2", large).
+			AddRow(3, "o3", large))
+	os, token, err := s.ListOccurrences(context.Background(), pid, "", "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() error = %v", err)
+	}
+	if len(os) != 2 || token == "" {
+		t.Fatalf("ListOccurrences() returned %d occurrences and token %q, want 2 and a token", len(os), token)
+	}
+	if got := decryptCursor(token, paginationKey, time.Hour).ID; got != 2 {
+		t.Errorf("ListOccurrences() token resumes after id %d, want 2", got)
+	}
+
+	// A single row larger than the budget is still returned.
+	huge := fmt.Sprintf(`{"remediation":%q}`, strings.Repeat("x", 200))
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(listOccurrences, ""))).WithArgs(pid, 2, 11).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "data"}).AddRow(3, "o3", huge))
+	os, token, err = s.ListOccurrences(context.Background(), pid, "", token, 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() error = %v", err)
+	}
+	if len(os) != 1 || token != "" {
+		t.Errorf("ListOccurrences() returned %d occurrences and token %q, want 1 and no token", len(os), token)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_ListOccurrencesByNotes(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+
+	// Repeated notes are listed once, and occurrences are paged by id.
+	notes := []string{
+		"projects/cve-feed/notes/CVE-2021-44228",
+		"projects/cve-feed/notes/CVE-2021-45046",
+		"projects/p1/notes/n1",
+		"projects/cve-feed/notes/CVE-2021-44228",
+	}
+	query := fmt.Sprintf(listOccurrencesByNotes, "($4, $5), ($6, $7), ($8, $9)")
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs("p1", int64(0), int64(3), "cve-feed", "CVE-2021-44228", "cve-feed", "CVE-2021-45046", "p1", "n1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "data"}).
+			AddRow(3, "o1", `{"noteName":"projects/cve-feed/notes/CVE-2021-44228"}`).
+			AddRow(5, "o2", `{"noteName":"projects/p1/notes/n1"}`).
+			AddRow(8, "o3", `{"noteName":"projects/cve-feed/notes/CVE-2021-45046"}`))
+	got, token, err := s.ListOccurrencesByNotes(ctx, "p1", notes, 2, "")
+	if err != nil {
+		t.Fatalf("ListOccurrencesByNotes() error = %v", err)
+	}
+	if len(got) != 2 || got[0].Name != "projects/p1/occurrences/o1" || got[1].Name != "projects/p1/occurrences/o2" {
+		t.Errorf("ListOccurrencesByNotes() = %v, want o1 and o2", got)
+	}
+	if token == "" {
+		t.Fatal("ListOccurrencesByNotes() returned no page token, want one")
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs("p1", int64(5), int64(3), "cve-feed", "CVE-2021-44228", "cve-feed", "CVE-2021-45046", "p1", "n1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "data"}).
+			AddRow(8, "o3", `{"noteName":"projects/cve-feed/notes/CVE-2021-45046"}`))
+	got, token, err = s.ListOccurrencesByNotes(ctx, "p1", notes, 2, token)
+	if err != nil {
+		t.Fatalf("ListOccurrencesByNotes() of page 2 error = %v", err)
+	}
+	if len(got) != 1 || got[0].Name != "projects/p1/occurrences/o3" || token != "" {
+		t.Errorf("ListOccurrencesByNotes() of page 2 = %v, %q, want o3 and no token", got, token)
+	}
+
+	for _, tc := range []struct {
+		desc  string
+		notes []string
+	}{
+		{desc: "no notes"},
+		{desc: "invalid note name", notes: []string{"projects/p1/notes/n1", "n2"}},
+		{desc: "too many notes", notes: make([]string, maxListedNotes+1)},
+	} {
+		if _, _, err := s.ListOccurrencesByNotes(ctx, "p1", tc.notes, 10, ""); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: ListOccurrencesByNotes() error = %v, want InvalidArgument", tc.desc, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -14,59 +14,381 @@
 
 package storage
 
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
 const (
+	// createTables is formatted with the index tablespace clause (%[1]s) and
+	// the table tablespace clause (%[2]s); see createTablesDDL.
 	createTables = `
 		CREATE TABLE IF NOT EXISTS projects (
-			id SERIAL PRIMARY KEY,
-			name TEXT NOT NULL UNIQUE
-		);
+			id SERIAL PRIMARY KEY%[1]s,
+			name TEXT NOT NULL UNIQUE%[1]s
+		)%[2]s;
 		CREATE TABLE IF NOT EXISTS notes (
-			id SERIAL PRIMARY KEY,
+			id SERIAL PRIMARY KEY%[1]s,
 			project_name TEXT NOT NULL,
 			note_name TEXT NOT NULL,
 			data JSONB,
-			UNIQUE (project_name, note_name)
-		);
+			created_by TEXT,
+			UNIQUE (project_name, note_name)%[1]s
+		)%[2]s;
+		ALTER TABLE notes ADD COLUMN IF NOT EXISTS created_by TEXT;
 		CREATE TABLE IF NOT EXISTS occurrences (
-			id SERIAL PRIMARY KEY,
+			id SERIAL PRIMARY KEY%[1]s,
 			project_name TEXT NOT NULL,
 			occurrence_name TEXT NOT NULL,
 			data JSONB,
 			note_id int REFERENCES notes NOT NULL,
-			UNIQUE (project_name, occurrence_name)
-		);`
+			created_at TIMESTAMPTZ,
+			idempotency_key TEXT,
+			deleted_at TIMESTAMPTZ,
+			severity SMALLINT,
+			updated_at TIMESTAMPTZ,
+			content_hash TEXT,
+			created_by TEXT,
+			labels JSONB,
+			resource_uri TEXT,
+			UNIQUE (project_name, occurrence_name)%[1]s
+		)%[2]s;
+		ALTER TABLE occurrences ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ;
+		CREATE INDEX IF NOT EXISTS occurrences_created_at_idx ON occurrences (project_name, created_at)%[2]s;
+		ALTER TABLE occurrences ADD COLUMN IF NOT EXISTS idempotency_key TEXT;
+		CREATE UNIQUE INDEX IF NOT EXISTS occurrences_idempotency_key_idx ON occurrences (project_name, idempotency_key)%[2]s;
+		CREATE INDEX IF NOT EXISTS occurrences_note_id_idx ON occurrences (note_id, id)%[2]s;
+		ALTER TABLE occurrences ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+		ALTER TABLE occurrences ADD COLUMN IF NOT EXISTS severity SMALLINT;
+		CREATE INDEX IF NOT EXISTS occurrences_severity_idx ON occurrences (project_name, severity)%[2]s;
+		ALTER TABLE occurrences ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+		CREATE INDEX IF NOT EXISTS occurrences_updated_at_idx ON occurrences (project_name, updated_at, id)%[2]s;
+		ALTER TABLE occurrences ADD COLUMN IF NOT EXISTS content_hash TEXT;
+		ALTER TABLE occurrences ADD COLUMN IF NOT EXISTS created_by TEXT;
+		CREATE INDEX IF NOT EXISTS occurrences_created_by_idx ON occurrences (project_name, created_by)%[2]s;
+		ALTER TABLE occurrences ADD COLUMN IF NOT EXISTS labels JSONB;
+		ALTER TABLE occurrences ADD COLUMN IF NOT EXISTS resource_uri TEXT;
+		CREATE INDEX IF NOT EXISTS occurrences_resource_uri_idx ON occurrences (project_name, resource_uri)%[2]s;
+		CREATE TABLE IF NOT EXISTS occurrence_links (
+			id SERIAL PRIMARY KEY%[1]s,
+			from_id int NOT NULL REFERENCES occurrences ON DELETE CASCADE,
+			to_id int NOT NULL REFERENCES occurrences ON DELETE CASCADE,
+			UNIQUE (from_id, to_id)%[1]s
+		)%[2]s;
+		CREATE INDEX IF NOT EXISTS occurrence_links_to_id_idx ON occurrence_links (to_id)%[2]s;`
+
+	// createFoldedIndexes indexes the lowercased names used by case-insensitive lookups.
+	// Like createExpiryIndex, it is formatted with the table tablespace clause.
+	createFoldedIndexes = `
+		CREATE INDEX IF NOT EXISTS projects_folded_name_idx ON projects (lower(name))%[1]s;
+		CREATE INDEX IF NOT EXISTS notes_folded_name_idx ON notes (lower(project_name), lower(note_name))%[1]s;
+		CREATE INDEX IF NOT EXISTS occurrences_folded_name_idx ON occurrences (lower(project_name), lower(occurrence_name))%[1]s;`
+	// createExpiryIndex indexes the creation times of occurrences across projects for purges.
+	createExpiryIndex = `CREATE INDEX IF NOT EXISTS occurrences_expiry_idx ON occurrences (created_at)%[1]s;`
+	// createContentHashIndex makes the content hashes of the live occurrences of a project unique.
+	createContentHashIndex = `CREATE UNIQUE INDEX IF NOT EXISTS occurrences_content_hash_idx
+	                            ON occurrences (project_name, content_hash)%[1]s WHERE deleted_at IS NULL;`
+	// createTextSearch adds the tsvector of the string values of occurrences, searched by
+	// SearchOccurrences, and its index. It is formatted with the text search configuration
+	// (%[1]s), as a quoted literal, and the table tablespace clause (%[2]s); see textSearchDDL.
+	createTextSearch = `
+		ALTER TABLE occurrences ADD COLUMN IF NOT EXISTS search_vector tsvector
+			GENERATED ALWAYS AS (jsonb_to_tsvector(%[1]s::regconfig, data, '["string"]')) STORED;
+		CREATE INDEX IF NOT EXISTS occurrences_search_vector_idx ON occurrences USING GIN (search_vector)%[2]s;`
+	// createDeletedIndex indexes the deletion times of soft-deleted occurrences for purges.
+	createDeletedIndex = `CREATE INDEX IF NOT EXISTS occurrences_deleted_at_idx ON occurrences (deleted_at)%[1]s;`
 
 	insertProject = `INSERT INTO projects(name) VALUES ($1)`
 	projectExists = `SELECT EXISTS (SELECT 1 FROM projects WHERE name = $1)`
 	deleteProject = `DELETE FROM projects WHERE name = $1`
 	// "ORDER BY id" is required because the default select order of PostgreSQL is not guaranteed.
-	listProjects  = `SELECT id, name FROM projects WHERE %s id > $1 ORDER BY id LIMIT $2`
-	projectsMaxID = `SELECT MAX(id) FROM projects`
-
-	insertOccurrence = `INSERT INTO occurrences(project_name, occurrence_name, note_id, data)
-                      VALUES ($1, $2, (SELECT id FROM notes WHERE project_name = $3 AND note_name = $4), $5)`
-	searchOccurrence = `SELECT data FROM occurrences WHERE project_name = $1 AND occurrence_name = $2`
-	updateOccurrence = `UPDATE occurrences SET data = $1 WHERE project_name = $2 AND occurrence_name = $3`
-	deleteOccurrence = `DELETE FROM occurrences WHERE project_name = $1 AND occurrence_name = $2`
+	listProjects = `SELECT id, name FROM projects WHERE id > $1 %s ORDER BY id LIMIT $2`
+	// matchProject is formatted with the filter predicate, or TRUE if there is no filter.
+	matchProject = `SELECT %s FROM projects WHERE name = $1`
+
+	insertOccurrence = `INSERT INTO occurrences(project_name, occurrence_name, note_id, data, created_at, idempotency_key, severity, updated_at, content_hash, created_by, resource_uri)
+                      VALUES ($1, $2, (SELECT id FROM notes WHERE project_name = $3 AND note_name = $4), $5, $6, $7, $8, $9, $10, $11, $12)
+                      RETURNING created_at`
+	// Soft-deleted occurrences, whose deleted_at is set, are only visible to purges, and to the
+	// reads of occurrenceQuery requested to include them.
+	searchOccurrence = `SELECT data FROM occurrences WHERE project_name = $1 AND occurrence_name = $2 AND deleted_at IS NULL`
+	// occurrenceDeleteTimes and occurrenceDeleteTimesFolded select the names among $2 of the
+	// soft-deleted occurrences of project $1, with their deletion times.
+	occurrenceDeleteTimes       = `SELECT occurrence_name, deleted_at FROM occurrences WHERE project_name = $1 AND occurrence_name = ANY($2) AND deleted_at IS NOT NULL`
+	occurrenceDeleteTimesFolded = `SELECT lower(occurrence_name), deleted_at FROM occurrences
+	                                 WHERE lower(project_name) = lower($1) AND lower(occurrence_name) = ANY($2) AND deleted_at IS NOT NULL`
+	// idempotentOccurrence finds the occurrence created with an idempotency key.
+	idempotentOccurrence = `SELECT occurrence_name, data FROM occurrences WHERE project_name = $1 AND idempotency_key = $2`
+	// duplicateOccurrence finds the live occurrence with a content hash.
+	duplicateOccurrence  = `SELECT occurrence_name, data FROM occurrences WHERE project_name = $1 AND content_hash = $2 AND deleted_at IS NULL`
+	updateOccurrence     = `UPDATE occurrences SET data = $1, severity = $4, updated_at = $5, resource_uri = $6, content_hash = NULL WHERE project_name = $2 AND occurrence_name = $3 AND deleted_at IS NULL`
+	deleteOccurrence     = `DELETE FROM occurrences WHERE project_name = $1 AND occurrence_name = $2 AND deleted_at IS NULL`
+	softDeleteOccurrence = `UPDATE occurrences SET deleted_at = now() WHERE project_name = $1 AND occurrence_name = $2 AND deleted_at IS NULL`
+	// lockOccurrence reads the data of an occurrence to update in a transaction, locking it.
+	lockOccurrence = `SELECT data FROM occurrences WHERE project_name = $1 AND occurrence_name = $2 AND deleted_at IS NULL FOR UPDATE`
+	// updateOccurrenceReturningOld is updateOccurrence returning the data it replaces. The row is
+	// locked by the subquery so that the returned data is the latest version.
+	updateOccurrenceReturningOld = `UPDATE occurrences AS o SET data = $1, severity = $4, updated_at = $5, resource_uri = $6, content_hash = NULL
+	                                  FROM (SELECT id, data FROM occurrences WHERE project_name = $2 AND occurrence_name = $3 AND deleted_at IS NULL FOR UPDATE) AS old
+	                                  WHERE o.id = old.id
+	                                  RETURNING old.data`
 	// "ORDER BY id" is required because the default select order of PostgreSQL is not guaranteed.
-	listOccurrences = `SELECT id, data FROM occurrences WHERE project_name = $1 %s AND id > $2 ORDER BY id LIMIT $3`
-	occurrenceMaxID = `SELECT MAX(id) FROM occurrences WHERE project_name = $1 %s`
+	listOccurrences = `SELECT id, occurrence_name, data FROM occurrences WHERE project_name = $1 AND deleted_at IS NULL %s AND id > $2 ORDER BY id LIMIT $3`
+	// listOccurrencesBasic is listOccurrences selecting the fields of OccurrenceViewBasic.
+	listOccurrencesBasic = `SELECT id, occurrence_name, data->>'kind', data->'resource', data->>'noteName', created_at, severity
+	                          FROM occurrences WHERE project_name = $1 AND deleted_at IS NULL %s AND id > $2 ORDER BY id LIMIT $3`
+	// listOccurrencesByCreateTime and listOccurrencesBasicByCreateTime are listOccurrences and
+	// listOccurrencesBasic in creation order, after the occurrence created at $2 with id $3, or
+	// from the first occurrence if $2 is NULL. Occurrences without a creation time are not listed.
+	listOccurrencesByCreateTime = `SELECT id, occurrence_name, data, created_at FROM occurrences
+	                                 WHERE project_name = $1 AND deleted_at IS NULL AND created_at IS NOT NULL %s
+	                                   AND ($2::timestamptz IS NULL OR (created_at, id) > ($2, $3))
+	                                 ORDER BY created_at, id LIMIT $4`
+	listOccurrencesBasicByCreateTime = `SELECT id, occurrence_name, data->>'kind', data->'resource', data->>'noteName', created_at, severity
+	                                      FROM occurrences
+	                                      WHERE project_name = $1 AND deleted_at IS NULL AND created_at IS NOT NULL %s
+	                                        AND ($2::timestamptz IS NULL OR (created_at, id) > ($2, $3))
+	                                      ORDER BY created_at, id LIMIT $4`
+	// listOccurrencesBySeverity and listOccurrencesBasicBySeverity are listOccurrences and
+	// listOccurrencesBasic most severe first, then in id order. They are formatted with the filter
+	// clause, and with the NULLS clause placing the occurrences without a severity and its keyset
+	// predicate, from severityNullsOrders. Unless $2 is false, for the first page, they resume
+	// after the occurrence of severity $3, NULL if it has none, and id $4.
+	listOccurrencesBySeverity = `SELECT id, occurrence_name, data, severity FROM occurrences
+	                               WHERE project_name = $1 AND deleted_at IS NULL %[1]s AND (NOT $2::boolean OR %[3]s)
+	                               ORDER BY severity DESC %[2]s, id LIMIT $5`
+	listOccurrencesBasicBySeverity = `SELECT id, occurrence_name, data->>'kind', data->'resource', data->>'noteName', created_at, severity
+	                                    FROM occurrences
+	                                    WHERE project_name = $1 AND deleted_at IS NULL %[1]s AND (NOT $2::boolean OR %[3]s)
+	                                    ORDER BY severity DESC %[2]s, id LIMIT $5`
 
-	insertNote          = `INSERT INTO notes(project_name, note_name, data) VALUES ($1, $2, $3)`
+	insertNote          = `INSERT INTO notes(project_name, note_name, data, created_by) VALUES ($1, $2, $3, $4)`
 	searchNote          = `SELECT data FROM notes WHERE project_name = $1 AND note_name = $2`
 	updateNote          = `UPDATE notes SET data = $1 WHERE project_name = $2 AND note_name = $3`
 	deleteNote          = `DELETE FROM notes WHERE project_name = $1 AND note_name = $2`
-	listNotes           = `SELECT id, data FROM notes WHERE project_name = $1 %s AND id > $2 ORDER BY id LIMIT $3`
-	notesMaxID          = `SELECT MAX(id) FROM notes WHERE project_name = $1 %s`
-	listNoteOccurrences = `SELECT o.id, o.data FROM occurrences as o, notes as n
+	listNotes           = `SELECT id, note_name, data FROM notes WHERE project_name = $1 %s AND id > $2 ORDER BY id LIMIT $3`
+	listNoteOccurrences = `SELECT o.id, o.project_name, o.occurrence_name, o.data FROM occurrences as o, notes as n
 	                         WHERE n.id = o.note_id
 	                           AND n.project_name = $1
 	                           AND n.note_name = $2
+	                           AND o.deleted_at IS NULL
 	                           AND o.id > $3
+	                           ORDER BY o.id
 	                           LIMIT $4`
 
-	NoteOccurrencesMaxID = `SELECT MAX(o.id) FROM occurrences as o, notes as n
-	                         WHERE n.id = o.note_id
-	                           AND n.project_name = $1
-	                           AND n.note_name = $2`
+	// listOccurrencesByNotes lists the occurrences of project $1 referencing any of the notes
+	// whose project and note names are listed as pairs of placeholders, from $4 on, after id $2.
+	listOccurrencesByNotes = `SELECT o.id, o.occurrence_name, o.data FROM occurrences AS o JOIN notes AS n ON n.id = o.note_id
+	                            WHERE o.project_name = $1
+	                              AND (n.project_name, n.note_name) IN (%s)
+	                              AND o.deleted_at IS NULL
+	                              AND o.id > $2
+	                              ORDER BY o.id
+	                              LIMIT $3`
+
+	// listNotesByOccurrenceCount lists the notes of project $1 by descending count of the
+	// occurrences of any project referencing them, then by id, after the note with count $2 and
+	// id $3, or from the first note if $2 is NULL.
+	listNotesByOccurrenceCount = `SELECT n.id, n.note_name, n.data, COUNT(o.id) AS occurrences
+	                                FROM notes AS n LEFT JOIN occurrences AS o ON o.note_id = n.id AND o.deleted_at IS NULL
+	                                WHERE n.project_name = $1
+	                                GROUP BY n.id
+	                                HAVING $2::bigint IS NULL OR COUNT(o.id) < $2 OR (COUNT(o.id) = $2 AND n.id > $3)
+	                                ORDER BY occurrences DESC, n.id
+	                                LIMIT $4`
+
+	// listResourceURIs lists the distinct resource URIs of the occurrences of project $1 in
+	// order, after $2.
+	listResourceURIs = `SELECT DISTINCT resource_uri FROM occurrences
+	                      WHERE project_name = $1 AND deleted_at IS NULL AND resource_uri > $2
+	                      ORDER BY resource_uri LIMIT $3`
+
+	// searchProjectFolded, searchOccurrenceFolded and searchNoteFolded match names case-insensitively,
+	// preferring an exact match should several names differ only in case.
+	searchProjectFolded    = `SELECT name FROM projects WHERE lower(name) = lower($1) ORDER BY name = $1 DESC, id LIMIT 1`
+	searchOccurrenceFolded = `SELECT project_name, occurrence_name, data FROM occurrences
+	                            WHERE lower(project_name) = lower($1) AND lower(occurrence_name) = lower($2) AND deleted_at IS NULL
+	                            ORDER BY project_name = $1 AND occurrence_name = $2 DESC, id LIMIT 1`
+	searchNoteFolded = `SELECT project_name, note_name, data FROM notes
+	                      WHERE lower(project_name) = lower($1) AND lower(note_name) = lower($2)
+	                      ORDER BY project_name = $1 AND note_name = $2 DESC, id LIMIT 1`
+
+	// notesExist and notesExistFolded select the names among $2 of the notes in project $1.
+	notesExist       = `SELECT note_name FROM notes WHERE project_name = $1 AND note_name = ANY($2)`
+	notesExistFolded = `SELECT lower(note_name) FROM notes WHERE lower(project_name) = lower($1) AND lower(note_name) = ANY($2)`
+
+	// searchOccurrences lists the live occurrences of project $1 matching the text search query
+	// $3 in configuration $2, best matches first.
+	searchOccurrences = `SELECT occurrence_name, data FROM occurrences, to_tsquery($2::regconfig, $3) AS query
+	                     WHERE project_name = $1 AND search_vector @@ query AND deleted_at IS NULL
+	                     ORDER BY ts_rank(search_vector, query) DESC, id`
+	// linkOccurrences links occurrence $1/$2 to occurrence $3/$4, unless it already is, and
+	// returns whether each of them exists.
+	linkOccurrences = `WITH f AS (SELECT id FROM occurrences WHERE project_name = $1 AND occurrence_name = $2 AND deleted_at IS NULL),
+	                        t AS (SELECT id FROM occurrences WHERE project_name = $3 AND occurrence_name = $4 AND deleted_at IS NULL),
+	                        l AS (INSERT INTO occurrence_links(from_id, to_id) SELECT f.id, t.id FROM f, t ON CONFLICT DO NOTHING)
+	                   SELECT EXISTS (SELECT 1 FROM f), EXISTS (SELECT 1 FROM t)`
+	// listLinkedOccurrences and listLinkingOccurrences list the occurrences occurrence $1/$2
+	// links to, and those linking to it, respectively.
+	listLinkedOccurrences = `SELECT o.project_name, o.occurrence_name, o.data FROM occurrence_links AS l, occurrences AS o
+	                           WHERE l.from_id = (SELECT id FROM occurrences WHERE project_name = $1 AND occurrence_name = $2 AND deleted_at IS NULL)
+	                             AND o.id = l.to_id AND o.deleted_at IS NULL
+	                           ORDER BY o.id`
+	listLinkingOccurrences = `SELECT o.project_name, o.occurrence_name, o.data FROM occurrence_links AS l, occurrences AS o
+	                            WHERE l.to_id = (SELECT id FROM occurrences WHERE project_name = $1 AND occurrence_name = $2 AND deleted_at IS NULL)
+	                              AND o.id = l.from_id AND o.deleted_at IS NULL
+	                            ORDER BY o.id`
+	// updateOccurrenceLabels and occurrenceLabels set and select the labels of an occurrence.
+	updateOccurrenceLabels = `UPDATE occurrences SET labels = $3 WHERE project_name = $1 AND occurrence_name = $2 AND deleted_at IS NULL`
+	occurrenceLabels       = `SELECT labels FROM occurrences WHERE project_name = $1 AND occurrence_name = $2 AND deleted_at IS NULL`
+
+	// occurrenceCreator and noteCreator select the user that created an entity.
+	occurrenceCreator = `SELECT created_by FROM occurrences WHERE project_name = $1 AND occurrence_name = $2 AND deleted_at IS NULL`
+	noteCreator       = `SELECT created_by FROM notes WHERE project_name = $1 AND note_name = $2`
+
+	// listOccurrencesModifiedSince lists the occurrences of project $1 after the cursor
+	// (updated_at $2, id $3) in update order.
+	listOccurrencesModifiedSince = `SELECT id, occurrence_name, data, updated_at FROM occurrences
+	                                  WHERE project_name = $1 AND deleted_at IS NULL AND (updated_at, id) > ($2, $3)
+	                                  ORDER BY updated_at, id LIMIT $4`
+
+	// streamOccurrences is formatted with the filter clause.
+	streamOccurrences = `SELECT occurrence_name, data FROM occurrences WHERE project_name = $1 AND deleted_at IS NULL %s ORDER BY id`
+	// streamRawOccurrences is formatted with the filter clause.
+	streamRawOccurrences = `SELECT data FROM occurrences WHERE project_name = $1 AND deleted_at IS NULL %s ORDER BY id`
+
+	// exportNotes and exportOccurrences select all the entities of project $1.
+	exportNotes       = `SELECT note_name, data FROM notes WHERE project_name = $1 ORDER BY id`
+	exportOccurrences = `SELECT occurrence_name, data FROM occurrences WHERE project_name = $1 AND deleted_at IS NULL ORDER BY id`
+	// importNote and importOccurrence are formatted with the ON CONFLICT clause of the import.
+	importNote       = `INSERT INTO notes(project_name, note_name, data) VALUES ($1, $2, $3) %s`
+	importOccurrence = `INSERT INTO occurrences(project_name, occurrence_name, note_id, data, created_at, severity, updated_at, resource_uri)
+	                      VALUES ($1, $2, (SELECT id FROM notes WHERE project_name = $3 AND note_name = $4), $5, $6, $7, $8, $9) %s`
+	// importSavepoint and its release and rollback bracket each insert of a best-effort import.
+	importSavepoint         = `SAVEPOINT import_record`
+	releaseImportSavepoint  = `RELEASE SAVEPOINT import_record`
+	rollbackImportSavepoint = `ROLLBACK TO SAVEPOINT import_record`
+
+	// purgeExpiredOccurrences deletes up to $2 occurrences created before $1.
+	purgeExpiredOccurrences = `DELETE FROM occurrences WHERE id IN (SELECT id FROM occurrences WHERE created_at < $1 LIMIT $2)`
+	// purgeDeletedOccurrences deletes up to $2 occurrences soft-deleted before $1.
+	purgeDeletedOccurrences = `DELETE FROM occurrences WHERE id IN (SELECT id FROM occurrences WHERE deleted_at < $1 LIMIT $2)`
+	// purgeProjectOccurrences and purgeProjectNotes delete up to $2 occurrences, including
+	// soft-deleted ones, and notes of project $1.
+	purgeProjectOccurrences = `DELETE FROM occurrences WHERE id IN (SELECT id FROM occurrences WHERE project_name = $1 LIMIT $2)`
+	purgeProjectNotes       = `DELETE FROM notes WHERE id IN (SELECT id FROM notes WHERE project_name = $1 LIMIT $2)`
+
+	// aggregateOccurrences is formatted with the grouping expression and the filter clause.
+	aggregateOccurrences = `SELECT COALESCE(%s, ''), COUNT(*) FROM occurrences WHERE project_name = $1 AND deleted_at IS NULL %s GROUP BY 1`
+	// occurrenceSeverityHistogram is formatted with the filter clause.
+	occurrenceSeverityHistogram = `SELECT severity, COUNT(*) FROM occurrences WHERE project_name = $1 AND deleted_at IS NULL %s GROUP BY severity`
+
+	occurrencesTableMaxID = `SELECT COALESCE(MAX(id), 0) FROM occurrences`
+
+	// projectStorageStats counts the rows of project $1, including soft-deleted occurrences,
+	// along with the average size of the data of the rows of each table, estimated by ANALYZE.
+	projectStorageStats = `SELECT
+	                         (SELECT COUNT(*) FROM occurrences WHERE project_name = $1),
+	                         (SELECT COUNT(*) FROM notes WHERE project_name = $1),
+	                         (SELECT COALESCE(MAX(avg_width), 0) FROM pg_stats WHERE schemaname = current_schema() AND tablename = 'occurrences' AND attname = 'data'),
+	                         (SELECT COALESCE(MAX(avg_width), 0) FROM pg_stats WHERE schemaname = current_schema() AND tablename = 'notes' AND attname = 'data')`
+
+	analyzeTables      = `ANALYZE projects, notes, occurrences`
+	analyzeProjects    = `ANALYZE projects`
+	analyzeNotes       = `ANALYZE notes`
+	analyzeOccurrences = `ANALYZE occurrences`
+
+	// schemaVersion reads the version of the schema recorded by its migration tool, and whether
+	// the last migration failed half-way.
+	schemaVersion = `SELECT version, dirty FROM schema_migrations LIMIT 1`
 )
+
+// derivedColumn is a column promoted out of the data blob.
+type derivedColumn struct {
+	name string
+	// expr derives the column value from the data column.
+	expr string
+}
+
+// occurrenceDerivedColumns lists the promoted columns of the occurrences table.
+var occurrenceDerivedColumns = []derivedColumn{
+	{name: "created_at", expr: "(data->>'createTime')::timestamptz"},
+	{name: severityColumn, expr: severityDerivation},
+	{name: "updated_at", expr: "COALESCE((data->>'updateTime')::timestamptz, (data->>'createTime')::timestamptz)"},
+	{name: "resource_uri", expr: "data->'resource'->>'uri'"},
+}
+
+// severityNullsOrders maps the values of Config.NullsOrder to the NULLS clauses of
+// listOccurrencesBySeverity and their keyset predicates. Comparisons with NULL are never true,
+// so the predicates handle a NULL severity, of either the cursor or the row, explicitly:
+// occurrences without a severity follow each other in id order, and all precede or follow
+// those with one.
+var severityNullsOrders = map[string][2]string{
+	nullsOrderLast: {
+		"NULLS LAST",
+		"CASE WHEN $3::smallint IS NULL THEN severity IS NULL AND id > $4 ELSE severity IS NULL OR severity < $3 OR (severity = $3 AND id > $4) END",
+	},
+	nullsOrderFirst: {
+		"NULLS FIRST",
+		"CASE WHEN $3::smallint IS NULL THEN severity IS NOT NULL OR id > $4 ELSE severity < $3 OR (severity = $3 AND id > $4) END",
+	},
+}
+
+// occurrenceGroupings maps the fields occurrences may be aggregated by to their grouping
+// expressions. Only fields that are cheap to extract from the data blob are listed.
+var occurrenceGroupings = map[string]string{
+	"kind":         "data->>'kind'",
+	"resource_uri": "data->'resource'->>'uri'",
+	"note_name":    "data->>'noteName'",
+}
+
+// rebuildDerivedColumnsQuery returns an UPDATE repopulating columns from the data blob
+// for the rows of table with $1 < id <= $2. Rows whose columns are already up to date
+// are skipped, so re-running an interrupted rebuild only rewrites the remaining rows.
+func rebuildDerivedColumnsQuery(table string, columns []derivedColumn) string {
+	var sets, stale []string
+	for _, c := range columns {
+		sets = append(sets, fmt.Sprintf("%s = %s", quoteIdentifier(c.name), c.expr))
+		stale = append(stale, fmt.Sprintf("%s IS DISTINCT FROM %s", quoteIdentifier(c.name), c.expr))
+	}
+	return fmt.Sprintf("UPDATE %s SET %s WHERE id > $1 AND id <= $2 AND (%s)",
+		quoteIdentifier(table), strings.Join(sets, ", "), strings.Join(stale, " OR "))
+}
+
+// quoteIdentifier quotes the unquoted identifier name for use in generated SQL, so that it
+// may be a reserved word such as user. The name is folded to lower case first, as
+// PostgreSQL does for unquoted identifiers, so that quoting does not change which object
+// it refers to.
+func quoteIdentifier(name string) string {
+	return pq.QuoteIdentifier(strings.ToLower(name))
+}
+
+// createTablesDDL returns the table creation DDL, placing the tables and their
+// constraint indexes in tablespace if it is not empty.
+func createTablesDDL(tablespace string) string {
+	if tablespace == "" {
+		return fmt.Sprintf(createTables, "", "")
+	}
+	tablespace = quoteIdentifier(tablespace)
+	return fmt.Sprintf(createTables, " USING INDEX TABLESPACE "+tablespace, " TABLESPACE "+tablespace)
+}
+
+// textSearchDDL returns the DDL of the occurrence text search column with configuration
+// config, placing its index in tablespace if it is not empty.
+func textSearchDDL(config, tablespace string) string {
+	if tablespace != "" {
+		tablespace = " TABLESPACE " + quoteIdentifier(tablespace)
+	}
+	return fmt.Sprintf(createTextSearch, pq.QuoteLiteral(config), tablespace)
+}
+
+// indexesDDL returns the DDL of optional indexes, such as createFoldedIndexes,
+// placing them in tablespace if it is not empty.
+func indexesDDL(indexes, tablespace string) string {
+	if tablespace == "" {
+		return fmt.Sprintf(indexes, "")
+	}
+	return fmt.Sprintf(indexes, " TABLESPACE "+quoteIdentifier(tablespace))
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"regexp"
+	"runtime"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// unsafeTagChars matches the characters replaced in query tag values, so that a tag, e.g. a
+// project ID, cannot end the comment holding it.
+var unsafeTagChars = regexp.MustCompile(`[^A-Za-z0-9_.:-]`)
+
+// queryTags are the values of the comment tagging the queries of a store operation. The
+// operation also names the slow queries and connection waits reported for it.
+type queryTags struct {
+	op, project string
+}
+
+// withQueryTags returns a copy of ctx naming the store operation calling it and project pID,
+// if any, in the tags and reports of the queries run with it. Store operations call it first,
+// so that the queries of their helpers and transactions are attributed to them.
+func (pg *PgSQLStore) withQueryTags(ctx context.Context, pID string) context.Context {
+	return context.WithValue(ctx, queryTagsKey, queryTags{op: callerOperation(1), project: pID})
+}
+
+// queryOperation returns the store operation ctx is tagged with, or "unknown".
+func queryOperation(ctx context.Context) string {
+	if tags, ok := ctx.Value(queryTagsKey).(queryTags); ok {
+		return tags.op
+	}
+	return "unknown"
+}
+
+// tagQuery prefixes query with a comment naming the store operation issuing it and its
+// project, if the store tags queries.
+func (pg *PgSQLStore) tagQuery(ctx context.Context, query string) string {
+	if !pg.tagQueries {
+		return query
+	}
+	tags, _ := ctx.Value(queryTagsKey).(queryTags)
+	tag := "/* op=" + unsafeTagChars.ReplaceAllString(queryOperation(ctx), "_")
+	if tags.project != "" {
+		tag += " project=" + unsafeTagChars.ReplaceAllString(tags.project, "_")
+	}
+	return tag + " */ " + query
+}
+
+// callerOperation returns the name of the store operation skip frames above its caller, or
+// "unknown".
+func callerOperation(skip int) string {
+	if pc, _, _, ok := runtime.Caller(skip + 1); ok {
+		return operationName(runtime.FuncForPC(pc).Name())
+	}
+	return "unknown"
+}
+
+// operationName returns the method name in the qualified function name fn, e.g. "GetNote" for
+// "github.com/grafeas/grafeas-pgsql/go/v1beta1/storage.(*PgSQLStore).GetNote".
+func operationName(fn string) string {
+	if i := strings.LastIndex(fn, ")."); i >= 0 {
+		fn = fn[i+2:]
+	} else if i := strings.LastIndex(fn, "."); i >= 0 {
+		fn = fn[i+1:]
+	}
+	// Closures are named after their enclosing function, e.g. "GetNote.func1".
+	if i := strings.Index(fn, "."); i >= 0 {
+		fn = fn[:i]
+	}
+	return fn
+}
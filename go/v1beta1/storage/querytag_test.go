@@ -0,0 +1,99 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/net/context"
+)
+
+func TestStore_TagQueries(t *testing.T) {
+	tests := []struct {
+		desc string
+		pID  string
+		want string
+	}{
+		{desc: "plain", pID: "p1", want: "/* op=GetOccurrence project=p1 */ "},
+		{desc: "injection", pID: "p1 */ DROP TABLE notes; /*", want: "/* op=GetOccurrence project=p1____DROP_TABLE_notes____ */ "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey, TagQueries: true})
+			mock.ExpectQuery("^"+regexp.QuoteMeta(tt.want+searchOccurrence)+"$").WithArgs(tt.pID, "o1").
+				WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow([]byte("{}")))
+			if _, err := s.GetOccurrence(context.Background(), tt.pID, "o1"); err != nil {
+				t.Fatalf("GetOccurrence() error = %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestStore_TagQueriesWithoutProject(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, TagQueries: true})
+	mock.ExpectQuery("^" + regexp.QuoteMeta("/* op=ListProjects */ "+fmt.Sprintf(listProjects, "")) + "$").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	if _, _, err := s.ListProjects(context.Background(), "", 10, ""); err != nil {
+		t.Fatalf("ListProjects() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_TagMaintenanceQueries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, TagQueries: true})
+	mock.ExpectExec("^" + regexp.QuoteMeta("/* op=AnalyzeTables */ "+analyzeTables) + "$").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := s.AnalyzeTables(context.Background()); err != nil {
+		t.Fatalf("AnalyzeTables() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestOperationName(t *testing.T) {
+	for fn, want := range map[string]string{
+		"github.com/grafeas/grafeas-pgsql/go/v1beta1/storage.(*PgSQLStore).GetNote":       "GetNote",
+		"github.com/grafeas/grafeas-pgsql/go/v1beta1/storage.(*PgSQLStore).GetNote.func1": "GetNote",
+		"github.com/grafeas/grafeas-pgsql/go/v1beta1/storage.prewarm":                     "prewarm",
+	} {
+		if got := operationName(fn); got != want {
+			t.Errorf("operationName(%q) = %q, want %q", fn, got, want)
+		}
+	}
+}
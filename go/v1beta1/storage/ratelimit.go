@@ -0,0 +1,124 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter throttles occurrence ingestion per project.
+type RateLimiter interface {
+	// Allow reports whether project pID may create n occurrences now, and if so
+	// accounts for them.
+	Allow(pID string, n int) bool
+}
+
+// RetryAfterLimiter is a RateLimiter which can tell when creates it denies would be allowed,
+// so that clients are told when to retry.
+type RetryAfterLimiter interface {
+	RateLimiter
+	// RetryAfter returns how long project pID has to wait before it may create n occurrences.
+	RetryAfter(pID string, n int) time.Duration
+}
+
+// tokenBucketLimiter is a RateLimiter keeping a token bucket per project.
+type tokenBucketLimiter struct {
+	// rate is the number of creates per second allowed to projects without an override.
+	rate float64
+	// burst is the number of creates a project may make at once after being idle.
+	burst float64
+	// overrides maps projects to their own rates.
+	overrides map[string]float64
+	now       func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket holds the tokens of a project as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucketLimiter returns a RateLimiter allowing each project rate occurrence creates
+// per second, or the rate in overrides for the projects listed there, in bursts of up to
+// burst creates. Projects with a zero rate are not throttled. A batch larger than burst is allowed
+// once the bucket is full, and the project then waits until the excess is paid back.
+func NewTokenBucketLimiter(rate float64, burst int, overrides map[string]float64) RateLimiter {
+	return newTokenBucketLimiter(rate, burst, overrides, time.Now)
+}
+
+func newTokenBucketLimiter(rate float64, burst int, overrides map[string]float64, now func() time.Time) *tokenBucketLimiter {
+	return &tokenBucketLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		overrides: overrides,
+		now:       now,
+		buckets:   map[string]*tokenBucket{},
+	}
+}
+
+// Allow implements RateLimiter.
+func (l *tokenBucketLimiter) Allow(pID string, n int) bool {
+	rate := l.rate
+	if r, ok := l.overrides[pID]; ok {
+		rate = r
+	}
+	if rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok := l.buckets[pID]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[pID] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < math.Min(float64(n), l.burst) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// RetryAfter implements RetryAfterLimiter.
+func (l *tokenBucketLimiter) RetryAfter(pID string, n int) time.Duration {
+	rate := l.rate
+	if r, ok := l.overrides[pID]; ok {
+		rate = r
+	}
+	if rate <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tokens := l.burst
+	if b, ok := l.buckets[pID]; ok {
+		tokens = math.Min(l.burst, b.tokens+l.now().Sub(b.last).Seconds()*rate)
+	}
+	missing := math.Min(float64(n), l.burst) - tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(missing / rate * float64(time.Second)))
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTokenBucketLimiter(2, 4, map[string]float64{"noisy": 1, "trusted": 0}, func() time.Time { return now })
+
+	steps := []struct {
+		desc    string
+		advance time.Duration
+		pID     string
+		n       int
+		want    bool
+	}{
+		{desc: "full bucket", pID: "p1", n: 4, want: true},
+		{desc: "bucket drained", pID: "p1", n: 1, want: false},
+		{desc: "other projects unaffected", pID: "p2", n: 1, want: true},
+		{desc: "refilled at the rate", advance: time.Second, pID: "p1", n: 2, want: true},
+		{desc: "drained again", pID: "p1", n: 1, want: false},
+		{desc: "batch larger than the burst needs a full bucket", advance: time.Second, pID: "p1", n: 10, want: false},
+		{desc: "batch larger than the burst", advance: time.Second, pID: "p1", n: 10, want: true},
+		{desc: "excess is paid back", advance: 3 * time.Second, pID: "p1", n: 1, want: false},
+		{desc: "override rate", pID: "noisy", n: 4, want: true},
+		{desc: "override rate refills slower", advance: time.Second, pID: "noisy", n: 2, want: false},
+		{desc: "unthrottled override", pID: "trusted", n: 1000, want: true},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		if got := l.Allow(step.pID, step.n); got != step.want {
+			t.Errorf("%s: Allow(%q, %d) = %v, want %v", step.desc, step.pID, step.n, got, step.want)
+		}
+	}
+}
+
+func TestTokenBucketLimiter_RetryAfter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTokenBucketLimiter(2, 4, map[string]float64{"trusted": 0}, func() time.Time { return now })
+	l.Allow("p1", 4)
+	now = now.Add(250 * time.Millisecond)
+
+	tests := []struct {
+		desc string
+		pID  string
+		n    int
+		want time.Duration
+	}{
+		{desc: "idle project", pID: "p2", n: 4, want: 0},
+		{desc: "partly refilled", pID: "p1", n: 1, want: 250 * time.Millisecond},
+		{desc: "several creates", pID: "p1", n: 3, want: 1250 * time.Millisecond},
+		{desc: "batch larger than the burst waits for a full bucket", pID: "p1", n: 10, want: 1750 * time.Millisecond},
+		{desc: "unthrottled override", pID: "trusted", n: 1000, want: 0},
+	}
+	for _, tt := range tests {
+		if got := l.RetryAfter(tt.pID, tt.n); got != tt.want {
+			t.Errorf("%s: RetryAfter(%q, %d) = %v, want %v", tt.desc, tt.pID, tt.n, got, tt.want)
+		}
+	}
+}
+
+// retryDelay returns the delay of the RetryInfo detail of err, or -1 if it has none.
+func retryDelay(err error) time.Duration {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration()
+		}
+	}
+	return -1
+}
+
+// denyLimiter is a RateLimiter throttling every project.
+type denyLimiter struct{}
+
+func (denyLimiter) Allow(string, int) bool {
+	return false
+}
+
+func TestStore_OccurrenceRateLimit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	o := &pb.Occurrence{NoteName: "projects/p1/notes/n1"}
+
+	s := newStore(db, &Config{PaginationKey: paginationKey, OccurrenceRateLimit: 1})
+	mock.ExpectQuery("INSERT INTO occurrences").WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	if _, err := s.CreateOccurrence(context.Background(), "p1", "", o); err != nil {
+		t.Fatalf("CreateOccurrence() error = %v", err)
+	}
+	_, err = s.CreateOccurrence(context.Background(), "p1", "", o)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("throttled CreateOccurrence() error = %v, want ResourceExhausted", err)
+	}
+	// The bucket refills at one create per second.
+	if d := retryDelay(err); d <= 0 || d > time.Second {
+		t.Errorf("throttled CreateOccurrence() retry delay = %v, want in (0, 1s]", d)
+	}
+
+	s.SetRateLimiter(denyLimiter{})
+	created, errs := s.BatchCreateOccurrences(context.Background(), "p1", "", []*pb.Occurrence{o, o})
+	if len(created) != 0 || len(errs) != 1 || status.Code(errs[0]) != codes.ResourceExhausted {
+		t.Errorf("throttled BatchCreateOccurrences() = %v, %v, want ResourceExhausted", created, errs)
+	} else if d := retryDelay(errs[0]); d != defaultRetryDelay {
+		t.Errorf("throttled BatchCreateOccurrences() retry delay = %v, want %v", d, defaultRetryDelay)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
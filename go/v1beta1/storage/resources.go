@@ -0,0 +1,78 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// occurrenceResourceURI returns the resource_uri column value of o.
+func occurrenceResourceURI(o *pb.Occurrence) sql.NullString {
+	uri := o.GetResource().GetUri()
+	return sql.NullString{String: uri, Valid: uri != ""}
+}
+
+// ListDistinctResourceURIs lists the distinct URIs of the resources of the occurrences of
+// project pID, in lexical order, e.g. for an artifact inventory. Pages resume after the last
+// URI of the previous page, so URIs are neither skipped nor repeated as occurrences are
+// created. Occurrences stored before their resource URI was promoted to its column are not
+// listed until RebuildDerivedColumns is run. Invalid and expired page tokens are rejected with
+// InvalidArgument.
+func (pg *PgSQLStore) ListDistinctResourceURIs(ctx context.Context, pID string, pageSize int32, pageToken string) ([]string, string, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	if pageSize <= 0 {
+		return nil, "", status.Error(codes.InvalidArgument, "Page size must be positive")
+	}
+	var after string
+	if pageToken != "" {
+		cursor := decryptCursor(pageToken, pg.paginationKey, pg.pageTokenTTL("ListDistinctResourceURIs"))
+		if cursor.Key == nil {
+			return nil, "", status.Error(codes.InvalidArgument, "Invalid page token")
+		}
+		after = *cursor.Key
+	}
+	// One more URI than requested is read to tell whether there is a next page.
+	rows, err := pg.queryContext(ctx, listResourceURIs, pID, after, pageSize+1)
+	if err != nil {
+		return nil, "", dbError(err, "Failed to list resource URIs from database")
+	}
+	defer rows.Close()
+
+	var uris []string
+	for rows.Next() {
+		if len(uris) == int(pageSize) {
+			last := uris[len(uris)-1]
+			encryptedPage, err := encryptCursor(pageCursor{Key: &last}, pg.paginationKey)
+			if err != nil {
+				return nil, "", status.Error(codes.Internal, "Failed to paginate resource URIs")
+			}
+			return uris, encryptedPage, nil
+		}
+		var uri string
+		if err := rows.Scan(&uri); err != nil {
+			return nil, "", status.Error(codes.Internal, "Failed to scan resource URIs row")
+		}
+		uris = append(uris, uri)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", dbError(err, "Failed to list resource URIs from database")
+	}
+	return uris, "", nil
+}
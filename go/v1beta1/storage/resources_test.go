@@ -0,0 +1,84 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStore_ListDistinctResourceURIs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	ctx := context.Background()
+	const (
+		a = "https://gcr.io/p/a@sha256:1"
+		b = "https://gcr.io/p/b@sha256:2"
+		c = "https://gcr.io/p/c@sha256:3"
+	)
+
+	mock.ExpectQuery(regexp.QuoteMeta(listResourceURIs)).WithArgs(pid, "", 3).
+		WillReturnRows(sqlmock.NewRows([]string{"resource_uri"}).AddRow(a).AddRow(b).AddRow(c))
+	got, token, err := s.ListDistinctResourceURIs(ctx, pid, 2, "")
+	if err != nil {
+		t.Fatalf("ListDistinctResourceURIs() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, []string{a, b}) || token == "" {
+		t.Fatalf("ListDistinctResourceURIs() = %v, %q; want %v and a page token", got, token, []string{a, b})
+	}
+
+	// The next page resumes after the last URI of the previous one.
+	mock.ExpectQuery(regexp.QuoteMeta(listResourceURIs)).WithArgs(pid, b, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"resource_uri"}).AddRow(c))
+	got, token, err = s.ListDistinctResourceURIs(ctx, pid, 2, token)
+	if err != nil {
+		t.Fatalf("ListDistinctResourceURIs() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, []string{c}) || token != "" {
+		t.Errorf("ListDistinctResourceURIs() = %v, %q; want %v and no page token", got, token, []string{c})
+	}
+
+	other, err := encryptCursor(pageCursor{ID: 2}, paginationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.ListDistinctResourceURIs(ctx, pid, 2, other); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListDistinctResourceURIs() with a ListOccurrences token error = %v, want InvalidArgument", err)
+	}
+	if _, _, err := s.ListDistinctResourceURIs(ctx, pid, 0, ""); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListDistinctResourceURIs() with no page size error = %v, want InvalidArgument", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestRebuildDerivedColumns_ResourceURI(t *testing.T) {
+	query := rebuildDerivedColumnsQuery("occurrences", occurrenceDerivedColumns)
+	if !strings.Contains(query, `"resource_uri" = data->'resource'->>'uri'`) {
+		t.Errorf("rebuild query does not backfill resource_uri: %s", query)
+	}
+}
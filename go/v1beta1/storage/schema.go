@@ -0,0 +1,47 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+)
+
+// undefinedTable is the SQLSTATE of queries of tables that do not exist.
+const undefinedTable = "42P01"
+
+// checkSchemaVersion checks that the schema of db, as recorded in schema_migrations, is at
+// version want and that no migration was left half-applied.
+func checkSchemaVersion(ctx context.Context, db *sql.DB, want int64) error {
+	var version int64
+	var dirty bool
+	err := db.QueryRowContext(ctx, schemaVersion).Scan(&version, &dirty)
+	var pqErr *pq.Error
+	switch {
+	case err == sql.ErrNoRows, errors.As(err, &pqErr) && pqErr.Code == undefinedTable:
+		return fmt.Errorf("database schema has no recorded version, binary expects v%d; has it been migrated?", want)
+	case err != nil:
+		return fmt.Errorf("failed to read the database schema version, err: %v", err)
+	case dirty:
+		return fmt.Errorf("database schema is at v%d, left dirty by a failed migration; binary expects v%d", version, want)
+	case version != want:
+		return fmt.Errorf("database schema is at v%d, binary expects v%d", version, want)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+)
+
+func TestNewStoreWithCustomConnectorConfig_SchemaVersion(t *testing.T) {
+	tests := []struct {
+		desc    string
+		rows    *sqlmock.Rows
+		err     error
+		wantErr string
+	}{
+		{desc: "expected version", rows: sqlmock.NewRows([]string{"version", "dirty"}).AddRow(7, false)},
+		{desc: "older schema", rows: sqlmock.NewRows([]string{"version", "dirty"}).AddRow(6, false), wantErr: "database schema is at v6, binary expects v7"},
+		{desc: "newer schema", rows: sqlmock.NewRows([]string{"version", "dirty"}).AddRow(8, false), wantErr: "database schema is at v8, binary expects v7"},
+		{desc: "dirty schema", rows: sqlmock.NewRows([]string{"version", "dirty"}).AddRow(7, true), wantErr: "left dirty by a failed migration"},
+		{desc: "no version", err: sql.ErrNoRows, wantErr: "no recorded version"},
+		{desc: "no migrations table", err: &pq.Error{Code: "42P01"}, wantErr: "no recorded version"},
+	}
+	for i, tt := range tests {
+		dsn := fmt.Sprintf("schema-version-%d", i)
+		db, mock, err := sqlmock.NewWithDSN(dsn)
+		if err != nil {
+			t.Fatalf("failed to create sqlmock: %v", err)
+		}
+		query := mock.ExpectQuery(regexp.QuoteMeta(schemaVersion))
+		if tt.rows != nil {
+			query.WillReturnRows(tt.rows)
+		} else {
+			query.WillReturnError(tt.err)
+		}
+		// The schema is only created once its version is checked.
+		if tt.wantErr == "" {
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS projects").WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		s, err := NewStoreWithCustomConnectorConfig(context.Background(), &mockConnector{dsn: dsn, drv: db.Driver()}, &Config{
+			PaginationKey: paginationKey,
+			SchemaVersion: 7,
+		})
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: NewStoreWithCustomConnectorConfig() error = %v", tt.desc, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: NewStoreWithCustomConnectorConfig() error = %v, want %q", tt.desc, err, tt.wantErr)
+		}
+		if s != nil {
+			s.Close()
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: unfulfilled expectations: %v", tt.desc, err)
+		}
+		db.Close()
+	}
+}
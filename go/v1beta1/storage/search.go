@@ -0,0 +1,91 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// syntaxError is the SQLSTATE of invalid text search queries, among other syntax errors.
+const syntaxError = "42601"
+
+// tsQueryOperators are the characters of the operators of to_tsquery.
+const tsQueryOperators = "&|!()<>:*'"
+
+// SearchOccurrences returns the occurrences of project pID whose string values, such as their
+// resource URI or package names, match the text search query, best matches first. query is
+// written as for PostgreSQL's to_tsquery, e.g. "openssl & !libssl", and words it lists without
+// operators must all match, e.g. "openssl debian" is "openssl & debian". Words are normalized
+// by the text search configuration of the store. It fails with FailedPrecondition unless the
+// store is configured with TextSearchConfig.
+func (pg *PgSQLStore) SearchOccurrences(ctx context.Context, pID, query string) ([]*pb.Occurrence, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	if pg.textSearchConfig == "" {
+		return nil, status.Error(codes.FailedPrecondition, "Text search is disabled")
+	}
+	query = tsQuery(query)
+	if query == "" {
+		return nil, status.Error(codes.InvalidArgument, "Search query must not be empty")
+	}
+	rows, err := pg.queryContext(ctx, searchOccurrences, pID, pg.textSearchConfig, query)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == syntaxError {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid search query %q: %s", query, pqErr.Message)
+		}
+		log.Println("Failed to search Occurrences", err)
+		return nil, dbError(err, "Failed to search Occurrences")
+	}
+	defer rows.Close()
+
+	var os []*pb.Occurrence
+	for rows.Next() {
+		var oID string
+		var data []byte
+		if err := rows.Scan(&oID, &data); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to scan Occurrences row")
+		}
+		var o pb.Occurrence
+		if err := protojson.Unmarshal(data, &o); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+		}
+		// Set the output-only field before returning
+		o.Name = name.FormatOccurrence(pID, oID)
+		os = append(os, &o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err, "Failed to search Occurrences")
+	}
+	return os, nil
+}
+
+// tsQuery returns the to_tsquery query of the search query q: q as is if it has operators,
+// or its words joined with "&" otherwise.
+func tsQuery(q string) string {
+	if strings.ContainsAny(q, tsQueryOperators) {
+		return strings.TrimSpace(q)
+	}
+	return strings.Join(strings.Fields(q), " & ")
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/grafeas/grafeas/go/name"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStore_SearchOccurrences(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, TextSearchConfig: "simple"})
+
+	mock.ExpectQuery(regexp.QuoteMeta(searchOccurrences)).
+		WithArgs(pid, "simple", "openssl & debian").
+		WillReturnRows(sqlmock.NewRows([]string{"occurrence_name", "data"}).
+			AddRow("o2", `{"resource":{"uri":"deb://debian/openssl"}}`).
+			AddRow("o1", `{"resource":{"uri":"deb://debian/libssl"}}`))
+	os, err := s.SearchOccurrences(context.Background(), pid, " openssl  debian ")
+	if err != nil {
+		t.Fatalf("SearchOccurrences() got error %v", err)
+	}
+	want := []string{name.FormatOccurrence(pid, "o2"), name.FormatOccurrence(pid, "o1")}
+	if len(os) != len(want) {
+		t.Fatalf("SearchOccurrences() returned %d occurrences, want %d", len(os), len(want))
+	}
+	for i, o := range os {
+		if o.Name != want[i] {
+			t.Errorf("SearchOccurrences()[%d].Name = %q, want %q", i, o.Name, want[i])
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStore_SearchOccurrencesErrors(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config string
+		query  string
+		dbErr  error
+		want   codes.Code
+	}{
+		{desc: "disabled", query: "openssl", want: codes.FailedPrecondition},
+		{desc: "empty query", config: "simple", query: "  ", want: codes.InvalidArgument},
+		{desc: "invalid query", config: "simple", query: "openssl &", dbErr: &pq.Error{Code: syntaxError, Message: "syntax error in tsquery"}, want: codes.InvalidArgument},
+		{desc: "database error", config: "simple", query: "openssl", dbErr: &pq.Error{Code: "XX000"}, want: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey, TextSearchConfig: tt.config})
+			if tt.dbErr != nil {
+				mock.ExpectQuery(regexp.QuoteMeta(searchOccurrences)).WillReturnError(tt.dbErr)
+			}
+			_, err = s.SearchOccurrences(context.Background(), pid, tt.query)
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("SearchOccurrences() = %v, want code %v", err, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestTSQuery(t *testing.T) {
+	tests := []struct {
+		q, want string
+	}{
+		{q: "openssl", want: "openssl"},
+		{q: "openssl debian  buster", want: "openssl & debian & buster"},
+		{q: "openssl | libssl", want: "openssl | libssl"},
+		{q: " open:* ", want: "open:*"},
+		{q: " ", want: ""},
+	}
+	for _, tt := range tests {
+		if got := tsQuery(tt.q); got != tt.want {
+			t.Errorf("tsQuery(%q) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestTextSearchDDL(t *testing.T) {
+	ddl := textSearchDDL("english", "fast")
+	for _, want := range []string{
+		`jsonb_to_tsvector('english'::regconfig, data, '["string"]')`,
+		`USING GIN (search_vector) TABLESPACE "fast";`,
+	} {
+		if !strings.Contains(ddl, want) {
+			t.Errorf("textSearchDDL() = %q, want it to contain %q", ddl, want)
+		}
+	}
+}
+
+func TestValidateConfig_TextSearchConfig(t *testing.T) {
+	tests := []struct {
+		config  Config
+		wantErr bool
+	}{
+		{config: Config{TextSearchConfig: "english"}},
+		{config: Config{TextSearchConfig: "english'; DROP TABLE occurrences; --"}, wantErr: true},
+		{config: Config{TextSearchConfig: "simple", Dialect: dialectCockroach}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateConfig(&tt.config); (err != nil) != tt.wantErr {
+			t.Errorf("validateConfig(%+v) = %v, want error %v", tt.config, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// sessionConnector wraps a connector to apply session settings to each connection it opens,
+// so that every pooled connection has the same settings whichever request opened it.
+type sessionConnector struct {
+	driver.Connector
+	// query sets the settings, whose names and values are args.
+	query string
+	args  []driver.NamedValue
+}
+
+// newSessionConnector returns a connector applying settings, e.g. {"jit": "off"}, to the
+// connections opened by connector. The settings are applied with set_config, which is
+// equivalent to SET but takes its arguments as parameters: values are interpreted as in
+// postgresql.conf, so that e.g. a search_path of "a, b" lists two schemas.
+func newSessionConnector(connector driver.Connector, settings map[string]string) *sessionConnector {
+	names := make([]string, 0, len(settings))
+	for n := range settings {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	c := &sessionConnector{Connector: connector}
+	var calls []string
+	for i, n := range names {
+		calls = append(calls, fmt.Sprintf("set_config($%d, $%d, false)", 2*i+1, 2*i+2))
+		c.args = append(c.args,
+			driver.NamedValue{Ordinal: 2*i + 1, Value: n},
+			driver.NamedValue{Ordinal: 2*i + 2, Value: settings[n]})
+	}
+	c.query = "SELECT " + strings.Join(calls, ", ")
+	return c
+}
+
+// Connect opens a connection and applies the session settings to it.
+func (c *sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.apply(ctx, conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to apply session settings, err: %v", err)
+	}
+	return conn, nil
+}
+
+// apply runs the settings query on conn.
+func (c *sessionConnector) apply(ctx context.Context, conn driver.Conn) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(ctx, c.query, c.args)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+	stmt, err := conn.Prepare(c.query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	values := make([]driver.Value, len(c.args))
+	for i, a := range c.args {
+		values[i] = a.Value
+	}
+	_, err = stmt.Exec(values)
+	return err
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql/driver"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+)
+
+// mockConnector connects to a sqlmock database.
+type mockConnector struct {
+	dsn string
+	drv driver.Driver
+}
+
+func (c *mockConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.drv.Open(c.dsn)
+}
+
+func (c *mockConnector) Driver() driver.Driver {
+	return c.drv
+}
+
+func TestNewStoreWithCustomConnectorConfig_SessionSettings(t *testing.T) {
+	db, mock, err := sqlmock.NewWithDSN("session-settings")
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	settings := map[string]string{"search_path": "grafeas, public", "jit": "off"}
+	query := regexp.QuoteMeta("SELECT set_config($1, $2, false), set_config($3, $4, false)")
+	// The startup ping opens the first connection, and prewarming two more.
+	mock.ExpectExec(query).WithArgs("jit", "off", "search_path", "grafeas, public").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS projects").WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < 2; i++ {
+		mock.ExpectExec(query).WithArgs("jit", "off", "search_path", "grafeas, public").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	s, err := NewStoreWithCustomConnectorConfig(context.Background(), &mockConnector{dsn: "session-settings", drv: db.Driver()}, &Config{
+		PaginationKey:   paginationKey,
+		SessionSettings: settings,
+		PrewarmConns:    3,
+	})
+	if err != nil {
+		t.Fatalf("NewStoreWithCustomConnectorConfig() error = %v", err)
+	}
+	defer s.Close()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestNewStoreWithCustomConnectorConfig_InvalidSessionSetting(t *testing.T) {
+	db, mock, err := sqlmock.NewWithDSN("invalid-session-setting")
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	mock.ExpectExec("set_config").WillReturnError(&pq.Error{Code: "42704", Message: `unrecognized configuration parameter "no_such_setting"`})
+
+	_, err = NewStoreWithCustomConnectorConfig(context.Background(), &mockConnector{dsn: "invalid-session-setting", drv: db.Driver()}, &Config{
+		PaginationKey:   paginationKey,
+		SessionSettings: map[string]string{"no_such_setting": "on"},
+	})
+	if err == nil {
+		t.Fatalf("NewStoreWithCustomConnectorConfig() succeeded, want error")
+	}
+}
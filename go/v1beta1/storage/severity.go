@@ -0,0 +1,102 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	vpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// severityColumn is the column of the occurrences table promoted from the severity of
+// vulnerability occurrences, holding the numeric value of the severity enum so that
+// severities may be compared by rank. It is NULL for other occurrences and for
+// vulnerabilities of unspecified severity.
+const severityColumn = "severity"
+
+// severityDerivation derives severityColumn from the data column. protojson writes enums
+// by name, so the names are mapped back to their numbers.
+var severityDerivation = enumDerivation("data->'vulnerability'->>'severity'", vpb.Severity_value)
+
+// occurrenceSeverity returns the severityColumn value of o.
+func occurrenceSeverity(o *pb.Occurrence) sql.NullInt64 {
+	s := o.GetVulnerability().GetSeverity()
+	if s == vpb.Severity_SEVERITY_UNSPECIFIED {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(s), Valid: true}
+}
+
+// OccurrenceSeverityHistogram counts the occurrences of project pID matching filter by
+// severity, keyed by severity name, in a single query over the severity column. Occurrences
+// without a severity, including those which are not vulnerabilities, are counted under
+// SEVERITY_UNSPECIFIED; filter on kind = "VULNERABILITY" to leave them out. Severities
+// without occurrences are omitted.
+func (pg *PgSQLStore) OccurrenceSeverityHistogram(ctx context.Context, pID, filter string) (map[string]int64, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	filterQuery, filterArgs, err := pg.filterClause(filter, occurrenceColumns, 1)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(occurrenceSeverityHistogram, filterQuery)
+	rows, err := pg.queryContext(ctx, query, append([]interface{}{pID}, filterArgs...)...)
+	if err != nil {
+		log.Println("Failed to count Occurrences by severity", err)
+		return nil, dbError(err, "Failed to count Occurrences by severity")
+	}
+	defer rows.Close()
+
+	counts := map[string]int64{}
+	for rows.Next() {
+		var severity sql.NullInt64
+		var count int64
+		if err := rows.Scan(&severity, &count); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to scan Occurrences severity row")
+		}
+		counts[vpb.Severity(severity.Int64).String()] += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err, "Failed to count Occurrences by severity")
+	}
+	return counts, nil
+}
+
+// enumDerivation returns a CASE expression mapping the enum names extracted by field to
+// their values. Zero values are not mapped: protojson omits them, so they derive NULL
+// like absent fields.
+func enumDerivation(field string, values map[string]int32) string {
+	var names []string
+	for n, v := range values {
+		if v != 0 {
+			names = append(names, n)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return values[names[i]] < values[names[j]] })
+	var b strings.Builder
+	fmt.Fprintf(&b, "CASE %s", field)
+	for _, n := range names {
+		fmt.Fprintf(&b, " WHEN %s THEN %d", quoteLiteral(n), values[n])
+	}
+	b.WriteString(" END")
+	return b.String()
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	vpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSeverityDerivation(t *testing.T) {
+	want := "CASE data->'vulnerability'->>'severity' WHEN 'MINIMAL' THEN 1 WHEN 'LOW' THEN 2 WHEN 'MEDIUM' THEN 3 WHEN 'HIGH' THEN 4 WHEN 'CRITICAL' THEN 5 END"
+	if severityDerivation != want {
+		t.Errorf("severityDerivation = %q, want %q", severityDerivation, want)
+	}
+}
+
+func TestOccurrenceSeverity(t *testing.T) {
+	tests := map[string]struct {
+		o    *pb.Occurrence
+		want sql.NullInt64
+	}{
+		"high": {
+			o:    &pb.Occurrence{Details: &pb.Occurrence_Vulnerability{Vulnerability: &vpb.Details{Severity: vpb.Severity_HIGH}}},
+			want: sql.NullInt64{Int64: 4, Valid: true},
+		},
+		"unspecified": {
+			o: &pb.Occurrence{Details: &pb.Occurrence_Vulnerability{Vulnerability: &vpb.Details{}}},
+		},
+		"not a vulnerability": {
+			o: &pb.Occurrence{},
+		},
+	}
+	for label, tt := range tests {
+		if got := occurrenceSeverity(tt.o); got != tt.want {
+			t.Errorf("%s: occurrenceSeverity() = %v, want %v", label, got, tt.want)
+		}
+	}
+}
+
+func TestStore_CreateOccurrenceSeverity(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WithArgs(pid, sqlmock.AnyArg(), pid, nid, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, int64(vpb.Severity_CRITICAL), sqlmock.AnyArg(), nil, nil, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	o := &pb.Occurrence{
+		NoteName: "projects/" + pid + "/notes/" + nid,
+		Details:  &pb.Occurrence_Vulnerability{Vulnerability: &vpb.Details{Severity: vpb.Severity_CRITICAL}},
+	}
+	if _, err := s.CreateOccurrence(context.Background(), pid, "", o); err != nil {
+		t.Fatalf("CreateOccurrence() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_OccurrenceSeverityHistogram(t *testing.T) {
+	tests := []struct {
+		desc   string
+		filter string
+		where  string
+		args   []driver.Value
+		rows   *sqlmock.Rows
+		want   map[string]int64
+	}{
+		{
+			desc: "mixed severities",
+			rows: sqlmock.NewRows([]string{"severity", "count"}).
+				AddRow(nil, 3).
+				AddRow(int64(vpb.Severity_LOW), 1).
+				AddRow(int64(vpb.Severity_HIGH), 5).
+				AddRow(int64(vpb.Severity_CRITICAL), 2),
+			want: map[string]int64{"SEVERITY_UNSPECIFIED": 3, "LOW": 1, "HIGH": 5, "CRITICAL": 2},
+		},
+		{
+			desc:   "filtered",
+			filter: `severity >= "HIGH"`,
+			where:  "AND (COALESCE(severity >= $2, FALSE))",
+			args:   []driver.Value{int64(vpb.Severity_HIGH)},
+			rows: sqlmock.NewRows([]string{"severity", "count"}).
+				AddRow(int64(vpb.Severity_HIGH), 5),
+			want: map[string]int64{"HIGH": 5},
+		},
+		{
+			desc: "no occurrences",
+			rows: sqlmock.NewRows([]string{"severity", "count"}),
+			want: map[string]int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey})
+
+			mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(occurrenceSeverityHistogram, tt.where))).
+				WithArgs(append([]driver.Value{"p1"}, tt.args...)...).
+				WillReturnRows(tt.rows)
+			got, err := s.OccurrenceSeverityHistogram(context.Background(), "p1", tt.filter)
+			if err != nil {
+				t.Fatalf("OccurrenceSeverityHistogram() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("OccurrenceSeverityHistogram() = %v, want %v", got, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestStore_OccurrenceSeverityHistogramInvalidFilter(t *testing.T) {
+	s := newStore(nil, &Config{PaginationKey: paginationKey})
+	if _, err := s.OccurrenceSeverityHistogram(context.Background(), "p1", `severity >= "SEVERE"`); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("OccurrenceSeverityHistogram() error = %v, want InvalidArgument", err)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// SlowQueryObserver is called with the store operation, e.g. "ListOccurrences", and the
+// duration of each query exceeding the slow query threshold, e.g. to record it as a metric.
+type SlowQueryObserver func(op string, elapsed time.Duration)
+
+// SetSlowQueryObserver sets the observer of slow queries, in addition to their being logged.
+// It must be called before the store is used; a nil observer removes it. Queries are
+// only timed if the store is configured with SlowQueryThreshold.
+func (pg *PgSQLStore) SetSlowQueryObserver(o SlowQueryObserver) {
+	pg.slowQueryObserver = o
+}
+
+// observeQuery logs and reports the query run with ctx and started at start if it exceeded
+// the slow query threshold, as a query of the store operation ctx is tagged with.
+func (pg *PgSQLStore) observeQuery(ctx context.Context, start time.Time) {
+	if pg.slowQueryThreshold <= 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	if elapsed < pg.slowQueryThreshold {
+		return
+	}
+	op := queryOperation(ctx)
+	log.Printf("Slow query in %s took %v", op, elapsed)
+	if pg.slowQueryObserver != nil {
+		pg.slowQueryObserver(op, elapsed)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+)
+
+func TestStore_SlowQueryObserver(t *testing.T) {
+	for _, tt := range []struct {
+		threshold string
+		delay     time.Duration
+		wantSlow  bool
+	}{
+		{threshold: "10ms", delay: 50 * time.Millisecond, wantSlow: true},
+		{threshold: "1h", delay: 0, wantSlow: false},
+		// Without a threshold queries are not timed.
+		{threshold: "", delay: 50 * time.Millisecond, wantSlow: false},
+	} {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		s := newStore(db, &Config{PaginationKey: paginationKey, SlowQueryThreshold: tt.threshold})
+		var ops []string
+		var elapsed time.Duration
+		s.SetSlowQueryObserver(func(op string, d time.Duration) {
+			ops = append(ops, op)
+			elapsed = d
+		})
+		mock.ExpectQuery(regexp.QuoteMeta(searchNote)).WithArgs(pid, nid).WillDelayFor(tt.delay).
+			WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow("{}"))
+		if _, err := s.GetNote(context.Background(), pid, nid); err != nil {
+			t.Fatalf("GetNote() error = %v", err)
+		}
+		if !tt.wantSlow {
+			if len(ops) != 0 {
+				t.Errorf("threshold %q: observed %v, want no slow queries", tt.threshold, ops)
+			}
+		} else if len(ops) != 1 || ops[0] != "GetNote" || elapsed < tt.delay {
+			t.Errorf("threshold %q: observed %v taking %v, want GetNote taking at least %v", tt.threshold, ops, elapsed, tt.delay)
+		}
+		db.Close()
+	}
+}
+
+func TestStore_SlowQueryOperationOfHelper(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, SlowQueryThreshold: "10ms"})
+	var ops []string
+	s.SetSlowQueryObserver(func(op string, d time.Duration) {
+		ops = append(ops, op)
+	})
+	// The insert is run by a helper of CreateOccurrence, which is reported instead.
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WithArgs(pid, sqlmock.AnyArg(), pid, nid, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg(), nil, nil, nil).
+		WillDelayFor(50 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	if _, err := s.CreateOccurrence(context.Background(), pid, "", &pb.Occurrence{NoteName: name.FormatNote(pid, nid)}); err != nil {
+		t.Fatalf("CreateOccurrence() error = %v", err)
+	}
+	if len(ops) != 1 || ops[0] != "CreateOccurrence" {
+		t.Errorf("observed %v, want CreateOccurrence", ops)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"log"
+
+	"golang.org/x/net/context"
+)
+
+// StorageStats describes the storage consumed by a project.
+type StorageStats struct {
+	// Occurrences and Notes are the numbers of occurrences, including soft-deleted ones, and
+	// notes of the project.
+	Occurrences, Notes int64
+	// ApproximateBytes estimates the size of the stored data of the entities of the project,
+	// from the average sizes of the data of all occurrences and notes gathered by ANALYZE. It
+	// is 0 if the tables have not been analyzed yet, and excludes indexes.
+	ApproximateBytes int64
+}
+
+// ProjectStorageStats returns the storage consumed by project pID, e.g. to identify heavy
+// tenants. The entities are counted from the project indexes, while their size is estimated
+// from table statistics rather than by reading their data.
+func (pg *PgSQLStore) ProjectStorageStats(ctx context.Context, pID string) (*StorageStats, error) {
+	ctx = pg.withQueryTags(ctx, pID)
+	if _, err := pg.GetProject(ctx, pID); err != nil {
+		return nil, err
+	}
+	var stats StorageStats
+	var occurrenceWidth, noteWidth int64
+	err := pg.queryRowContext(ctx, projectStorageStats, pID).Scan(&stats.Occurrences, &stats.Notes, &occurrenceWidth, &noteWidth)
+	if err != nil {
+		log.Println("Failed to query project storage stats", err)
+		return nil, dbError(err, "Failed to query project storage stats from database")
+	}
+	stats.ApproximateBytes = stats.Occurrences*occurrenceWidth + stats.Notes*noteWidth
+	return &stats, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStore_ProjectStorageStats(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+
+	expectProject(mock)
+	mock.ExpectQuery(regexp.QuoteMeta(projectStorageStats)).WithArgs(pid).
+		WillReturnRows(sqlmock.NewRows([]string{"occurrences", "notes", "occurrence_width", "note_width"}).
+			AddRow(int64(1000), int64(10), int64(1500), int64(400)))
+	got, err := s.ProjectStorageStats(context.Background(), pid)
+	if err != nil {
+		t.Fatalf("ProjectStorageStats() error = %v", err)
+	}
+	want := StorageStats{Occurrences: 1000, Notes: 10, ApproximateBytes: 1000*1500 + 10*400}
+	if *got != want {
+		t.Errorf("ProjectStorageStats() = %+v, want %+v", *got, want)
+	}
+
+	// Unknown projects are not reported as empty.
+	mock.ExpectQuery(regexp.QuoteMeta(projectExists)).WithArgs("projects/missing").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	if _, err := s.ProjectStorageStats(context.Background(), "missing"); status.Code(err) != codes.NotFound {
+		t.Errorf("ProjectStorageStats() of a missing project error = %v, want NotFound", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// cacheableQueries is the set of queries eligible for prepared-statement caching.
+// Queries carrying a user filter are assembled per request and are never cached;
+// only their unfiltered form is listed here.
+var cacheableQueries = map[string]bool{
+	insertProject:                                     true,
+	projectExists:                                     true,
+	searchProjectFolded:                               true,
+	deleteProject:                                     true,
+	purgeProjectOccurrences:                           true,
+	purgeProjectNotes:                                 true,
+	fmt.Sprintf(listProjects, ""):                     true,
+	insertOccurrence:                                  true,
+	searchOccurrence:                                  true,
+	searchOccurrenceFolded:                            true,
+	updateOccurrence:                                  true,
+	updateOccurrenceReturningOld:                      true,
+	deleteOccurrence:                                  true,
+	softDeleteOccurrence:                              true,
+	fmt.Sprintf(listOccurrences, ""):                  true,
+	fmt.Sprintf(listOccurrencesBasic, ""):             true,
+	fmt.Sprintf(listOccurrencesByCreateTime, ""):      true,
+	fmt.Sprintf(listOccurrencesBasicByCreateTime, ""): true,
+	listOccurrencesModifiedSince:                      true,
+	insertNote:                                        true,
+	searchNote:                                        true,
+	searchNoteFolded:                                  true,
+	notesExist:                                        true,
+	notesExistFolded:                                  true,
+	updateNote:                                        true,
+	deleteNote:                                        true,
+	fmt.Sprintf(listNotes, ""):                        true,
+	listNoteOccurrences:                               true,
+	listNotesByOccurrenceCount:                        true,
+	listResourceURIs:                                  true,
+	fmt.Sprintf(occurrenceSeverityHistogram, ""):      true,
+	searchOccurrences:                                 true,
+	fmt.Sprintf(streamRawOccurrences, ""):             true,
+	linkOccurrences:                                   true,
+	listLinkedOccurrences:                             true,
+	listLinkingOccurrences:                            true,
+}
+
+// The queries listing occurrences by severity are cacheable in either nulls order.
+func init() {
+	for _, nulls := range severityNullsOrders {
+		cacheableQueries[fmt.Sprintf(listOccurrencesBySeverity, "", nulls[0], nulls[1])] = true
+		cacheableQueries[fmt.Sprintf(listOccurrencesBasicBySeverity, "", nulls[0], nulls[1])] = true
+	}
+}
+
+// stmtCache lazily prepares statements and keeps them for the lifetime of the store.
+type stmtCache struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{
+		db:    db,
+		stmts: map[string]*sql.Stmt{},
+	}
+}
+
+// get returns the prepared statement for query, preparing it on first use.
+func (c *stmtCache) get(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// close closes all cached statements.
+func (c *stmtCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var firstErr error
+	for query, stmt := range c.stmts {
+		if err := stmt.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.stmts, query)
+	}
+	return firstErr
+}
+
+// stmt returns a cached prepared statement for query run with q, or nil if statement caching
+// is disabled, the query is not cacheable, or the statement could not be prepared. Statements
+// are prepared on the pool, so queries run on a single connection taken from it are not
+// prepared.
+func (pg *PgSQLStore) stmt(ctx context.Context, q querier, query string) *sql.Stmt {
+	if pg.stmts == nil || q != querier(pg.db) || !cacheableQueries[query] {
+		return nil
+	}
+	stmt, err := pg.stmts.get(ctx, query)
+	if err != nil {
+		log.Printf("Failed to prepare statement, falling back to unprepared query: %v", err)
+		return nil
+	}
+	return stmt
+}
+
+// execContext executes query, using a cached prepared statement when possible.
+// Like queryContext and queryRowContext, it reports the query if it is slow.
+func (pg *PgSQLStore) execContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	defer pg.observeQuery(ctx, time.Now())
+	q, release, err := pg.acquireConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	query = pg.tagQuery(ctx, query)
+	if stmt := pg.stmt(ctx, q, query); stmt != nil {
+		return stmt.ExecContext(ctx, args...)
+	}
+	return q.ExecContext(ctx, query, args...)
+}
+
+// queryContext runs query, using a cached prepared statement when possible.
+// The rows hold the connection of the query until they are closed.
+func (pg *PgSQLStore) queryContext(ctx context.Context, query string, args ...interface{}) (*tenantRows, error) {
+	defer pg.observeQuery(ctx, time.Now())
+	q, release, err := pg.acquireConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query = pg.tagQuery(ctx, query)
+	var rows *sql.Rows
+	if stmt := pg.stmt(ctx, q, query); stmt != nil {
+		rows, err = stmt.QueryContext(ctx, args...)
+	} else {
+		rows, err = q.QueryContext(ctx, query, args...)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &tenantRows{Rows: rows, release: release}, nil
+}
+
+// queryRowContext runs query, using a cached prepared statement when possible.
+// The row holds the connection of the query until it is scanned.
+func (pg *PgSQLStore) queryRowContext(ctx context.Context, query string, args ...interface{}) *tenantRow {
+	defer pg.observeQuery(ctx, time.Now())
+	q, release, err := pg.acquireConn(ctx)
+	if err != nil {
+		return &tenantRow{err: err}
+	}
+	query = pg.tagQuery(ctx, query)
+	if stmt := pg.stmt(ctx, q, query); stmt != nil {
+		return &tenantRow{row: stmt.QueryRowContext(ctx, args...), release: release}
+	}
+	return &tenantRow{row: q.QueryRowContext(ctx, query, args...), release: release}
+}
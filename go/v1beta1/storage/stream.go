@@ -0,0 +1,113 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// StreamOccurrences calls fn with each occurrence of project pID matching filter, in creation
+// order, as an alternative to paging through ListOccurrences for very large result sets. fn is
+// called synchronously and the next row is only read once it returns, so a consumer sending
+// each occurrence on a gRPC stream, whose Send blocks under flow control, paces the scan: rows
+// wait in the database connection rather than in memory. Streaming stops at the first error
+// returned by fn, which StreamOccurrences returns as is.
+func (pg *PgSQLStore) StreamOccurrences(ctx context.Context, pID, filter string, fn func(*pb.Occurrence) error) error {
+	ctx = pg.withQueryTags(ctx, pID)
+	filterQuery, filterArgs, err := pg.filterClause(filter, occurrenceColumns, 1)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(streamOccurrences, filterQuery)
+	rows, err := pg.queryContext(ctx, query, append([]interface{}{pID}, filterArgs...)...)
+	if err != nil {
+		return dbError(err, "Failed to stream Occurrences from database")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oID string
+		var data []byte
+		if err := rows.Scan(&oID, &data); err != nil {
+			return status.Error(codes.Internal, "Failed to scan Occurrences row")
+		}
+		var o pb.Occurrence
+		if err := protojson.Unmarshal(data, &o); err != nil {
+			return status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+		}
+		// Set the output-only field before returning
+		o.Name = name.FormatOccurrence(pID, oID)
+		if err := fn(&o); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return dbError(err, "Failed to stream Occurrences from database")
+	}
+	return nil
+}
+
+// StreamRawOccurrences writes the occurrences of project pID matching filter to w, in creation
+// order, as newline-delimited JSON: the data column of each occurrence as the database returns
+// it, without the proto round trip of StreamOccurrences, e.g. for bulk exports to analytics
+// systems. The JSON is that of the stored occurrences, whatever version of the proto wrote
+// them, and is not normalized; output-only fields, such as the name, are as stored.
+func (pg *PgSQLStore) StreamRawOccurrences(ctx context.Context, pID, filter string, w io.Writer) error {
+	ctx = pg.withQueryTags(ctx, pID)
+	filterQuery, filterArgs, err := pg.filterClause(filter, occurrenceColumns, 1)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(streamRawOccurrences, filterQuery)
+	rows, err := pg.queryContext(ctx, query, append([]interface{}{pID}, filterArgs...)...)
+	if err != nil {
+		return dbError(err, "Failed to stream Occurrences from database")
+	}
+	defer rows.Close()
+	bw := bufio.NewWriter(w)
+	for rows.Next() {
+		// The data is only valid until the next row is read, which saves copying it.
+		var data sql.RawBytes
+		if err := rows.Scan(&data); err != nil {
+			return status.Error(codes.Internal, "Failed to scan Occurrences row")
+		}
+		if _, err := bw.Write(data); err != nil {
+			log.Println("Failed to write Occurrences", err)
+			return status.Error(codes.Internal, "Failed to write Occurrences")
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			log.Println("Failed to write Occurrences", err)
+			return status.Error(codes.Internal, "Failed to write Occurrences")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return dbError(err, "Failed to stream Occurrences from database")
+	}
+	if err := bw.Flush(); err != nil {
+		log.Println("Failed to write Occurrences", err)
+		return status.Error(codes.Internal, "Failed to write Occurrences")
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pacedConnector connects to a sqlmock database, recording when each result row is read
+// from the driver.
+type pacedConnector struct {
+	dsn string
+	drv driver.Driver
+
+	mu    sync.Mutex
+	reads []time.Time
+}
+
+func (c *pacedConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.drv.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &pacedConn{Conn: conn, c: c}, nil
+}
+
+func (c *pacedConnector) Driver() driver.Driver {
+	return c.drv
+}
+
+type pacedConn struct {
+	driver.Conn
+	c *pacedConnector
+}
+
+func (conn *pacedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := conn.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &pacedRows{Rows: rows, c: conn.c}, nil
+}
+
+type pacedRows struct {
+	driver.Rows
+	c *pacedConnector
+}
+
+func (r *pacedRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == nil {
+		r.c.mu.Lock()
+		r.c.reads = append(r.c.reads, time.Now())
+		r.c.mu.Unlock()
+	}
+	return err
+}
+
+func TestStore_StreamOccurrencesBackpressure(t *testing.T) {
+	db, mock, err := sqlmock.NewWithDSN("stream-backpressure")
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	connector := &pacedConnector{dsn: "stream-backpressure", drv: db.Driver()}
+	pacedDB := sql.OpenDB(connector)
+	defer pacedDB.Close()
+	s := newStore(pacedDB, &Config{PaginationKey: paginationKey})
+
+	const n = 5
+	rows := sqlmock.NewRows([]string{"occurrence_name", "data"})
+	for i := 0; i < n; i++ {
+		rows.AddRow(fmt.Sprintf("o%d", i), "{}")
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(streamOccurrences, ""))).WithArgs(pid).WillReturnRows(rows)
+
+	// A slow consumer: each row must not be read before the previous one was consumed.
+	const delay = 10 * time.Millisecond
+	var consumed []time.Time
+	var names []string
+	err = s.StreamOccurrences(context.Background(), pid, "", func(o *pb.Occurrence) error {
+		time.Sleep(delay)
+		names = append(names, o.Name)
+		consumed = append(consumed, time.Now())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamOccurrences() error = %v", err)
+	}
+	if len(names) != n || names[0] != "projects/pid/occurrences/o0" {
+		t.Fatalf("StreamOccurrences() streamed %v, want %d occurrences starting at o0", names, n)
+	}
+	if len(connector.reads) != n {
+		t.Fatalf("read %d rows, want %d", len(connector.reads), n)
+	}
+	for i := 1; i < n; i++ {
+		if connector.reads[i].Before(consumed[i-1]) {
+			t.Errorf("row %d was read before row %d was consumed", i, i-1)
+		}
+	}
+	if elapsed := connector.reads[n-1].Sub(connector.reads[0]); elapsed < (n-1)*delay {
+		t.Errorf("rows were read over %v, want at least %v at the consumer's pace", elapsed, (n-1)*delay)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_StreamOccurrencesStopsOnError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT occurrence_name, data FROM occurrences")).
+		WithArgs(pid).
+		WillReturnRows(sqlmock.NewRows([]string{"occurrence_name", "data"}).AddRow("o1", "{}").AddRow("o2", "{}"))
+	errStop := errors.New("client went away")
+	calls := 0
+	err = s.StreamOccurrences(context.Background(), pid, `kind="BUILD"`, func(*pb.Occurrence) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Errorf("StreamOccurrences() = %v after %d calls, want %v after 1", err, calls, errStop)
+	}
+}
+
+func TestStore_StreamOccurrencesBindsFilter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	// The pattern is bound after the project, the only argument of the query.
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(streamOccurrences, " AND (COALESCE(data->'resource'->>'uri' LIKE $2, FALSE))"))).
+		WithArgs(pid, "https://gcr.io/%").
+		WillReturnRows(sqlmock.NewRows([]string{"occurrence_name", "data"}).AddRow("o1", "{}"))
+	var got []string
+	err = s.StreamOccurrences(context.Background(), pid, `resource.uri:"https://gcr.io/*"`, func(o *pb.Occurrence) error {
+		got = append(got, o.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamOccurrences() error = %v", err)
+	}
+	if len(got) != 1 || got[0] != "projects/pid/occurrences/o1" {
+		t.Errorf("StreamOccurrences() streamed %v, want o1", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_StreamRawOccurrences(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	stored := []string{
+		`{"kind": "BUILD", "name": "projects/pid/occurrences/o1", "noteName": "projects/pid/notes/n1"}`,
+		`{"kind": "BUILD", "build": {"provenance": {"id": "b2"}}, "name": "projects/pid/occurrences/o2"}`,
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(streamRawOccurrences, " AND (COALESCE(data->>'kind' = 'BUILD', FALSE))"))).
+		WithArgs(pid).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(stored[0]).AddRow(stored[1]))
+
+	var buf bytes.Buffer
+	if err := s.StreamRawOccurrences(context.Background(), pid, `kind="BUILD"`, &buf); err != nil {
+		t.Fatalf("StreamRawOccurrences() error = %v", err)
+	}
+	if want := stored[0] + "\n" + stored[1] + "\n"; buf.String() != want {
+		t.Errorf("StreamRawOccurrences() wrote %q, want %q", buf.String(), want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("client went away")
+}
+
+func TestStore_StreamRawOccurrencesWriteError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(streamRawOccurrences, ""))).
+		WithArgs(pid).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow("{}"))
+	err = s.StreamRawOccurrences(context.Background(), pid, "", failingWriter{})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("StreamRawOccurrences() = %v, want code Internal", err)
+	}
+}
+
+func TestStore_StreamRawOccurrencesLargeRowWriteError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	// A row larger than the write buffer goes straight to the writer.
+	large := `{"name":"` + strings.Repeat("x", 8192) + `"}`
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(streamRawOccurrences, ""))).
+		WithArgs(pid).
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(large).AddRow(large))
+	err = s.StreamRawOccurrences(context.Background(), pid, "", failingWriter{})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("StreamRawOccurrences() = %v, want code Internal", err)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// tenantLimiter bounds the number of connections each tenant holds at once, so that a tenant
+// issuing many concurrent queries cannot exhaust the pool shared with the others.
+type tenantLimiter struct {
+	// max is the number of connections of tenants without an override; 0 means no limit.
+	max int
+	// overrides maps tenants to their own limits.
+	overrides map[string]int
+	// retryDelay is the delay after which tenants at their limit are told to retry.
+	retryDelay time.Duration
+
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+func newTenantLimiter(max int, overrides map[string]int, retryDelay time.Duration) *tenantLimiter {
+	return &tenantLimiter{max: max, overrides: overrides, retryDelay: retryDelay, sems: map[string]chan struct{}{}}
+}
+
+// acquire waits for a connection slot of the tenant carried by ctx, and returns the function
+// releasing it, which may be called more than once. Calls without a tenant, or of tenants
+// without a limit, are not bounded. If ctx is done before a slot is free, acquire fails with
+// ResourceExhausted.
+func (l *tenantLimiter) acquire(ctx context.Context) (func(), error) {
+	sem := l.semaphore(tenant(ctx))
+	if sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, resourceExhausted(l.retryDelay, "Connection limit of tenant %q reached", tenant(ctx))
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-sem }) }, nil
+}
+
+// semaphore returns the semaphore of tenant t, or nil if its connections are not limited.
+func (l *tenantLimiter) semaphore(t string) chan struct{} {
+	if t == "" {
+		return nil
+	}
+	max := l.max
+	if m, ok := l.overrides[t]; ok {
+		max = m
+	}
+	if max <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sem, ok := l.sems[t]
+	if !ok {
+		sem = make(chan struct{}, max)
+		l.sems[t] = sem
+	}
+	return sem
+}
+
+// acquireConn waits for a connection slot of the tenant carried by ctx, if the store limits
+// tenant connections, and then for a connection (see conn). It returns the querier to run a
+// query with and the function releasing both once the query is done.
+func (pg *PgSQLStore) acquireConn(ctx context.Context) (querier, func(), error) {
+	release := func() {}
+	if pg.tenants != nil {
+		var err error
+		if release, err = pg.tenants.acquire(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+	q, closeConn, err := pg.conn(ctx)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return q, func() {
+		closeConn()
+		release()
+	}, nil
+}
+
+// tenantRows are the rows of a query, holding its connection and the connection slot of its
+// tenant until they are closed.
+type tenantRows struct {
+	*sql.Rows
+	release func()
+}
+
+// Close closes the rows and releases the connection and its slot.
+func (r *tenantRows) Close() error {
+	defer r.release()
+	return r.Rows.Close()
+}
+
+// tenantRow is the row of a query, holding its connection and the connection slot of its
+// tenant until it is scanned.
+type tenantRow struct {
+	row     *sql.Row
+	err     error
+	release func()
+}
+
+// Scan scans the row as sql.Row.Scan does and releases the connection and its slot.
+func (r *tenantRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.release()
+	return r.row.Scan(dest...)
+}
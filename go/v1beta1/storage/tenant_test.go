@@ -0,0 +1,120 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStore_TenantConnLimits(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, TenantMaxConns: 1, TenantConnLimits: map[string]int{"t3": 0}})
+	t1 := WithTenant(context.Background(), "t1")
+	t2 := WithTenant(context.Background(), "t2")
+	t3 := WithTenant(context.Background(), "t3")
+
+	// Rows of t1 held open hold its only connection.
+	mock.ExpectQuery("SELECT id, name FROM projects").WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	rows, err := s.queryContext(t1, "SELECT id, name FROM projects")
+	if err != nil {
+		t.Fatalf("queryContext() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(t1, 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.execContext(ctx, "DELETE FROM projects"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("execContext() of t1 error = %v, want ResourceExhausted", err)
+	}
+	var exists bool
+	if err := s.queryRowContext(ctx, projectExists, "projects/p1").Scan(&exists); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("queryRowContext() of t1 error = %v, want ResourceExhausted", err)
+	}
+
+	// Other tenants, and queries without a tenant, are not affected.
+	for _, ctx := range []context.Context{t2, t3, context.Background()} {
+		mock.ExpectExec("DELETE FROM projects").WillReturnResult(sqlmock.NewResult(0, 0))
+		if _, err := s.execContext(ctx, "DELETE FROM projects"); err != nil {
+			t.Errorf("execContext() of %q error = %v", tenant(ctx), err)
+		}
+	}
+
+	// Closing the rows frees the connection of t1.
+	if err := rows.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	mock.ExpectExec("DELETE FROM projects").WillReturnResult(sqlmock.NewResult(0, 0))
+	if _, err := s.execContext(t1, "DELETE FROM projects"); err != nil {
+		t.Errorf("execContext() of t1 after Close() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestStore_CreateAtTenantConnLimit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, TenantMaxConns: 1})
+	t1 := WithTenant(context.Background(), "t1")
+
+	// Rows of t1 held open hold its only connection, so nothing can be inserted.
+	mock.ExpectQuery("SELECT id, name FROM projects").WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	rows, err := s.queryContext(t1, "SELECT id, name FROM projects")
+	if err != nil {
+		t.Fatalf("queryContext() error = %v", err)
+	}
+	defer rows.Close()
+
+	ctx, cancel := context.WithTimeout(t1, 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.CreateProject(ctx, pid, &prpb.Project{}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("CreateProject() error = %v, want ResourceExhausted", err)
+	}
+	if _, err := s.CreateNote(ctx, pid, nid, "", &pb.Note{}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("CreateNote() error = %v, want ResourceExhausted", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestValidateConfig_TenantConnLimits(t *testing.T) {
+	for _, c := range []*Config{
+		{TenantMaxConns: -1},
+		{TenantConnLimits: map[string]int{"t1": -2}},
+	} {
+		if err := validateConfig(c); err == nil {
+			t.Errorf("validateConfig(%+v) succeeded, want error", c)
+		}
+	}
+	if err := validateConfig(&Config{TenantMaxConns: 4, TenantConnLimits: map[string]int{"t1": 16}}); err != nil {
+		t.Errorf("validateConfig() error = %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithTransaction runs fn in a transaction, committed if fn returns nil and rolled back
+// otherwise. If the transaction fails with a serialization failure, as may happen under
+// REPEATABLE READ or SERIALIZABLE isolation, it is retried up to the TxRetries budget of
+// the store. fn may thus run several times and must have no effects outside of tx; it
+// should return the errors of tx unwrapped so that serialization failures are recognized.
+// The transaction uses the isolation level requested by ctx with WithIsolationLevel, or else
+// the IsolationLevel of the store. Transactions run with a context not tagged by a store
+// operation are reported as WithTransaction.
+func (pg *PgSQLStore) WithTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if _, ok := ctx.Value(queryTagsKey).(queryTags); !ok {
+		ctx = pg.withQueryTags(ctx, "")
+	}
+	for attempt := 0; ; attempt++ {
+		err := pg.runTransaction(ctx, fn)
+		if !isSerializationFailure(err) {
+			return err
+		}
+		if attempt == pg.txRetries {
+			log.Println("Transaction failed after retries", err)
+			return status.Errorf(codes.Aborted, "Transaction aborted after %d serialization failures", attempt+1)
+		}
+	}
+}
+
+// runTransaction runs fn in a single transaction.
+func (pg *PgSQLStore) runTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	q, release, err := pg.acquireConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	tx, err := q.BeginTx(ctx, &sql.TxOptions{Isolation: isolationLevel(ctx, pg.isolation)})
+	if err != nil {
+		log.Println("Failed to begin transaction", err)
+		return dbError(err, "Failed to begin transaction")
+	}
+	if pg.txStmts != nil {
+		pg.txStmts.begin(tx)
+		defer pg.txStmts.end(tx)
+	}
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Println("Failed to roll back transaction", rbErr)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		if isSerializationFailure(err) {
+			return err
+		}
+		log.Println("Failed to commit transaction", err)
+		return status.Error(codes.Internal, "Failed to commit transaction")
+	}
+	return nil
+}
+
+// isSerializationFailure reports whether err is a PostgreSQL serialization_failure.
+func isSerializationFailure(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "40001"
+}
+
+// txStmtCaches maps running transactions to the statements prepared in them.
+type txStmtCaches struct {
+	mu     sync.Mutex
+	caches map[*sql.Tx]map[string]*sql.Stmt
+}
+
+func (c *txStmtCaches) begin(tx *sql.Tx) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.caches[tx] = map[string]*sql.Stmt{}
+}
+
+// end forgets the statements of tx once it is committed or rolled back, which closes them.
+func (c *txStmtCaches) end(tx *sql.Tx) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.caches, tx)
+}
+
+// get returns the statements prepared in tx, by query. A transaction runs one statement at a
+// time, so they are not shared with another goroutine.
+func (c *txStmtCaches) get(tx *sql.Tx) (map[string]*sql.Stmt, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stmts, ok := c.caches[tx]
+	return stmts, ok
+}
+
+// txStmt returns the statement prepared for query in tx, preparing it on first use, or nil if
+// PrepareTxStatements is not set or tx was not begun by the store. Unlike a statement prepared
+// on the pool, one failing to prepare aborts tx, so its error is returned.
+func (pg *PgSQLStore) txStmt(ctx context.Context, tx *sql.Tx, query string) (*sql.Stmt, error) {
+	if pg.txStmts == nil {
+		return nil, nil
+	}
+	stmts, ok := pg.txStmts.get(tx)
+	if !ok {
+		return nil, nil
+	}
+	if stmt, ok := stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	stmts[query] = stmt
+	return stmt, nil
+}
+
+// txExecContext executes query in tx, with the statement prepared for it in tx if possible.
+func (pg *PgSQLStore) txExecContext(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := pg.txStmt(ctx, tx, query)
+	if err != nil {
+		return nil, err
+	}
+	if stmt != nil {
+		return stmt.ExecContext(ctx, args...)
+	}
+	return tx.ExecContext(ctx, query, args...)
+}
+
+// txQueryRowContext runs query in tx, with the statement prepared for it in tx if possible.
+// The error preparing the statement, if any, is returned by Scan.
+func (pg *PgSQLStore) txQueryRowContext(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) *tenantRow {
+	stmt, err := pg.txStmt(ctx, tx, query)
+	if err != nil {
+		return &tenantRow{err: err}
+	}
+	if stmt != nil {
+		return &tenantRow{row: stmt.QueryRowContext(ctx, args...), release: func() {}}
+	}
+	return &tenantRow{row: tx.QueryRowContext(ctx, query, args...), release: func() {}}
+}
@@ -0,0 +1,235 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWithTransaction_RetriesSerializationFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, TxRetries: 2})
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE notes").WillReturnError(&pq.Error{Code: "40001"})
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE notes").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	runs := 0
+	err = s.WithTransaction(context.Background(), func(tx *sql.Tx) error {
+		runs++
+		_, err := tx.Exec(updateNote, `{}`, "p1", "n1")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WithTransaction() error = %v", err)
+	}
+	if runs != 2 {
+		t.Errorf("WithTransaction() ran the closure %d times, want 2", runs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestWithTransaction_RetryBudget(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, TxRetries: 1})
+
+	// The serialization failure is reported at commit time on both attempts.
+	for i := 0; i < 2; i++ {
+		mock.ExpectBegin()
+		mock.ExpectCommit().WillReturnError(&pq.Error{Code: "40001"})
+	}
+	runs := 0
+	err = s.WithTransaction(context.Background(), func(*sql.Tx) error {
+		runs++
+		return nil
+	})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("WithTransaction() error = %v, want Aborted", err)
+	}
+	if runs != 2 {
+		t.Errorf("WithTransaction() ran the closure %d times, want 2", runs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestWithTransaction_OtherErrorsNotRetried(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, TxRetries: 3})
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	want := status.Error(codes.NotFound, "Note does not exist")
+	if err := s.WithTransaction(context.Background(), func(*sql.Tx) error { return want }); err != want {
+		t.Errorf("WithTransaction() error = %v, want %v", err, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// isolationConnector connects to a sqlmock database, recording the isolation level
+// of each transaction begun.
+type isolationConnector struct {
+	dsn    string
+	drv    driver.Driver
+	levels []sql.IsolationLevel
+}
+
+func (c *isolationConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.drv.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &isolationConn{Conn: conn, c: c}, nil
+}
+
+func (c *isolationConnector) Driver() driver.Driver {
+	return c.drv
+}
+
+type isolationConn struct {
+	driver.Conn
+	c *isolationConnector
+}
+
+func (conn *isolationConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	conn.c.levels = append(conn.c.levels, sql.IsolationLevel(opts.Isolation))
+	return conn.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func TestWithTransaction_IsolationLevel(t *testing.T) {
+	tests := []struct {
+		config   string
+		override sql.IsolationLevel // LevelDefault means no override
+		want     sql.IsolationLevel
+	}{
+		{config: "", want: sql.LevelDefault},
+		{config: "Read Committed", want: sql.LevelReadCommitted},
+		{config: "read committed", override: sql.LevelSerializable, want: sql.LevelSerializable},
+	}
+	for i, tt := range tests {
+		dsn := fmt.Sprintf("isolation-%d", i)
+		db, mock, err := sqlmock.NewWithDSN(dsn)
+		if err != nil {
+			t.Fatalf("failed to create sqlmock: %v", err)
+		}
+		connector := &isolationConnector{dsn: dsn, drv: db.Driver()}
+		txDB := sql.OpenDB(connector)
+		s := newStore(txDB, &Config{PaginationKey: paginationKey, IsolationLevel: tt.config})
+
+		mock.ExpectBegin()
+		mock.ExpectCommit()
+		ctx := context.Background()
+		if tt.override != sql.LevelDefault {
+			ctx = WithIsolationLevel(ctx, tt.override)
+		}
+		if err := s.WithTransaction(ctx, func(*sql.Tx) error { return nil }); err != nil {
+			t.Fatalf("WithTransaction() error = %v", err)
+		}
+		if len(connector.levels) != 1 || connector.levels[0] != tt.want {
+			t.Errorf("isolation_level %q: began transactions at %v, want %v", tt.config, connector.levels, tt.want)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet expectations: %v", err)
+		}
+		txDB.Close()
+		db.Close()
+	}
+}
+
+func TestValidateConfig_IsolationLevel(t *testing.T) {
+	if err := validateConfig(&Config{IsolationLevel: "snapshot"}); err == nil {
+		t.Errorf("validateConfig() with isolation_level snapshot succeeded, want error")
+	}
+	if err := validateConfig(&Config{IsolationLevel: "SERIALIZABLE"}); err != nil {
+		t.Errorf("validateConfig() error = %v", err)
+	}
+}
+
+func TestWithTransaction_PreparesStatementsPerTransaction(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, PrepareTxStatements: true})
+	ctx := context.Background()
+
+	// Each transaction prepares the statement once, and it is closed when the transaction ends.
+	for i := 0; i < 2; i++ {
+		mock.ExpectBegin()
+		prep := mock.ExpectPrepare("UPDATE notes").WillBeClosed()
+		prep.ExpectExec().WithArgs("n1").WillReturnResult(sqlmock.NewResult(0, 1))
+		prep.ExpectExec().WithArgs("n2").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		err := s.WithTransaction(ctx, func(tx *sql.Tx) error {
+			for _, nID := range []string{"n1", "n2"} {
+				if _, err := s.txExecContext(ctx, tx, "UPDATE notes SET data = data WHERE note_name = $1", nID); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("WithTransaction() error = %v", err)
+		}
+	}
+	if n := len(s.txStmts.caches); n != 0 {
+		t.Errorf("%d statement caches left after the transactions ended, want none", n)
+	}
+
+	// A statement failing to prepare fails its transaction.
+	mock.ExpectBegin()
+	mock.ExpectPrepare("UPDATE notes").WillReturnError(&pq.Error{Code: "42601"})
+	mock.ExpectRollback()
+	err = s.WithTransaction(ctx, func(tx *sql.Tx) error {
+		_, err := s.txExecContext(ctx, tx, "UPDATE notes SET", "n1")
+		return err
+	})
+	if err == nil {
+		t.Error("WithTransaction() with a failing prepare succeeded, want error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
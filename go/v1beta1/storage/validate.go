@@ -0,0 +1,73 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	cpb "github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// detailsKind returns the kind of the details set in o, or NOTE_KIND_UNSPECIFIED if none.
+func detailsKind(o *pb.Occurrence) cpb.NoteKind {
+	switch o.Details.(type) {
+	case *pb.Occurrence_Vulnerability:
+		return cpb.NoteKind_VULNERABILITY
+	case *pb.Occurrence_Build:
+		return cpb.NoteKind_BUILD
+	case *pb.Occurrence_DerivedImage:
+		return cpb.NoteKind_IMAGE
+	case *pb.Occurrence_Installation:
+		return cpb.NoteKind_PACKAGE
+	case *pb.Occurrence_Deployment:
+		return cpb.NoteKind_DEPLOYMENT
+	case *pb.Occurrence_Discovered:
+		return cpb.NoteKind_DISCOVERY
+	case *pb.Occurrence_Attestation:
+		return cpb.NoteKind_ATTESTATION
+	case *pb.Occurrence_Intoto:
+		return cpb.NoteKind_INTOTO
+	default:
+		return cpb.NoteKind_NOTE_KIND_UNSPECIFIED
+	}
+}
+
+// validateKind checks that o has details of a known kind, matching its kind.
+func validateKind(o *pb.Occurrence) error {
+	kind := detailsKind(o)
+	if kind == cpb.NoteKind_NOTE_KIND_UNSPECIFIED {
+		return status.Error(codes.InvalidArgument, "Occurrence has no details of a known kind")
+	}
+	if o.Kind != kind {
+		return status.Errorf(codes.InvalidArgument, "Occurrence of kind %s has %s details", o.Kind, kind)
+	}
+	return nil
+}
+
+// nilError returns the error of the create and update methods passed a nil entity of kind,
+// e.g. "Occurrence", rather than letting them dereference it.
+func nilError(kind string) error {
+	return status.Errorf(codes.InvalidArgument, "%s must not be nil", kind)
+}
+
+// checkEntitySize rejects the entity of kind, e.g. "Occurrence", whose JSON encoding is data,
+// if it is larger than the store allows.
+func (pg *PgSQLStore) checkEntitySize(kind string, data []byte) error {
+	if pg.maxEntitySize > 0 && len(data) > pg.maxEntitySize {
+		return status.Errorf(codes.InvalidArgument, "%s is %d bytes, over the limit of %d bytes", kind, len(data), pg.maxEntitySize)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/grafeas/grafeas/go/name"
+	bpb "github.com/grafeas/grafeas/proto/v1beta1/build_go_proto"
+	cpb "github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	vpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateKind(t *testing.T) {
+	vuln := &pb.Occurrence_Vulnerability{Vulnerability: &vpb.Details{}}
+	tests := []struct {
+		desc string
+		o    *pb.Occurrence
+		want codes.Code
+	}{
+		{desc: "valid", o: &pb.Occurrence{Kind: cpb.NoteKind_VULNERABILITY, Details: vuln}, want: codes.OK},
+		{desc: "missing details", o: &pb.Occurrence{Kind: cpb.NoteKind_VULNERABILITY}, want: codes.InvalidArgument},
+		{desc: "missing kind", o: &pb.Occurrence{Details: vuln}, want: codes.InvalidArgument},
+		{desc: "mismatched kind", o: &pb.Occurrence{Kind: cpb.NoteKind_BUILD, Details: vuln}, want: codes.InvalidArgument},
+		{
+			desc: "build",
+			o:    &pb.Occurrence{Kind: cpb.NoteKind_BUILD, Details: &pb.Occurrence_Build{Build: &bpb.Details{}}},
+			want: codes.OK,
+		},
+	}
+	for _, tt := range tests {
+		if got := status.Code(validateKind(tt.o)); got != tt.want {
+			t.Errorf("%s: validateKind() = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestStore_CreateOccurrenceKindValidation(t *testing.T) {
+	o := &pb.Occurrence{NoteName: name.FormatNote(pid, nid)}
+	for _, validate := range []bool{false, true} {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		s := newStore(db, &Config{PaginationKey: paginationKey, ValidateOccurrenceKinds: validate})
+		want := codes.InvalidArgument
+		if !validate {
+			// Lenient ingestion stores the occurrence without details.
+			mock.ExpectQuery("INSERT INTO occurrences").
+				WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+			want = codes.OK
+		}
+		if _, err := s.CreateOccurrence(context.Background(), pid, "", o); status.Code(err) != want {
+			t.Errorf("validation %v: CreateOccurrence() error = %v, want %v", validate, err, want)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("validation %v: unfulfilled expectations: %v", validate, err)
+		}
+		db.Close()
+	}
+}
+
+func TestStore_BatchCreateOccurrencesKindValidation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, ValidateOccurrenceKinds: true})
+	vuln := &pb.Occurrence_Vulnerability{Vulnerability: &vpb.Details{}}
+	occs := []*pb.Occurrence{
+		{NoteName: name.FormatNote(pid, nid), Kind: cpb.NoteKind_VULNERABILITY, Details: vuln},
+		{NoteName: name.FormatNote(pid, nid)},
+	}
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	created, errs := s.BatchCreateOccurrences(context.Background(), pid, "", occs)
+	if len(created) != 1 || len(errs) != 1 || status.Code(errs[0]) != codes.InvalidArgument ||
+		!strings.HasPrefix(status.Convert(errs[0]).Message(), "Occurrence 1 of the batch") {
+		t.Errorf("BatchCreateOccurrences() = %d occurrences, %v, want 1 occurrence and an InvalidArgument error for occurrence 1", len(created), errs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_NilEntities(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	ctx := context.Background()
+
+	tests := []struct {
+		desc string
+		call func() error
+	}{
+		{desc: "CreateProject", call: func() error { _, err := s.CreateProject(ctx, pid, nil); return err }},
+		{desc: "CreateOccurrence", call: func() error { _, err := s.CreateOccurrence(ctx, pid, "", nil); return err }},
+		{desc: "UpdateOccurrence", call: func() error { _, err := s.UpdateOccurrence(ctx, pid, "o1", nil, nil); return err }},
+		{desc: "CreateNote", call: func() error { _, err := s.CreateNote(ctx, pid, nid, "", nil); return err }},
+		{desc: "UpdateNote", call: func() error { _, err := s.UpdateNote(ctx, pid, nid, nil, nil); return err }},
+	}
+	for _, tt := range tests {
+		if err := tt.call(); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s(nil) = %v, want code InvalidArgument", tt.desc, err)
+		}
+	}
+
+	created, errs := s.BatchCreateOccurrences(ctx, pid, "", []*pb.Occurrence{nil})
+	if len(created) != 0 || len(errs) != 1 || status.Code(errs[0]) != codes.InvalidArgument {
+		t.Errorf("BatchCreateOccurrences(nil) = %v, %v, want an InvalidArgument error", created, errs)
+	}
+	notes, errs := s.BatchCreateNotes(ctx, pid, "", map[string]*pb.Note{nid: nil})
+	if len(notes) != 0 || len(errs) != 1 || status.Code(errs[0]) != codes.InvalidArgument {
+		t.Errorf("BatchCreateNotes(nil) = %v, %v, want an InvalidArgument error", notes, errs)
+	}
+	// Nil entities are rejected before any query.
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStore_MaxEntitySize(t *testing.T) {
+	const max = 1024
+	small := &pb.Occurrence{NoteName: name.FormatNote(pid, nid)}
+	large := &pb.Occurrence{NoteName: name.FormatNote(pid, nid), Remediation: strings.Repeat("x", max)}
+	for _, tt := range []struct {
+		desc string
+		o    *pb.Occurrence
+		want codes.Code
+	}{
+		{desc: "under the limit", o: small, want: codes.OK},
+		{desc: "over the limit", o: large, want: codes.InvalidArgument},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey, MaxEntitySizeBytes: max})
+			ctx := context.Background()
+			if tt.want == codes.OK {
+				mock.ExpectQuery("INSERT INTO occurrences").
+					WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+				mock.ExpectExec("UPDATE occurrences").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO notes").WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			if _, err := s.CreateOccurrence(ctx, pid, "", tt.o); status.Code(err) != tt.want {
+				t.Errorf("CreateOccurrence() error = %v, want %v", err, tt.want)
+			}
+			if _, err := s.UpdateOccurrence(ctx, pid, "o1", tt.o, nil); status.Code(err) != tt.want {
+				t.Errorf("UpdateOccurrence() error = %v, want %v", err, tt.want)
+			}
+			if _, err := s.CreateNote(ctx, pid, nid, "", &pb.Note{LongDescription: tt.o.Remediation}); status.Code(err) != tt.want {
+				t.Errorf("CreateNote() error = %v, want %v", err, tt.want)
+			}
+			// Oversized entities are rejected before any query.
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+
+	if err := validateConfig(&Config{MaxEntitySizeBytes: -1}); err == nil {
+		t.Error("validateConfig() with a negative max_entity_size_bytes succeeded, want error")
+	}
+}
+
+func TestStore_MaxEntitySizeBatch(t *testing.T) {
+	const max = 1024
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey, MaxEntitySizeBytes: max})
+	ctx := context.Background()
+
+	// Only the small entities are inserted; the oversized ones are reported.
+	mock.ExpectQuery("INSERT INTO occurrences").
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	occs := []*pb.Occurrence{
+		{NoteName: name.FormatNote(pid, nid), Remediation: strings.Repeat("x", max)},
+		{NoteName: name.FormatNote(pid, nid)},
+	}
+	created, errs := s.BatchCreateOccurrences(ctx, pid, "", occs)
+	if len(created) != 1 || len(errs) != 1 || status.Code(errs[0]) != codes.InvalidArgument ||
+		!strings.HasPrefix(status.Convert(errs[0]).Message(), "Occurrence 0 of the batch") {
+		t.Errorf("BatchCreateOccurrences() = %d occurrences, %v, want 1 occurrence and an InvalidArgument error for occurrence 0", len(created), errs)
+	}
+
+	mock.ExpectExec("INSERT INTO notes").WillReturnResult(sqlmock.NewResult(1, 1))
+	notes := map[string]*pb.Note{"n1": {}, "n2": {LongDescription: strings.Repeat("x", max)}}
+	createdNotes, errs := s.BatchCreateNotes(ctx, pid, "", notes)
+	if len(createdNotes) != 1 || len(errs) != 1 || status.Code(errs[0]) != codes.InvalidArgument ||
+		!strings.Contains(errs[0].Error(), name.FormatNote(pid, "n2")) {
+		t.Errorf("BatchCreateNotes() = %d notes, %v, want 1 note and an InvalidArgument error for n2", len(createdNotes), errs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
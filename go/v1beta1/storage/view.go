@@ -0,0 +1,99 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+
+	"github.com/grafeas/grafeas/go/name"
+	cpb "github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	vpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// OccurrenceView selects the fields of the occurrences returned by ListOccurrences;
+// see WithOccurrenceView.
+type OccurrenceView int
+
+const (
+	// OccurrenceViewFull returns complete occurrences. It is the default.
+	OccurrenceViewFull OccurrenceView = iota
+	// OccurrenceViewBasic returns occurrences with only their name, kind, resource, note name,
+	// creation time and, for vulnerabilities, severity, held by otherwise empty vulnerability
+	// details. These fields are read from the promoted columns and extracted from the data
+	// blob by the database, so that the blob is neither transferred nor unmarshaled whole.
+	OccurrenceViewBasic
+)
+
+// OccurrenceOrder selects the order of the occurrences returned by ListOccurrences;
+// see WithOccurrenceOrder.
+type OccurrenceOrder int
+
+const (
+	// OccurrenceOrderInsertion returns occurrences in the order they were stored, which is
+	// usually but not necessarily their creation order, e.g. for imported occurrences. It is
+	// the default, and the cheapest.
+	OccurrenceOrderInsertion OccurrenceOrder = iota
+	// OccurrenceOrderCreateTime returns occurrences oldest first by creation time, then in
+	// the order they were stored. Occurrences without a creation time, which predate it being
+	// promoted to its column, are not listed until RebuildDerivedColumns is run.
+	OccurrenceOrderCreateTime
+	// OccurrenceOrderSeverity returns occurrences most severe first, then in the order they were
+	// stored. Occurrences without a severity, including those which are not vulnerabilities,
+	// are listed last, or first as per Config.NullsOrder.
+	OccurrenceOrderSeverity
+)
+
+const (
+	// nullsOrderLast and nullsOrderFirst are the values of Config.NullsOrder.
+	nullsOrderLast  = "last"
+	nullsOrderFirst = "first"
+)
+
+// scanBasicOccurrence scans a row of listOccurrencesBasic into an occurrence of project pID,
+// and returns it with its id.
+func scanBasicOccurrence(rows *sql.Rows, pID string) (int64, *pb.Occurrence, error) {
+	var id int64
+	var oID string
+	var kind, noteName sql.NullString
+	var resource []byte
+	var createdAt sql.NullTime
+	var severity sql.NullInt64
+	if err := rows.Scan(&id, &oID, &kind, &resource, &noteName, &createdAt, &severity); err != nil {
+		return 0, nil, status.Error(codes.Internal, "Failed to scan Occurrences row")
+	}
+	o := &pb.Occurrence{
+		Name:     name.FormatOccurrence(pID, oID),
+		Kind:     cpb.NoteKind(cpb.NoteKind_value[kind.String]),
+		NoteName: noteName.String,
+	}
+	if resource != nil {
+		o.Resource = &pb.Resource{}
+		if err := protojson.Unmarshal(resource, o.Resource); err != nil {
+			return 0, nil, status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+		}
+	}
+	if createdAt.Valid {
+		o.CreateTime = timestamppb.New(createdAt.Time)
+	}
+	if severity.Valid {
+		o.Details = &pb.Occurrence_Vulnerability{Vulnerability: &vpb.Details{Severity: vpb.Severity(severity.Int64)}}
+	}
+	return id, o, nil
+}
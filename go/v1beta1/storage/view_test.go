@@ -0,0 +1,300 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	cpb "github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	vpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestStore_ListOccurrencesViews(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	created := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	full := &pb.Occurrence{
+		Name:        "projects/pid/occurrences/o1",
+		Kind:        cpb.NoteKind_VULNERABILITY,
+		Resource:    &pb.Resource{Uri: "https://gcr.io/p/image@sha256:abc"},
+		NoteName:    "projects/vendor/notes/cve",
+		Remediation: "upgrade",
+		CreateTime:  timestamppb.New(created),
+		Details: &pb.Occurrence_Vulnerability{Vulnerability: &vpb.Details{
+			Severity:         vpb.Severity_HIGH,
+			ShortDescription: "a long description",
+		}},
+	}
+	data, err := marshalJSON(full)
+	if err != nil {
+		t.Fatalf("failed to marshal occurrence: %v", err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(listOccurrences, ""))).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "data"}).AddRow(1, "o1", data))
+	got, _, err := s.ListOccurrences(context.Background(), pid, "", "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() error = %v", err)
+	}
+	if len(got) != 1 || !proto.Equal(got[0], full) {
+		t.Errorf("ListOccurrences() = %v, want %v", got, full)
+	}
+
+	// The basic view only holds the summary fields, selected without the data blob.
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(listOccurrencesBasic, ""))).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "kind", "resource", "note_name", "created_at", "severity"}).
+			AddRow(1, "o1", "VULNERABILITY", `{"uri":"https://gcr.io/p/image@sha256:abc"}`, "projects/vendor/notes/cve", created, int64(vpb.Severity_HIGH)))
+	got, _, err = s.ListOccurrences(WithOccurrenceView(context.Background(), OccurrenceViewBasic), pid, "", "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() with the basic view error = %v", err)
+	}
+	basic := proto.Clone(full).(*pb.Occurrence)
+	basic.Remediation = ""
+	basic.GetVulnerability().ShortDescription = ""
+	if len(got) != 1 || !proto.Equal(got[0], basic) {
+		t.Errorf("ListOccurrences() with the basic view = %v, want %v", got, basic)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_ListOccurrencesBasicViewWithoutDetails(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+
+	// A build occurrence has no severity, and this one no resource.
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(listOccurrencesBasic, ""))).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "kind", "resource", "note_name", "created_at", "severity"}).
+			AddRow(1, "o1", "BUILD", nil, "projects/pid/notes/n1", nil, nil))
+	got, _, err := s.ListOccurrences(WithOccurrenceView(context.Background(), OccurrenceViewBasic), pid, "", "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() with the basic view error = %v", err)
+	}
+	want := &pb.Occurrence{Name: "projects/pid/occurrences/o1", Kind: cpb.NoteKind_BUILD, NoteName: "projects/pid/notes/n1"}
+	if len(got) != 1 || !proto.Equal(got[0], want) {
+		t.Errorf("ListOccurrences() with the basic view = %v, want %v", got, want)
+	}
+
+	_, _, err = s.ListOccurrences(WithOccurrenceView(context.Background(), OccurrenceView(7)), pid, "", "", 10)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListOccurrences() with an invalid view error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestStore_ListOccurrencesByCreateTime(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := newStore(db, &Config{PaginationKey: paginationKey})
+	ctx := WithOccurrenceOrder(context.Background(), OccurrenceOrderCreateTime)
+	t1 := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	cols := []string{"id", "occurrence_name", "data", "created_at"}
+	occ := func(created time.Time) string {
+		return fmt.Sprintf(`{"createTime":%q}`, created.Format(time.RFC3339))
+	}
+
+	// o3 was imported first with the oldest creation time; o1 and o2 share one.
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(listOccurrencesByCreateTime, ""))).WithArgs(pid, nil, 0, 3).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(3, "o3", occ(t1), t1).
+			AddRow(1, "o1", occ(t2), t2).
+			AddRow(2, "o2", occ(t2), t2))
+	got, token, err := s.ListOccurrences(ctx, pid, "", "", 2)
+	if err != nil {
+		t.Fatalf("ListOccurrences() error = %v", err)
+	}
+	if len(got) != 2 || got[0].Name != "projects/pid/occurrences/o3" || got[1].Name != "projects/pid/occurrences/o1" || token == "" {
+		t.Fatalf("ListOccurrences() = %v, %q; want o3, o1 and a page token", got, token)
+	}
+	if !got[0].CreateTime.AsTime().Before(got[1].CreateTime.AsTime()) {
+		t.Errorf("ListOccurrences() is not oldest first: %v", got)
+	}
+
+	// The next page resumes after o1, at the same creation time.
+	mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf(listOccurrencesBasicByCreateTime, " AND (COALESCE(data->>'kind' = 'BUILD', FALSE))"))).
+		WithArgs(pid, t2, 1, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "occurrence_name", "kind", "resource", "note_name", "created_at", "severity"}).
+			AddRow(2, "o2", "BUILD", nil, "projects/pid/notes/n1", t2, nil))
+	got, token, err = s.ListOccurrences(WithOccurrenceView(ctx, OccurrenceViewBasic), pid, `kind = "BUILD"`, token, 2)
+	if err != nil {
+		t.Fatalf("ListOccurrences() error = %v", err)
+	}
+	if len(got) != 1 || got[0].Name != "projects/pid/occurrences/o2" || token != "" {
+		t.Errorf("ListOccurrences() = %v, %q; want o2 and no page token", got, token)
+	}
+
+	// Page tokens of the insertion order do not resume the creation order.
+	other, err := encryptCursor(pageCursor{ID: 2}, paginationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.ListOccurrences(ctx, pid, "", other, 2); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListOccurrences() with an insertion order token error = %v, want InvalidArgument", err)
+	}
+	if _, _, err := s.ListOccurrences(WithOccurrenceOrder(context.Background(), OccurrenceOrder(7)), pid, "", "", 2); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListOccurrences() with an invalid order error = %v, want InvalidArgument", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestStore_ListOccurrencesBySeverity(t *testing.T) {
+	type row struct {
+		id       int64
+		severity interface{}
+	}
+	type page struct {
+		// args are the resumption arguments of the query: whether it resumes, and the severity
+		// and id of the last occurrence of the previous page.
+		args []driver.Value
+		rows []row
+		want []int64
+	}
+	// Occurrences 2 and 4 have no severity.
+	tests := []struct {
+		nullsOrder string
+		nulls      string
+		pages      []page
+	}{
+		{
+			nullsOrder: "",
+			nulls:      nullsOrderLast,
+			pages: []page{
+				{args: []driver.Value{false, nil, 0}, rows: []row{{3, 5}, {1, 4}, {5, 4}}, want: []int64{3, 1}},
+				{args: []driver.Value{true, 4, 1}, rows: []row{{5, 4}, {2, nil}, {4, nil}}, want: []int64{5, 2}},
+				{args: []driver.Value{true, nil, 2}, rows: []row{{4, nil}}, want: []int64{4}},
+			},
+		},
+		{
+			nullsOrder: nullsOrderFirst,
+			nulls:      nullsOrderFirst,
+			pages: []page{
+				{args: []driver.Value{false, nil, 0}, rows: []row{{2, nil}, {4, nil}, {3, 5}}, want: []int64{2, 4}},
+				{args: []driver.Value{true, nil, 4}, rows: []row{{3, 5}, {1, 4}, {5, 4}}, want: []int64{3, 1}},
+				{args: []driver.Value{true, 4, 1}, rows: []row{{5, 4}}, want: []int64{5}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.nulls, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create sqlmock: %v", err)
+			}
+			defer db.Close()
+			s := newStore(db, &Config{PaginationKey: paginationKey, NullsOrder: tt.nullsOrder})
+			ctx := WithOccurrenceOrder(context.Background(), OccurrenceOrderSeverity)
+			nulls := severityNullsOrders[tt.nulls]
+			query := fmt.Sprintf(listOccurrencesBySeverity, "", nulls[0], nulls[1])
+
+			var token string
+			for i, p := range tt.pages {
+				rows := sqlmock.NewRows([]string{"id", "occurrence_name", "data", "severity"})
+				for _, r := range p.rows {
+					data := "{}"
+					if r.severity != nil {
+						data = fmt.Sprintf(`{"vulnerability":{"severity":%q}}`, vpb.Severity(r.severity.(int)))
+					}
+					rows.AddRow(r.id, fmt.Sprintf("o%d", r.id), data, r.severity)
+				}
+				mock.ExpectQuery(regexp.QuoteMeta(query)).
+					WithArgs(append(append([]driver.Value{pid}, p.args...), 3)...).
+					WillReturnRows(rows)
+				got, next, err := s.ListOccurrences(ctx, pid, "", token, 2)
+				if err != nil {
+					t.Fatalf("page %d: ListOccurrences() error = %v", i, err)
+				}
+				var ids []int64
+				for _, o := range got {
+					var id int64
+					fmt.Sscanf(o.Name, "projects/pid/occurrences/o%d", &id)
+					ids = append(ids, id)
+				}
+				if !reflect.DeepEqual(ids, p.want) {
+					t.Errorf("page %d: ListOccurrences() = %v, want %v", i, ids, p.want)
+				}
+				if last := i == len(tt.pages)-1; last != (next == "") {
+					t.Errorf("page %d: ListOccurrences() page token = %q", i, next)
+				}
+				token = next
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestStore_ListOccurrencesInsertionOrderTokens(t *testing.T) {
+	s := newStore(nil, &Config{PaginationKey: paginationKey})
+	created := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	severity := int64(3)
+	// Page tokens of the other orders do not resume the insertion order.
+	for desc, c := range map[string]pageCursor{
+		"creation time": {ID: 2, CreatedAt: &created},
+		"severity":      {ID: 2, Severity: &severity},
+		"null severity": {ID: 2, NullSeverity: true},
+	} {
+		token, err := encryptCursor(c, paginationKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.ListOccurrences(context.Background(), pid, "", token, 2); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListOccurrences() with a %s order token error = %v, want InvalidArgument", desc, err)
+		}
+	}
+}
+
+func TestStore_ListOccurrencesBySeverityTokens(t *testing.T) {
+	s := newStore(nil, &Config{PaginationKey: paginationKey})
+	ctx := WithOccurrenceOrder(context.Background(), OccurrenceOrderSeverity)
+	// Page tokens of the insertion order do not resume the severity order.
+	other, err := encryptCursor(pageCursor{ID: 2}, paginationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.ListOccurrences(ctx, pid, "", other, 2); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListOccurrences() with an insertion order token error = %v, want InvalidArgument", err)
+	}
+	if err := validateConfig(&Config{NullsOrder: "middle"}); err == nil {
+		t.Error("validateConfig() with nulls_order middle succeeded, want error")
+	}
+}